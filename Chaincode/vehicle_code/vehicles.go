@@ -5,16 +5,28 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
 	"encoding/json"
-	"crypto/x509"
+	"encoding/csv"
+	"bytes"
+	"reflect"
+	"sort"
+	"math"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/binary"
+	"encoding/base64"
+	"encoding/asn1"
 	"encoding/pem"
-	"net/http"
-	"net/url"
-	"io/ioutil"
-	"math/rand"
-	//	"regexp" //regex for GO...used later when chacking values -> TODO
-	"fabric/core/ledger/statemgmt/state"
+	"regexp"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"math/big"
+	"sync"
 )
 
 //==============================================================================================================================
@@ -28,937 +40,11907 @@ const SELLER_BANK = 4
 const BUYER_BANK = 5
 const SHIPPER = 6
 const PRODUCT = 7
+const RECYCLER = 8
 
+var ROLE_NAMES = map[int]string{GOVERNMENT: "GOVERNMENT", SELLER: "MANUFACTURER", BUYER: "BUYER", SELLER_BANK: "SELLER_BANK", BUYER_BANK: "BUYER_BANK", SHIPPER: "SHIPPER", PRODUCT: "PRODUCT", RECYCLER: "RECYCLER"}
 
 //==============================================================================================================================
 //	 Status types - Asset lifecycle is broken down into 8 statuses, this is part of the business logic to determine what can
 //					be done to the product and its busines parts at points in its lifecycle
 //==============================================================================================================================
-const STATE_PRODUCTPASSPORTADDED = 0
-const STATE_CONTRACTADDED = 1
-const STATE_PAYMENTANDPROPERTYPLANADDED = 2
-const STATE_LETTEROFCREDITACCEPTED = 3
-const STATE_PRODUCTPASSPORTCOMPLETE = 4
-const STATE_PRODUCTBEINGSHIPPED = 5
-const STATE_PRODUCTINUSE = 6
-const STATE_MAINTENANCENEEDED = 7
+const STATE_SALESCONTRACT = 0
+const STATE_ACCREDITIVE = 1
+const STATE_CHECK_ACCREDITIVE = 2
+const STATE_MANUFACTURE = 3
+const STATE_SHIPPING = 4
+const STATE_PAYMENT = 5
+const STATE_INUSE = 6
+const STATE_SCRAPPED = 7
+
+var STATE_NAMES = []string{"SALESCONTRACT", "ACCREDITIVE", "CHECK_ACCREDITIVE", "MANUFACTURE", "SHIPPING", "PAYMENT", "INUSE", "SCRAPPED"}
 
 //==============================================================================================================================
-//	 Structure Definitions 
+//	 Reversals - Transition actions that may legitimately move a product back to an earlier state
 //==============================================================================================================================
-//	Chaincode - A blank struct for use with Shim (A HyperLedger included go file used for get/put state
-//				and other HyperLedger functions)
+var REVERSALS = map[string]bool{
+	"cancel":   true,
+	"withdraw": true,
+	"refund":   true,
+	"revert":   true,
+	"reject":   true,
+}
+
 //==============================================================================================================================
-type  SimpleChaincode struct {
+//	 SHARE_TOLERANCE - How far the ownership shares of a product may be from summing to exactly 1.0.
+//==============================================================================================================================
+const SHARE_TOLERANCE = 0.000001
+
+//==============================================================================================================================
+//	 Currencies - ISO 4217 codes accepted for product prices
+//==============================================================================================================================
+var CURRENCIES = map[string]bool{
+	"AUD": true, "BRL": true, "CAD": true, "CHF": true, "CNY": true, "CZK": true, "DKK": true,
+	"EUR": true, "GBP": true, "HKD": true, "INR": true, "JPY": true, "KRW": true, "MXN": true,
+	"NOK": true, "NZD": true, "PLN": true, "RUB": true, "SEK": true, "SGD": true, "TRY": true,
+	"USD": true, "ZAR": true,
 }
 
 //==============================================================================================================================
-//	Product 	- Defines the structure for a product passport object.
-//	Contract	- Defines the structure for a sales contract, regarding the Product.
-//	PPP		- Defines the structure for a Payment and Property Plan (PPP) regarding the Contract and the Product. JSON on right tells it what JSON fields to map to
-//			  that element when reading a JSON object into the struct e.g. JSON make -> Struct Make.
+//	 CURRENCY_EXPONENTS - Decimal places of the minor unit of the currencies that don't have two, see Money
 //==============================================================================================================================
-//noinspection GoStructTag
-type Product struct {
-	ProductID        string `json:pid`
-	CheckID          string `json:checksum`
-	Manufacturer     string `json:manufacturer`
-	Owner            string `json:owner`
-	Current_location string `json:current_location`
-	State            int `json:state`
-	Width            float32 `json:width`
-	Height           float32 `json:height`
-	Weight           float32 `json:weight`
-	Contracts        []Contract
+var CURRENCY_EXPONENTS = map[string]int{
+	"JPY": 0, "KRW": 0,
 }
 
-type Contract struct {
-	Seller      string `json:seller`
-	Buyer       string `json:buyer`
-	Buyer_Bank  string `json:buyerbank`
-	Seller_Bank string `json:sellerbank`
-	Price       float32 `json:price`
-	Currency    string `json:currency`
-	Origin      string `json:origin`
-	Destination string `json:destination`
-	Route       string `json:route`
-	Product     Product
-	PPP         PPP
+//==============================================================================================================================
+//	 Units - Accepted length and mass units with their factor to metres and kilograms respectively
+//==============================================================================================================================
+var LENGTH_UNITS = map[string]float64{
+	"mm": 0.001, "cm": 0.01, "m": 1, "in": 0.0254, "ft": 0.3048,
 }
 
-type PPP struct {
-	State            int `json:state`
-	Property_Plan 	[]string `json:sellerbank`
-	Payment_Plan 	[]string `json:sellerbank`
+var MASS_UNITS = map[string]float64{
+	"g": 0.001, "kg": 1, "oz": 0.028349523125, "lb": 0.45359237,
 }
 
+var UNIT_SYSTEMS = map[string]Units{
+	"metric":   Units{Length: "cm", Mass: "kg"},
+	"imperial": Units{Length: "in", Mass: "lb"},
+}
 
 //==============================================================================================================================
-//	ProductID Holder - Defines the structure that holds all the ProductIDs for products that have been created.
-//				Used as an index when querying all products.
+//	 Structure Definitions 
+//==============================================================================================================================
+//	Chaincode - A struct for use with Shim (A HyperLedger included go file used for get/put state
+//				and other HyperLedger functions). FX can be set to replace the exchange rates configured at Init.
+//				audit_seq counts the audit log entries of each transaction in progress, see audit, and events
+//				holds the events they emitted, see emit.
 //==============================================================================================================================
+type  SimpleChaincode struct {
+	FX FXProvider
 
-type ProductID_Holder struct {
-	ProductIDs []int `json:"productIds"`
+	tx_lock   sync.Mutex
+	audit_seq map[string]int
+	events    map[string][]Event
 }
 
 //==============================================================================================================================
-//	ECertResponse - Struct for storing the JSON response of retrieving an ECert. JSON OK -> Struct OK
+//	FXProvider - Converts an amount from one currency to another. Returns an error when no rate is available.
 //==============================================================================================================================
-type ECertResponse struct {
-	OK    string `json:"OK"`
-	Error string `json:"Error"`
+type FXProvider interface {
+	Convert(amount float64, from string, to string) (float64, error)
 }
 
 //==============================================================================================================================
-//	Init Function - Called when the user deploys the chaincode																	
+//	ConfigFXProvider - FXProvider backed by the rates passed to Init. The inverse of a configured pair is used when only
+//					   the opposite direction is configured.
 //==============================================================================================================================
-func (t *SimpleChaincode) Init(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
-
-	//Args
-	//				0
-	//			peer_address
-
-
-	var ProductIds ProductID_Holder
+type ConfigFXProvider struct {
+	Rates map[string]float64
+}
 
-	bytes, err := json.Marshal(ProductIds)
+func (p ConfigFXProvider) Convert(amount float64, from string, to string) (float64, error) {
 
-	if err != nil {
-		return nil, errors.New("Error creating Product_Id_Holder record")
+	if from == to {
+		return amount, nil
 	}
 
-	err = stub.PutState("pids", bytes)
+	if rate, ok := p.Rates[from + "/" + to]; ok && rate > 0 {
+		return amount * rate, nil
+	}
 
-	err = stub.PutState("Peer_Address", []byte(args[0]))
-	if err != nil {
-		return nil, errors.New("Error storing peer address")
+	if rate, ok := p.Rates[to + "/" + from]; ok && rate > 0 {
+		return amount / rate, nil
 	}
 
-	return nil, nil
+	return 0, errors.New("No exchange rate available for " + from + "/" + to)
 }
 
 //==============================================================================================================================
-//	 General Functions
+//	FXRate - One entry of the exchange rate table kept by set_fx_rate: from EffectiveFrom on, one unit of the first
+//			 currency of Pair buys Rate units of the second. Stored under the composite key fx~pair~effectiveFrom.
+//==============================================================================================================================
+type FXRate struct {
+	Pair          string  `json:"pair"`
+	Rate          float64 `json:"rate"`
+	EffectiveFrom int64   `json:"effectiveFrom"`
+	SetBy         string  `json:"setBy"`
+	TxID          string  `json:"txId"`
+}
+
+//==============================================================================================================================
+//	FX_RATE_INDEX - The object type of the composite keys of the exchange rate table.
+//==============================================================================================================================
+const FX_RATE_INDEX = "fx"
+
 //==============================================================================================================================
-//	 get_ecert - Takes the name passed and calls out to the REST API for HyperLedger to retrieve the ecert
-//				 for that user. Returns the ecert as retrived including html encoding.
+//	LedgerFXProvider - FXProvider backed by the exchange rate table on the ledger, using the rates in effect at time At.
+//					   As with ConfigFXProvider the inverse of a pair is used when only the opposite direction is in
+//					   the table. Pairs that aren't in the table at all are left to Fallback.
 //==============================================================================================================================
-func (t *SimpleChaincode) get_ecert(stub *shim.ChaincodeStub, name string) ([]byte, error) {
+type LedgerFXProvider struct {
+	Stub     shim.ChaincodeStubInterface
+	At       int64
+	Fallback FXProvider
+}
 
-	var cert ECertResponse
+func (p LedgerFXProvider) Convert(amount float64, from string, to string) (float64, error) {
 
-	peer_address, err := stub.GetState("Peer_Address")
-	if err != nil {
-		return nil, errors.New("Error retrieving peer address")
+	if from == to {
+		return amount, nil
 	}
 
-	response, err := http.Get("http://" + string(peer_address) + "/registrar/" + name + "/ecert")        // Calls out to the HyperLedger REST API to get the ecert of the user with that name
-
-	fmt.Println("HTTP RESPONSE", response)
+	rate, err := p.Rate(from + "/" + to)
 
 	if err != nil {
-		return nil, errors.New("Error calling ecert API")
+		return 0, err
 	}
 
-	defer response.Body.Close()
-	contents, err := ioutil.ReadAll(response.Body)                                        // Read the response from the http callout into the variable contents
+	if rate > 0 {
+		return amount * rate, nil
+	}
 
-	fmt.Println("HTTP BODY:", string(contents))
+	rate, err = p.Rate(to + "/" + from)
 
 	if err != nil {
-		return nil, errors.New("Could not read body")
+		return 0, err
 	}
 
-	err = json.Unmarshal(contents, &cert)
+	if rate > 0 {
+		return amount / rate, nil
+	}
+
+	return p.Fallback.Convert(amount, from, to)
+}
+
+//==============================================================================================================================
+//	Rate - The rate of a pair in effect at At, or 0 when the table has none.
+//==============================================================================================================================
+func (p LedgerFXProvider) Rate(pair string) (float64, error) {
+
+	rates, err := p.Rates(pair)
 
 	if err != nil {
-		return nil, errors.New("Could not retrieve ecert for user: " + name)
+		return 0, err
 	}
 
-	fmt.Println("CERT OBJECT:", cert)
+	rate := 0.0
 
-	if cert.Error != "" {
-		fmt.Println("GET ECERT ERRORED: ", cert.Error); return nil, errors.New(cert.Error)
+	for _, entry := range rates {
+		if entry.EffectiveFrom <= p.At {
+			rate = entry.Rate
+		}
 	}
 
-	return []byte(string(cert.OK)), nil
+	return rate, nil
 }
 
 //==============================================================================================================================
-//	 get_caller - Retrieves the username of the user who invoked the chaincode.
-//				  Returns the username as a string.
+//	Rates - The entries of a pair in the table, oldest first. An empty pair returns the entries of every pair.
 //==============================================================================================================================
+func (p LedgerFXProvider) Rates(pair string) ([]FXRate, error) {
 
-func (t *SimpleChaincode) get_username(stub *shim.ChaincodeStub) (string, error) {
+	attributes := []string{}
 
-	bytes, err := stub.GetCallerCertificate();
-	if err != nil {
-		return "", errors.New("Couldn't retrieve caller certificate")
+	if pair != "" {
+		attributes = append(attributes, pair)
 	}
-	x509Cert, err := x509.ParseCertificate(bytes); // Extract Certificate from result of GetCallerCertificate
+
+	iter, err := p.Stub.GetStateByPartialCompositeKey(FX_RATE_INDEX, attributes)
+
 	if err != nil {
-		return "", errors.New("Couldn't parse certificate")
+		return nil, errors.New("Unable to query the exchange rate table")
+	}
+
+	defer iter.Close()
+
+	rates := []FXRate{}
+
+	for iter.HasNext() {
+
+		kv, err := iter.Next()
+
+		if err != nil {
+			return nil, errors.New("Unable to read the exchange rate table")
+		}
+
+		var entry FXRate
+
+		err = json.Unmarshal(kv.Value, &entry)
+
+		if err != nil {
+			return nil, errors.New("Corrupt exchange rate record " + kv.Key)
+		}
+
+		rates = append(rates, entry)
 	}
 
-	return x509Cert.Subject.CommonName, nil
+	return rates, nil
 }
 
 //==============================================================================================================================
-//	 check_affiliation - Takes an ecert as a string, decodes it to remove html encoding then parses it and checks the
-// 				  		certificates common name. The affiliation is stored as part of the common name.
+//	Money - An amount in the minor unit of its currency, e.g. cents for USD or yen for JPY. Records and JSON documents
+//			hold amounts as whole minor units. Amounts passed as plain string args, like the price of create_product,
+//			are decimals in the major unit and go through parse_money.
+//==============================================================================================================================
+type Money int64
+
+//==============================================================================================================================
+//	Product 	- Defines the structure for a product passport object.
+//	Contract	- Defines the structure for a sales contract, regarding the Product. Only found on products created
+//			  before sales contracts became records of their own, see SalesContract.
+//	Units		- The units Width/Height (Length) and Weight (Mass) are expressed in, e.g. "cm" and "kg".
+//	Accreditive	- A letter of credit a bank issued to pay for one or more Products, stored under "Accreditive_<id>".
+//			  Amount is in Currency, which may differ from the currency of the Products' prices. A Product links
+//			  the credit paying for it by AccreditiveID, with its IssuingBank copied so the Product can be
+//			  indexed by it. Products issued a credit before accreditives became records of their own hold a copy
+//			  of it in Accreditive and PastAccreditives instead, see product_accreditive.
+//	BillOfLading	- The bill of lading the shipper issued for the Product, stored under "BillOfLading_<id>". Whoever
+//			  holds it is entitled to the goods. Endorsements lists every change of holder in order.
+//	Invoice		- An invoice for the Product or its carriage, stored under "Invoice_<id>". ContractID links the sales
+//			  contract of the Product, if it has one. Status is ISSUED, ACCEPTED or PAID. Invoices not yet paid
+//			  are listed under their debtor in INVOICE_INDEX.
+//	SalesContract	- The sales contract of the Product, stored under "SalesContract_<id>" and linked from the Product by
+//			  its id. DocumentHash is the SHA-256 hash of the contract document. Status is PENDING until the
+//			  signatures of both parties over the hash are verified by execute_sales_contract and EXECUTED after.
+//			  Its banks are copied to SellerBank and BuyerBank of the Product, so they can be read and indexed
+//			  without retrieving the contract.
+//	CustodyEntry	- Records who held physical custody of the Product from the given transaction time onwards.
+//	ShippingMilestone - A stage of the shipment reached, one of MILESTONES, with where and when and the shipper
+//			  that reported it. Location is the last position reported before the milestone, if any.
+//	Location	- The last position reported for the Product with update_location. LocationHistory keeps the latest
+//			  MAX_LOCATION_HISTORY positions, oldest first.
+//	Thresholds	- The allowed range of each sensor type, set with set_thresholds. Breached is set by the first reading
+//			  outside its range and Breaches lists every such reading.
+//	OwnerChange	- Records one lifecycle transition of the Product: the owner and state before and after, who caused it and
+//			  when. Reverts are appended as their own entries and mark the entry they undo as reverted.
+//	Hold		- A regulatory hold on the Product, placed by the regulator with a reason. While it is set the Product
+//			  can't be transferred or updated.
+//	ProofOfDelivery	- The buyer's attestation that it received the Product: when, the SHA-256 fingerprint of the
+//			  certificate the buyer confirmed with and optionally the hash of a signed receipt.
+//	DestructionCertificate - The certificate of destruction the recycler issued when confirming the Product was
+//			  scrapped. Reference identifies the certificate document.
+//	Batch		- The manufacturing batch the Product belongs to, set by the manufacturer with update_batch. Recalled is
+//			  set once a recall covers the Product, RecallID naming the latest recall that did.
+//	StateEntry	- Records the Product entering a state: in which transaction, at what time and by whose doing. CreatedAt
+//			  is the time of the transaction that created the Product and LastModified that of the latest save.
+//	CommercialTerms	- The price, currency and sales contracts of the Product and the banks named in them, with its
+//			  payments and letters of credit whose amounts would give the price away. Kept in the private data collection when one is configured,
+//			  with only their hash in TermsHash on the public record. Salt is hashed with the terms so the few
+//			  likely prices can't be tried against the hash. Terms stored before MinorUnits was set hold float
+//			  amounts, see migrate_money.
+//	PPP		- Defines the structure for a Payment and Property Plan (PPP) regarding the Contract and the Product.
+//			  These records have no JSON tags, their fields are stored under the Go field names.
 //==============================================================================================================================
+type Product struct {
+	ProductID        string
+	CheckID          string
+	Manufacturer     string
+	Owner            string
+	Buyer            string
+	Custodian        string
+	CustodyHistory   []CustodyEntry
+	Milestones       []ShippingMilestone
+	OwnerHistory     []OwnerChange
+	StateTimestamps  map[int]int64
+	StateHistory     []StateEntry
+	CreatedAt        int64
+	LastModified     int64
+	Locked           bool
+	Hold             *Hold
+	Destruction      *DestructionCertificate
+	Batch            string
+	Recalled         bool
+	RecallID         string
+	ScrapApprovals   []string
+	OwnershipShares  map[string]float64
+	TransferCount    int
+	Accreditive      *Accreditive
+	PastAccreditives []Accreditive
+	AccreditiveID    string
+	IssuingBank      string
+	PaymentReleased  bool
+	Payments         []Payment
+	Inspection       *Inspection
+	Delivery         *ProofOfDelivery
+	BillOfLading     string
+	ShippingCost     Money
+	Location         *GeoLocation
+	LocationHistory  []GeoLocation
+	Thresholds       map[string]Threshold
+	Breached         bool
+	Breaches         []TelemetryReading
+	Origin           string
+	Destination      string
+	Route            string
+	State            int
+	Price            Money
+	Currency         string
+	TermsHash        string
+	Units            Units
+	Width            float32
+	Height           float32
+	Weight           float32
+	SalesContract    string
+	SellerBank       string
+	BuyerBank        string
+	Contracts        []Contract
+}
 
-func (t *SimpleChaincode) check_affiliation(stub *shim.ChaincodeStub, cert string) (int, error) {
+type Units struct {
+	Length string
+	Mass   string
+}
 
-	decodedCert, err := url.QueryUnescape(cert); // make % etc normal //
+type Accreditive struct {
+	AccreditiveID string
+	ProductIDs    []string
+	IssuingBank   string
+	Beneficiary   string
+	Amount        Money
+	Currency      string
+	IssuedAt      int64
+	Expiry        int64
+	Withdrawn     bool
+	Rejected      bool
+	RejectedBy    string
+	Reason        string
+	ConfirmedBy   string
+	Drawn         Money
+}
 
-	if err != nil {
-		return -1, errors.New("Could not decode certificate")
-	}
+type Payment struct {
+	Amount    Money
+	Currency  string
+	Payer     string
+	Payee     string
+	Timestamp int64
+}
+
+type CommercialTerms struct {
+	Price            Money
+	Currency         string
+	Contracts        []Contract
+	SellerBank       string
+	BuyerBank        string
+	Payments         []Payment
+	Accreditive      *Accreditive
+	PastAccreditives []Accreditive
+	MinorUnits       bool
+	Salt             string
+}
 
-	pem, _ := pem.Decode([]byte(decodedCert))                                        // Make Plain text   //
+type Hold struct {
+	PlacedBy string
+	Reason   string
+	PlacedAt int64
+}
 
-	x509Cert, err := x509.ParseCertificate(pem.Bytes); // Extract Certificate from argument //
+type DestructionCertificate struct {
+	Reference string
+	Recycler  string
+	IssuedAt  int64
+}
 
-	if err != nil {
-		return -1, errors.New("Couldn't parse certificate")
-	}
+type ProofOfDelivery struct {
+	Recipient       string
+	DeliveredAt     int64
+	CertFingerprint string
+	ReceiptHash     string
+}
+
+type Inspection struct {
+	Inspector string
+	Passed    bool
+	Notes     string
+	Timestamp int64
+}
 
-	cn := x509Cert.Subject.CommonName
+type BillOfLading struct {
+	BillID        string
+	ProductID     string
+	Shipper       string
+	Consignee     string
+	Holder        string
+	IssuedAt      int64
+	Endorsements  []Endorsement
+	Surrendered   bool
+	SurrenderedAt int64
+}
+
+type SalesContract struct {
+	ContractID       string
+	ProductID        string
+	Seller           string
+	Buyer            string
+	SellerBank       string
+	BuyerBank        string
+	Terms            string
+	Price            Money
+	Currency         string
+	DeliveryDeadline int64
+	DocumentHash     string
+	Status           string
+	CreatedAt        int64
+	SellerSignature  string
+	BuyerSignature   string
+	ExecutedAt       int64
+}
+
+type Invoice struct {
+	InvoiceID  string
+	Issuer     string
+	Debtor     string
+	Amount     Money
+	Currency   string
+	DueDate    int64
+	ProductID  string
+	ContractID string
+	Status     string
+	IssuedAt   int64
+	AcceptedAt int64
+	PaidAt     int64
+	PaidBy     string
+}
+
+type Endorsement struct {
+	From      string
+	To        string
+	Timestamp int64
+}
+
+type CustodyEntry struct {
+	Custodian string
+	Timestamp int64
+}
+
+type OwnerChange struct {
+	Action        string
+	PreviousOwner string
+	PreviousState int
+	Owner         string
+	State         int
+	Actor         string
+	Timestamp     int64
+	Reverted      bool
+}
+
+type ShippingMilestone struct {
+	Milestone  string
+	Location   *GeoLocation
+	Timestamp  int64
+	RecordedBy string
+}
 
-	res := strings.Split(cn, "\\")
+type StateEntry struct {
+	State     int
+	TxID      string
+	Timestamp int64
+	Actor     string
+}
 
-	affiliation, _ := strconv.Atoi(res[2])
+type Contract struct {
+	Seller      string
+	Buyer       string
+	Buyer_Bank  string
+	Seller_Bank string
+	Price       Money
+	Currency    string
+	Origin      string
+	Destination string
+	Route       string
+	Product     Product
+	PPP         PPP
+}
 
-	return affiliation, nil
+type PPP struct {
+	State         int
+	Property_Plan []string
+	Payment_Plan  []string
 }
 
+
 //==============================================================================================================================
-//	 get_caller_data - Calls the get_ecert and check_role functions and returns the ecert and role for the
-//					 name passed.
+//	ProductID Holder - Defines the structure that holds all the ProductIDs for products that have been created.
+//				Built from the pid index when querying all products, and the format of the legacy index records.
 //==============================================================================================================================
 
-func (t *SimpleChaincode) get_caller_data(stub *shim.ChaincodeStub) (string, int, error) {
+type ProductID_Holder struct {
+	ProductIDs []int `json:"productIds"`
+}
 
-	user, err := t.get_username(stub)
-	if err != nil {
-		return "", -1, err
-	}
+//==============================================================================================================================
+//	Config - Deployment settings passed to Init as an optional JSON document and stored under the key "Config".
+//			 DwellLimits maps a state to the maximum number of seconds a product should stay in it.
+//			 Waypoints, when set, is the list of locations routes and current locations may use.
+//			 FXRates maps a currency pair such as "EUR/USD" to the amount of the second currency one unit of the
+//			 first buys. Pairs in the exchange rate table kept by set_fx_rate take precedence.
+//			 RatePerKg is the shipping cost per kilogram used when start_shipping isn't given a cost.
+//			 MaxResultBytes caps the size of a get_vehicles response. Zero means no cap.
+//			 DefaultCurrency is used by create_product when no currency is passed.
+//			 AuditLog turns on the on-ledger audit log, which keeps its last AuditLogSize entries (100 when not
+//			 set) for get_audit_log.
+//			 TransferCooldown is the minimum number of seconds between two changes of owner of a product.
+//			 TransferExpiry is how many seconds a proposed transfer may be accepted for. Zero means it doesn't expire.
+//			 ScrapApprovalsRequired is how many distinct approvers scrap_product needs (1 when not set).
+//			 Strict makes create_product and save_changes refuse UNDEFINED placeholders and unset dimensions. Leave it
+//			 off for ledgers migrated from older versions of this chaincode.
+//			 PrivateCollection names the private data collection price, currency and sales contracts are kept in.
+//			 It must be in the collection config the chaincode is deployed with and can't be changed once set. The
+//			 Init setting it moves the terms of existing products into it, and needs the transient field "salt"
+//			 when there are any, see terms_salt.
+//==============================================================================================================================
+type Config struct {
+	DwellLimits       map[int]int64      `json:"dwellLimits"`
+	Waypoints         []string           `json:"waypoints"`
+	FXRates           map[string]float64 `json:"fxRates"`
+	RatePerKg         float64            `json:"shippingRatePerKg"`
+	MaxResultBytes    int                `json:"maxResultBytes"`
+	DefaultCurrency   string             `json:"defaultCurrency"`
+	AuditLog          bool               `json:"auditLog"`
+	AuditLogSize      int                `json:"auditLogSize"`
+	Strict            bool               `json:"strict"`
+	ScrapApprovals    int                `json:"scrapApprovalsRequired"`
+	TransferCooldown  int64              `json:"transferCooldown"`
+	PrivateCollection string             `json:"privateCollection"`
+	TransferExpiry    int64              `json:"transferExpiry"`
+}
 
-	ecert, err := t.get_ecert(stub, user);
-	if err != nil {
-		return "", -1, err
-	}
+//==============================================================================================================================
+//	CurrencyExposure - Response envelope for get_products_by_currency. Holds the matching products and the summed price.
+//==============================================================================================================================
+type CurrencyExposure struct {
+	Currency string    `json:"currency"`
+	Total    Money     `json:"total"`
+	Count    int       `json:"count"`
+	Products []Product `json:"products"`
+}
 
-	affiliation, err := t.check_affiliation(stub, string(ecert));
-	if err != nil {
-		return "", -1, err
-	}
+//==============================================================================================================================
+//	ConvertedDimensions - Response of convert_units, the dimensions of a product expressed in the requested units.
+//==============================================================================================================================
+type ConvertedDimensions struct {
+	ProductID string  `json:"productId"`
+	Units     Units   `json:"units"`
+	Width     float64 `json:"width"`
+	Height    float64 `json:"height"`
+	Weight    float64 `json:"weight"`
+}
 
-	return user, affiliation, nil
+//==============================================================================================================================
+//	SupplyChainView - Every party involved in the trade of a product and the shipping milestones reached, as returned by
+//					  get_supply_chain_view.
+//==============================================================================================================================
+type SupplyChainView struct {
+	ProductID    string              `json:"productId"`
+	Manufacturer string              `json:"manufacturer"`
+	Owner        string              `json:"owner"`
+	Custodian    string              `json:"custodian"`
+	IssuingBank  string              `json:"issuingBank"`
+	BuyerBank    string              `json:"buyerBank"`
+	State        int                 `json:"state"`
+	StateName    string              `json:"state_name"`
+	Milestones   []ShippingMilestone `json:"milestones"`
 }
 
 //==============================================================================================================================
-//	 retrieve_v5c - Gets the state of the data at v5cID in the ledger then converts it from the stored 
-//					JSON into the Vehicle struct for use in the contract. Returns the Vehcile struct.
-//					Returns empty v if it errors.
+//	SwapProposal - A pending offer to exchange products, stored under "swap_<offered>_<requested>" until the owner of
+//				   the requested product accepts it by calling swap_products with the ids the other way round.
 //==============================================================================================================================
-func (t *SimpleChaincode) retrieve_product(stub *shim.ChaincodeStub, productId string) (Product, error) {
+type SwapProposal struct {
+	Proposer  string `json:"proposer"`
+	Offered   string `json:"offered"`
+	Requested string `json:"requested"`
+	Timestamp int64  `json:"timestamp"`
+}
 
-	var product Product
+//==============================================================================================================================
+//	Participant - An entry of the participant registry, stored under "Participant_<name>". Managed entries were set by
+//				  the regulator and take precedence over the role in the participant's certificate. Certificate is the
+//				  PEM encoded certificate pinned for the participant: the one the regulator registered for it or the
+//				  newest one it has invoked the chaincode with, see record_participant.
+//==============================================================================================================================
+type Participant struct {
+	Name        string `json:"name"`
+	Role        int    `json:"role"`
+	Managed     bool   `json:"managed"`
+	Revoked     bool   `json:"revoked"`
+	UpdatedBy   string `json:"updatedBy"`
+	UpdatedAt   int64  `json:"updatedAt"`
+	Certificate string `json:"certificate,omitempty"`
+}
 
-	bytes, err := stub.GetState(productId);
+//==============================================================================================================================
+//	TransferProposal - A transfer waiting for its recipient, stored under "transfer_<productId>" until it is accepted,
+//					   rejected or cancelled. Function and Args are the transfer to carry out, as they would be passed
+//					   to invoke. A proposal can't be accepted after ExpiresAt unless that is zero.
+//==============================================================================================================================
+type TransferProposal struct {
+	ProductID string   `json:"productId"`
+	Function  string   `json:"function"`
+	Args      []string `json:"args"`
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Timestamp int64    `json:"timestamp"`
+	ExpiresAt int64    `json:"expiresAt"`
+}
 
-	if err != nil {
-		fmt.Printf("RETRIEVE_PRODUCT: Failed to invoke chaincode: %s", err); return product, errors.New("RETRIEVE_V5C: Error retrieving vehicle with pid = " + productId)
-	}
+//==============================================================================================================================
+//	ProductDefinition - One product passed to create_products_bulk, with the values create_product takes as arguments.
+//						Units default to metric and Price is in minor units, see Money.
+//==============================================================================================================================
+type ProductDefinition struct {
+	Buyer         string         `json:"buyer"`
+	Destination   string         `json:"destination"`
+	Price         Money          `json:"price"`
+	Currency      string         `json:"currency"`
+	SalesContract *ContractTerms `json:"salesContract"`
+	Units         *Units         `json:"units"`
+}
 
-	err = json.Unmarshal(bytes, &product);
+//==============================================================================================================================
+//	ContractTerms - The sales contract passed when creating a product, e.g. {"buyerBank":...,"deliveryDeadline":...}.
+//					Every field is optional. DocumentHash is the hex encoded SHA-256 hash of the contract document.
+//==============================================================================================================================
+type ContractTerms struct {
+	SellerBank       string `json:"sellerBank"`
+	BuyerBank        string `json:"buyerBank"`
+	Terms            string `json:"terms"`
+	DeliveryDeadline int64  `json:"deliveryDeadline"`
+	DocumentHash     string `json:"documentHash"`
+}
 
-	if err != nil {
-		fmt.Printf("RETRIEVE_PRODUCT: Corrupt product record " + string(bytes) + ": %s", err); return product, errors.New("RETRIEVE_PRODUCT: Corrupt product record" + string(bytes))
-	}
+//==============================================================================================================================
+//	MAX_BULK_PRODUCTS - The most products create_products_bulk creates in one transaction.
+//==============================================================================================================================
+const MAX_BULK_PRODUCTS = 500
 
-	return product, nil
+//==============================================================================================================================
+//	MIN_SALT_BYTES - The fewest random bytes a client may pass in the transient field "salt" for the terms of a product.
+//==============================================================================================================================
+const MIN_SALT_BYTES = 16
+
+//==============================================================================================================================
+//	GeoLocation - A position of a product: latitude and longitude in decimal degrees, when it was recorded and what
+//				  reported it, e.g. a GPS tracker id.
+//==============================================================================================================================
+type GeoLocation struct {
+	Lat        float64 `json:"lat"`
+	Lon        float64 `json:"lon"`
+	RecordedAt int64   `json:"recordedAt"`
+	Source     string  `json:"source"`
 }
 
 //==============================================================================================================================
-// save_changes - Writes to the ledger the Vehicle struct passed in a JSON format. Uses the shim file's 
-//				  method 'PutState'.
+//	Threshold - The range a sensor reading must stay within, e.g. {"min":2,"max":8} for a temperature. Either bound may
+//				be left out. Devices names the participants registered as PRODUCT that may report readings of the
+//				sensor type for the product.
+//==============================================================================================================================
+type Threshold struct {
+	Min     *float64 `json:"min,omitempty"`
+	Max     *float64 `json:"max,omitempty"`
+	Devices []string `json:"devices,omitempty"`
+}
+
+//==============================================================================================================================
+//	TelemetryReading - One sensor reading recorded with record_telemetry, stored under the composite key
+//					   telemetry~productId~sensorType~timestamp~txId. Breach is set when the reading was outside the
+//					   threshold of the product for its sensor type.
+//==============================================================================================================================
+type TelemetryReading struct {
+	ProductID  string  `json:"productId"`
+	SensorType string  `json:"sensorType"`
+	Value      float64 `json:"value"`
+	Timestamp  int64   `json:"timestamp"`
+	RecordedBy string  `json:"recordedBy"`
+	TxID       string  `json:"txId"`
+	Breach     bool    `json:"breach"`
+}
+
+//==============================================================================================================================
+//	TELEMETRY_INDEX - The object type of the composite keys of telemetry readings.
+//==============================================================================================================================
+const TELEMETRY_INDEX = "telemetry"
+
+//==============================================================================================================================
+//	MAX_LOCATION_HISTORY - The most positions kept in the location history of a product. Older ones are dropped.
+//==============================================================================================================================
+const MAX_LOCATION_HISTORY = 100
+
+//==============================================================================================================================
+//	ProductRequest - The JSON form of the args of a function acting on one product, see request_args. NewValue is the
+//					 value of an update, or the optional value of a transfer such as a shipping cost.
+//	CreateRequest  - The JSON form of the args of create_product. Price is in minor units, see Money. A missing price
+//					 means the terms are in the transient field "terms".
+//==============================================================================================================================
+type ProductRequest struct {
+	ProductID string `json:"productId"`
+	Recipient string `json:"recipient"`
+	NewValue  string `json:"newValue"`
+	Nonce     string `json:"nonce"`
+}
+
+type CreateRequest struct {
+	Buyer         string         `json:"buyer"`
+	Destination   string         `json:"destination"`
+	Price         *Money         `json:"price"`
+	Currency      string         `json:"currency"`
+	SalesContract *ContractTerms `json:"salesContract"`
+	Units         *Units         `json:"units"`
+	Nonce         string         `json:"nonce"`
+}
+
+//==============================================================================================================================
+//	OwnershipBreakdown - Response of get_ownership_breakdown. A product without shares is held entirely by its owner.
+//==============================================================================================================================
+type OwnershipBreakdown struct {
+	ProductID string             `json:"productId"`
+	Owner     string             `json:"owner"`
+	Shares    map[string]float64 `json:"shares"`
+}
+
+//==============================================================================================================================
+//	TradeFinanceStatus - Response of get_trade_finance_status: where a product is in the letter of credit process.
+//==============================================================================================================================
+type TradeFinanceStatus struct {
+	ProductID           string `json:"productId"`
+	StateName           string `json:"state_name"`
+	AccreditiveIssued   bool   `json:"accreditiveIssued"`
+	AccreditiveChecked  bool   `json:"accreditiveChecked"`
+	Inspected           bool   `json:"inspected"`
+	Paid                bool   `json:"paid"`
+	Refunded            bool   `json:"refunded"`
+	Price               Money  `json:"price"`
+	Currency            string `json:"currency"`
+	AccreditiveAmount   Money  `json:"accreditiveAmount"`
+	AccreditiveCurrency string `json:"accreditiveCurrency"`
+}
+
+//==============================================================================================================================
+//	PriceQuote - Response of get_product_price: the price of a product and what it comes to in another currency.
+//==============================================================================================================================
+type PriceQuote struct {
+	ProductID         string `json:"productId"`
+	Price             Money  `json:"price"`
+	Currency          string `json:"currency"`
+	ConvertedPrice    Money  `json:"convertedPrice"`
+	ConvertedCurrency string `json:"convertedCurrency"`
+}
+
+//==============================================================================================================================
+//	Recall - A recall issued by a manufacturer or the regulator, stored under "Recall_<id>". It covers the products listed
+//			 in ProductIDs or, when Batch is given, every product of that batch. ProductIDs of a stored recall lists
+//			 the products it was propagated to.
+//==============================================================================================================================
+type Recall struct {
+	RecallID   string   `json:"recallId"`
+	ProductIDs []string `json:"productIds"`
+	Batch      string   `json:"batch"`
+	Reason     string   `json:"reason"`
+	IssuedBy   string   `json:"issuedBy"`
+	IssuedAt   int64    `json:"issuedAt"`
+}
+
+//==============================================================================================================================
+//	RecalledProduct - One entry of get_recalled_owners: a recalled product and who owns and holds it now.
+//==============================================================================================================================
+type RecalledProduct struct {
+	ProductID string `json:"productId"`
+	RecallID  string `json:"recallId"`
+	Owner     string `json:"owner"`
+	Custodian string `json:"custodian"`
+	State     int    `json:"state"`
+}
+
+//==============================================================================================================================
+//	HeldProduct - One entry of get_held_products: a product on hold and the details of the hold.
+//==============================================================================================================================
+type HeldProduct struct {
+	ProductID string `json:"productId"`
+	Owner     string `json:"owner"`
+	State     int    `json:"state"`
+	PlacedBy  string `json:"placedBy"`
+	Reason    string `json:"reason"`
+	PlacedAt  int64  `json:"placedAt"`
+}
+
+//==============================================================================================================================
+//	BatchResult - Outcome for one product of a batch operation that reports partial results.
+//	BatchError	- Why a product of such a batch failed, with the code the product would have failed with on its own.
+//==============================================================================================================================
+type BatchResult struct {
+	ProductID string      `json:"productId"`
+	Success   bool        `json:"success"`
+	Error     *BatchError `json:"error,omitempty"`
+}
+
+type BatchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+//==============================================================================================================================
+//	RepairReport - Result of validate_and_repair_product. Lists every invariant the stored product violates and whether
+//				   it was repaired. Saved is true when the repaired product was written back.
+//==============================================================================================================================
+type RepairReport struct {
+	ProductID  string      `json:"productId"`
+	Violations []Violation `json:"violations"`
+	Saved      bool        `json:"saved"`
+}
+
+type Violation struct {
+	Field    string `json:"field"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+}
+
+type RepairOptions struct {
+	Repair bool `json:"repair"`
+}
+
+//==============================================================================================================================
+//	BuyerObligations - Response of get_buyer_obligations: the products a buyer has committed to pay for and the total
+//					   owed in each currency.
+//==============================================================================================================================
+type BuyerObligations struct {
+	Buyer    string           `json:"buyer"`
+	Products []Product        `json:"products"`
+	Totals   map[string]Money `json:"totals"`
+}
+
+//==============================================================================================================================
+//	ScrappedProducts - Response of get_products_scrapped_between: the matching products and how many there are.
+//==============================================================================================================================
+type ScrappedProducts struct {
+	Count    int       `json:"count"`
+	Products []Product `json:"products"`
+}
+
+//==============================================================================================================================
+//	ManufacturerGroup - One entry of get_products_grouped_by_manufacturer.
+//==============================================================================================================================
+type ManufacturerGroup struct {
+	Manufacturer          string           `json:"manufacturer"`
+	Count                 int              `json:"count"`
+	TotalValuePerCurrency map[string]Money `json:"totalValuePerCurrency"`
+}
+
+//==============================================================================================================================
+//	ManufacturerPage - Response of get_products_grouped_by_manufacturer. NextBookmark is the id of the product the next
+//					   page starts at, empty once the last page has been returned.
+//==============================================================================================================================
+type ManufacturerPage struct {
+	Groups       []ManufacturerGroup `json:"groups"`
+	NextBookmark string              `json:"nextBookmark"`
+}
+
+//==============================================================================================================================
+//	BankExposure - Response of get_products_for_bank: the products a bank has issued or confirms credit for and the
+//				   amount still outstanding in each currency.
+//==============================================================================================================================
+type BankExposure struct {
+	Bank        string              `json:"bank"`
+	Products    []BankExposureEntry `json:"products"`
+	Outstanding map[string]Money    `json:"outstanding"`
+}
+
+//==============================================================================================================================
+//	BankExposureEntry - One product in a BankExposure. Role is "issuing" or "confirming".
+//==============================================================================================================================
+type BankExposureEntry struct {
+	ProductID   string `json:"productId"`
+	Role        string `json:"role"`
+	State       int    `json:"state"`
+	Amount      Money  `json:"amount"`
+	Currency    string `json:"currency"`
+	Outstanding Money  `json:"outstanding"`
+}
+
+//==============================================================================================================================
+//	FieldUpdateEvent - Payload of the field_updated event sent whenever an update function changes a product field.
+//==============================================================================================================================
+type FieldUpdateEvent struct {
+	ProductID string      `json:"productId"`
+	Field     string      `json:"field"`
+	OldValue  interface{} `json:"oldValue"`
+	NewValue  interface{} `json:"newValue"`
+}
+
 //==============================================================================================================================
-func (t *SimpleChaincode) save_changes(stub *shim.ChaincodeStub, product Product) (bool, error) {
+//	MilestoneEvent - Payload of the milestone_reached event sent when a shipping milestone is recorded for a product.
+//==============================================================================================================================
+type MilestoneEvent struct {
+	ProductID  string `json:"productId"`
+	Milestone  string       `json:"milestone"`
+	Location   *GeoLocation `json:"location"`
+	Timestamp  int64        `json:"timestamp"`
+	RecordedBy string       `json:"recordedBy"`
+}
+
+//==============================================================================================================================
+//	Event - An event emitted by a transaction. The peer keeps a single event per transaction, so when a transaction
+//			emits several of them they are sent together as an "events" event holding the list, see send_events.
+//==============================================================================================================================
+type Event struct {
+	Name    string          `json:"name"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+//==============================================================================================================================
+//	TransitionLogEntry - One line of get_state_transitions_log. Type is "created", "state" or "custody"; From and To are
+//						 state names for state changes and custodians for custody changes.
+//==============================================================================================================================
+type TransitionLogEntry struct {
+	Timestamp int64  `json:"timestamp"`
+	Type      string `json:"type"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Actor     string `json:"actor"`
+}
+
+//==============================================================================================================================
+//	AuditEntry - One line of the audit log. Each is kept under its own composite key, see AUDIT_INDEX, and Seq numbers
+//				 the entries of a transaction in the order it wrote them. Logs written by older versions of this
+//				 chaincode are kept as a list under the key "AuditLog".
+//==============================================================================================================================
+type AuditEntry struct {
+	Seq       int64  `json:"seq"`
+	TxID      string `json:"txId"`
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+//==============================================================================================================================
+//	TrailEntry - One successful invocation in the audit trail, written by record_invocation under its own key so entries
+//				 are never rewritten. ProductID is empty for functions that don't act on one product. There is no
+//				 outcome: the writes of a failed invocation are discarded, its entry with them, so every entry succeeded.
+//==============================================================================================================================
+type TrailEntry struct {
+	TxID        string `json:"txId"`
+	Timestamp   int64  `json:"timestamp"`
+	Function    string `json:"function"`
+	Caller      string `json:"caller"`
+	Affiliation int    `json:"affiliation"`
+	ProductID   string `json:"productId"`
+}
+
+//==============================================================================================================================
+//	TrailFilter - Optional JSON argument to get_audit_trail. Empty fields match every entry. From and To are unix
+//				  times and both inclusive. PageSize and Bookmark page through the result as in get_vehicles.
+//	TrailPage	- Response of get_audit_trail. NextBookmark is empty once the last entry has been read.
+//==============================================================================================================================
+type TrailFilter struct {
+	ProductID string `json:"productId"`
+	Caller    string `json:"caller"`
+	From      int64  `json:"from"`
+	To        int64  `json:"to"`
+	PageSize  int    `json:"pageSize"`
+	Bookmark  string `json:"bookmark"`
+}
+
+type TrailPage struct {
+	Entries      []TrailEntry `json:"entries"`
+	NextBookmark string       `json:"nextBookmark"`
+	Count        int          `json:"count"`
+}
+
+//==============================================================================================================================
+//	TRAIL_PREFIX - Audit trail entries are kept under TRAIL_PREFIX followed by the zero padded transaction time and the
+//				   transaction id, so they sort by time and a time range is a single range query.
+//==============================================================================================================================
+const TRAIL_PREFIX = "AuditTrail_"
+
+//==============================================================================================================================
+//	AUDIT_INDEX - The object type of the composite keys of audit log entries. The attributes are the zero padded
+//				  transaction time, the transaction id and the zero padded Seq, so entries sort oldest first and no two
+//				  transactions write the same key.
+//	DEFAULT_AUDIT_LOG_SIZE - How many entries the audit log keeps when AuditLogSize isn't set.
+//==============================================================================================================================
+const AUDIT_INDEX = "AuditLog"
+const DEFAULT_AUDIT_LOG_SIZE = 100
+
+//==============================================================================================================================
+//	HistoryEntry   - One write of a product in the history of its key: the transaction, its time, whether it deleted
+//					 the key and the product record written.
+//	FieldChange	   - The old and new value of a field that differs between two versions.
+//==============================================================================================================================
+type HistoryEntry struct {
+	TxID      string          `json:"txId"`
+	Timestamp int64           `json:"timestamp"`
+	IsDelete  bool            `json:"isDelete"`
+	Value     json.RawMessage `json:"value"`
+}
+
+type FieldChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+//==============================================================================================================================
+//	DetailOptions - Optional JSON argument to get_vehicle_details. With {"labels":true} the response is a
+//					LabelledProduct.
+//	LabelledProduct - A product together with the role names of its owner and manufacturer.
+//==============================================================================================================================
+type DetailOptions struct {
+	Labels bool `json:"labels"`
+}
+
+type LabelledProduct struct {
+	Product
+	OwnerRole        string `json:"ownerRole"`
+	ManufacturerRole string `json:"manufacturerRole"`
+}
+
+//==============================================================================================================================
+//	ListOptions - Optional JSON argument to get_vehicles controlling how the list is returned. Format is "json" (the
+//				  default, a single array) or "ndjson" (one product per line). MaxBytes lowers the configured size
+//				  cap for this call and After continues a truncated listing from the given product id.
+//==============================================================================================================================
+type ListOptions struct {
+	Format   string `json:"format"`
+	MaxBytes int    `json:"maxBytes"`
+	After    string `json:"after"`
+	PageSize int    `json:"pageSize"`
+	Bookmark string `json:"bookmark"`
+}
+
+//==============================================================================================================================
+//	ListPage - Response envelope for get_vehicles when a size cap is in effect or the listing stopped at
+//			   MAX_PAGE_READS. LastID is the id to pass as "after" to fetch the next page.
+//==============================================================================================================================
+type ListPage struct {
+	Products  []json.RawMessage `json:"products"`
+	Truncated bool              `json:"truncated"`
+	LastID    string            `json:"lastId"`
+}
+
+//==============================================================================================================================
+//	RecordPage - Response envelope for get_vehicles when a page size or bookmark is passed. NextBookmark is the bookmark
+//				 the peer returned for the pid index, to pass to get the next page, and is empty once the last
+//				 product has been read.
+//==============================================================================================================================
+type RecordPage struct {
+	Records      []json.RawMessage `json:"records"`
+	NextBookmark string            `json:"nextBookmark"`
+	Count        int               `json:"count"`
+}
+
+//==============================================================================================================================
+//	ProductPage - Response envelope of the queries that read the product index a page at a time, returned when a
+//				  bookmark is passed or the page stopped at MAX_PAGE_READS. NextBookmark is the id of the product the
+//				  next page starts at and is empty once the last product has been read.
+//==============================================================================================================================
+type ProductPage struct {
+	Products     []Product `json:"products"`
+	NextBookmark string    `json:"nextBookmark"`
+}
+
+//==============================================================================================================================
+//	Paging limits - A page holds at most MAX_PAGE_SIZE products and reads at most MAX_PAGE_READS product records, so
+//					a caller who may see few products doesn't make the peer read the whole ledger in one query.
+//==============================================================================================================================
+const MAX_PAGE_SIZE = 100
+const MAX_PAGE_READS = 1000
+
+//==============================================================================================================================
+//	ConsolidationGroup - A set of un-shipped products from one manufacturer that go to the same destination in the same
+//						 currency and could be shipped together.
+//==============================================================================================================================
+type ConsolidationGroup struct {
+	Destination string   `json:"destination"`
+	Currency    string   `json:"currency"`
+	ProductIDs  []string `json:"productIds"`
+}
+
+//==============================================================================================================================
+//	Error codes - Machine readable codes for failures, each with the HTTP-like status it is returned with.
+//				  ChaincodeError carries a code and a message; errors without a code are classified by respond.
+//==============================================================================================================================
+const ERR_PERMISSION_DENIED = "PERMISSION_DENIED"
+const ERR_NOT_FOUND = "NOT_FOUND"
+const ERR_INVALID_STATE = "INVALID_STATE"
+const ERR_VALIDATION_FAILED = "VALIDATION_FAILED"
+const ERR_INTERNAL = "INTERNAL"
+const ERR_HOLD_ACTIVE = "HOLD_ACTIVE"
+
+var ERROR_STATUS = map[string]int32{
+	ERR_PERMISSION_DENIED: 403,
+	ERR_NOT_FOUND:         404,
+	ERR_INVALID_STATE:     409,
+	ERR_VALIDATION_FAILED: 400,
+	ERR_INTERNAL:          500,
+	ERR_HOLD_ACTIVE:       423,
+}
+
+type ChaincodeError struct {
+	Code    string
+	Message string
+	Fields  []FieldError
+}
+
+//==============================================================================================================================
+//	FieldError - One field of a product that failed validation and why.
+//==============================================================================================================================
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *ChaincodeError) Error() string {
+	return e.Message
+}
+
+//==============================================================================================================================
+//	Envelope - The response to every invoke and query. Data holds the result, as JSON when the function returns JSON
+//			   and as a string otherwise. Failures are returned with their status and the envelope as the message;
+//			   Errors lists the offending fields when validation failed.
+//==============================================================================================================================
+type Envelope struct {
+	OK      bool            `json:"ok"`
+	Code    string          `json:"code"`
+	Data    json.RawMessage `json:"data"`
+	Message string          `json:"message"`
+	Errors  []FieldError    `json:"errors,omitempty"`
+}
+
+//==============================================================================================================================
+//	Init Function - Called when the user instantiates or upgrades the chaincode. See deploy.
+//==============================================================================================================================
+func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+
+	defer t.end_tx(stub.GetTxID())
+
+	_, args := stub.GetFunctionAndParameters()
+
+	return t.respond(t.deploy(stub, args))
+}
+
+//==============================================================================================================================
+//	deploy - Sets up the ledger: migrates the product index and amounts, indexes existing products and stores the config.
+//			 The config passed is merged into the stored one, so an upgrade only passes the settings it changes. Once
+//			 set the private collection can't be changed, and the Init setting it moves the terms of the existing
+//			 products into it.
+//==============================================================================================================================
+func (t *SimpleChaincode) deploy(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	//Args
+	//				0
+	//			config (optional JSON)
+
+
+	err := t.migrate_product_index(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	products, err := t.migrate_money(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.migrate_invoice_index(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.migrate_checksum_index(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := t.get_config(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config := stored
+
+	if len(args) > 0 {
+		config, err = t.merge_config(stored, args[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if stored.PrivateCollection != "" && config.PrivateCollection != stored.PrivateCollection {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "The private collection " + stored.PrivateCollection + " can't be changed once set")
+	}
+
+	for state, limit := range config.DwellLimits {
+		if state < STATE_SALESCONTRACT || state > STATE_SCRAPPED || limit < 0 {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid dwell limit for state " + strconv.Itoa(state))
+		}
+	}
+
+	if config.MaxResultBytes < 0 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid maxResultBytes")
+	}
+
+	if config.DefaultCurrency != "" && !t.is_valid_currency(config.DefaultCurrency) {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid default currency " + config.DefaultCurrency)
+	}
+
+	if config.AuditLogSize < 0 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid auditLogSize")
+	}
+
+	if config.ScrapApprovals < 0 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid scrapApprovalsRequired")
+	}
+
+	if config.TransferCooldown < 0 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid transferCooldown")
+	}
+
+	if config.TransferExpiry < 0 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid transferExpiry")
+	}
+
+	if stored.PrivateCollection == "" && config.PrivateCollection != "" {
+
+		if products == nil {
+
+			products, err = t.retrieve_all_products(stub)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = t.move_terms(stub, products, config.PrivateCollection)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = t.index_existing_products(stub, products, config.PrivateCollection)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(config)
+	if err != nil {
+		return nil, errors.New("Error creating Config record")
+	}
+
+	err = stub.PutState("Config", bytes)
+	if err != nil {
+		return nil, errors.New("Error storing config")
+	}
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 get_config - Reads the deployment settings stored by Init. Ledgers deployed without a config get the zero Config.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_config(stub shim.ChaincodeStubInterface) (Config, error) {
+
+	var config Config
+
+	bytes, err := stub.GetState("Config")
+
+	if err != nil {
+		return config, errors.New("Error retrieving config")
+	}
+
+	if len(bytes) == 0 {
+		return config, nil
+	}
+
+	err = json.Unmarshal(bytes, &config)
+
+	if err != nil {
+		return config, errors.New("Corrupt Config record")
+	}
+
+	return config, nil
+}
+
+//==============================================================================================================================
+//	 merge_config - Applies the settings in the config JSON passed to the config given. Settings left out keep their
+//					value, and maps passed replace the ones stored rather than adding to them.
+//==============================================================================================================================
+func (t *SimpleChaincode) merge_config(config Config, document string) (Config, error) {
+
+	var fields map[string]json.RawMessage
+
+	err := json.Unmarshal([]byte(document), &fields)
+
+	if err != nil {
+		return config, t.fail(ERR_VALIDATION_FAILED, "Invalid config JSON")
+	}
+
+	for field := range fields {
+		if strings.EqualFold(field, "dwellLimits") {
+			config.DwellLimits = nil
+		} else if strings.EqualFold(field, "fxRates") {
+			config.FXRates = nil
+		}
+	}
+
+	err = json.Unmarshal([]byte(document), &config)
+
+	if err != nil {
+		return config, t.fail(ERR_VALIDATION_FAILED, "Invalid config JSON")
+	}
+
+	return config, nil
+}
+
+//==============================================================================================================================
+//	 General Functions
+//==============================================================================================================================
+//	 ROLE_ATTRIBUTE - The certificate attribute the certificate authority puts the affiliation of a participant in, e.g.
+//					  role=3 for a buyer.
+//==============================================================================================================================
+const ROLE_ATTRIBUTE = "role"
+
+//==============================================================================================================================
+//	 update_blacklist - Adds a participant to or removes one from the blacklist. Regulator only. An optional nonce
+//						guards against the request being replayed.
+//==============================================================================================================================
+func (t *SimpleChaincode) update_blacklist(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string, add bool) ([]byte, error) {
+
+	if (len(args) != 1 && len(args) != 2) || strings.TrimSpace(args[0]) == "" {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "UPDATE_BLACKLIST: Expecting the name of one participant and an optional nonce")
+	}
+
+	if caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if len(args) == 2 {
+
+		err := t.check_nonce(stub, "blacklist", args[1])
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	blacklist, err := t.get_blacklist(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	i := sort.SearchStrings(blacklist, args[0])
+	listed := i < len(blacklist) && blacklist[i] == args[0]
+
+	if add && listed {
+		return nil, t.fail(ERR_INVALID_STATE, "UPDATE_BLACKLIST: " + args[0] + " is already blacklisted")
+	} else if !add && !listed {
+		return nil, t.fail(ERR_NOT_FOUND, "UPDATE_BLACKLIST: " + args[0] + " is not blacklisted")
+	}
+
+	if add {
+		blacklist = append(blacklist, "")
+		copy(blacklist[i + 1:], blacklist[i:])
+		blacklist[i] = args[0]
+	} else {
+		blacklist = append(blacklist[:i], blacklist[i + 1:]...)
+	}
+
+	bytes, err := json.Marshal(blacklist)
+
+	if err != nil {
+		return nil, errors.New("Error creating blacklist record")
+	}
+
+	err = stub.PutState("Blacklist", bytes)
+
+	if err != nil {
+		return nil, errors.New("Error storing blacklist")
+	}
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 update_participant - The regulator manages the participant registry. register_participant takes a name and a role,
+//						  its number or its name, and adds or replaces the participant as a managed entry, which also
+//						  reinstates a revoked participant. A PEM encoded certificate may be passed third, which is
+//						  pinned for the participant in place of the one recorded, e.g. once it has been renewed.
+//						  set_role changes the role of a registered participant and revoke_participant revokes one.
+//						  Regulators can't revoke themselves or give up their own role, so there is always someone
+//						  left to manage the registry.
+//==============================================================================================================================
+func (t *SimpleChaincode) update_participant(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, function string, args []string) ([]byte, error) {
+
+	expected := 2
+
+	if function == "revoke_participant" {
+		expected = 1
+	} else if function == "register_participant" && len(args) == 3 {
+		expected = 3
+	}
+
+	if len(args) != expected || strings.TrimSpace(args[0]) == "" {
+		return nil, t.fail(ERR_VALIDATION_FAILED, strings.ToUpper(function) + ": Incorrect number of arguments passed")
+	}
+
+	if caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	participant, found, err := t.load_participant(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if function != "register_participant" && !found {
+		return nil, t.fail(ERR_NOT_FOUND, strings.ToUpper(function) + ": Unknown participant " + args[0])
+	}
+
+	if function != "register_participant" && participant.Revoked {
+		return nil, t.fail(ERR_INVALID_STATE, strings.ToUpper(function) + ": Participant " + args[0] + " has been revoked")
+	}
+
+	if function == "revoke_participant" {
+
+		if args[0] == caller {
+			return nil, t.fail(ERR_PERMISSION_DENIED, "REVOKE_PARTICIPANT: Regulators can't revoke themselves")
+		}
+
+		participant.Revoked = true
+
+	} else {
+
+		role, err := t.parse_role(args[1])
+
+		if err != nil {
+			return nil, t.wrap_error(strings.ToUpper(function) + ": ", err)
+		}
+
+		if args[0] == caller && role != GOVERNMENT {
+			return nil, t.fail(ERR_PERMISSION_DENIED, strings.ToUpper(function) + ": Regulators can't give up their own role")
+		}
+
+		participant.Role = role
+		participant.Revoked = false
+
+		if len(args) == 3 {
+
+			certificate, err := t.parse_certificate(args[2], args[0])
+
+			if err != nil {
+				return nil, t.wrap_error(strings.ToUpper(function) + ": ", err)
+			}
+
+			participant.Certificate = certificate
+		}
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	participant.Managed = true
+	participant.UpdatedBy = caller
+	participant.UpdatedAt = now
+
+	err = t.save_participant(stub, participant)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+//==============================================================================================================================
+//	 get_username - Retrieves the username of the user who invoked the chaincode, the common name of their certificate
+//					qualified by the MSP ID of their organisation, e.g. alice@Org1MSP. Members of different
+//					organisations whose certificates have the same common name are different participants.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) get_username(stub shim.ChaincodeStubInterface) (string, error) {
+
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil || cert == nil {
+		return "", errors.New("Couldn't retrieve caller certificate")
+	}
+
+	mspid, err := cid.GetMSPID(stub)
+	if err != nil || mspid == "" {
+		return "", errors.New("Couldn't retrieve caller MSP ID")
+	}
+
+	return cert.Subject.CommonName + "@" + mspid, nil
+}
+
+//==============================================================================================================================
+//	 get_cert_fingerprint - The SHA-256 fingerprint of the caller's certificate, hex encoded.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) get_cert_fingerprint(stub shim.ChaincodeStubInterface) (string, error) {
+
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil || cert == nil {
+		return "", errors.New("Couldn't retrieve caller certificate")
+	}
+
+	sum := sha256.Sum256(cert.Raw)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+//==============================================================================================================================
+//	 get_caller_data - Returns the name of the caller and their affiliation, read from the role attribute of their
+//					   certificate unless the regulator manages their registry entry. Revoked participants are refused.
+//==============================================================================================================================
+
+func (t *SimpleChaincode) get_caller_data(stub shim.ChaincodeStubInterface) (string, int, error) {
+
+	user, err := t.get_username(stub)
+	if err != nil {
+		return "", -1, err
+	}
+
+	participant, found, err := t.load_participant(stub, user)
+	if err != nil {
+		return "", -1, err
+	}
+
+	if found && participant.Revoked {
+		return "", -1, t.fail(ERR_PERMISSION_DENIED, "Participant " + user + " has been revoked")
+	}
+
+	if found && participant.Managed {
+		return user, participant.Role, nil
+	}
+
+	role, found, err := cid.GetAttributeValue(stub, ROLE_ATTRIBUTE)
+	if err != nil {
+		return "", -1, errors.New("Couldn't read caller attributes")
+	}
+
+	if !found {
+		return "", -1, t.fail(ERR_PERMISSION_DENIED, "Caller certificate has no " + ROLE_ATTRIBUTE + " attribute")
+	}
+
+	affiliation, err := strconv.Atoi(role)
+	if err != nil || ROLE_NAMES[affiliation] == "" {
+		return "", -1, t.fail(ERR_VALIDATION_FAILED, "Caller certificate has an invalid " + ROLE_ATTRIBUTE + " attribute")
+	}
+
+	return user, affiliation, nil
+}
+
+//==============================================================================================================================
+//	 Participants - The registry of participants and their affiliations, kept under "Participant_<name>" where name
+//					is the MSP qualified name get_username gives, e.g. "Participant_alice@Org1MSP". Every caller
+//					is recorded there by invoke with the role attribute of their certificate, which means a
+//					participant has to have invoked the chaincode once before anything can be sent to them. The
+//					regulator can also manage entries with register_participant, set_role and revoke_participant.
+//					A managed entry takes precedence over the certificate, and a revoked participant can neither call
+//					the chaincode nor be sent anything.
+//==============================================================================================================================
+//	 load_participant - Returns the registry entry of a participant and whether there is one. Entries recorded by older
+//						versions of this chaincode hold just the affiliation.
+//==============================================================================================================================
+func (t *SimpleChaincode) load_participant(stub shim.ChaincodeStubInterface, name string) (Participant, bool, error) {
+
+	participant := Participant{Name: name}
+
+	stored, err := stub.GetState("Participant_" + name)
+
+	if err != nil {
+		return participant, false, errors.New("Unable to get participant " + name)
+	}
+
+	if len(stored) == 0 {
+		return participant, false, nil
+	}
+
+	if affiliation, err := strconv.Atoi(string(stored)); err == nil {
+		participant.Role = affiliation
+		return participant, true, nil
+	}
+
+	err = json.Unmarshal(stored, &participant)
+
+	if err != nil {
+		return participant, false, errors.New("Corrupt participant record " + name)
+	}
+
+	return participant, true, nil
+}
+
+//==============================================================================================================================
+//	 save_participant - Writes the registry entry of a participant.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_participant(stub shim.ChaincodeStubInterface, participant Participant) (error) {
+
+	bytes, err := json.Marshal(participant)
+
+	if err != nil {
+		return errors.New("Error creating participant record")
+	}
+
+	err = stub.PutState("Participant_" + participant.Name, bytes)
+
+	if err != nil {
+		return errors.New("Unable to store participant " + participant.Name)
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 record_participant - Records the affiliation a caller's certificate gives them and pins the certificate itself,
+//						  which signatures of the participant are verified against. A caller presenting another
+//						  certificate than the one pinned has the same common name from the same MSP, as get_username
+//						  derives the name from both, e.g. after re-enrolling. Their certificate is pinned in place of
+//						  the old one unless it was issued before it and the old one is still valid. Nothing is written
+//						  while the pinned certificate stays, so routine transactions don't all write the same key.
+//==============================================================================================================================
+func (t *SimpleChaincode) record_participant(stub shim.ChaincodeStubInterface, name string, affiliation int) (error) {
+
+	participant, found, err := t.load_participant(stub, name)
+
+	if err != nil {
+		return err
+	}
+
+	cert, err := cid.GetX509Certificate(stub)
+	if err != nil || cert == nil {
+		return errors.New("Couldn't retrieve caller certificate")
+	}
+
+	certificate := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+
+	if found && participant.Certificate == certificate {
+		return nil
+	}
+
+	if found && participant.Certificate != "" {
+
+		superseded, err := t.certificate_superseded(stub, participant.Certificate, cert)
+
+		if err != nil || !superseded {
+			return err
+		}
+	}
+
+	if !found || !participant.Managed {
+		participant = Participant{Name: name, Role: affiliation}
+	}
+
+	participant.Certificate = certificate
+
+	return t.save_participant(stub, participant)
+}
+
+//==============================================================================================================================
+//	 certificate_superseded - Whether a caller's certificate replaces the PEM encoded certificate pinned for them: it was
+//							  issued after the pinned one, or the pinned one has expired or can't be read.
+//==============================================================================================================================
+func (t *SimpleChaincode) certificate_superseded(stub shim.ChaincodeStubInterface, pinned string, cert *x509.Certificate) (bool, error) {
+
+	block, _ := pem.Decode([]byte(pinned))
+
+	if block == nil {
+		return true, nil
+	}
+
+	old, err := x509.ParseCertificate(block.Bytes)
+
+	if err != nil || cert.NotBefore.After(old.NotBefore) {
+		return true, nil
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return false, err
+	}
+
+	return now > old.NotAfter.Unix(), nil
+}
+
+//==============================================================================================================================
+//	 parse_certificate - Checks a PEM encoded certificate passed for a participant is one and was issued to them, that
+//						 is its common name is the name of the participant without its MSP ID. Returns the certificate
+//						 encoded the way record_participant records certificates.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_certificate(value string, name string) (string, error) {
+
+	block, _ := pem.Decode([]byte(value))
+
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", t.fail(ERR_VALIDATION_FAILED, "Invalid certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+
+	if err != nil {
+		return "", t.fail(ERR_VALIDATION_FAILED, "Invalid certificate: " + err.Error())
+	}
+
+	at := strings.LastIndex(name, "@")
+
+	if at < 0 || cert.Subject.CommonName != name[:at] {
+		return "", t.fail(ERR_VALIDATION_FAILED, "Certificate wasn't issued to " + name)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})), nil
+}
+
+//==============================================================================================================================
+//	 verify_signature - Checks a base64 encoded detached signature over a SHA-256 digest against the public key of the
+//						PEM encoded certificate passed. ECDSA signatures, as made by Fabric identities, and RSA PKCS #1
+//						v1.5 signatures are supported.
+//==============================================================================================================================
+func (t *SimpleChaincode) verify_signature(certificate string, digest []byte, signature string) (error) {
+
+	block, _ := pem.Decode([]byte(certificate))
+
+	if block == nil {
+		return t.fail(ERR_VALIDATION_FAILED, "Invalid certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+
+	if err != nil {
+		return t.fail(ERR_VALIDATION_FAILED, "Invalid certificate: " + err.Error())
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+
+	if err != nil {
+		return t.fail(ERR_VALIDATION_FAILED, "Signature must be base64 encoded")
+	}
+
+	switch key := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+
+		var point struct {
+			R, S *big.Int
+		}
+
+		_, err = asn1.Unmarshal(sig, &point)
+
+		if err != nil || point.R == nil || point.S == nil || !ecdsa.Verify(key, digest, point.R, point.S) {
+			return t.fail(ERR_VALIDATION_FAILED, "Invalid signature")
+		}
+
+	case *rsa.PublicKey:
+
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig) != nil {
+			return t.fail(ERR_VALIDATION_FAILED, "Invalid signature")
+		}
+
+	default:
+		return t.fail(ERR_VALIDATION_FAILED, "Unsupported certificate key type")
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 get_affiliation - Returns the affiliation recorded for a participant.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_affiliation(stub shim.ChaincodeStubInterface, name string) (int, error) {
+
+	participant, found, err := t.load_participant(stub, name)
+
+	if err != nil {
+		return -1, err
+	}
+
+	if !found {
+		return -1, t.fail(ERR_NOT_FOUND, "Unknown participant " + name)
+	}
+
+	if participant.Revoked {
+		return -1, t.fail(ERR_INVALID_STATE, "Participant " + name + " has been revoked")
+	}
+
+	return participant.Role, nil
+}
+
+//==============================================================================================================================
+//	 parse_role - Reads a role passed either as its number or its name in ROLE_NAMES.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_role(value string) (int, error) {
+
+	role, err := strconv.Atoi(value)
+
+	if err != nil {
+		for affiliation, name := range ROLE_NAMES {
+			if name == strings.ToUpper(value) {
+				role = affiliation
+			}
+		}
+	}
+
+	if ROLE_NAMES[role] == "" {
+		return -1, t.fail(ERR_VALIDATION_FAILED, "Unknown role " + value)
+	}
+
+	return role, nil
+}
+
+//==============================================================================================================================
+//	 retrieve_product - Gets the state of the data at productId in the ledger then converts it from the stored
+//						JSON into the Product struct for use in the contract. Returns the Product struct.
+//						Returns an empty product if it errors.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_product(stub shim.ChaincodeStubInterface, productId string) (Product, error) {
+
+	var product Product
+
+	if !PRODUCT_ID_PATTERN.MatchString(productId) {
+		return product, t.fail(ERR_VALIDATION_FAILED, "RETRIEVE_PRODUCT: Invalid product id " + productId)
+	}
+
+	bytes, err := stub.GetState(productId);
+
+	if err != nil {
+		t.audit(stub, "RETRIEVE_PRODUCT: Failed to invoke chaincode: %s", err); return product, errors.New("RETRIEVE_PRODUCT: Error retrieving product with pid = " + productId)
+	}
+
+	if len(bytes) == 0 {
+		return product, t.fail(ERR_NOT_FOUND, "RETRIEVE_PRODUCT: Product " + productId + " not found")
+	}
+
+	err = json.Unmarshal(bytes, &product);
+
+	if err != nil {
+		t.audit(stub, "RETRIEVE_PRODUCT: Corrupt product record %s: %s", productId, err); return product, errors.New("RETRIEVE_PRODUCT: Corrupt product record " + productId)
+	}
+
+	if product.TermsHash != "" {
+
+		err = t.load_terms(stub, &product)
+
+		if err != nil {
+			t.audit(stub, "RETRIEVE_PRODUCT: %s", err); return product, err
+		}
+	}
+
+	return product, nil
+}
+
+//==============================================================================================================================
+// Commercial terms - With a private collection configured, save_changes moves the price, currency and sales contracts
+//					  of a product into it and leaves their hash on the public record. Peers outside the collection
+//					  only see the public record, so transactions that read the terms must be endorsed by members.
+//==============================================================================================================================
+//	 store_terms - Writes the terms of the product to the collection and returns the product as it goes on the public
+//				   ledger.
+//==============================================================================================================================
+func (t *SimpleChaincode) store_terms(stub shim.ChaincodeStubInterface, collection string, product Product) (Product, error) {
+
+	salt, err := t.terms_salt(stub, collection, product.ProductID)
+
+	if err != nil {
+		return product, err
+	}
+
+	bytes, err := json.Marshal(CommercialTerms{Price: product.Price, Currency: product.Currency, Contracts: product.Contracts,
+		SellerBank: product.SellerBank, BuyerBank: product.BuyerBank, Payments: product.Payments, Accreditive: product.Accreditive, PastAccreditives: product.PastAccreditives, MinorUnits: true, Salt: salt})
+
+	if err != nil {
+		return product, errors.New("Error creating CommercialTerms record")
+	}
+
+	err = stub.PutPrivateData(collection, product.ProductID, bytes)
+
+	if err != nil {
+		return product, errors.New("Error storing commercial terms of product " + product.ProductID)
+	}
+
+	sum := sha256.Sum256(bytes)
+
+	product.TermsHash = hex.EncodeToString(sum[:])
+
+	return t.public_view(product), nil
+}
+
+//==============================================================================================================================
+//	 transient_terms - The terms passed in the transient field "terms", for functions taking a price that shouldn't
+//					   appear in the transaction.
+//==============================================================================================================================
+func (t *SimpleChaincode) transient_terms(stub shim.ChaincodeStubInterface) (CommercialTerms, error) {
+
+	var terms CommercialTerms
+
+	transient, err := stub.GetTransient()
+
+	if err != nil {
+		return terms, errors.New("Unable to read transient data")
+	}
+
+	err = json.Unmarshal(transient["terms"], &terms)
+
+	if err != nil {
+		return terms, t.fail(ERR_VALIDATION_FAILED, "Expecting a price or transient terms JSON")
+	}
+
+	return terms, nil
+}
+
+//==============================================================================================================================
+//	 terms_salt - The salt to hash the terms of a product with. Chaincode can't draw random numbers of its own, as every
+//				  endorser has to write the same terms, so the client passes at least MIN_SALT_BYTES of them in the
+//				  transient field "salt" when the terms are first stored. Later writes keep the salt already stored
+//				  unless a new one is passed. Terms stored before salts were introduced stay unsalted until then.
+//==============================================================================================================================
+func (t *SimpleChaincode) terms_salt(stub shim.ChaincodeStubInterface, collection string, productId string) (string, error) {
+
+	transient, err := stub.GetTransient()
+
+	if err != nil {
+		return "", errors.New("Unable to read transient data")
+	}
+
+	if salt, ok := transient["salt"]; ok {
+
+		if len(salt) < MIN_SALT_BYTES {
+			return "", t.fail(ERR_VALIDATION_FAILED, "The salt must hold at least " + strconv.Itoa(MIN_SALT_BYTES) + " random bytes")
+		}
+
+		return hex.EncodeToString(salt), nil
+	}
+
+	bytes, err := stub.GetPrivateData(collection, productId)
+
+	if err != nil {
+		return "", errors.New("Error retrieving commercial terms of product " + productId)
+	}
+
+	if len(bytes) == 0 {
+		return "", t.fail(ERR_VALIDATION_FAILED, "Pass a random salt in the transient field salt to keep the terms of product " + productId + " private")
+	}
+
+	var stored struct {
+		Salt string
+	}
+
+	err = json.Unmarshal(bytes, &stored)
+
+	if err != nil {
+		return "", errors.New("Corrupt CommercialTerms record")
+	}
+
+	return stored.Salt, nil
+}
+
+//==============================================================================================================================
+//	 load_terms - Fills in the terms of a product from the collection. Leaves the product as it is when this peer
+//				  doesn't hold them, so it can still be read, and refuses terms that don't match the hash on the public
+//				  record. Functions writing the product check check_terms_held first.
+//==============================================================================================================================
+func (t *SimpleChaincode) load_terms(stub shim.ChaincodeStubInterface, product *Product) (error) {
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return err
+	}
+
+	if config.PrivateCollection == "" {
+		return nil
+	}
+
+	bytes, err := stub.GetPrivateData(config.PrivateCollection, product.ProductID)
+
+	if err != nil || len(bytes) == 0 {
+		return nil
+	}
+
+	sum := sha256.Sum256(bytes)
+
+	if hex.EncodeToString(sum[:]) != product.TermsHash {
+		return errors.New("Commercial terms of product " + product.ProductID + " don't match their hash")
+	}
+
+	var terms CommercialTerms
+
+	err = json.Unmarshal(bytes, &terms)
+
+	if err != nil || !terms.MinorUnits {
+		err = t.decode_legacy(bytes, &terms, t.legacy_terms)
+	}
+
+	if err != nil {
+		return errors.New("Corrupt CommercialTerms record")
+	}
+
+	product.Price = terms.Price
+	product.Currency = terms.Currency
+	product.Contracts = terms.Contracts
+	product.SellerBank = terms.SellerBank
+	product.BuyerBank = terms.BuyerBank
+
+	// Terms stored before the payments and credits moved into them leave those on the public record as they are
+	if terms.Payments != nil {
+		product.Payments = terms.Payments
+	}
+
+	if terms.Accreditive != nil {
+		product.Accreditive = terms.Accreditive
+	}
+
+	if terms.PastAccreditives != nil {
+		product.PastAccreditives = terms.PastAccreditives
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 check_terms_held - Refuses to go on with a product whose terms are kept in the collection when load_terms couldn't
+//						fill them in. Writing it would store a price of 0 and drop the terms from the collection.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_terms_held(product Product) (error) {
+
+	if product.TermsHash != "" && product.Currency == "" {
+		return t.fail(ERR_INVALID_STATE, "The terms of product " + product.ProductID + " are not held by this peer")
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 public_view - The product without its commercial terms. Its payments and letters of credit stay, so their parties
+//				   and dates can be followed, but without the amounts that would give the price away.
+//==============================================================================================================================
+func (t *SimpleChaincode) public_view(product Product) (Product) {
+
+	product.Price = 0
+	product.Currency = ""
+	product.Contracts = nil
+	product.SellerBank = ""
+	product.BuyerBank = ""
+
+	payments := make([]Payment, len(product.Payments))
+
+	for i, payment := range product.Payments {
+		payment.Amount = 0
+		payment.Currency = ""
+		payments[i] = payment
+	}
+
+	if product.Payments != nil {
+		product.Payments = payments
+	}
+
+	if product.Accreditive != nil {
+		credit := t.public_accreditive(*product.Accreditive)
+		product.Accreditive = &credit
+	}
+
+	past := make([]Accreditive, len(product.PastAccreditives))
+
+	for i, credit := range product.PastAccreditives {
+		past[i] = t.public_accreditive(credit)
+	}
+
+	if product.PastAccreditives != nil {
+		product.PastAccreditives = past
+	}
+
+	return product
+}
+
+//==============================================================================================================================
+//	 public_accreditive - A letter of credit without its amounts.
+//==============================================================================================================================
+func (t *SimpleChaincode) public_accreditive(credit Accreditive) (Accreditive) {
+
+	credit.Amount = 0
+	credit.Currency = ""
+	credit.Drawn = 0
+
+	return credit
+}
+
+//==============================================================================================================================
+//	 can_view_terms - Whether the caller may see the commercial terms of a product: the regulator and the parties to the
+//					  sale, but never a shipper.
+//==============================================================================================================================
+func (t *SimpleChaincode) can_view_terms(product Product, caller string, caller_affiliation int) (bool) {
+
+	if caller_affiliation == GOVERNMENT {
+		return true
+	}
+
+	if caller_affiliation == SHIPPER {
+		return false
+	}
+
+	return caller == product.Owner                                                ||
+		caller == product.Manufacturer                                           ||
+		caller == product.Buyer                                                  ||
+		caller == t.buyer_bank(product)                                          ||
+		caller == t.issuing_bank(product)
+}
+
+//==============================================================================================================================
+//	 view_for - The product as the caller may see it, without the commercial terms unless can_view_terms allows them.
+//==============================================================================================================================
+func (t *SimpleChaincode) view_for(product Product, caller string, caller_affiliation int) (Product) {
+
+	if t.can_view_terms(product, caller, caller_affiliation) {
+		return product
+	}
+
+	return t.public_view(product)
+}
+
+//==============================================================================================================================
+// get_blacklist - Returns the sorted list of participants no product may be transferred to.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_blacklist(stub shim.ChaincodeStubInterface) ([]string, error) {
+
+	var blacklist []string
+
+	bytes, err := stub.GetState("Blacklist")
+
+	if err != nil {
+		return nil, errors.New("Unable to get blacklist")
+	}
+
+	if len(bytes) == 0 {
+		return blacklist, nil
+	}
+
+	err = json.Unmarshal(bytes, &blacklist)
+
+	if err != nil {
+		return nil, errors.New("Corrupt blacklist")
+	}
+
+	return blacklist, nil
+}
+
+//==============================================================================================================================
+// check_recipient - Every transfer calls this with the name of the recipient before anything is changed. Transfers to
+//					 blacklisted participants are rejected.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_recipient(stub shim.ChaincodeStubInterface, recipient string) (error) {
+
+	blacklist, err := t.get_blacklist(stub)
+
+	if err != nil {
+		return err
+	}
+
+	i := sort.SearchStrings(blacklist, recipient)
+
+	if i < len(blacklist) && blacklist[i] == recipient {
+		return t.fail(ERR_PERMISSION_DENIED, "Recipient " + recipient + " is blacklisted")
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// check_invariants - Last line of defence before a product is written. Whatever path got us here, a product must never be
+//					  stored with a price that isn't positive, a negative weight or a state outside the lifecycle.
+//					  Weight is allowed to be 0 as it is only known once the product has been manufactured.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_invariants(product Product) (error) {
+
+	if product.Price <= 0 {
+		return t.fail(ERR_VALIDATION_FAILED, "Invariant violated: price must be greater than 0")
+	}
+
+	if product.Weight < 0 {
+		return t.fail(ERR_VALIDATION_FAILED, "Invariant violated: weight must not be negative")
+	}
+
+	if product.State < STATE_SALESCONTRACT || product.State > STATE_SCRAPPED {
+		return t.fail(ERR_VALIDATION_FAILED, "Invariant violated: state " + strconv.Itoa(product.State) + " is not a valid state")
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// Validation - Formats product fields must have. validate_fields checks every product save_changes writes, so nothing
+//				malformed reaches the ledger whichever function changed it. Fields that are empty or UNDEFINED aren't
+//				known yet and are left to validate_new_product and strict mode.
+//==============================================================================================================================
+var PRODUCT_ID_PATTERN = regexp.MustCompile(`^[1-9][0-9]{8}$`)
+var CURRENCY_PATTERN = regexp.MustCompile(`^[A-Z]{3}$`)
+var LOCATION_PATTERN = regexp.MustCompile(`^[\p{L}\p{N}][\p{L}\p{N} ,.'()/&-]{0,99}$`)
+var HASH_PATTERN = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+//==============================================================================================================================
+//	 validate_fields - Returns a FieldError for each field of the product that isn't valid.
+//==============================================================================================================================
+func (t *SimpleChaincode) validate_fields(product Product) ([]FieldError) {
+
+	var invalid []FieldError
+
+	if !PRODUCT_ID_PATTERN.MatchString(product.ProductID) {
+		invalid = append(invalid, FieldError{Field: "productId", Message: "must be a nine digit number"})
+	}
+
+	if product.Currency != "" && (!CURRENCY_PATTERN.MatchString(product.Currency) || !t.is_valid_currency(product.Currency)) {
+		invalid = append(invalid, FieldError{Field: "currency", Message: "must be an ISO 4217 code such as EUR"})
+	}
+
+	locations := map[string]string{"destination": product.Destination, "origin": product.Origin}
+
+	for _, field := range []string{"destination", "origin"} {
+		if locations[field] != "" && locations[field] != "UNDEFINED" && !LOCATION_PATTERN.MatchString(locations[field]) {
+			invalid = append(invalid, FieldError{Field: field, Message: "must be up to 100 letters, digits, spaces and ,.'()/&-"})
+		}
+	}
+
+	if product.Location != nil && (product.Location.Lat < -90 || product.Location.Lat > 90 || product.Location.Lon < -180 || product.Location.Lon > 180) {
+		invalid = append(invalid, FieldError{Field: "location", Message: "must have a latitude between -90 and 90 and a longitude between -180 and 180"})
+	}
+
+	hashes := map[string]string{"termsHash": product.TermsHash}
+
+	if product.Delivery != nil {
+		hashes["delivery.certFingerprint"] = product.Delivery.CertFingerprint
+		hashes["delivery.receiptHash"] = product.Delivery.ReceiptHash
+	}
+
+	for _, field := range []string{"termsHash", "delivery.certFingerprint", "delivery.receiptHash"} {
+		if hashes[field] != "" && !HASH_PATTERN.MatchString(hashes[field]) {
+			invalid = append(invalid, FieldError{Field: field, Message: "must be a hex encoded SHA-256 hash"})
+		}
+	}
+
+	dimensions := map[string]float32{"width": product.Width, "height": product.Height, "weight": product.Weight}
+
+	for _, field := range []string{"width", "height", "weight"} {
+		if dimensions[field] < 0 {
+			invalid = append(invalid, FieldError{Field: field, Message: "must not be negative"})
+		}
+	}
+
+	return invalid
+}
+
+//==============================================================================================================================
+//	 check_fields - validate_fields as an error listing every invalid field, or nil if there are none.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_fields(product Product) (error) {
+
+	invalid := t.validate_fields(product)
+
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	var messages []string
+
+	for _, field := range invalid {
+		messages = append(messages, field.Field + " " + field.Message)
+	}
+
+	return &ChaincodeError{Code: ERR_VALIDATION_FAILED, Message: "Invalid product " + product.ProductID + ": " + strings.Join(messages, "; "), Fields: invalid}
+}
+
+//==============================================================================================================================
+// audit - Adds a message to the audit log when it is enabled in the config. Every entry is written under a key of its
+//		   own made from the transaction, see AUDIT_INDEX, and the oldest entries are deleted so the log never holds
+//		   more than AuditLogSize, see prune_audit_log. A transaction keeps at most that many entries of its own.
+//		   Logging never fails the caller. Entries written by a transaction that goes on to fail are discarded with the
+//		   rest of its writes, and queries can't write so nothing they log is kept.
+//==============================================================================================================================
+func (t *SimpleChaincode) audit(stub shim.ChaincodeStubInterface, format string, a ...interface{}) {
+
+	config, err := t.get_config(stub)
+
+	if err != nil || !config.AuditLog {
+		return
+	}
+
+	size := config.AuditLogSize
+
+	if size == 0 {
+		size = DEFAULT_AUDIT_LOG_SIZE
+	}
+
+	now, _ := t.get_tx_time(stub)
+
+	entry := AuditEntry{Seq: int64(t.next_audit_seq(stub.GetTxID())), TxID: stub.GetTxID(), Timestamp: now, Message: fmt.Sprintf(format, a...)}
+
+	if entry.Seq >= int64(size) {
+		return
+	}
+
+	key, err := stub.CreateCompositeKey(AUDIT_INDEX, []string{fmt.Sprintf("%019d", now), entry.TxID, fmt.Sprintf("%06d", entry.Seq)})
+
+	if err != nil {
+		return
+	}
+
+	bytes, err := json.Marshal(entry)
+
+	if err != nil {
+		return
+	}
+
+	err = stub.PutState(key, bytes)
+
+	if err == nil {
+		t.prune_audit_log(stub, size, int(entry.Seq) + 1)
+	}
+}
+
+//==============================================================================================================================
+// prune_audit_log - Deletes the oldest entries of the audit log written by other transactions until they and the own
+//					 entries of the transaction, of which there are count, fit in size. A transaction doesn't read its
+//					 own writes on a peer, so its own entries are counted rather than read. Pruning reads the whole
+//					 log, so transactions logging at the same time conflict and all but one have to be resubmitted;
+//					 that is why the log is off by default.
+//==============================================================================================================================
+func (t *SimpleChaincode) prune_audit_log(stub shim.ChaincodeStubInterface, size int, count int) {
+
+	iter, err := stub.GetStateByPartialCompositeKey(AUDIT_INDEX, []string{})
+
+	if err != nil {
+		return
+	}
+
+	var others []string
+
+	for iter.HasNext() {
+
+		kv, err := iter.Next()
+
+		if err != nil {
+			iter.Close()
+			return
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+
+		if err == nil && len(attributes) == 3 && attributes[1] == stub.GetTxID() {
+			continue
+		}
+
+		others = append(others, kv.Key)
+	}
+
+	iter.Close()                                                                                          // Closed before deleting from the range it reads
+
+	for i := 0; i < len(others) + count - size && i < len(others); i++ {
+		stub.DelState(others[i])
+	}
+}
+
+//==============================================================================================================================
+// next_audit_seq - Returns the number of the next audit log entry of a transaction, counting from 0. Every endorser
+//					numbers the entries of a transaction the same way. Invoke and Init release the count once the
+//					transaction is done with end_tx.
+//==============================================================================================================================
+func (t *SimpleChaincode) next_audit_seq(txid string) (int) {
+
+	t.tx_lock.Lock()
+	defer t.tx_lock.Unlock()
+
+	if t.audit_seq == nil {
+		t.audit_seq = make(map[string]int)
+	}
+
+	seq := t.audit_seq[txid]
+	t.audit_seq[txid] = seq + 1
+
+	return seq
+}
+
+//==============================================================================================================================
+// emit - Queues an event of the transaction. The events are sent once the transaction succeeded, see send_events.
+//==============================================================================================================================
+func (t *SimpleChaincode) emit(stub shim.ChaincodeStubInterface, name string, payload []byte) {
+
+	t.tx_lock.Lock()
+	defer t.tx_lock.Unlock()
+
+	if t.events == nil {
+		t.events = make(map[string][]Event)
+	}
+
+	txid := stub.GetTxID()
+
+	t.events[txid] = append(t.events[txid], Event{Name: name, Payload: json.RawMessage(payload)})
+}
+
+//==============================================================================================================================
+// queued_events / discard_events - The number of events the transaction has queued, and dropping those queued after
+//									the first count of them. Batches reporting partial results drop the events of a
+//									product that failed, as the product wasn't changed.
+//==============================================================================================================================
+func (t *SimpleChaincode) queued_events(stub shim.ChaincodeStubInterface) (int) {
+
+	t.tx_lock.Lock()
+	defer t.tx_lock.Unlock()
+
+	return len(t.events[stub.GetTxID()])
+}
+
+func (t *SimpleChaincode) discard_events(stub shim.ChaincodeStubInterface, count int) {
+
+	t.tx_lock.Lock()
+	defer t.tx_lock.Unlock()
+
+	txid := stub.GetTxID()
+
+	if len(t.events[txid]) > count {
+		t.events[txid] = t.events[txid][:count]
+	}
+}
+
+//==============================================================================================================================
+// send_events - Sends the events queued by the transaction. The peer only keeps the last event set by a transaction,
+//				 so a single event is sent as it is and several ones are sent as one "events" event listing them in
+//				 the order they were emitted.
+//==============================================================================================================================
+func (t *SimpleChaincode) send_events(stub shim.ChaincodeStubInterface) (error) {
+
+	t.tx_lock.Lock()
+	events := t.events[stub.GetTxID()]
+	t.tx_lock.Unlock()
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	if len(events) == 1 {
+		return stub.SetEvent(events[0].Name, events[0].Payload)
+	}
+
+	bytes, err := json.Marshal(events)
+
+	if err != nil {
+		return errors.New("Error creating events event")
+	}
+
+	return stub.SetEvent("events", bytes)
+}
+
+//==============================================================================================================================
+// end_tx - Forgets the audit log entry count and the events of a finished transaction.
+//==============================================================================================================================
+func (t *SimpleChaincode) end_tx(txid string) {
+
+	t.tx_lock.Lock()
+	defer t.tx_lock.Unlock()
+
+	delete(t.audit_seq, txid)
+	delete(t.events, txid)
+}
+
+//==============================================================================================================================
+// record_invocation - Appends an invocation to the audit trail. Called by invoke for every function that succeeds.
+//					   The peer discards every write of a failed transaction, so failures can't be recorded and the
+//					   trail only holds the invocations that went through. An invocation that can't be recorded fails,
+//					   so none is missing from the trail.
+//==============================================================================================================================
+func (t *SimpleChaincode) record_invocation(stub shim.ChaincodeStubInterface, function string, caller string, caller_affiliation int, productId string) (error) {
+
+	now, _ := t.get_tx_time(stub)
+
+	entry := TrailEntry{
+		TxID:        stub.GetTxID(),
+		Timestamp:   now,
+		Function:    function,
+		Caller:      caller,
+		Affiliation: caller_affiliation,
+		ProductID:   productId,
+	}
+
+	bytes, err := json.Marshal(entry)
+
+	if err != nil {
+		return errors.New("RECORD_INVOCATION: Error creating audit trail entry")
+	}
+
+	err = stub.PutState(TRAIL_PREFIX + fmt.Sprintf("%019d", now) + "_" + entry.TxID, bytes)
+
+	if err != nil {
+		return errors.New("RECORD_INVOCATION: Error writing audit trail entry")
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// check_strict - Extra checks made by save_changes in strict mode. No text field may hold the UNDEFINED placeholder and
+//				  once a product has been manufactured its width, height and weight must be set.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_strict(product Product) (error) {
+
+	value := reflect.ValueOf(product)
+
+	for i := 0; i < value.NumField(); i++ {
+		if value.Field(i).Kind() == reflect.String && value.Field(i).String() == "UNDEFINED" {
+			return t.fail(ERR_VALIDATION_FAILED, "Strict mode: " + value.Type().Field(i).Name + " is UNDEFINED")
+		}
+	}
+
+	if product.State >= STATE_SHIPPING && (product.Width <= 0 || product.Height <= 0 || product.Weight <= 0) {
+		return t.fail(ERR_VALIDATION_FAILED, "Strict mode: width, height and weight must be set once a product is manufactured")
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// check_hold - Called by save_changes. A product on hold can't be changed, so a product still on hold may only be
+//				saved by the transaction placing the hold. Lifting the hold is the one save that clears it. Breaches
+//				of thresholds are still flagged, see write_product.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_hold(stub shim.ChaincodeStubInterface, product Product) (error) {
+
+	if product.Hold == nil {
+		return nil
+	}
+
+	bytes, err := stub.GetState(product.ProductID)
+
+	if err != nil {
+		return errors.New("Unable to get product " + product.ProductID)
+	}
+
+	var stored Product
+
+	if len(bytes) != 0 && json.Unmarshal(bytes, &stored) == nil && stored.Hold == nil {
+		return nil
+	}
+
+	return t.hold_error(product)
+}
+
+//==============================================================================================================================
+// hold_error - The error a function acting on a product on hold fails with.
+//==============================================================================================================================
+func (t *SimpleChaincode) hold_error(product Product) (error) {
+	return t.fail(ERR_HOLD_ACTIVE, "Product " + product.ProductID + " is on hold by " + product.Hold.PlacedBy + ": " + product.Hold.Reason)
+}
+
+//==============================================================================================================================
+// recall_error - The error a transfer of a recalled product fails with. Recalled products may only go to a recycler.
+//==============================================================================================================================
+func (t *SimpleChaincode) recall_error(product Product) (error) {
+	return t.fail(ERR_INVALID_STATE, "Product " + product.ProductID + " is recalled under recall " + product.RecallID)
+}
+
+//==============================================================================================================================
+// save_changes - Writes to the ledger the Product struct passed in a JSON format. Uses the shim file's 
+//				  method 'PutState'.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_changes(stub shim.ChaincodeStubInterface, product Product) (bool, error) {
+
+	err := t.check_hold(stub, product)
+
+	if err != nil {
+		t.audit(stub, "SAVE_CHANGES: Refusing to store product %s: %s", product.ProductID, err); return false, err
+	}
+
+	return t.write_product(stub, product)
+}
+
+//==============================================================================================================================
+// write_product - Does the work of save_changes except for checking the hold. Only called directly for changes a hold
+//				   doesn't stop, such as flagging a breach of a threshold.
+//==============================================================================================================================
+func (t *SimpleChaincode) write_product(stub shim.ChaincodeStubInterface, product Product) (bool, error) {
+
+	err := t.check_terms_held(product)
+
+	if err != nil {
+		t.audit(stub, "SAVE_CHANGES: Refusing to store product %s: %s", product.ProductID, err); return false, err
+	}
+
+	err = t.check_fields(product)                                                                         // First, so every invalid field is reported at once
+
+	if err != nil {
+		t.audit(stub, "SAVE_CHANGES: Refusing to store product %s: %s", product.ProductID, err); return false, err
+	}
+
+	err = t.check_invariants(product)
+
+	if err != nil {
+		t.audit(stub, "SAVE_CHANGES: Refusing to store product %s: %s", product.ProductID, err); return false, err
+	}
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return false, err
+	}
+
+	if config.Strict {
+
+		err = t.check_strict(product)
+
+		if err != nil {
+			t.audit(stub, "SAVE_CHANGES: Refusing to store product %s: %s", product.ProductID, err); return false, err
+		}
+	}
+
+	product.LastModified, err = t.get_tx_time(stub)
+
+	if err != nil {
+		return false, err
+	}
+
+	indexed := product
+
+	if config.PrivateCollection != "" {
+		indexed = t.public_view(product)                                        // Index keys are public, the terms aren't
+	}
+
+	err = t.update_indexes(stub, indexed)
+
+	if err != nil {
+		t.audit(stub, "SAVE_CHANGES: Error updating indexes: %s", err); return false, errors.New("Error updating indexes")
+	}
+
+	if config.PrivateCollection != "" {
+
+		product, err = t.store_terms(stub, config.PrivateCollection, product)
+
+		if err != nil {
+			t.audit(stub, "SAVE_CHANGES: %s", err); return false, err
+		}
+	}
+
+	bytes, err := json.Marshal(product)
+
+	if err != nil {
+		t.audit(stub, "SAVE_CHANGES: Error converting product record: %s", err); return false, errors.New("Error converting product record")
+	}
+
+	err = stub.PutState(product.ProductID, bytes)
+
+	if err != nil {
+		t.audit(stub, "SAVE_CHANGES: Error storing product record: %s", err); return false, errors.New("Error storing product record")
+	}
+
+	t.audit(stub, "SAVE_CHANGES: Stored product %s in state %d owned by %s", product.ProductID, product.State, product.Owner)
+
+	return true, nil
+}
+
+//==============================================================================================================================
+// save_transfer - save_changes for transfer functions. A transfer only moves ownership, custody and state, so the
+//				   product is compared with the stored record first and refused if its id, price or currency changed.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_transfer(stub shim.ChaincodeStubInterface, product Product) (bool, error) {
+
+	stored, err := t.retrieve_product(stub, product.ProductID)
+
+	if err != nil {
+		return false, err
+	}
+
+	if stored.ProductID != product.ProductID        ||
+		stored.Price != product.Price                ||
+		stored.Currency != product.Currency {
+		return false, t.fail(ERR_VALIDATION_FAILED, "Transfer may not change the id, price or currency of product " + stored.ProductID)
+	}
+
+	return t.save_changes(stub, product)
+}
+
+//==============================================================================================================================
+// retrieve_history - Returns the history of a product's key, oldest first. Needs the history database of the peer to
+//					  be enabled.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_history(stub shim.ChaincodeStubInterface, productId string) ([]HistoryEntry, error) {
+
+	iter, err := stub.GetHistoryForKey(productId)
+
+	if err != nil {
+		return nil, errors.New("Unable to get the history of product " + productId)
+	}
+
+	defer iter.Close()
+
+	history := []HistoryEntry{}
+
+	for iter.HasNext() {
+
+		modification, err := iter.Next()
+
+		if err != nil {
+			return nil, errors.New("Unable to read the history of product " + productId)
+		}
+
+		entry := HistoryEntry{TxID: modification.TxId, IsDelete: modification.IsDelete}
+
+		if modification.Timestamp != nil {
+			entry.Timestamp = modification.Timestamp.Seconds
+		}
+
+		if !modification.IsDelete {
+			entry.Value = json.RawMessage(modification.Value)
+		}
+
+		history = append(history, entry)
+	}
+
+	return history, nil
+}
+//==============================================================================================================================
+// check_nonce - Rejects a government override whose nonce has been used before for the same action, so a resubmitted
+//				 transaction can't be applied twice. The nonce is optional; without one nothing is checked.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_nonce(stub shim.ChaincodeStubInterface, action string, nonce string) (error) {
+
+	if nonce == "" {
+		return nil
+	}
+
+	key := "Nonce_" + action + "_" + nonce
+
+	bytes, err := stub.GetState(key)
+
+	if err != nil {
+		return errors.New("Unable to get nonce")
+	}
+
+	if bytes != nil {
+		return t.fail(ERR_INVALID_STATE, "duplicate request")
+	}
+
+	err = stub.PutState(key, []byte(stub.GetTxID()))
+
+	if err != nil {
+		return errors.New("Error storing nonce")
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// get_tx_time - Returns the timestamp of the current transaction in seconds since the epoch. All peers see the same value
+//				 so it is safe to store on the ledger.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_tx_time(stub shim.ChaincodeStubInterface) (int64, error) {
+
+	ts, err := stub.GetTxTimestamp()
+
+	if err != nil || ts == nil {
+		return 0, errors.New("Unable to get transaction timestamp")
+	}
+
+	return ts.Seconds, nil
+}
+
+//==============================================================================================================================
+// record_custody - Makes custodian the holder of the product and appends the change to its custody history. The first
+//					entry is always the owner that handed the product over.
+//==============================================================================================================================
+func (t *SimpleChaincode) record_custody(stub shim.ChaincodeStubInterface, product *Product, custodian string) (error) {
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return err
+	}
+
+	if len(product.CustodyHistory) == 0 {
+		product.CustodyHistory = append(product.CustodyHistory, CustodyEntry{Custodian: product.Owner, Timestamp: now})
+	}
+
+	product.Custodian = custodian
+	product.CustodyHistory = append(product.CustodyHistory, CustodyEntry{Custodian: custodian, Timestamp: now})
+
+	return nil
+}
+
+//==============================================================================================================================
+// check_progression - The lifecycle only moves forward. A transition to an earlier state is only allowed for the
+//					   actions listed in REVERSALS.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_progression(from int, to int, action string) (error) {
+
+	if to < STATE_SALESCONTRACT || to > STATE_SCRAPPED {
+		return t.fail(ERR_VALIDATION_FAILED, "Invalid state " + strconv.Itoa(to))
+	}
+
+	if to < from && !REVERSALS[action] {
+		return t.fail(ERR_INVALID_STATE, "Illegal backward transition from state " + strconv.Itoa(from) + " to " + strconv.Itoa(to))
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// parse_time_range - Parses a from/to pair of epoch seconds and checks that from is not after to.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_time_range(args []string) (int64, int64, error) {
+
+	if len(args) != 2 {
+		return 0, 0, t.fail(ERR_VALIDATION_FAILED, "Incorrect number of arguments passed, expecting from and to")
+	}
+
+	from, err := strconv.ParseInt(args[0], 10, 64)
+
+	if err != nil {
+		return 0, 0, t.fail(ERR_VALIDATION_FAILED, "Invalid from time " + args[0])
+	}
+
+	to, err := strconv.ParseInt(args[1], 10, 64)
+
+	if err != nil {
+		return 0, 0, t.fail(ERR_VALIDATION_FAILED, "Invalid to time " + args[1])
+	}
+
+	if from > to {
+		return 0, 0, t.fail(ERR_VALIDATION_FAILED, "Invalid time range, from is after to")
+	}
+
+	return from, to, nil
+}
+
+//==============================================================================================================================
+// dwell_exceeded - Returns true when the product has stayed in its current state longer than the configured limit.
+//==============================================================================================================================
+func (t *SimpleChaincode) dwell_exceeded(config Config, product Product, now int64) (bool) {
+
+	limit, ok := config.DwellLimits[product.State]
+
+	if !ok || limit <= 0 {
+		return false
+	}
+
+	entered, ok := product.StateTimestamps[product.State]
+
+	if !ok {
+		return false
+	}
+
+	return now - entered > limit
+}
+
+//==============================================================================================================================
+// check_dwell_time - Called before a transition. Emits a dwell_exceeded event when the product overstayed its current
+//					  state, sent with the other events of the transaction, but never blocks the transition itself.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_dwell_time(stub shim.ChaincodeStubInterface, product Product, now int64) (error) {
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return err
+	}
+
+	if !t.dwell_exceeded(config, product, now) {
+		return nil
+	}
+
+	payload := fmt.Sprintf("{\"productId\":%q,\"state\":%d,\"enteredAt\":%d,\"limit\":%d}", product.ProductID, product.State, product.StateTimestamps[product.State], config.DwellLimits[product.State])
+
+	t.emit(stub, "dwell_exceeded", []byte(payload))
+
+	return nil
+}
+
+//==============================================================================================================================
+// check_transfer_cooldown - Deters wash trading by refusing a change of owner within the configured cooldown of the
+//							 previous one. Changes made by the regulator, e.g. with revert_last_transition, are not held
+//							 back by it.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_transfer_cooldown(stub shim.ChaincodeStubInterface, product Product, actor string, now int64) (error) {
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return err
+	}
+
+	if config.TransferCooldown == 0 {
+		return nil
+	}
+
+	affiliation, err := t.get_affiliation(stub, actor)
+
+	if err != nil {
+		return err
+	}
+
+	if affiliation == GOVERNMENT {
+		return nil
+	}
+
+	for i := len(product.OwnerHistory) - 1; i >= 0; i-- {
+
+		change := product.OwnerHistory[i]
+
+		if change.Owner != change.PreviousOwner {
+
+			if now - change.Timestamp < config.TransferCooldown {
+				return t.fail(ERR_INVALID_STATE, "transfer cooldown active")
+			}
+
+			return nil
+		}
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// get_fx_provider - Returns the FXProvider set on the chaincode, otherwise the exchange rate table at the time of the
+//					 transaction, falling back to the rates configured at Init.
+//==============================================================================================================================
+func (t *SimpleChaincode) get_fx_provider(stub shim.ChaincodeStubInterface) (FXProvider, error) {
+
+	if t.FX != nil {
+		return t.FX, nil
+	}
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return LedgerFXProvider{Stub: stub, At: now, Fallback: ConfigFXProvider{Rates: config.FXRates}}, nil
+}
+
+//==============================================================================================================================
+// check_coverage - Checks that an accreditive covers the summed price of the products passed, converting each price into
+//					the currency of the credit. Products whose terms this peer doesn't hold can't be priced, so the
+//					check fails rather than leave them out.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_coverage(stub shim.ChaincodeStubInterface, credit Accreditive, products ...Product) (error) {
+
+	fx, err := t.get_fx_provider(stub)
+
+	if err != nil {
+		return err
+	}
+
+	var total Money
+
+	for _, p := range products {
+
+		err = t.check_terms_held(p)
+
+		if err != nil {
+			return err
+		}
+
+		price, err := t.convert_money(fx, p.Price, p.Currency, credit.Currency)
+
+		if err != nil {
+			return t.wrap_error("Unable to convert the price of product " + p.ProductID + " to " + credit.Currency + ": ", err)
+		}
+
+		total += price
+	}
+
+	if credit.Amount < total {
+		return t.fail(ERR_VALIDATION_FAILED, "Accreditive does not cover the price of the product")
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// check_changed - Update functions call this before writing so that an update to the value a field already has is
+//				   rejected instead of being written to the ledger and announced to listeners.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_changed(old_value interface{}, new_value interface{}) (error) {
+
+	if reflect.DeepEqual(old_value, new_value) {
+		return t.fail(ERR_VALIDATION_FAILED, "no change")
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// emitFieldUpdate - Emits a field_updated event telling listeners which field of a product changed and how. Called by
+//					 the update functions once the change has been saved.
+//==============================================================================================================================
+func (t *SimpleChaincode) emitFieldUpdate(stub shim.ChaincodeStubInterface, productId string, field string, old_value interface{}, new_value interface{}) (error) {
+
+	payload, err := json.Marshal(FieldUpdateEvent{ProductID: productId, Field: field, OldValue: old_value, NewValue: new_value})
+
+	if err != nil {
+		return errors.New("Error creating field_updated event")
+	}
+
+	t.emit(stub, "field_updated", payload)
+
+	return nil
+}
+
+//==============================================================================================================================
+//	MILESTONES - The shipping milestones in the order a shipment reaches them. DELIVERED is recorded by
+//				 hand_over if the shipper hasn't recorded it already.
+//==============================================================================================================================
+var MILESTONES = []string{"LOADED", "DEPARTED_ORIGIN", "CUSTOMS_CLEARED", "ARRIVED_DESTINATION", "DELIVERED"}
+
+//==============================================================================================================================
+// record_milestone - Appends a shipping milestone to the product, located at its last position, and emits a
+//					  milestone_reached event. Milestones must be recorded in the order of MILESTONES, though some may
+//					  be skipped. The event is queued before the product is saved, so a batch carrying on after a
+//					  product failed has to discard its events, see discard_events.
+//==============================================================================================================================
+func (t *SimpleChaincode) record_milestone(stub shim.ChaincodeStubInterface, product *Product, milestone string, caller string) (error) {
+
+	rank := -1
+
+	for i, name := range MILESTONES {
+		if name == milestone {
+			rank = i
+		}
+	}
+
+	if rank < 0 {
+		return t.fail(ERR_VALIDATION_FAILED, "Unknown milestone " + milestone)
+	}
+
+	for _, reached := range product.Milestones {
+		for i, name := range MILESTONES {
+			if name == reached.Milestone && i >= rank {
+				return t.fail(ERR_INVALID_STATE, "Milestone " + milestone + " can't follow " + reached.Milestone)
+			}
+		}
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return err
+	}
+
+	entry := ShippingMilestone{Milestone: milestone, Location: product.Location, Timestamp: now, RecordedBy: caller}
+	product.Milestones = append(product.Milestones, entry)
+
+	payload, err := json.Marshal(MilestoneEvent{ProductID: product.ProductID, Milestone: entry.Milestone, Location: entry.Location, Timestamp: entry.Timestamp, RecordedBy: entry.RecordedBy})
+
+	if err != nil {
+		return errors.New("Error creating milestone_reached event")
+	}
+
+	t.emit(stub, "milestone_reached", payload)
+
+	return nil
+}
+
+//==============================================================================================================================
+// milestone_reached - Whether the milestone has been recorded for the product.
+//==============================================================================================================================
+func (t *SimpleChaincode) milestone_reached(product Product, milestone string) (bool) {
+
+	for _, reached := range product.Milestones {
+		if reached.Milestone == milestone {
+			return true
+		}
+	}
+
+	return false
+}
+
+//==============================================================================================================================
+// record_transition - Moves the product to new_owner and new_state, appending the change to its owner history and
+//					   entering the new state with enter_state. All lifecycle transitions should go through here.
+//					   action names the kind of transition, e.g. "transfer" or one of the REVERSALS. A change of
+//					   owner clears the scrap approvals given while the previous owner held the product.
+//==============================================================================================================================
+func (t *SimpleChaincode) record_transition(stub shim.ChaincodeStubInterface, product *Product, action string, actor string, new_owner string, new_state int) (error) {
+
+	if product.Locked {
+		return t.fail(ERR_INVALID_STATE, "product is locked")
+	}
+
+	err := t.check_progression(product.State, new_state, action)
+
+	if err != nil {
+		return err
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return err
+	}
+
+	err = t.check_dwell_time(stub, *product, now)
+
+	if err != nil {
+		return err
+	}
+
+	if new_owner != product.Owner {
+
+		err = t.check_transfer_cooldown(stub, *product, actor, now)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	product.OwnerHistory = append(product.OwnerHistory, OwnerChange{
+		Action:        action,
+		PreviousOwner: product.Owner,
+		PreviousState: product.State,
+		Owner:         new_owner,
+		State:         new_state,
+		Actor:         actor,
+		Timestamp:     now,
+	})
+
+	if new_owner != product.Owner {
+		product.TransferCount++
+		product.ScrapApprovals = nil
+	}
+
+	product.Owner = new_owner
+	t.enter_state(stub, product, new_state, actor, now)
+
+	return nil
+}
+
+//==============================================================================================================================
+// enter_state - Puts the product in a state, stamping the time it was entered and appending it to the state history.
+//				 Called by record_transition and, for the first state, when a product is created.
+//==============================================================================================================================
+func (t *SimpleChaincode) enter_state(stub shim.ChaincodeStubInterface, product *Product, state int, actor string, now int64) {
+
+	if product.StateTimestamps == nil {
+		product.StateTimestamps = make(map[int]int64)
+	}
+
+	product.State = state
+	product.StateTimestamps[state] = now
+	product.StateHistory = append(product.StateHistory, StateEntry{State: state, TxID: stub.GetTxID(), Timestamp: now, Actor: actor})
+}
+
+//==============================================================================================================================
+// can_update_manufacture - Manufacturing details may only be changed by the manufacturer that created the product and
+//							only until it is shipped. Ownership is irrelevant here as a bank may hold the product while
+//							it is still being built.
+//==============================================================================================================================
+func (t *SimpleChaincode) can_update_manufacture(product Product, caller string, caller_affiliation int) (bool) {
+
+	return product.Manufacturer == caller                &&
+		caller_affiliation == SELLER                        &&
+		product.State < STATE_SHIPPING
+}
+
+//==============================================================================================================================
+// can_update_transit - While a product is being shipped only its custodian may change where it is or where it goes,
+//						otherwise the owner keeps that right.
+//==============================================================================================================================
+func (t *SimpleChaincode) can_update_transit(product Product, caller string, caller_affiliation int) (bool) {
+
+	if product.State == STATE_SHIPPING {
+		return product.Custodian == caller && caller_affiliation == SHIPPER
+	}
+
+	return product.Owner == caller && product.State != STATE_SCRAPPED
+}
+
+//==============================================================================================================================
+// route_waypoints - Splits a comma separated route into its trimmed, non-empty waypoints.
+//==============================================================================================================================
+func (t *SimpleChaincode) route_waypoints(route string) ([]string) {
+
+	var waypoints []string
+
+	for _, w := range strings.Split(route, ",") {
+		if w = strings.TrimSpace(w); w != "" {
+			waypoints = append(waypoints, w)
+		}
+	}
+
+	return waypoints
+}
+
+//==============================================================================================================================
+// check_waypoints - Rejects locations that aren't in the configured waypoint list. Without a configured list any
+//					 location is accepted.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_waypoints(stub shim.ChaincodeStubInterface, locations []string) (error) {
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return err
+	}
+
+	if len(config.Waypoints) == 0 {
+		return nil
+	}
+
+	for _, location := range locations {
+
+		known := false
+
+		for _, w := range config.Waypoints {
+			if strings.EqualFold(strings.TrimSpace(location), w) {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			return t.fail(ERR_VALIDATION_FAILED, "Unknown waypoint " + location)
+		}
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// parse_dimension - Converts a dimension or weight passed as a string into a non-negative float.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_dimension(new_value string) (float32, error) {
+
+	value, err := strconv.ParseFloat(new_value, 32)
+
+	if err != nil || value < 0 {
+		return 0, t.fail(ERR_VALIDATION_FAILED, "Invalid value " + new_value + ", must be a non-negative number")
+	}
+
+	return float32(value), nil
+}
+
+//==============================================================================================================================
+// estimate_shipping_cost - Works out the cost of shipping a product from its weight in kg and the configured rate.
+//==============================================================================================================================
+func (t *SimpleChaincode) estimate_shipping_cost(config Config, product Product) (float64, error) {
+
+	if config.RatePerKg <= 0 {
+		return 0, t.fail(ERR_INVALID_STATE, "No shipping rate per kg configured")
+	}
+
+	factor, ok := MASS_UNITS[product.Units.Mass]
+
+	if !ok || product.Weight <= 0 {
+		return 0, t.fail(ERR_INVALID_STATE, "Product " + product.ProductID + " has no known weight")
+	}
+
+	return float64(product.Weight) * factor * config.RatePerKg, nil
+}
+
+//==============================================================================================================================
+// state_name - Returns the name of a lifecycle state for use in responses.
+//==============================================================================================================================
+func (t *SimpleChaincode) state_name(state int) (string) {
+
+	if state < 0 || state >= len(STATE_NAMES) {
+		return "UNKNOWN"
+	}
+
+	return STATE_NAMES[state]
+}
+
+//==============================================================================================================================
+// role_name - Looks up the affiliation of a participant and returns its name, or UNKNOWN when the participant isn't
+//			   registered.
+//==============================================================================================================================
+func (t *SimpleChaincode) role_name(stub shim.ChaincodeStubInterface, name string) (string) {
+
+	affiliation, err := t.get_affiliation(stub, name)
+
+	if err != nil || ROLE_NAMES[affiliation] == "" {
+		return "UNKNOWN"
+	}
+
+	return ROLE_NAMES[affiliation]
+}
+
+//==============================================================================================================================
+// buyer_bank - Returns the buyer's bank named in the sales contract of the product, if any. Products created before
+//				 sales contracts became records of their own name it in their most recent Contract.
+//==============================================================================================================================
+func (t *SimpleChaincode) buyer_bank(product Product) (string) {
+
+	if product.BuyerBank != "" || len(product.Contracts) == 0 {
+		return product.BuyerBank
+	}
+
+	return product.Contracts[len(product.Contracts) - 1].Buyer_Bank
+}
+
+//==============================================================================================================================
+// issuing_bank - Returns the bank that issued the accreditive paying for the product, if any.
+//==============================================================================================================================
+func (t *SimpleChaincode) issuing_bank(product Product) (string) {
+
+	if product.IssuingBank != "" || product.Accreditive == nil {
+		return product.IssuingBank
+	}
+
+	return product.Accreditive.IssuingBank
+}
+
+//==============================================================================================================================
+// retrieve_transfer_proposal - Returns the transfer pending for a product, or nil if there is none.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_transfer_proposal(stub shim.ChaincodeStubInterface, productId string) (*TransferProposal, error) {
+
+	bytes, err := stub.GetState("transfer_" + productId)
+
+	if err != nil {
+		return nil, errors.New("Unable to get transfer proposal for " + productId)
+	}
+
+	if len(bytes) == 0 {
+		return nil, nil
+	}
+
+	var proposal TransferProposal
+
+	err = json.Unmarshal(bytes, &proposal)
+
+	if err != nil {
+		return nil, errors.New("Corrupt transfer proposal for " + productId)
+	}
+
+	return &proposal, nil
+}
+
+//==============================================================================================================================
+// transfer_pending - Whether a proposed transfer is still waiting for its recipient at the transaction time now.
+//==============================================================================================================================
+func (t *SimpleChaincode) transfer_pending(proposal *TransferProposal, now int64) (bool) {
+	return proposal != nil && (proposal.ExpiresAt == 0 || now <= proposal.ExpiresAt)
+}
+
+//==============================================================================================================================
+// Accreditives - Letters of credit are stored under "Accreditive_<id>" and may cover several products. A bank issues
+//				  one for a single product with bank_issue_accreditive, or for several with open_accreditive. Like
+//				  the commercial terms, their amounts are kept in the private collection when one is configured.
+//==============================================================================================================================
+//	 retrieve_accreditive - Gets the accreditive stored under the id passed. Peers outside the private collection, and
+//							accreditives stored before it was configured, only have the public record.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_accreditive(stub shim.ChaincodeStubInterface, id string) (Accreditive, error) {
+
+	var credit Accreditive
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return credit, err
+	}
+
+	var bytes []byte
+
+	if config.PrivateCollection != "" {
+		bytes, err = stub.GetPrivateData(config.PrivateCollection, "Accreditive_" + id)
+	}
+
+	if err == nil && len(bytes) == 0 {
+		bytes, err = stub.GetState("Accreditive_" + id)
+	}
+
+	if err != nil {
+		return credit, errors.New("Unable to get accreditive " + id)
+	}
+
+	if len(bytes) == 0 {
+		return credit, t.fail(ERR_NOT_FOUND, "No accreditive " + id)
+	}
+
+	err = json.Unmarshal(bytes, &credit)
+
+	if err != nil {
+		return credit, errors.New("Corrupt accreditive record " + id)
+	}
+
+	return credit, nil
+}
+
+//==============================================================================================================================
+//	 save_accreditive - Writes an accreditive to its own key. With a private collection the public record goes without
+//						the amounts.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_accreditive(stub shim.ChaincodeStubInterface, credit Accreditive) (error) {
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(credit)
+
+	if err != nil {
+		return errors.New("Error converting accreditive record")
+	}
+
+	if config.PrivateCollection != "" {
+
+		err = stub.PutPrivateData(config.PrivateCollection, "Accreditive_" + credit.AccreditiveID, bytes)
+
+		if err != nil {
+			return errors.New("Error storing accreditive record")
+		}
+
+		bytes, err = json.Marshal(t.public_accreditive(credit))
+
+		if err != nil {
+			return errors.New("Error converting accreditive record")
+		}
+	}
+
+	err = stub.PutState("Accreditive_" + credit.AccreditiveID, bytes)
+
+	if err != nil {
+		return errors.New("Error storing accreditive record")
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 product_accreditive - The accreditive paying for a product, or nil if it was never issued one. The copy a product
+//						   holds from before accreditives became records of their own is given the id it is saved
+//						   under by link_accreditive once it changes.
+//==============================================================================================================================
+func (t *SimpleChaincode) product_accreditive(stub shim.ChaincodeStubInterface, product Product) (*Accreditive, error) {
+
+	if product.AccreditiveID == "" {
+
+		if product.Accreditive == nil {
+			return nil, nil
+		}
+
+		credit := *product.Accreditive
+		credit.AccreditiveID = "LC" + product.ProductID
+		credit.ProductIDs = []string{product.ProductID}
+
+		return &credit, nil
+	}
+
+	credit, err := t.retrieve_accreditive(stub, product.AccreditiveID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &credit, nil
+}
+
+//==============================================================================================================================
+//	 link_accreditive - Saves the accreditive paying for a product and links it from the product, replacing any copy
+//						the product held.
+//==============================================================================================================================
+func (t *SimpleChaincode) link_accreditive(stub shim.ChaincodeStubInterface, product *Product, credit Accreditive) (error) {
+
+	err := t.save_accreditive(stub, credit)
+
+	if err != nil {
+		return err
+	}
+
+	product.AccreditiveID = credit.AccreditiveID
+	product.IssuingBank = credit.IssuingBank
+	product.Accreditive = nil
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 retrieve_bill_of_lading - Gets the bill of lading stored under the id passed.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_bill_of_lading(stub shim.ChaincodeStubInterface, id string) (BillOfLading, error) {
+
+	var bill BillOfLading
+
+	bytes, err := stub.GetState("BillOfLading_" + id)
+
+	if err != nil {
+		return bill, errors.New("Unable to get bill of lading " + id)
+	}
+
+	if len(bytes) == 0 {
+		return bill, t.fail(ERR_NOT_FOUND, "No bill of lading " + id)
+	}
+
+	err = json.Unmarshal(bytes, &bill)
+
+	if err != nil {
+		return bill, errors.New("Corrupt bill of lading record " + id)
+	}
+
+	return bill, nil
+}
+
+//==============================================================================================================================
+//	 save_bill_of_lading - Writes a bill of lading to its own key.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_bill_of_lading(stub shim.ChaincodeStubInterface, bill BillOfLading) (error) {
+
+	bytes, err := json.Marshal(bill)
+
+	if err != nil {
+		return errors.New("Error converting bill of lading record")
+	}
+
+	err = stub.PutState("BillOfLading_" + bill.BillID, bytes)
+
+	if err != nil {
+		return errors.New("Error storing bill of lading record")
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 Sales contract statuses - A sales contract is PENDING until both parties signed it, then EXECUTED.
+//==============================================================================================================================
+const CONTRACT_PENDING = "PENDING"
+const CONTRACT_EXECUTED = "EXECUTED"
+
+//==============================================================================================================================
+//	 parse_contract_terms - Reads the sales contract arg of create_product: empty for none, a ContractTerms JSON object,
+//							or for older clients any other text, which is kept as the terms.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_contract_terms(value string) (*ContractTerms, error) {
+
+	if value == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(strings.TrimSpace(value), "{") {
+		return &ContractTerms{Terms: value}, nil
+	}
+
+	var terms ContractTerms
+
+	err := json.Unmarshal([]byte(value), &terms)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid sales contract JSON")
+	}
+
+	return &terms, nil
+}
+
+//==============================================================================================================================
+//	 create_sales_contract - Creates the sales contract of a new product between its manufacturer and buyer at the
+//							 product's price and links it from the product. The banks named must be registered as such.
+//==============================================================================================================================
+func (t *SimpleChaincode) create_sales_contract(stub shim.ChaincodeStubInterface, product *Product, terms ContractTerms, now int64) (error) {
+
+	banks := map[string]int{terms.SellerBank: SELLER_BANK, terms.BuyerBank: BUYER_BANK}
+
+	for bank, role := range banks {
+
+		if bank == "" {
+			continue
+		}
+
+		affiliation, err := t.get_affiliation(stub, bank)
+
+		if err != nil {
+			return err
+		}
+
+		if affiliation != role {
+			return t.fail(ERR_VALIDATION_FAILED, bank + " is not registered as " + ROLE_NAMES[role])
+		}
+	}
+
+	if terms.DocumentHash != "" && !HASH_PATTERN.MatchString(terms.DocumentHash) {
+		return t.fail(ERR_VALIDATION_FAILED, "The document hash must be a hex encoded SHA-256 hash")
+	}
+
+	if terms.DeliveryDeadline != 0 && terms.DeliveryDeadline <= now {
+		return t.fail(ERR_VALIDATION_FAILED, "The delivery deadline must be in the future")
+	}
+
+	contract := SalesContract{
+		ContractID:       "SC" + product.ProductID,
+		ProductID:        product.ProductID,
+		Seller:           product.Manufacturer,
+		Buyer:            product.Buyer,
+		SellerBank:       terms.SellerBank,
+		BuyerBank:        terms.BuyerBank,
+		Terms:            terms.Terms,
+		Price:            product.Price,
+		Currency:         product.Currency,
+		DeliveryDeadline: terms.DeliveryDeadline,
+		DocumentHash:     strings.ToLower(terms.DocumentHash),
+		Status:           CONTRACT_PENDING,
+		CreatedAt:        now,
+	}
+
+	err := t.save_sales_contract(stub, contract)
+
+	if err != nil {
+		return err
+	}
+
+	product.SalesContract = contract.ContractID
+	product.SellerBank = contract.SellerBank
+	product.BuyerBank = contract.BuyerBank
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 retrieve_sales_contract - Gets the sales contract stored under the id passed. Like the commercial terms, sales
+//							   contracts are kept in the private collection when one is configured. Contracts stored
+//							   before it was configured are read from the world state until they are next saved.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_sales_contract(stub shim.ChaincodeStubInterface, id string) (SalesContract, error) {
+
+	var contract SalesContract
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return contract, err
+	}
+
+	var bytes []byte
+
+	if config.PrivateCollection != "" {
+		bytes, err = stub.GetPrivateData(config.PrivateCollection, "SalesContract_" + id)
+	}
+
+	if err == nil && len(bytes) == 0 {
+		bytes, err = stub.GetState("SalesContract_" + id)
+	}
+
+	if err != nil {
+		return contract, errors.New("Unable to get sales contract " + id)
+	}
+
+	if len(bytes) == 0 {
+		return contract, t.fail(ERR_NOT_FOUND, "No sales contract " + id)
+	}
+
+	err = json.Unmarshal(bytes, &contract)
+
+	if err != nil {
+		return contract, errors.New("Corrupt sales contract record " + id)
+	}
+
+	return contract, nil
+}
+
+//==============================================================================================================================
+//	 save_sales_contract - Writes a sales contract to its own key, in the private collection if one is configured. A
+//						   copy left in the world state from before the collection was configured is deleted.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_sales_contract(stub shim.ChaincodeStubInterface, contract SalesContract) (error) {
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return err
+	}
+
+	bytes, err := json.Marshal(contract)
+
+	if err != nil {
+		return errors.New("Error converting sales contract record")
+	}
+
+	if config.PrivateCollection != "" {
+		err = stub.PutPrivateData(config.PrivateCollection, "SalesContract_" + contract.ContractID, bytes)
+	} else {
+		err = stub.PutState("SalesContract_" + contract.ContractID, bytes)
+	}
+
+	if err != nil {
+		return errors.New("Error storing sales contract record")
+	}
+
+	if config.PrivateCollection == "" {
+		return nil
+	}
+
+	public, err := stub.GetState("SalesContract_" + contract.ContractID)
+
+	if err != nil {
+		return errors.New("Unable to get sales contract " + contract.ContractID)
+	}
+
+	if len(public) != 0 {
+
+		err = stub.DelState("SalesContract_" + contract.ContractID)
+
+		if err != nil {
+			return errors.New("Error removing public sales contract record")
+		}
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 Invoice statuses - An invoice is ISSUED, then ACCEPTED by the debtor and finally PAID.
+//==============================================================================================================================
+const INVOICE_ISSUED = "ISSUED"
+const INVOICE_ACCEPTED = "ACCEPTED"
+const INVOICE_PAID = "PAID"
+
+//==============================================================================================================================
+//	 retrieve_invoice - Gets the invoice stored under the id passed.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_invoice(stub shim.ChaincodeStubInterface, id string) (Invoice, error) {
+
+	var invoice Invoice
+
+	bytes, err := stub.GetState("Invoice_" + id)
+
+	if err != nil {
+		return invoice, errors.New("Unable to get invoice " + id)
+	}
+
+	if len(bytes) == 0 {
+		return invoice, t.fail(ERR_NOT_FOUND, "No invoice " + id)
+	}
+
+	err = json.Unmarshal(bytes, &invoice)
+
+	if err != nil {
+		return invoice, errors.New("Corrupt invoice record " + id)
+	}
+
+	return invoice, nil
+}
+
+//==============================================================================================================================
+// INVOICE_INDEX - Every invoice not yet paid has an empty record under the composite key debtor~name~invoiceId, so the
+//				   unpaid invoices of a debtor are a partial key query. INVOICE_INDEX_KEY is set once Init has
+//				   indexed the invoices issued before the index existed.
+//==============================================================================================================================
+const INVOICE_INDEX = "debtor"
+const INVOICE_INDEX_KEY = "Invoice_Index"
+
+//==============================================================================================================================
+//	 save_invoice - Writes an invoice to its own key and lists it under its debtor until it is paid.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_invoice(stub shim.ChaincodeStubInterface, invoice Invoice) (error) {
+
+	bytes, err := json.Marshal(invoice)
+
+	if err != nil {
+		return errors.New("Error converting invoice record")
+	}
+
+	err = stub.PutState("Invoice_" + invoice.InvoiceID, bytes)
+
+	if err != nil {
+		return errors.New("Error storing invoice record")
+	}
+
+	key, err := stub.CreateCompositeKey(INVOICE_INDEX, []string{invoice.Debtor, invoice.InvoiceID})
+
+	if err != nil {
+		return errors.New("Unable to create invoice index key for invoice " + invoice.InvoiceID)
+	}
+
+	if invoice.Status == INVOICE_PAID {
+		err = stub.DelState(key)
+	} else {
+		err = stub.PutState(key, []byte{0})
+	}
+
+	if err != nil {
+		return errors.New("Unable to index invoice " + invoice.InvoiceID)
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 migrate_invoice_index - Called by Init. Lists the invoices issued before INVOICE_INDEX existed under their debtor,
+//							 then sets INVOICE_INDEX_KEY so running Init again doesn't read them.
+//==============================================================================================================================
+func (t *SimpleChaincode) migrate_invoice_index(stub shim.ChaincodeStubInterface) (error) {
+
+	marker, err := stub.GetState(INVOICE_INDEX_KEY)
+
+	if err != nil {
+		return errors.New("Unable to get " + INVOICE_INDEX_KEY)
+	}
+
+	if len(marker) != 0 {
+		return nil
+	}
+
+	iter, err := stub.GetStateByRange("Invoice_", "Invoice`")
+
+	if err != nil {
+		return errors.New("Unable to query invoices")
+	}
+
+	defer iter.Close()
+
+	for iter.HasNext() {
+
+		kv, err := iter.Next()
+
+		if err != nil {
+			return errors.New("Unable to read invoices")
+		}
+
+		var invoice Invoice
+
+		err = json.Unmarshal(kv.Value, &invoice)
+
+		if err != nil {
+			return errors.New("Corrupt invoice record " + kv.Key)
+		}
+
+		if invoice.Status == INVOICE_PAID {
+			continue
+		}
+
+		key, err := stub.CreateCompositeKey(INVOICE_INDEX, []string{invoice.Debtor, invoice.InvoiceID})
+
+		if err != nil {
+			return errors.New("Unable to create invoice index key for invoice " + invoice.InvoiceID)
+		}
+
+		err = stub.PutState(key, []byte{0})
+
+		if err != nil {
+			return errors.New("Unable to index invoice " + invoice.InvoiceID)
+		}
+	}
+
+	err = stub.PutState(INVOICE_INDEX_KEY, []byte("debtor"))
+
+	if err != nil {
+		return errors.New("Unable to store " + INVOICE_INDEX_KEY)
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 invoice_bank - Whether the bank passed is named by the product invoiced or its sales contract, as the seller's or
+//					buyer's bank or the bank that issued its accreditive. Records the peer can't read name no bank.
+//==============================================================================================================================
+func (t *SimpleChaincode) invoice_bank(stub shim.ChaincodeStubInterface, invoice Invoice, bank string) (bool) {
+
+	product, err := t.retrieve_product(stub, invoice.ProductID)
+
+	if err == nil && (product.SellerBank == bank || t.buyer_bank(product) == bank || t.issuing_bank(product) == bank) {
+		return true
+	}
+
+	if err == nil && len(product.Contracts) > 0 && product.Contracts[len(product.Contracts) - 1].Seller_Bank == bank {
+		return true
+	}
+
+	if invoice.ContractID == "" {
+		return false
+	}
+
+	contract, err := t.retrieve_sales_contract(stub, invoice.ContractID)
+
+	return err == nil && (contract.SellerBank == bank || contract.BuyerBank == bank)
+}
+
+//==============================================================================================================================
+//	 retrieve_recall - Gets the recall stored under the id passed.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_recall(stub shim.ChaincodeStubInterface, id string) (Recall, error) {
+
+	var recall Recall
+
+	bytes, err := stub.GetState("Recall_" + id)
+
+	if err != nil {
+		return recall, errors.New("Unable to get recall " + id)
+	}
+
+	if len(bytes) == 0 {
+		return recall, t.fail(ERR_NOT_FOUND, "No recall " + id)
+	}
+
+	err = json.Unmarshal(bytes, &recall)
+
+	if err != nil {
+		return recall, errors.New("Corrupt recall record " + id)
+	}
+
+	return recall, nil
+}
+
+//==============================================================================================================================
+// accreditive_active - An accreditive stays active until it is withdrawn, rejected or reaches its expiry, if it has one.
+//==============================================================================================================================
+func (t *SimpleChaincode) accreditive_active(credit *Accreditive, now int64) (bool) {
+
+	return credit != nil                                        &&
+		!credit.Withdrawn                                        &&
+		!credit.Rejected                                        &&
+		(credit.Expiry == 0 || now < credit.Expiry)
+}
+
+//==============================================================================================================================
+// isActive - Scrapped products no longer carry any value or obligation and are left out of aggregates.
+//==============================================================================================================================
+func (t *SimpleChaincode) isActive(product Product) (bool) {
+	return product.State != STATE_SCRAPPED
+}
+
+//==============================================================================================================================
+// check_shares - Every share must be positive and together they must add up to 1.0.
+//==============================================================================================================================
+func (t *SimpleChaincode) check_shares(shares map[string]float64) (error) {
+
+	total := 0.0
+
+	for holder, share := range shares {
+		if share <= 0 {
+			return t.fail(ERR_VALIDATION_FAILED, "Share of " + holder + " must be greater than 0")
+		}
+		total += share
+	}
+
+	if math.Abs(total - 1.0) > SHARE_TOLERANCE {
+		return t.fail(ERR_VALIDATION_FAILED, "Shares must sum to 1.0, got " + strconv.FormatFloat(total, 'f', -1, 64))
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// MONEY_PATTERN - A decimal amount in the major unit of a currency, as parse_money accepts it.
+//==============================================================================================================================
+var MONEY_PATTERN = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+//==============================================================================================================================
+// minor_exponent - The number of decimal places of the minor unit of a currency.
+//==============================================================================================================================
+func (t *SimpleChaincode) minor_exponent(currency string) (int) {
+
+	if exponent, ok := CURRENCY_EXPONENTS[currency]; ok {
+		return exponent
+	}
+
+	return 2
+}
+
+//==============================================================================================================================
+// parse_money - Converts a decimal amount in the major unit of a currency, such as "12.50", to minor units. Amounts
+//				 with more decimal places than the currency has are refused rather than rounded.
+//==============================================================================================================================
+func (t *SimpleChaincode) parse_money(value string, currency string) (Money, error) {
+
+	if !MONEY_PATTERN.MatchString(value) {
+		return 0, t.fail(ERR_VALIDATION_FAILED, "Invalid amount " + value)
+	}
+
+	exponent := t.minor_exponent(currency)
+
+	whole, fraction := value, ""
+
+	if dot := strings.Index(value, "."); dot >= 0 {
+		whole, fraction = value[:dot], value[dot + 1:]
+	}
+
+	if len(fraction) > exponent {
+		return 0, t.fail(ERR_VALIDATION_FAILED, "Amount " + value + " has more than " + strconv.Itoa(exponent) + " decimal places for " + currency)
+	}
+
+	amount, err := strconv.ParseInt(whole + fraction + strings.Repeat("0", exponent - len(fraction)), 10, 64)
+
+	if err != nil {
+		return 0, t.fail(ERR_VALIDATION_FAILED, "Amount " + value + " out of range")
+	}
+
+	return Money(amount), nil
+}
+
+//==============================================================================================================================
+// format_money - The amount as a decimal in the major unit of the currency, the inverse of parse_money.
+//==============================================================================================================================
+func (t *SimpleChaincode) format_money(amount Money, currency string) (string) {
+
+	exponent := t.minor_exponent(currency)
+
+	if exponent == 0 {
+		return strconv.FormatInt(int64(amount), 10)
+	}
+
+	sign := ""
+
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+
+	unit := Money(math.Pow10(exponent))
+
+	return fmt.Sprintf("%s%d.%0*d", sign, amount / unit, exponent, amount % unit)
+}
+
+//==============================================================================================================================
+// to_major / from_major - Convert between minor units and a float in the major unit, for exchange rates and rates per
+//						   kg. from_major rounds to the nearest minor unit.
+//==============================================================================================================================
+func (t *SimpleChaincode) to_major(amount Money, currency string) (float64) {
+	return float64(amount) / math.Pow10(t.minor_exponent(currency))
+}
+
+func (t *SimpleChaincode) from_major(amount float64, currency string) (Money) {
+	return Money(math.Round(amount * math.Pow10(t.minor_exponent(currency))))
+}
+
+//==============================================================================================================================
+// convert_money - Converts an amount to another currency with the exchange rates of the FX provider.
+//==============================================================================================================================
+func (t *SimpleChaincode) convert_money(fx FXProvider, amount Money, from string, to string) (Money, error) {
+
+	converted, err := fx.Convert(t.to_major(amount, from), from, to)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return t.from_major(converted, to), nil
+}
+
+//==============================================================================================================================
+// Money migration - Older versions of this chaincode stored amounts as floats in the major unit. migrate_money converts
+//					 the products and accreditives on the ledger when Init runs and then sets MONEY_UNITS_KEY, so
+//					 running Init again leaves them as they are. Commercial terms in a private collection can only be
+//					 read by peers holding them, so they are converted by load_terms when read instead.
+//==============================================================================================================================
+const MONEY_UNITS_KEY = "Money_Units"
+
+//==============================================================================================================================
+//	 migrate_money - Called by Init. Returns every product in the product index, converted, as the records written by
+//					 the migration are not visible to the rest of Init. Returns nil if the ledger was already migrated.
+//==============================================================================================================================
+func (t *SimpleChaincode) migrate_money(stub shim.ChaincodeStubInterface) ([]Product, error) {
+
+	marker, err := stub.GetState(MONEY_UNITS_KEY)
+
+	if err != nil {
+		return nil, errors.New("Unable to get " + MONEY_UNITS_KEY)
+	}
+
+	if string(marker) == "minor" {
+		return nil, nil
+	}
+
+	index, err := t.loadProductIndex(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	products := []Product{}
+
+	for _, id := range index.ProductIDs {
+
+		productId := strconv.Itoa(id)
+
+		bytes, err := stub.GetState(productId)
+
+		if err != nil {
+			return nil, errors.New("Unable to get product " + productId)
+		}
+
+		if len(bytes) == 0 {
+			continue
+		}
+
+		var product Product
+
+		err = t.decode_legacy(bytes, &product, t.legacy_product)
+
+		if err != nil {
+			return nil, errors.New("Corrupt product record " + productId)
+		}
+
+		bytes, err = json.Marshal(product)
+
+		if err != nil {
+			return nil, errors.New("Error converting product record " + productId)
+		}
+
+		err = stub.PutState(productId, bytes)
+
+		if err != nil {
+			return nil, errors.New("Error storing product " + productId)
+		}
+
+		products = append(products, product)
+	}
+
+	iter, err := stub.GetStateByRange("Accreditive_", "Accreditive`")
+
+	if err != nil {
+		return nil, errors.New("Unable to query accreditives")
+	}
+
+	defer iter.Close()
+
+	for iter.HasNext() {
+
+		kv, err := iter.Next()
+
+		if err != nil {
+			return nil, errors.New("Unable to read accreditives")
+		}
+
+		var credit Accreditive
+
+		err = t.decode_legacy(kv.Value, &credit, t.legacy_accreditive)
+
+		if err != nil {
+			return nil, errors.New("Corrupt accreditive record " + kv.Key)
+		}
+
+		err = t.save_accreditive(stub, credit)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = stub.PutState(MONEY_UNITS_KEY, []byte("minor"))
+
+	if err != nil {
+		return nil, errors.New("Unable to store " + MONEY_UNITS_KEY)
+	}
+
+	return products, nil
+}
+
+//==============================================================================================================================
+//	 decode_legacy - Decodes a record with float amounts into v. convert is passed the record as a generic map first to
+//					 put its amounts in minor units.
+//==============================================================================================================================
+func (t *SimpleChaincode) decode_legacy(data []byte, v interface{}, convert func(map[string]interface{}) error) (error) {
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var record map[string]interface{}
+
+	err := decoder.Decode(&record)
+
+	if err != nil {
+		return err
+	}
+
+	err = convert(record)
+
+	if err != nil {
+		return err
+	}
+
+	converted, err := json.Marshal(record)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(converted, v)
+}
+
+//==============================================================================================================================
+//	 legacy_to_minor - Converts the fields of a record passed from floats in the major unit of the record's Currency to
+//					   minor units.
+//==============================================================================================================================
+func (t *SimpleChaincode) legacy_to_minor(record map[string]interface{}, fields ...string) (error) {
+
+	currency, _ := record["Currency"].(string)
+
+	for _, field := range fields {
+
+		number, ok := record[field].(json.Number)
+
+		if !ok {
+			continue
+		}
+
+		value, err := number.Float64()
+
+		if err != nil {
+			return t.fail(ERR_VALIDATION_FAILED, "Invalid amount in " + field)
+		}
+
+		record[field] = t.from_major(value, currency)
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 legacy_list - Applies legacy_to_minor to every record in a list held in field.
+//==============================================================================================================================
+func (t *SimpleChaincode) legacy_list(record map[string]interface{}, field string, fields ...string) (error) {
+
+	list, _ := record[field].([]interface{})
+
+	for _, entry := range list {
+
+		if entry, ok := entry.(map[string]interface{}); ok {
+
+			err := t.legacy_to_minor(entry, fields...)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 legacy_product / legacy_accreditive / legacy_terms - The amounts of each kind of record. The shipping cost of a
+//						product is in the product's currency.
+//==============================================================================================================================
+func (t *SimpleChaincode) legacy_product(record map[string]interface{}) (error) {
+
+	err := t.legacy_to_minor(record, "Price", "ShippingCost")
+
+	if err != nil {
+		return err
+	}
+
+	if credit, ok := record["Accreditive"].(map[string]interface{}); ok {
+
+		err = t.legacy_accreditive(credit)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = t.legacy_list(record, "PastAccreditives", "Amount", "Drawn")
+
+	if err != nil {
+		return err
+	}
+
+	err = t.legacy_list(record, "Payments", "Amount")
+
+	if err != nil {
+		return err
+	}
+
+	return t.legacy_list(record, "Contracts", "Price")
+}
+
+func (t *SimpleChaincode) legacy_accreditive(record map[string]interface{}) (error) {
+	return t.legacy_to_minor(record, "Amount", "Drawn")
+}
+
+func (t *SimpleChaincode) legacy_terms(record map[string]interface{}) (error) {
+
+	err := t.legacy_to_minor(record, "Price")
+
+	if err != nil {
+		return err
+	}
+
+	return t.legacy_list(record, "Contracts", "Price")
+}
+
+//==============================================================================================================================
+// outstanding - What is left to pay for a product after the payments recorded so far.
+//==============================================================================================================================
+func (t *SimpleChaincode) outstanding(product Product) (Money) {
+
+	left := product.Price
+
+	for _, payment := range product.Payments {
+		left -= payment.Amount
+	}
+
+	if left < 0 {
+		return 0
+	}
+
+	return left
+}
+
+//==============================================================================================================================
+// is_valid_currency - Checks that the code passed is a known ISO 4217 currency code.
+//==============================================================================================================================
+func (t *SimpleChaincode) is_valid_currency(currency string) (bool) {
+	return CURRENCIES[currency]
+}
+
+//==============================================================================================================================
+// visible_products - Returns the products passed that the caller is allowed to view.
+//==============================================================================================================================
+func (t *SimpleChaincode) visible_products(stub shim.ChaincodeStubInterface, products []Product, caller string, caller_affiliation int) ([]Product) {
+
+	var visible []Product
+
+	for _, p := range products {
+
+		_, err := t.get_vehicle_details(stub, p, caller, caller_affiliation)
+
+		if err == nil {
+			visible = append(visible, p)
+		}
+	}
+
+	return visible
+}
+
+//==============================================================================================================================
+// retrieve_visible_page - Walks the product index from the product named by the bookmark, or from the first product
+//						   when it is empty, and returns the products the caller is allowed to view. At most
+//						   MAX_PAGE_READS products are read. Also returns the id of the first product left unread as the
+//						   bookmark of the next page, or "" once the index has been read to the end.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_visible_page(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, bookmark string) ([]Product, string, error) {
+
+	index, err := t.loadProductIndex(stub)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	start := 0
+
+	if bookmark != "" {
+
+		start = -1
+
+		for i, id := range index.ProductIDs {
+			if strconv.Itoa(id) == bookmark {
+				start = i
+				break
+			}
+		}
+
+		if start < 0 {
+			return nil, "", t.fail(ERR_NOT_FOUND, "Unknown bookmark " + bookmark)
+		}
+	}
+
+	end := len(index.ProductIDs)
+	next := ""
+
+	if end - start > MAX_PAGE_READS {
+		end = start + MAX_PAGE_READS
+		next = strconv.Itoa(index.ProductIDs[end])
+	}
+
+	var products []Product
+
+	for _, id := range index.ProductIDs[start:end] {
+
+		p, err := t.retrieve_product(stub, strconv.Itoa(id))
+
+		if err != nil {
+			return nil, "", errors.New("Failed to retrieve product " + strconv.Itoa(id))
+		}
+
+		products = append(products, p)
+	}
+
+	return t.visible_products(stub, products, caller, caller_affiliation), next, nil
+}
+
+//==============================================================================================================================
+// product_page - Marshals the products a query found on a page of the product index. Without a bookmark, and when
+//				  nothing was left unread, the products are returned as a plain array as they were before the queries
+//				  were paged.
+//==============================================================================================================================
+func (t *SimpleChaincode) product_page(products []Product, bookmark string, next string) ([]byte, error) {
+
+	if bookmark == "" && next == "" {
+		return json.Marshal(products)
+	}
+
+	return json.Marshal(ProductPage{Products: products, NextBookmark: next})
+}
+
+//==============================================================================================================================
+// retrieve_all_products - Walks the product index and returns every product. Callers are responsible for checking what
+//						   the caller may see.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_all_products(stub shim.ChaincodeStubInterface) ([]Product, error) {
+
+	productIds, err := t.loadProductIndex(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var products []Product
+
+	for _, pid := range productIds.ProductIDs {
+
+		p, err := t.retrieve_product(stub, strconv.Itoa(pid))
+
+		if err != nil {
+			return nil, errors.New("Failed to retrieve product " + strconv.Itoa(pid))
+		}
+
+		products = append(products, p)
+	}
+
+	return products, nil
+}
+
+//==============================================================================================================================
+// validate_new_product - Checks the fields of a freshly unmarshalled product so that a partially zeroed struct is never
+//						  written to the ledger. Returns an error naming the first offending field.
+//==============================================================================================================================
+func (t *SimpleChaincode) validate_new_product(product Product) (error) {
+
+	if strings.TrimSpace(product.Destination) == "" {
+		return t.fail(ERR_VALIDATION_FAILED, "Invalid product: destination is required")
+	}
+
+	if product.Price <= 0 {
+		return t.fail(ERR_VALIDATION_FAILED, "Invalid product: price must be greater than 0")
+	}
+
+	if !t.is_valid_currency(product.Currency) {
+		return t.fail(ERR_VALIDATION_FAILED, "Invalid product: currency '" + product.Currency + "' is not a valid ISO 4217 code")
+	}
+
+	if strings.TrimSpace(product.Manufacturer) == "" {
+		return t.fail(ERR_VALIDATION_FAILED, "Invalid product: manufacturer is required")
+	}
+
+	if _, ok := LENGTH_UNITS[product.Units.Length]; !ok {
+		return t.fail(ERR_VALIDATION_FAILED, "Invalid product: unknown length unit '" + product.Units.Length + "'")
+	}
+
+	if _, ok := MASS_UNITS[product.Units.Mass]; !ok {
+		return t.fail(ERR_VALIDATION_FAILED, "Invalid product: unknown mass unit '" + product.Units.Mass + "'")
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// PRODUCT_INDEX - Every product has an empty record under the composite key pid~productId, so checking an id is a single
+//				   read and listing the products is a partial key query. Product ids are nine digits, so the keys come
+//				   back in numeric order.
+//==============================================================================================================================
+const PRODUCT_INDEX = "pid"
+
+//==============================================================================================================================
+// loadProductIndex - Reads the ids of all products from the pid index. Until Init has migrated them, ids still held in
+//					  the old "product_ids" record or a legacy index key are included as well, since the writes of the
+//					  migrating transaction are not visible to its own reads.
+//==============================================================================================================================
+func (t *SimpleChaincode) loadProductIndex(stub shim.ChaincodeStubInterface) (ProductID_Holder, error) {
+
+	var productIds ProductID_Holder
+
+	iter, err := stub.GetStateByPartialCompositeKey(PRODUCT_INDEX, []string{})
+
+	if err != nil {
+		return productIds, errors.New("Unable to query the product index")
+	}
+
+	defer iter.Close()
+
+	known := make(map[int]bool)
+
+	for iter.HasNext() {
+
+		kv, err := iter.Next()
+
+		if err != nil {
+			return productIds, errors.New("Unable to read the product index")
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+
+		if err != nil || len(attributes) != 1 {
+			return productIds, errors.New("Corrupt product index key")
+		}
+
+		id, err := strconv.Atoi(attributes[0])
+
+		if err != nil {
+			return productIds, errors.New("Corrupt product index key")
+		}
+
+		known[id] = true
+		productIds.ProductIDs = append(productIds.ProductIDs, id)
+	}
+
+	legacy, err := t.load_legacy_index(stub)
+
+	if err != nil {
+		return productIds, err
+	}
+
+	merged := false
+
+	for _, id := range legacy {
+		if !known[id] {
+			known[id] = true
+			merged = true
+			productIds.ProductIDs = append(productIds.ProductIDs, id)
+		}
+	}
+
+	if merged {
+		sort.Ints(productIds.ProductIDs)
+	}
+
+	return productIds, nil
+}
+
+//==============================================================================================================================
+// LEGACY_INDEX_KEYS - Keys earlier versions of this chaincode kept the product index under as a single record.
+//==============================================================================================================================
+var LEGACY_INDEX_KEYS = []string{"product_ids", "v5cIDs", "productId", "pids"}
+
+//==============================================================================================================================
+// load_legacy_index - Returns the ids held under any of the legacy index keys.
+//==============================================================================================================================
+func (t *SimpleChaincode) load_legacy_index(stub shim.ChaincodeStubInterface) ([]int, error) {
+
+	var ids []int
+
+	for _, key := range LEGACY_INDEX_KEYS {
+
+		bytes, err := stub.GetState(key)
+
+		if err != nil {
+			return nil, errors.New("Unable to get " + key)
+		}
+
+		if len(bytes) == 0 {
+			continue
+		}
+
+		var legacy ProductID_Holder
+
+		err = json.Unmarshal(bytes, &legacy)
+
+		if err != nil {
+			return nil, errors.New("Corrupt legacy index " + key)
+		}
+
+		ids = append(ids, legacy.ProductIDs...)
+	}
+
+	return ids, nil
+}
+
+//==============================================================================================================================
+// migrate_product_index - Called by Init. Adds the ids found under any legacy index key to the pid index and deletes
+//						   the legacy keys. Once migrated there is nothing left to move, so running Init again leaves
+//						   the index as it is.
+//==============================================================================================================================
+func (t *SimpleChaincode) migrate_product_index(stub shim.ChaincodeStubInterface) (error) {
+
+	ids, err := t.load_legacy_index(stub)
+
+	if err != nil {
+		return err
+	}
+
+	err = t.add_to_index(stub, ids...)
+
+	if err != nil {
+		return err
+	}
+
+	for _, key := range LEGACY_INDEX_KEYS {
+
+		err = stub.DelState(key)
+
+		if err != nil {
+			return errors.New("Unable to delete legacy index " + key)
+		}
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// CHECKSUM_INDEX - The object type of the keys set_checksum claims a checksum of a manufacturer under. Older versions of
+//					this chaincode used "Checksum_<manufacturer>_<checksum>", which two different pairs could share, and
+//					migrate_checksum_index moves those keys over.
+//==============================================================================================================================
+const CHECKSUM_INDEX = "checksum"
+
+//==============================================================================================================================
+// checksum_key - The key claiming a checksum of a manufacturer, holding the id of the product using it.
+//==============================================================================================================================
+func (t *SimpleChaincode) checksum_key(stub shim.ChaincodeStubInterface, manufacturer string, checksum string) (string, error) {
+
+	key, err := stub.CreateCompositeKey(CHECKSUM_INDEX, []string{manufacturer, checksum})
+
+	if err != nil {
+		return "", errors.New("Unable to create checksum index key for checksum " + checksum)
+	}
+
+	return key, nil
+}
+
+//==============================================================================================================================
+// migrate_checksum_index - Called by Init. Replaces the keys older versions wrote for checksums in use by composite keys.
+//							The manufacturer and checksum are taken from the product a key holds the id of, as the
+//							old key can't be split reliably. Keys no longer matching their product are deleted.
+//==============================================================================================================================
+func (t *SimpleChaincode) migrate_checksum_index(stub shim.ChaincodeStubInterface) (error) {
+
+	iter, err := stub.GetStateByRange("Checksum_", "Checksum`")
+
+	if err != nil {
+		return errors.New("Unable to query the checksum index")
+	}
+
+	defer iter.Close()
+
+	for iter.HasNext() {
+
+		kv, err := iter.Next()
+
+		if err != nil {
+			return errors.New("Unable to read the checksum index")
+		}
+
+		product, err := t.retrieve_product(stub, string(kv.Value))
+
+		if err == nil && kv.Key == "Checksum_" + product.Manufacturer + "_" + product.CheckID {                // Keys of products since changed are dropped
+
+			key, err := t.checksum_key(stub, product.Manufacturer, product.CheckID)
+
+			if err != nil {
+				return err
+			}
+
+			err = stub.PutState(key, kv.Value)
+
+			if err != nil {
+				return errors.New("Unable to store checksum index key for product " + product.ProductID)
+			}
+		}
+
+		err = stub.DelState(kv.Key)
+
+		if err != nil {
+			return errors.New("Unable to delete legacy checksum key " + kv.Key)
+		}
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// product_index_key - The key of the entry for productId in the pid index.
+//==============================================================================================================================
+func (t *SimpleChaincode) product_index_key(stub shim.ChaincodeStubInterface, productId int) (string, error) {
+
+	key, err := stub.CreateCompositeKey(PRODUCT_INDEX, []string{strconv.Itoa(productId)})
+
+	if err != nil {
+		return "", errors.New("Unable to create product index key for product " + strconv.Itoa(productId))
+	}
+
+	return key, nil
+}
+
+//==============================================================================================================================
+// add_to_index - Adds newly created products to the pid index. Each product has its own key, so products created in
+//				  different transactions never conflict over the index.
+//==============================================================================================================================
+func (t *SimpleChaincode) add_to_index(stub shim.ChaincodeStubInterface, productIds ...int) (error) {
+
+	for _, id := range productIds {
+
+		key, err := t.product_index_key(stub, id)
+
+		if err != nil {
+			return err
+		}
+
+		err = stub.PutState(key, []byte{0})
+
+		if err != nil {
+			return errors.New("Unable to add product " + strconv.Itoa(id) + " to the product index")
+		}
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// Composite indexes - Secondary indexes are kept as empty records under the composite key index~attribute~productId
+//					   and read back with a partial key query over the attribute. INDEXES maps each index to the
+//					   field of the product it is built from. A product whose attribute is empty isn't in the index,
+//					   so e.g. the hold index only lists the products on hold.
+//==============================================================================================================================
+var INDEXES = map[string]func(Product) string{
+	"owner":        func(p Product) string { return p.Owner },
+	"state":        func(p Product) string { return strconv.Itoa(p.State) },
+	"custodian":    func(p Product) string { return p.Custodian },
+	"buyer":        func(p Product) string { return p.Buyer },
+	"manufacturer": func(p Product) string { return p.Manufacturer },
+	"currency":     func(p Product) string { return p.Currency },
+	"batch":        func(p Product) string { return p.Batch },
+	"recall":       func(p Product) string { return p.RecallID },
+	"hold": func(p Product) string {
+		if p.Hold == nil {
+			return ""
+		}
+		return p.Hold.PlacedBy
+	},
+	"issuing_bank": func(p Product) string {
+		if p.IssuingBank != "" || p.Accreditive == nil {
+			return p.IssuingBank
+		}
+		return p.Accreditive.IssuingBank
+	},
+	"buyer_bank": func(p Product) string {
+		if p.BuyerBank != "" || len(p.Contracts) == 0 {
+			return p.BuyerBank
+		}
+		return p.Contracts[len(p.Contracts) - 1].Buyer_Bank
+	},
+}
+
+//==============================================================================================================================
+//	 index_key - The key of the entry for productId in the given index.
+//==============================================================================================================================
+func (t *SimpleChaincode) index_key(stub shim.ChaincodeStubInterface, index string, attribute string, productId string) (string, error) {
+
+	key, err := stub.CreateCompositeKey(index, []string{attribute, productId})
+
+	if err != nil {
+		return "", errors.New("Unable to create " + index + " index key for product " + productId)
+	}
+
+	return key, nil
+}
+
+//==============================================================================================================================
+//	 update_indexes - Called by save_changes before the product is written. Compares the product with the stored record
+//					  and moves its entry in each index whose attribute changed. New products are added to every index.
+//==============================================================================================================================
+func (t *SimpleChaincode) update_indexes(stub shim.ChaincodeStubInterface, product Product) (error) {
+
+	bytes, err := stub.GetState(product.ProductID)
+
+	if err != nil {
+		return errors.New("Unable to get product " + product.ProductID)
+	}
+
+	var stored Product
+
+	if len(bytes) != 0 {
+
+		err = json.Unmarshal(bytes, &stored)
+
+		if err != nil {
+			return errors.New("Corrupt product record " + product.ProductID)
+		}
+	}
+
+	for index, attribute := range INDEXES {
+
+		old_value := attribute(stored)
+		new_value := attribute(product)
+
+		if stored.ProductID != "" && old_value == new_value {
+			continue
+		}
+
+		if stored.ProductID != "" && old_value != "" {
+
+			key, err := t.index_key(stub, index, old_value, product.ProductID)
+
+			if err != nil {
+				return err
+			}
+
+			err = stub.DelState(key)
+
+			if err != nil {
+				return errors.New("Unable to remove product " + product.ProductID + " from the " + index + " index")
+			}
+		}
+
+		if new_value == "" {
+			continue
+		}
+
+		key, err := t.index_key(stub, index, new_value, product.ProductID)
+
+		if err != nil {
+			return err
+		}
+
+		err = stub.PutState(key, []byte{0})
+
+		if err != nil {
+			return errors.New("Unable to add product " + product.ProductID + " to the " + index + " index")
+		}
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 index_lookup - Returns the ids of the products with the given attribute in an index, or of every product in the
+//					index when the attribute is empty.
+//==============================================================================================================================
+func (t *SimpleChaincode) index_lookup(stub shim.ChaincodeStubInterface, index string, attribute string) ([]string, error) {
+
+	attributes := []string{attribute}
+
+	if attribute == "" {
+		attributes = []string{}
+	}
+
+	iter, err := stub.GetStateByPartialCompositeKey(index, attributes)
+
+	if err != nil {
+		return nil, errors.New("Unable to query the " + index + " index")
+	}
+
+	defer iter.Close()
+
+	var ids []string
+
+	for iter.HasNext() {
+
+		kv, err := iter.Next()
+
+		if err != nil {
+			return nil, errors.New("Unable to read the " + index + " index")
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+
+		if err != nil || len(attributes) != 2 {
+			return nil, errors.New("Corrupt " + index + " index key")
+		}
+
+		ids = append(ids, attributes[1])
+	}
+
+	return ids, nil
+}
+
+//==============================================================================================================================
+//	 retrieve_indexed_products - Returns the products found by any of the lookups passed, each an index and an
+//								 attribute as taken by index_lookup. The products are in id order and each is returned
+//								 once. Index entries only narrow the search, callers still check the products.
+//==============================================================================================================================
+func (t *SimpleChaincode) retrieve_indexed_products(stub shim.ChaincodeStubInterface, lookups ...[2]string) ([]Product, error) {
+
+	var ids []string
+
+	for _, lookup := range lookups {
+
+		found, err := t.index_lookup(stub, lookup[0], lookup[1])
+
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, found...)
+	}
+
+	// Product ids are nine digits, so they sort in numeric order
+	sort.Strings(ids)
+
+	var products []Product
+
+	for i, id := range ids {
+
+		if i > 0 && id == ids[i - 1] {
+			continue
+		}
+
+		p, err := t.retrieve_product(stub, id)
+
+		if err != nil {
+			return nil, errors.New("Failed to retrieve product " + id)
+		}
+
+		products = append(products, p)
+	}
+
+	return products, nil
+}
+
+//==============================================================================================================================
+//	 move_terms - Called by the Init setting the private collection. Moves the terms of the products passed, their sales
+//				  contracts and the amounts of the letters of credit out of the world state into the collection, as
+//				  save_changes, save_sales_contract and save_accreditive would store them now.
+//==============================================================================================================================
+func (t *SimpleChaincode) move_terms(stub shim.ChaincodeStubInterface, products []Product, collection string) (error) {
+
+	for _, p := range products {
+
+		if p.TermsHash != "" {
+			continue
+		}
+
+		public, err := t.store_terms(stub, collection, p)
+
+		if err != nil {
+			return err
+		}
+
+		bytes, err := json.Marshal(public)
+
+		if err != nil {
+			return errors.New("Error converting product record " + p.ProductID)
+		}
+
+		err = stub.PutState(p.ProductID, bytes)
+
+		if err != nil {
+			return errors.New("Error storing product " + p.ProductID)
+		}
+	}
+
+	contracts, err := stub.GetStateByRange("SalesContract_", "SalesContract`")
+
+	if err != nil {
+		return errors.New("Unable to query sales contracts")
+	}
+
+	defer contracts.Close()
+
+	moved := make(map[string][]byte)                                                                   // Collected first, the keys are deleted below
+
+	for contracts.HasNext() {
+
+		kv, err := contracts.Next()
+
+		if err != nil {
+			return errors.New("Unable to read sales contracts")
+		}
+
+		moved[kv.Key] = kv.Value
+	}
+
+	for key, value := range moved {
+
+		err = stub.PutPrivateData(collection, key, value)
+
+		if err != nil {
+			return errors.New("Error storing sales contract record " + key)
+		}
+
+		err = stub.DelState(key)
+
+		if err != nil {
+			return errors.New("Error removing public sales contract record " + key)
+		}
+	}
+
+	credits, err := stub.GetStateByRange("Accreditive_", "Accreditive`")
+
+	if err != nil {
+		return errors.New("Unable to query accreditives")
+	}
+
+	defer credits.Close()
+
+	for credits.HasNext() {
+
+		kv, err := credits.Next()
+
+		if err != nil {
+			return errors.New("Unable to read accreditives")
+		}
+
+		var credit Accreditive
+
+		err = t.decode_legacy(kv.Value, &credit, t.legacy_accreditive)
+
+		if err != nil {
+			return errors.New("Corrupt accreditive record " + kv.Key)
+		}
+
+		bytes, err := json.Marshal(credit)
+
+		if err != nil {
+			return errors.New("Error converting accreditive record")
+		}
+
+		err = stub.PutPrivateData(collection, kv.Key, bytes)
+
+		if err != nil {
+			return errors.New("Error storing accreditive record")
+		}
+
+		bytes, err = json.Marshal(t.public_accreditive(credit))
+
+		if err != nil {
+			return errors.New("Error converting accreditive record")
+		}
+
+		err = stub.PutState(kv.Key, bytes)
+
+		if err != nil {
+			return errors.New("Error storing accreditive record")
+		}
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+//	 index_existing_products - Called by Init. Adds the products passed, or every product if nil, to the composite
+//							   indexes, so products created before an index existed can be found through it. With a
+//							   private collection only the public view of a product is indexed, like save_changes
+//							   does, and the entries written for its terms before the collection was set are removed.
+//							   Once done INDEXES_KEY records the indexes built, and later Inits skip the products until
+//							   an index is added or the collection is set.
+//==============================================================================================================================
+const INDEXES_KEY = "Indexes_Built"
+
+func (t *SimpleChaincode) index_existing_products(stub shim.ChaincodeStubInterface, products []Product, collection string) (error) {
+
+	var names []string
+
+	for index := range INDEXES {
+		names = append(names, index)
+	}
+
+	sort.Strings(names)
+
+	built := strings.Join(names, ",")
+
+	if collection != "" {
+		built += ";public"
+	}
+
+	marker, err := stub.GetState(INDEXES_KEY)
+
+	if err != nil {
+		return errors.New("Unable to get " + INDEXES_KEY)
+	}
+
+	if string(marker) == built {
+		return nil
+	}
+
+	if products == nil {
+
+		products, err = t.retrieve_all_products(stub)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range products {
+
+		if collection != "" {
+
+			public := t.public_view(p)
+
+			for index, attribute := range INDEXES {
+
+				if attribute(p) == "" || attribute(p) == attribute(public) {
+					continue
+				}
+
+				key, err := t.index_key(stub, index, attribute(p), p.ProductID)
+
+				if err != nil {
+					return err
+				}
+
+				err = stub.DelState(key)
+
+				if err != nil {
+					return errors.New("Unable to remove product " + p.ProductID + " from the " + index + " index")
+				}
+			}
+
+			p = public
+		}
+
+		for index, attribute := range INDEXES {
+
+			if attribute(p) == "" {
+				continue
+			}
+
+			key, err := t.index_key(stub, index, attribute(p), p.ProductID)
+
+			if err != nil {
+				return err
+			}
+
+			err = stub.PutState(key, []byte{0})
+
+			if err != nil {
+				return errors.New("Unable to add product " + p.ProductID + " to the " + index + " index")
+			}
+		}
+	}
+
+	err = stub.PutState(INDEXES_KEY, []byte(built))
+
+	if err != nil {
+		return errors.New("Unable to store " + INDEXES_KEY)
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// reserve_product_id - Claims a product id by writing a placeholder at its key before the product record is built.
+//						The id key is read first, so it is part of this transaction's read set as well as its write
+//						set. If two create_product transactions in the same block pick the same id, the second fails
+//						validation with a read conflict at commit instead of silently overwriting the first product
+//						or adding the id to the index twice. The catch is that both transactions must be endorsed
+//						against the same committed state; a client retrying after such a conflict gets a fresh id
+//						as the retry has a new transaction id. The placeholder is replaced by the real record in the same
+//						transaction and is discarded with the rest of the writes if create_product fails.
+//==============================================================================================================================
+func (t *SimpleChaincode) reserve_product_id(stub shim.ChaincodeStubInterface, productId string) (error) {
+
+	record, err := stub.GetState(productId)
+
+	if err != nil {
+		return errors.New("Unable to check product id " + productId)
+	}
+
+	if len(record) != 0 {
+		return t.fail(ERR_INVALID_STATE, "Product " + productId + " already exists")
+	}
+
+	err = stub.PutState(productId, []byte("{\"reserved\":true}"))
+
+	if err != nil {
+		return errors.New("Unable to reserve product id " + productId)
+	}
+
+	return nil
+}
+
+//==============================================================================================================================
+// Product ids - Product ids are nine digit numbers in this range.
+//==============================================================================================================================
+const PRODUCT_ID_MIN = 100000000
+const PRODUCT_ID_MAX = 999999999
+
+//==============================================================================================================================
+// generate_product_id - Derives the id of a new product from the transaction id, so every endorsing peer comes up with
+//						 the same id. A client creating several products in one go can pass a nonce to tell them
+//						 apart. Ids that are indexed already are skipped by hashing again with a counter.
+//==============================================================================================================================
+func (t *SimpleChaincode) generate_product_id(stub shim.ChaincodeStubInterface, nonce string) (int, error) {
+
+	for attempt := 0; attempt < 100; attempt++ {
+
+		sum := sha256.Sum256([]byte(stub.GetTxID() + "|" + nonce + "|" + strconv.Itoa(attempt)))
+		id := PRODUCT_ID_MIN + int(binary.BigEndian.Uint64(sum[:8]) % uint64(PRODUCT_ID_MAX - PRODUCT_ID_MIN))
+
+		key, err := t.product_index_key(stub, id)
+
+		if err != nil {
+			return 0, err
+		}
+
+		indexed, err := stub.GetState(key)
+
+		if err != nil {
+			return 0, errors.New("Unable to check product id " + strconv.Itoa(id))
+		}
+
+		if len(indexed) == 0 {
+			return id, nil
+		}
+	}
+
+	return 0, errors.New("Unable to generate a free product id")
+}
+//==============================================================================================================================
+//	 Router Functions
+//==============================================================================================================================
+//	Invoke - Called for every transaction and query. Functions listed in QUERY_ARGS are routed to query, everything
+//			 else to invoke.
+//==============================================================================================================================
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+
+	defer t.end_tx(stub.GetTxID())
+
+	function, args := stub.GetFunctionAndParameters()
+
+	if _, ok := QUERY_ARGS[function]; ok {
+		return t.respond(t.query(stub, function, args))
+	}
+
+	payload, err := t.invoke(stub, function, args)
+
+	if err == nil {
+		err = t.send_events(stub)
+	}
+
+	return t.respond(payload, err)
+}
+
+//==============================================================================================================================
+//	respond - Turns the result of a router function into an Envelope returned to the peer. Failures keep an error
+//			  status so the peer discards their writes.
+//==============================================================================================================================
+func (t *SimpleChaincode) respond(payload []byte, err error) (pb.Response) {
+
+	if err != nil {
+
+		failure := t.classify(err)
+
+		bytes, _ := json.Marshal(Envelope{Code: failure.Code, Message: failure.Message, Errors: failure.Fields})
+
+		return pb.Response{Status: ERROR_STATUS[failure.Code], Message: string(bytes)}
+	}
+
+	data := json.RawMessage(payload)
+
+	if payload != nil && !json.Valid(payload) {
+		data, _ = json.Marshal(string(payload))
+	}
+
+	bytes, err := json.Marshal(Envelope{OK: true, Code: "OK", Data: data})
+
+	if err != nil {
+		return shim.Error("Error creating response")
+	}
+
+	return shim.Success(bytes)
+}
+
+//==============================================================================================================================
+//	fail - Returns an error with one of the error codes.
+//==============================================================================================================================
+func (t *SimpleChaincode) fail(code string, message string) (error) {
+	return &ChaincodeError{Code: code, Message: message}
+}
+
+//==============================================================================================================================
+//	wrap_error - Prefixes the message of an error, keeping its code and field errors.
+//==============================================================================================================================
+func (t *SimpleChaincode) wrap_error(prefix string, err error) (error) {
+
+	failure := t.classify(err)
+
+	return &ChaincodeError{Code: failure.Code, Message: prefix + failure.Message, Fields: failure.Fields}
+}
+
+//==============================================================================================================================
+//	save_error - The error returned by a function whose save failed. Validation failures, holds and terms this peer
+//				 doesn't hold are passed on so the caller learns what stopped them, anything else is reported as a
+//				 failed save.
+//==============================================================================================================================
+func (t *SimpleChaincode) save_error(err error) (error) {
+
+	if failure, ok := err.(*ChaincodeError); ok && (failure.Code == ERR_VALIDATION_FAILED || failure.Code == ERR_HOLD_ACTIVE || failure.Code == ERR_INVALID_STATE) {
+		return err
+	}
+
+	return errors.New("Error saving changes")
+}
+
+//==============================================================================================================================
+//	classify - Returns the code of an error. Functions raise errors with their code through fail, so errors raised
+//			   without one come from something failing unexpectedly and are INTERNAL.
+//==============================================================================================================================
+func (t *SimpleChaincode) classify(err error) (*ChaincodeError) {
+
+	if failure, ok := err.(*ChaincodeError); ok {
+		return failure
+	}
+
+	return &ChaincodeError{Code: ERR_INTERNAL, Message: err.Error()}
+}
+
+//==============================================================================================================================
+//	invoke - Takes a function name passed and calls that function. Converts some initial arguments passed to other
+//			 things for use in the called function e.g. name -> affiliation. Every successful call is recorded in the
+//			 audit trail.
+//==============================================================================================================================
+func (t *SimpleChaincode) invoke(stub shim.ChaincodeStubInterface, function string, args []string) (payload []byte, err error) {
+
+	caller, caller_affiliation, err := t.get_caller_data(stub)
+
+	if _, denied := err.(*ChaincodeError); denied {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.New("Error retrieving caller information")
+	}
+
+	target := ""
+
+	defer func() {
+		if err != nil {
+			return
+		}
+		if function == "create_product" {
+			target = string(payload)
+		}
+		err = t.record_invocation(stub, function, caller, caller_affiliation, target)
+		if err != nil {
+			payload = nil
+		}
+	}()
+
+	err = t.record_participant(stub, caller, caller_affiliation)
+
+	if err != nil {
+		return nil, err
+	}
+
+	args, err = t.request_args(function, args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if function == "confirm_deliveries" {
+		return t.confirm_deliveries(stub, caller, caller_affiliation, args)
+	} else if function == "accept_deliveries" {
+		return t.accept_deliveries(stub, caller, caller_affiliation, args)
+	} else if function == "swap_products" {
+		return t.swap_products(stub, caller, caller_affiliation, args)
+	} else if function == "propose_transfer" {
+		return t.propose_transfer(stub, caller, caller_affiliation, args)
+	} else if function == "confirm_delivery" {
+		return t.confirm_delivery(stub, caller, caller_affiliation, args)
+	} else if function == "create_products_bulk" {
+		return t.create_products_bulk(stub, caller, caller_affiliation, args)
+	} else if function == "transfer_products_bulk" {
+		return t.transfer_products_bulk(stub, caller, caller_affiliation, args)
+	} else if function == "set_fx_rate" {
+		return t.set_fx_rate(stub, caller, caller_affiliation, args)
+	} else if function == "issue_recall" {
+		return t.issue_recall(stub, caller, caller_affiliation, args)
+	} else if function == "record_telemetry" {
+		return t.record_telemetry(stub, caller, caller_affiliation, args)
+	} else if function == "open_accreditive" {
+		return t.open_accreditive(stub, caller, caller_affiliation, args)
+	} else if function == "confirm_accreditive" {
+		return t.confirm_accreditive(stub, caller, caller_affiliation, args)
+	} else if function == "amend_accreditive" {
+		return t.amend_accreditive(stub, caller, caller_affiliation, args)
+	} else if function == "draw_accreditive" {
+		return t.draw_accreditive(stub, caller, caller_affiliation, args)
+	} else if function == "issue_bill_of_lading" {
+		return t.issue_bill_of_lading(stub, caller, caller_affiliation, args)
+	} else if function == "endorse_bill_of_lading" {
+		return t.endorse_bill_of_lading(stub, caller, caller_affiliation, args)
+	} else if function == "surrender_bill_of_lading" {
+		return t.surrender_bill_of_lading(stub, caller, caller_affiliation, args)
+	} else if function == "execute_sales_contract" {
+		return t.execute_sales_contract(stub, caller, caller_affiliation, args)
+	} else if function == "issue_invoice" {
+		return t.issue_invoice(stub, caller, caller_affiliation, args)
+	} else if function == "accept_invoice" {
+		return t.accept_invoice(stub, caller, caller_affiliation, args)
+	} else if function == "mark_paid" {
+		return t.mark_paid(stub, caller, caller_affiliation, args)
+	} else if function == "validate_and_repair_product" {
+		return t.validate_and_repair_product(stub, caller, caller_affiliation, args)
+	} else if function == "register_participant" || function == "set_role" || function == "revoke_participant" {
+		return t.update_participant(stub, caller, caller_affiliation, function, args)
+	} else if function == "add_to_blacklist" {
+		return t.update_blacklist(stub, caller, caller_affiliation, args, true)
+	} else if function == "remove_from_blacklist" {
+		return t.update_blacklist(stub, caller, caller_affiliation, args, false)
+	} else if function == "create_product" {
+		// Args: buyer, destination, price, currency, sales contract, then optionally units and a nonce for the id.
+		// The buyer's affiliation is needed to check its role.
+
+		if len(args) < 5 || len(args) > 7 {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "Incorrect number of arguments passed")
+		}
+
+		buyer_affiliation, err := t.get_affiliation(stub, args[0])
+
+		if err != nil {
+			return nil, err
+		}
+
+		if args[2] == "" {
+			// Price and currency may be passed in the transient field "terms" so they don't appear in the transaction.
+
+			terms, err := t.transient_terms(stub)
+
+			if err != nil {
+				return nil, err
+			}
+
+			args[2] = t.format_money(terms.Price, terms.Currency)
+			args[3] = terms.Currency
+		}
+
+		if args[3] == "" {
+			// The default currency decides how many decimal places the price has, so resolve it before parsing.
+
+			config, err := t.get_config(stub)
+
+			if err != nil {
+				return nil, err
+			}
+
+			args[3] = config.DefaultCurrency
+		}
+
+		price, err := t.parse_money(args[2], args[3])
+
+		if err != nil {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid price " + args[2])
+		}
+
+		contract, err := t.parse_contract_terms(args[4])
+
+		if err != nil {
+			return nil, err
+		}
+
+		units := UNIT_SYSTEMS["metric"]
+
+		if len(args) > 5 && args[5] != "" {
+			err = json.Unmarshal([]byte(args[5]), &units)
+			if err != nil {
+				return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid units JSON")
+			}
+		}
+
+		nonce := ""
+
+		if len(args) > 6 {
+			nonce = args[6]
+		}
+
+		return t.create_product(stub, caller, args[0], caller_affiliation, buyer_affiliation, args[1], price, args[3], contract, units, nonce)
+	} else {
+		// If the function is not a create then there must be a product so we need to retrieve the product. Unknown
+		// function names are refused before anything is read rather than being taken for a transfer.
+
+		if !t.is_transfer(function)                          &&
+			!strings.HasPrefix(function, "update_")            &&
+			!PRODUCT_ONLY_FUNCTIONS[function]                    &&
+			!VALUE_FUNCTIONS[function] {
+			return nil, t.fail(ERR_NOT_FOUND, "Function of that name doesn't exist.")
+		}
+
+		argPos := 1
+
+		if PRODUCT_ONLY_FUNCTIONS[function] {
+			// If its a scrap product (or another function only acting on the product) then only two arguments are passed (no update value) all others have three arguments and the productId is expected in the last argument
+			argPos = 0
+		}
+
+		if len(args) <= argPos {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "Incorrect number of arguments passed")
+		}
+
+		product, err := t.retrieve_product(stub, args[argPos])
+
+		if err != nil {
+			t.audit(stub, "INVOKE: Error retrieving product: %s", err); return nil, t.wrap_error("Error retrieving product: ", err)
+		}
+
+		target = product.ProductID
+
+		if product.Hold != nil && function != "lift_hold" {
+			return nil, t.hold_error(product)
+		}
+
+		err = t.check_terms_held(product)
+
+		if err != nil {
+			return nil, err
+		}
+
+		nonce := ""
+
+		if argPos == 0 && len(args) > 1 {
+			// Product only functions may be passed a nonce after the product id so overrides can't be replayed
+			nonce = args[1]
+		}
+
+		if t.is_transfer(function) {
+			//If the function is a transfer we need to get the affiliation of the recipient.
+
+			pending, err := t.retrieve_transfer_proposal(stub, product.ProductID)
+
+			if err != nil {
+				return nil, err
+			}
+
+			now, err := t.get_tx_time(stub)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if t.transfer_pending(pending, now) {
+				return nil, t.fail(ERR_INVALID_STATE, "A transfer of product " + product.ProductID + " to " + pending.To + " is pending")
+			}
+
+			return t.transfer(stub, product, function, caller, caller_affiliation, args)
+		} else if function == "update_location" {
+			return t.update_location(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "update_route" {
+			return t.update_route(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "update_price" {
+			return t.update_price(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "update_width" {
+			return t.update_width(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "update_height" {
+			return t.update_height(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "update_weight" {
+			return t.update_weight(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "update_batch" {
+			return t.update_batch(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "scrap_product" {
+			return t.scrap_product(stub, product, caller, caller_affiliation)
+		} else if function == "set_thresholds" {
+			return t.set_thresholds(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "add_milestone" {
+			return t.add_milestone(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "confirm_scrapped" {
+			return t.confirm_scrapped(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "revert_last_transition" {
+			return t.revert_last_transition(stub, product, caller, caller_affiliation, nonce)
+		} else if function == "bank_issue_accreditive" {
+			return t.bank_issue_accreditive(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "record_inspection" {
+			return t.record_inspection(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "check_accreditive" {
+			return t.check_accreditive(stub, product, caller, caller_affiliation)
+		} else if function == "set_checksum" {
+			return t.set_checksum(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "assign_shares" {
+			return t.assign_shares(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "reject_accreditive" {
+			return t.reject_accreditive(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "reissue_accreditive" {
+			return t.reissue_accreditive(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "withdraw_accreditive" {
+			return t.withdraw_accreditive(stub, product, caller, caller_affiliation)
+		} else if function == "put_in_use" {
+			return t.put_in_use(stub, product, caller, caller_affiliation)
+		} else if function == "pay_partial" {
+			return t.pay_partial(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "pay_full" || function == "release_payment" {
+			return t.settle_payment(stub, product, caller, caller_affiliation, t.outstanding(product))
+		} else if function == "accept_transfer" {
+			return t.accept_transfer(stub, product, caller, caller_affiliation)
+		} else if function == "reject_transfer" {
+			return t.reject_transfer(stub, product, caller, caller_affiliation)
+		} else if function == "cancel_transfer" {
+			return t.cancel_transfer(stub, product, caller, caller_affiliation)
+		} else if function == "lock_product" {
+			return t.set_lock(stub, product, caller, caller_affiliation, true, nonce)
+		} else if function == "unlock_product" {
+			return t.set_lock(stub, product, caller, caller_affiliation, false, nonce)
+		} else if function == "place_hold" {
+			return t.place_hold(stub, product, caller, caller_affiliation, args[0])
+		} else if function == "lift_hold" {
+			return t.lift_hold(stub, product, caller, caller_affiliation)
+		}
+
+		return nil, t.fail(ERR_NOT_FOUND, "Function of that name doesn't exist.")
+
+	}
+}
+//=================================================================================================================================
+//	transfer - Carries out the transfer function passed. Args are the recipient, the product id and for some transfers a
+//			   value. Called by invoke and by accept_transfer, which passes the proposer as the caller. A locked product
+//			   can't be transferred, not even by the transfers that only change its custody.
+//=================================================================================================================================
+func (t *SimpleChaincode) transfer(stub shim.ChaincodeStubInterface, product Product, function string, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if product.Locked {
+		return nil, t.fail(ERR_INVALID_STATE, "product is locked")
+	}
+
+	err := t.check_recipient(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	rec_affiliation, err := t.get_affiliation(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if product.Recalled && function != "private_to_recycler" {
+		return nil, t.recall_error(product)
+	}
+
+	if function == "start_shipping" || function == "manufacturer_to_shipper" {
+		shipping_cost := ""
+
+		if len(args) > 2 {
+			shipping_cost = args[2]
+		}
+
+		return t.start_shipping(stub, product, caller, caller_affiliation, args[0], rec_affiliation, shipping_cost)
+	} else if function == "transfer_share" {
+
+		if len(args) != 3 {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "Incorrect number of arguments passed")
+		}
+
+		return t.transfer_share(stub, product, caller, caller_affiliation, args[0], args[2])
+	} else if function == "clone_product" {
+		return t.clone_product(stub, product, caller, caller_affiliation, args[0], rec_affiliation)
+	} else if function == "reassign_shipper" {
+		return t.reassign_shipper(stub, product, caller, caller_affiliation, args[0], rec_affiliation)
+	} else if function == "shipper_to_buyer" {
+		return t.hand_over(stub, product, caller, caller_affiliation, args[0], rec_affiliation)
+	} else if function == "private_to_recycler" {
+		return t.private_to_recycler(stub, product, caller, caller_affiliation, args[0], rec_affiliation)
+	}
+
+	return nil, t.fail(ERR_NOT_FOUND, "Function of that name doesn't exist.")
+}
+
+//=================================================================================================================================
+//	request_args - create_product and the functions acting on one product may be passed a single JSON document instead
+//				   of positional args, e.g. {"productId":"...","recipient":"..."} for a transfer. The document is
+//				   checked against the fields the function needs and turned into the positional args it expects.
+//				   Args of any other form are returned as they are.
+//=================================================================================================================================
+func (t *SimpleChaincode) request_args(function string, args []string) ([]string, error) {
+
+	if len(args) != 1 || !strings.HasPrefix(strings.TrimSpace(args[0]), "{") {
+		return args, nil
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(args[0]))
+	decoder.DisallowUnknownFields()
+
+	if function == "create_product" {
+
+		var request CreateRequest
+
+		err := decoder.Decode(&request)
+
+		if err != nil {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "CREATE_PRODUCT: Invalid request: " + err.Error())
+		}
+
+		if request.Buyer == "" || request.Destination == "" {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "CREATE_PRODUCT: Request is missing buyer or destination")
+		}
+
+		price := ""
+
+		if request.Price != nil {
+			price = t.format_money(*request.Price, request.Currency)
+		}
+
+		contract := ""
+
+		if request.SalesContract != nil {
+
+			bytes, err := json.Marshal(request.SalesContract)
+
+			if err != nil {
+				return nil, t.fail(ERR_VALIDATION_FAILED, "CREATE_PRODUCT: Invalid sales contract")
+			}
+
+			contract = string(bytes)
+		}
+
+		units := ""
+
+		if request.Units != nil {
+
+			bytes, err := json.Marshal(request.Units)
+
+			if err != nil {
+				return nil, t.fail(ERR_VALIDATION_FAILED, "CREATE_PRODUCT: Invalid units")
+			}
+
+			units = string(bytes)
+		}
+
+		return []string{request.Buyer, request.Destination, price, request.Currency, contract, units, request.Nonce}, nil
+	}
+
+	product_only := PRODUCT_ONLY_FUNCTIONS[function]
+	update := strings.HasPrefix(function, "update_") || VALUE_FUNCTIONS[function]
+	transfer := PROPOSABLE_TRANSFERS[function] || function == "clone_product"
+
+	if !product_only && !update && !transfer {
+		return args, nil
+	}
+
+	var request ProductRequest
+
+	err := decoder.Decode(&request)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, strings.ToUpper(function) + ": Invalid request: " + err.Error())
+	}
+
+	if request.ProductID == "" {
+		return nil, t.fail(ERR_VALIDATION_FAILED, strings.ToUpper(function) + ": Request is missing productId")
+	}
+
+	if product_only {
+
+		if request.Nonce != "" {
+			return []string{request.ProductID, request.Nonce}, nil
+		}
+
+		return []string{request.ProductID}, nil
+	}
+
+	if update {
+
+		if request.NewValue == "" {
+			return nil, t.fail(ERR_VALIDATION_FAILED, strings.ToUpper(function) + ": Request is missing newValue")
+		}
+
+		return []string{request.NewValue, request.ProductID}, nil
+	}
+
+	if request.Recipient == "" {
+		return nil, t.fail(ERR_VALIDATION_FAILED, strings.ToUpper(function) + ": Request is missing recipient")
+	}
+
+	if request.NewValue != "" {
+		return []string{request.Recipient, request.ProductID, request.NewValue}, nil
+	}
+
+	return []string{request.Recipient, request.ProductID}, nil
+}
+
+//=================================================================================================================================
+//	PRODUCT_ONLY_FUNCTIONS - Invoke functions that take nothing but the product id.
+//=================================================================================================================================
+var PRODUCT_ONLY_FUNCTIONS = map[string]bool{
+	"scrap_product":          true,
+	"revert_last_transition": true,
+	"lock_product":           true,
+	"unlock_product":         true,
+	"check_accreditive":      true,
+	"withdraw_accreditive":   true,
+	"release_payment":        true,
+	"put_in_use":             true,
+	"pay_full":               true,
+	"accept_transfer":        true,
+	"reject_transfer":        true,
+	"cancel_transfer":        true,
+	"lift_hold":              true,
+}
+
+//=================================================================================================================================
+//	PROPOSABLE_TRANSFERS - Transfer functions that may be proposed with propose_transfer instead of being carried out
+//						   straight away.
+//=================================================================================================================================
+var PROPOSABLE_TRANSFERS = map[string]bool{
+	"start_shipping":          true,
+	"manufacturer_to_shipper": true,
+	"reassign_shipper":        true,
+	"shipper_to_buyer":        true,
+	"transfer_share":          true,
+	"private_to_recycler":     true,
+}
+
+//=================================================================================================================================
+//	is_transfer - Whether invoke routes the function passed to transfer: the proposable transfers and clone_product,
+//				  which can't be proposed.
+//=================================================================================================================================
+func (t *SimpleChaincode) is_transfer(function string) (bool) {
+	return PROPOSABLE_TRANSFERS[function] || function == "clone_product"
+}
+
+//=================================================================================================================================
+//	VALUE_FUNCTIONS - Invoke functions that take a value and the product id like the updates, but aren't named update_.
+//=================================================================================================================================
+var VALUE_FUNCTIONS = map[string]bool{
+	"bank_issue_accreditive": true,
+	"record_inspection":      true,
+	"reject_accreditive":     true,
+	"assign_shares":          true,
+	"set_checksum":           true,
+	"reissue_accreditive":    true,
+	"pay_partial":            true,
+	"place_hold":             true,
+	"confirm_scrapped":       true,
+	"add_milestone":          true,
+	"set_thresholds":         true,
+}
+
+//=================================================================================================================================
+//	QUERY_ARGS - The smallest and largest number of arguments each query accepts. Invoke routes the functions listed here
+//				 to query, which checks the arguments against this table, so no query can index past the end of args.
+//=================================================================================================================================
+var QUERY_ARGS = map[string][2]int{
+	"get_vehicle_details":                  {1, 2},
+	"get_vehicles":                         {0, 2},
+	"get_custody_chain":                    {1, 1},
+	"convert_units":                        {2, 2},
+	"get_products_created_between":         {2, 3},
+	"get_products_modified_since":          {1, 2},
+	"get_products_scrapped_between":        {2, 2},
+	"get_product_diff":                     {3, 3},
+	"get_supply_chain_view":                {1, 1},
+	"get_products_summary_csv":             {0, 1},
+	"get_high_velocity_products":           {1, 2},
+	"get_product_as_of":                    {2, 2},
+	"get_buyer_obligations":                {1, 1},
+	"get_state_transitions_log":            {1, 1},
+	"get_estimated_shipping_cost":          {1, 1},
+	"get_stale_products":                   {0, 2},
+	"suggest_consolidations":               {1, 1},
+	"get_products_by_currency":             {1, 1},
+	"get_products_requiring_inspection":    {0, 0},
+	"get_products_for_bank":                {1, 1},
+	"get_ownership_breakdown":              {1, 1},
+	"get_products_by_custodian":            {1, 1},
+	"get_audit_log":                        {0, 0},
+	"get_pending_actions":                  {0, 0},
+	"get_products_grouped_by_manufacturer": {0, 2},
+	"get_products_by_route_contains":       {1, 2},
+	"get_product_count":                    {0, 0},
+	"get_trade_finance_status":             {1, 1},
+	"get_accreditive":                      {1, 1},
+	"get_products_by_owner":                {0, 0},
+	"get_products_by_state":                {1, 1},
+	"get_product_history":                  {1, 1},
+	"get_product_terms":                    {1, 1},
+	"get_fx_rates":                         {0, 1},
+	"get_product_price":                    {2, 2},
+	"get_audit_trail":                      {0, 1},
+	"get_held_products":                    {0, 0},
+	"get_recall":                           {1, 1},
+	"get_recalled_owners":                  {0, 1},
+	"get_telemetry":                        {1, 2},
+	"get_bill_of_lading":                   {1, 1},
+	"get_invoice":                          {1, 1},
+	"get_unpaid_invoices":                  {1, 1},
+	"get_sales_contract":                   {1, 1},
+}
+
+//=================================================================================================================================	
+//	query - Called by Invoke for the read only functions. Takes a function name passed and calls that function. Passes the
+//  		initial arguments passed are passed on to the called function.
+//=================================================================================================================================	
+func (t *SimpleChaincode) query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+
+	caller, caller_affiliation, err := t.get_caller_data(stub)
+
+	if _, denied := err.(*ChaincodeError); denied {
+		return nil, err
+	} else if err != nil {
+		t.audit(stub, "QUERY: Error retrieving caller details %s", err); return nil, errors.New("QUERY: Error retrieving caller details")
+	}
+
+	bounds, ok := QUERY_ARGS[function]
+
+	if !ok {
+		return nil, t.fail(ERR_NOT_FOUND, "Received unknown function invocation")
+	}
+
+	if len(args) < bounds[0] || len(args) > bounds[1] {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "QUERY: Incorrect number of arguments passed to " + function)
+	}
+
+	if function == "get_vehicle_details" {
+
+		v, err := t.retrieve_product(stub, args[0])
+		if err != nil {
+			t.audit(stub, "QUERY: Error retrieving product: %s", err); return nil, t.wrap_error("QUERY: Error retrieving product ", err)
+		}
+
+		if len(args) == 2 {
+
+			var options DetailOptions
+
+			err = json.Unmarshal([]byte(args[1]), &options)
+			if err != nil {
+				return nil, t.fail(ERR_VALIDATION_FAILED, "QUERY: Invalid options JSON")
+			}
+
+			if options.Labels {
+				return t.get_labelled_details(stub, v, caller, caller_affiliation)
+			}
+		}
+
+		return t.get_vehicle_details(stub, v, caller, caller_affiliation)
+
+	} else if function == "get_vehicles" {
+		return t.get_vehicles(stub, caller, caller_affiliation, args)
+	} else if function == "get_custody_chain" {
+
+		p, err := t.retrieve_product(stub, args[0])
+		if err != nil {
+			t.audit(stub, "QUERY: Error retrieving product: %s", err); return nil, t.wrap_error("QUERY: Error retrieving product ", err)
+		}
+
+		return t.get_custody_chain(stub, p, caller, caller_affiliation)
+
+	} else if function == "convert_units" {
+
+		p, err := t.retrieve_product(stub, args[0])
+		if err != nil {
+			t.audit(stub, "QUERY: Error retrieving product: %s", err); return nil, t.wrap_error("QUERY: Error retrieving product ", err)
+		}
+
+		return t.convert_units(stub, p, caller, caller_affiliation, args[1])
+
+	} else if function == "get_products_created_between" {
+		return t.get_products_created_between(stub, caller, caller_affiliation, args)
+	} else if function == "get_products_modified_since" {
+		return t.get_products_modified_since(stub, caller, caller_affiliation, args)
+	} else if function == "get_products_scrapped_between" {
+		return t.get_products_scrapped_between(stub, caller, caller_affiliation, args)
+	} else if function == "get_product_diff" {
+
+		p, err := t.retrieve_product(stub, args[0])
+		if err != nil {
+			t.audit(stub, "QUERY: Error retrieving product: %s", err); return nil, t.wrap_error("QUERY: Error retrieving product ", err)
+		}
+
+		return t.get_product_diff(stub, p, caller, caller_affiliation, args[1], args[2])
+
+	} else if function == "get_supply_chain_view" {
+
+		p, err := t.retrieve_product(stub, args[0])
+		if err != nil {
+			t.audit(stub, "QUERY: Error retrieving product: %s", err); return nil, t.wrap_error("QUERY: Error retrieving product ", err)
+		}
+
+		return t.get_supply_chain_view(stub, p, caller, caller_affiliation)
+
+	} else if function == "get_products_summary_csv" {
+		return t.get_products_summary_csv(stub, caller, caller_affiliation, args)
+	} else if function == "get_high_velocity_products" {
+		return t.get_high_velocity_products(stub, caller, caller_affiliation, args)
+	} else if function == "get_product_terms" {
+
+		p, err := t.retrieve_product(stub, args[0])
+		if err != nil {
+			t.audit(stub, "QUERY: Error retrieving product: %s", err); return nil, t.wrap_error("QUERY: Error retrieving product ", err)
+		}
+
+		return t.get_product_terms(stub, p, caller, caller_affiliation)
+	} else if function == "get_product_history" {
+
+		p, err := t.retrieve_product(stub, args[0])
+		if err != nil {
+			t.audit(stub, "QUERY: Error retrieving product: %s", err); return nil, t.wrap_error("QUERY: Error retrieving product ", err)
+		}
+
+		return t.get_product_history(stub, p, caller, caller_affiliation)
+	} else if function == "get_product_as_of" {
+
+		p, err := t.retrieve_product(stub, args[0])
+		if err != nil {
+			t.audit(stub, "QUERY: Error retrieving product: %s", err); return nil, t.wrap_error("QUERY: Error retrieving product ", err)
+		}
+
+		return t.get_product_as_of(stub, p, caller, caller_affiliation, args[1])
+
+	} else if function == "get_buyer_obligations" {
+		return t.get_buyer_obligations(stub, caller, caller_affiliation, args)
+	} else if function == "get_state_transitions_log" {
+
+		p, err := t.retrieve_product(stub, args[0])
+		if err != nil {
+			t.audit(stub, "QUERY: Error retrieving product: %s", err); return nil, t.wrap_error("QUERY: Error retrieving product ", err)
+		}
+
+		return t.get_state_transitions_log(stub, p, caller, caller_affiliation)
+
+	} else if function == "get_estimated_shipping_cost" {
+
+		p, err := t.retrieve_product(stub, args[0])
+		if err != nil {
+			t.audit(stub, "QUERY: Error retrieving product: %s", err); return nil, t.wrap_error("QUERY: Error retrieving product ", err)
+		}
+
+		return t.get_estimated_shipping_cost(stub, p, caller, caller_affiliation)
+
+	} else if function == "get_stale_products" {
+		return t.get_stale_products(stub, caller, caller_affiliation, args)
+	} else if function == "suggest_consolidations" {
+		return t.suggest_consolidations(stub, caller, caller_affiliation, args)
+	} else if function == "get_products_by_currency" {
+		return t.get_products_by_currency(stub, caller, caller_affiliation, args)
+	} else if function == "get_products_requiring_inspection" {
+		return t.get_products_requiring_inspection(stub, caller, caller_affiliation)
+	} else if function == "get_products_for_bank" {
+		return t.get_products_for_bank(stub, caller, caller_affiliation, args)
+	} else if function == "get_ownership_breakdown" {
+
+		p, err := t.retrieve_product(stub, args[0])
+		if err != nil {
+			t.audit(stub, "QUERY: Error retrieving product: %s", err); return nil, t.wrap_error("QUERY: Error retrieving product ", err)
+		}
+
+		return t.get_ownership_breakdown(stub, p, caller, caller_affiliation)
+
+	} else if function == "get_products_by_custodian" {
+		return t.get_products_by_custodian(stub, caller, caller_affiliation, args)
+	} else if function == "get_audit_log" {
+		return t.get_audit_log(stub, caller, caller_affiliation)
+	} else if function == "get_audit_trail" {
+		return t.get_audit_trail(stub, caller, caller_affiliation, args)
+	} else if function == "get_held_products" {
+		return t.get_held_products(stub, caller, caller_affiliation)
+	} else if function == "get_recall" {
+		return t.get_recall(stub, caller, caller_affiliation, args[0])
+	} else if function == "get_recalled_owners" {
+		return t.get_recalled_owners(stub, caller, caller_affiliation, args)
+	} else if function == "get_telemetry" {
+
+		p, err := t.retrieve_product(stub, args[0])
+		if err != nil {
+			t.audit(stub, "QUERY: Error retrieving product: %s", err); return nil, t.wrap_error("QUERY: Error retrieving product ", err)
+		}
+
+		return t.get_telemetry(stub, p, caller, caller_affiliation, args[1:])
+
+	} else if function == "get_pending_actions" {
+		return t.get_pending_actions(stub, caller, caller_affiliation)
+	} else if function == "get_products_grouped_by_manufacturer" {
+		return t.get_products_grouped_by_manufacturer(stub, caller, caller_affiliation, args)
+	} else if function == "get_products_by_route_contains" {
+		return t.get_products_by_route_contains(stub, caller, caller_affiliation, args)
+	} else if function == "get_product_count" {
+		return t.get_product_count(stub)
+	} else if function == "get_accreditive" {
+		return t.get_accreditive(stub, caller, caller_affiliation, args[0])
+	} else if function == "get_bill_of_lading" {
+		return t.get_bill_of_lading(stub, caller, caller_affiliation, args[0])
+	} else if function == "get_sales_contract" {
+		return t.get_sales_contract(stub, caller, caller_affiliation, args[0])
+	} else if function == "get_invoice" {
+		return t.get_invoice(stub, caller, caller_affiliation, args[0])
+	} else if function == "get_unpaid_invoices" {
+		return t.get_unpaid_invoices(stub, caller, caller_affiliation, args[0])
+	} else if function == "get_products_by_owner" {
+		return t.get_products_by_owner(stub, caller, caller_affiliation)
+	} else if function == "get_products_by_state" {
+		return t.get_products_by_state(stub, caller, caller_affiliation, args)
+	} else if function == "get_trade_finance_status" {
+
+		p, err := t.retrieve_product(stub, args[0])
+		if err != nil {
+			t.audit(stub, "QUERY: Error retrieving product: %s", err); return nil, t.wrap_error("QUERY: Error retrieving product ", err)
+		}
+
+		return t.get_trade_finance_status(stub, p, caller, caller_affiliation)
+	} else if function == "get_fx_rates" {
+		return t.get_fx_rates(stub, args)
+	} else if function == "get_product_price" {
+
+		p, err := t.retrieve_product(stub, args[0])
+		if err != nil {
+			t.audit(stub, "QUERY: Error retrieving product: %s", err); return nil, t.wrap_error("QUERY: Error retrieving product ", err)
+		}
+
+		return t.get_product_price(stub, p, caller, caller_affiliation, args[1])
+	}
+	return nil, t.fail(ERR_NOT_FOUND, "Received unknown function invocation")
+}
+
+//=================================================================================================================================
+//	 Create Function
+//=================================================================================================================================									
+//	 Create Product - Creates the initial JSON for the product and then saves it to the ledger.
+// caller1 : Seller - caller2 : Buyer
+//	 Only a manufacturer (SELLER) may create a product and the buyer must be registered as a BUYER.
+//	 When contract terms are passed a SalesContract is created for the product and linked from it.
+//	 An empty currency falls back to the default currency configured at Init.
+//	 Returns the id assigned to the new product.
+//=================================================================================================================================
+func (t *SimpleChaincode) create_product(stub shim.ChaincodeStubInterface, caller1 string, caller2 string, caller1_affiliation int, caller2_affiliation int, product_destination string, product_price Money, product_currency string, contract *ContractTerms, units Units, nonce string) ([]byte, error) {
+
+	product, productId, err := t.build_product(stub, caller1, caller2, caller1_affiliation, caller2_affiliation, product_destination, product_price, product_currency, contract, units, nonce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.add_to_index(stub, productId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(product.ProductID), nil                                                                // Only hand the id back once the index knows about it
+
+}
+
+//=================================================================================================================================
+//	 build_product - Does the work of create_product except for adding the product to the index: checks the roles,
+//					 assigns an id and saves the new product. Returns the product and its id.
+//=================================================================================================================================
+func (t *SimpleChaincode) build_product(stub shim.ChaincodeStubInterface, caller1 string, caller2 string, caller1_affiliation int, caller2_affiliation int, product_destination string, product_price Money, product_currency string, contract *ContractTerms, units Units, nonce string) (Product, int, error) {
+
+	var product Product
+
+	if caller1_affiliation != SELLER {
+		return product, 0, t.fail(ERR_PERMISSION_DENIED, "only manufacturers may create products")
+	}
+
+	if caller2_affiliation != BUYER {
+		return product, 0, t.fail(ERR_VALIDATION_FAILED, "the buyer " + caller2 + " is not registered as a buyer")
+	}
+
+	productId, err := t.generate_product_id(stub, nonce)
+
+	if err != nil {
+		return product, 0, err
+	}
+
+	err = t.reserve_product_id(stub, strconv.Itoa(productId))                                        // Claim the id before anything else is built
+
+	if err != nil {
+		return product, 0, err
+	}
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return product, 0, err
+	}
+
+	if product_currency == "" {
+		product_currency = config.DefaultCurrency
+	}
+
+	if config.Strict && (product_destination == "UNDEFINED" || product_currency == "UNDEFINED") {
+		return product, 0, t.fail(ERR_VALIDATION_FAILED, "Strict mode: destination and currency may not be UNDEFINED")
+	}
+
+	product = Product{                                                                                // Fields that aren't known yet start as UNDEFINED
+		ProductID:        strconv.Itoa(productId),
+		CheckID:          "UNDEFINED",
+		Manufacturer:     caller1,
+		Owner:            caller1,
+		Buyer:            caller2,
+		Origin:           "UNDEFINED",
+		Destination:      product_destination,
+		Route:            "UNDEFINED",
+		State:            STATE_SALESCONTRACT,
+		Price:            product_price,
+		Currency:         product_currency,
+		Units:            units,
+	}
+
+	if config.Strict {
+		// Strict ledgers leave fields that aren't known yet empty instead of storing placeholders
+		product.CheckID = ""
+		product.Origin = ""
+		product.Route = ""
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return product, 0, err
+	}
+
+	product.CreatedAt = now
+	t.enter_state(stub, &product, STATE_SALESCONTRACT, caller1, now)
+
+	if contract != nil {
+
+		err = t.create_sales_contract(stub, &product, *contract, now)
+
+		if err != nil {
+			return product, 0, err
+		}
+	}
+
+	err = t.validate_new_product(product)
+
+	if err != nil {
+		t.audit(stub, "CREATE_PRODUCT: Invalid product: %s", err); return product, 0, err
+	}
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "CREATE_PRODUCT: Error saving changes: %s", err); return product, 0, t.save_error(err)
+	}
+
+	return product, productId, nil
+}
+
+//=================================================================================================================================
+//	 create_products_bulk - Creates every product in a JSON array of ProductDefinitions in one transaction, e.g. for a
+//							production run. Each is checked like a product passed to create_product and the whole
+//							batch fails if one of them does. The index is updated once at the end. An optional nonce
+//							tells apart batches submitted in one go. Returns the ids created, in the order given.
+//=================================================================================================================================
+func (t *SimpleChaincode) create_products_bulk(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 1 && len(args) != 2 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "CREATE_PRODUCTS_BULK: Expecting a JSON array of products and an optional nonce")
+	}
+
+	var definitions []ProductDefinition
+
+	err := json.Unmarshal([]byte(args[0]), &definitions)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "CREATE_PRODUCTS_BULK: Invalid products JSON")
+	}
+
+	if len(definitions) == 0 || len(definitions) > MAX_BULK_PRODUCTS {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "CREATE_PRODUCTS_BULK: Expecting between 1 and " + strconv.Itoa(MAX_BULK_PRODUCTS) + " products")
+	}
+
+	nonce := ""
+
+	if len(args) == 2 {
+		nonce = args[1]
+	}
+
+	var ids []int
+	created := []string{}
+	seen := make(map[int]bool)
+
+	for i, definition := range definitions {
+
+		buyer_affiliation, err := t.get_affiliation(stub, definition.Buyer)
+
+		if err != nil {
+			return nil, t.wrap_error("CREATE_PRODUCTS_BULK: Product " + strconv.Itoa(i) + ": ", err)
+		}
+
+		units := UNIT_SYSTEMS["metric"]
+
+		if definition.Units != nil {
+			units = *definition.Units
+		}
+
+		product, productId, err := t.build_product(stub, caller, definition.Buyer, caller_affiliation, buyer_affiliation, definition.Destination, definition.Price, definition.Currency, definition.SalesContract, units, nonce + "|" + strconv.Itoa(i))
+
+		if err != nil {
+			return nil, t.wrap_error("CREATE_PRODUCTS_BULK: Product " + strconv.Itoa(i) + ": ", err)
+		}
+
+		if seen[productId] {                                                                        // Ids reserved in this batch aren't visible to generate_product_id yet
+			return nil, t.fail(ERR_INVALID_STATE, "CREATE_PRODUCTS_BULK: Product " + strconv.Itoa(i) + " was given a duplicate id, retry with another nonce")
+		}
+
+		seen[productId] = true
+		ids = append(ids, productId)
+		created = append(created, product.ProductID)
+	}
+
+	err = t.add_to_index(stub, ids...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(created)
+
+	if err != nil {
+		return nil, errors.New("CREATE_PRODUCTS_BULK: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 clone_product - Creates a new product for another buyer from the descriptive fields of an existing one: price,
+//					 destination, route, dimensions and units. The clone gets a fresh id and starts as a new sales
+//					 contract owned by the manufacturer, without any accreditive, custody, shares or history.
+//					 Only the manufacturer of the original may clone it. Returns the id of the clone.
+//=================================================================================================================================
+func (t *SimpleChaincode) clone_product(stub shim.ChaincodeStubInterface, original Product, caller string, caller_affiliation int, buyer string, buyer_affiliation int) ([]byte, error) {
+
+	if original.Manufacturer != caller || caller_affiliation != SELLER {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "only the manufacturer may clone a product")
+	}
+
+	if buyer_affiliation != BUYER {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "the buyer " + buyer + " is not registered as a buyer")
+	}
+
+	productId, err := t.generate_product_id(stub, "clone")
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.reserve_product_id(stub, strconv.Itoa(productId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clone := Product{
+		ProductID:    strconv.Itoa(productId),
+		Manufacturer: caller,
+		Owner:        caller,
+		Buyer:        buyer,
+		CreatedAt:    now,
+		Origin:       original.Origin,
+		Destination:  original.Destination,
+		Route:        original.Route,
+		Price:        original.Price,
+		Currency:     original.Currency,
+		Units:        original.Units,
+		Width:        original.Width,
+		Height:       original.Height,
+		Weight:       original.Weight,
+	}
+
+	t.enter_state(stub, &clone, STATE_SALESCONTRACT, caller, now)
+
+	err = t.validate_new_product(clone)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.save_changes(stub, clone)
+
+	if err != nil {
+		t.audit(stub, "CLONE_PRODUCT: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	err = t.add_to_index(stub, productId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(clone.ProductID), nil
+}
+
+//=================================================================================================================================
+//	 Transfer Functions
+//=================================================================================================================================
+//	 bank_issue_accreditive - A seller bank issues a letter of credit for the product. The value passed is a JSON
+//							  object with the amount in minor units and the currency of the credit, e.g.
+//							  {"amount":100000,"currency":"EUR"}, with an optional expiry.
+//							  The credit is stored as an accreditive of its own covering the product, which then
+//							  waits for the buyer's bank to check it.
+//=================================================================================================================================
+func (t *SimpleChaincode) bank_issue_accreditive(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	var credit Accreditive
+
+	err := json.Unmarshal([]byte(new_value), &credit)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid accreditive JSON")
+	}
+
+	if credit.Amount <= 0 || !t.is_valid_currency(credit.Currency) {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Accreditive needs a positive amount and a valid currency")
+	}
+
+	if (product.State == STATE_SALESCONTRACT || product.State == STATE_ACCREDITIVE)        &&
+		caller_affiliation == SELLER_BANK {
+
+		now, err := t.get_tx_time(stub)
+
+		if err != nil {
+			return nil, err
+		}
+
+		current, err := t.product_accreditive(stub, product)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if t.accreditive_active(current, now) {
+			return nil, t.fail(ERR_INVALID_STATE, "Product already has an active accreditive, withdraw it first")
+		}
+
+		if credit.Expiry != 0 && credit.Expiry <= now {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "Accreditive expiry must be in the future")
+		}
+
+		credit = Accreditive{
+			AccreditiveID: "LC" + stub.GetTxID(),
+			ProductIDs:    []string{product.ProductID},
+			IssuingBank:   caller,
+			Beneficiary:   product.Manufacturer,
+			Amount:        credit.Amount,
+			Currency:      credit.Currency,
+			IssuedAt:      now,
+			Expiry:        credit.Expiry,
+		}
+
+		err = t.link_accreditive(stub, &product, credit)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = t.record_transition(stub, &product, "transfer", caller, product.Owner, STATE_CHECK_ACCREDITIVE)
+
+		if err != nil {
+			return nil, err
+		}
+
+	} else {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "BANK_ISSUE_ACCREDITIVE: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 check_accreditive - The buyer's bank confirms the letter of credit covers the price of the product, converting the
+//						 credit into the product's currency when they differ. Manufacturing can start once it does,
+//						 and the manufacturer can draw on the confirmed credit. When the sales contract names the
+//						 buyer's bank only that bank checks the credit.
+//=================================================================================================================================
+func (t *SimpleChaincode) check_accreditive(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	buyer_bank := t.buyer_bank(product)
+
+	if product.State != STATE_CHECK_ACCREDITIVE                ||
+		caller_affiliation != BUYER_BANK                        ||
+		(buyer_bank != "" && buyer_bank != caller) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	credit, err := t.product_accreditive(stub, product)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if credit == nil {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	err = t.check_coverage(stub, *credit, product)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !t.accreditive_active(credit, now) {
+		return nil, t.fail(ERR_INVALID_STATE, "Accreditive has expired")
+	}
+
+	credit.ConfirmedBy = caller
+
+	err = t.link_accreditive(stub, &product, *credit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.record_transition(stub, &product, "transfer", caller, product.Owner, STATE_MANUFACTURE)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "CHECK_ACCREDITIVE: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 withdraw_accreditive - The issuing bank withdraws its letter of credit before the buyer's bank has accepted it.
+//							This is the only way to replace an active accreditive. The product goes back to
+//							STATE_ACCREDITIVE.
+//=================================================================================================================================
+func (t *SimpleChaincode) withdraw_accreditive(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	credit, err := t.product_accreditive(stub, product)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if (product.State != STATE_ACCREDITIVE && product.State != STATE_CHECK_ACCREDITIVE)        ||
+		caller_affiliation != SELLER_BANK                                                        ||
+		credit == nil                                                                                ||
+		credit.IssuingBank != caller {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if credit.Withdrawn {
+		return nil, t.fail(ERR_INVALID_STATE, "Accreditive is already withdrawn")
+	}
+
+	credit.Withdrawn = true
+
+	err = t.link_accreditive(stub, &product, *credit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.record_transition(stub, &product, "withdraw", caller, product.Owner, STATE_ACCREDITIVE)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "WITHDRAW_ACCREDITIVE: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 reissue_accreditive - The issuing bank replaces its active accreditive with one for a new amount, e.g. after the
+//						   price was corrected. The value is {"amount":...,"currency":...,"expiry":...}; the currency
+//						   and expiry default to those of the old credit, other fields are ignored. The new credit has
+//						   to be confirmed again. The old credit is withdrawn and kept under its own id, and both
+//						   the withdrawal and the new issue are recorded in the owner history. A product has no
+//						   quantity, so the new amount has to cover the price.
+//=================================================================================================================================
+func (t *SimpleChaincode) reissue_accreditive(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	old, err := t.product_accreditive(stub, product)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if (product.State != STATE_ACCREDITIVE && product.State != STATE_CHECK_ACCREDITIVE)        ||
+		caller_affiliation != SELLER_BANK                                                        ||
+		!t.accreditive_active(old, now)                                                                ||
+		old.IssuingBank != caller {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	reissued := struct {
+		Amount   Money  `json:"amount"`
+		Currency string `json:"currency"`
+		Expiry   int64  `json:"expiry"`
+	}{Currency: old.Currency, Expiry: old.Expiry}
+
+	err = json.Unmarshal([]byte(new_value), &reissued)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid accreditive JSON")
+	}
+
+	credit := Accreditive{
+		AccreditiveID: "LC" + stub.GetTxID(),
+		ProductIDs:    []string{product.ProductID},
+		IssuingBank:   old.IssuingBank,
+		Beneficiary:   old.Beneficiary,
+		Amount:        reissued.Amount,
+		Currency:      reissued.Currency,
+		Expiry:        reissued.Expiry,
+	}
+
+	if credit.Amount <= 0 || !t.is_valid_currency(credit.Currency) {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Accreditive needs a positive amount and a valid currency")
+	}
+
+	if credit.Expiry != 0 && credit.Expiry <= now {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Accreditive expiry must be in the future")
+	}
+
+	err = t.check_coverage(stub, credit, product)
+
+	if err != nil {
+		return nil, err
+	}
+
+	old.Withdrawn = true
+
+	err = t.save_accreditive(stub, *old)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.record_transition(stub, &product, "withdraw", caller, product.Owner, STATE_ACCREDITIVE)
+
+	if err != nil {
+		return nil, err
+	}
+
+	credit.IssuedAt = now
+
+	err = t.link_accreditive(stub, &product, credit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.record_transition(stub, &product, "transfer", caller, product.Owner, STATE_CHECK_ACCREDITIVE)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "REISSUE_ACCREDITIVE: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 reject_accreditive - The buyer's bank turns down a letter of credit it finds non-compliant. The reason is kept on
+//						  the accreditive and the product goes back to STATE_ACCREDITIVE so the issuing bank can
+//						  issue a new one. Like check_accreditive, only the buyer's bank named in the sales contract
+//						  may reject it when one is named.
+//=================================================================================================================================
+func (t *SimpleChaincode) reject_accreditive(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, reason string) ([]byte, error) {
+
+	credit, err := t.product_accreditive(stub, product)
+
+	if err != nil {
+		return nil, err
+	}
+
+	buyer_bank := t.buyer_bank(product)
+
+	if product.State != STATE_CHECK_ACCREDITIVE                ||
+		caller_affiliation != BUYER_BANK                        ||
+		(buyer_bank != "" && buyer_bank != caller)        ||
+		credit == nil {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if strings.TrimSpace(reason) == "" {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "A reason is required to reject an accreditive")
+	}
+
+	credit.Rejected = true
+	credit.RejectedBy = caller
+	credit.Reason = reason
+
+	err = t.link_accreditive(stub, &product, *credit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.record_transition(stub, &product, "reject", caller, product.Owner, STATE_ACCREDITIVE)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "REJECT_ACCREDITIVE: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 start_shipping - Hands a manufactured product to a shipper. The shipper only takes custody of the product, legal
+//					  ownership stays with the current owner. The shipping cost can be passed as an optional third
+//					  argument, otherwise it is worked out from the weight when a rate per kg is configured.
+//					  Also invoked as manufacturer_to_shipper, in line with the naming of the other transfers.
+//=================================================================================================================================
+func (t *SimpleChaincode) start_shipping(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int, shipping_cost string) ([]byte, error) {
+
+	if product.State == STATE_MANUFACTURE        &&
+		product.Owner == caller                        &&
+		caller_affiliation == SELLER                &&
+		recipient_affiliation == SHIPPER {
+
+		if shipping_cost != "" {
+
+			cost, err := t.parse_money(shipping_cost, product.Currency)
+
+			if err != nil || cost < 0 {
+				return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid shipping cost " + shipping_cost)
+			}
+
+			product.ShippingCost = cost
+
+		} else {
+
+			config, err := t.get_config(stub)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if config.RatePerKg > 0 {
+
+				cost, err := t.estimate_shipping_cost(config, product)
+
+				if err != nil {
+					return nil, err
+				}
+
+				product.ShippingCost = t.from_major(cost, product.Currency)
+			}
+		}
+
+		err := t.record_custody(stub, &product, recipient_name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = t.record_transition(stub, &product, "transfer", caller, product.Owner, STATE_SHIPPING)
+
+		if err != nil {
+			return nil, err
+		}
+
+	} else {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	_, err := t.save_transfer(stub, product)
+
+	if err != nil {
+		t.audit(stub, "START_SHIPPING: Error saving changes: %s", err); return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 reassign_shipper - Lets the owner move a product that is being shipped to a different shipper.
+//=================================================================================================================================
+func (t *SimpleChaincode) reassign_shipper(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+
+	if product.State == STATE_SHIPPING        &&
+		product.Owner == caller                        &&
+		recipient_affiliation == SHIPPER        &&
+		product.Custodian != recipient_name {
+
+		err := t.record_custody(stub, &product, recipient_name)
+
+		if err != nil {
+			return nil, err
+		}
+
+	} else {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	_, err := t.save_transfer(stub, product)
+
+	if err != nil {
+		t.audit(stub, "REASSIGN_SHIPPER: Error saving changes: %s", err); return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 hand_over - Called by the shipper holding the product when it has been handed to the buyer, invoked as
+//				 shipper_to_buyer. Custody passes to the buyer and the DELIVERED milestone is recorded unless the
+//				 shipper already did. The product stays in shipping until the buyer confirms the delivery with
+//				 confirm_delivery. The product can only go to its buyer, or if a bill of lading was issued for it to
+//				 the holder who surrendered the bill.
+//=================================================================================================================================
+func (t *SimpleChaincode) hand_over(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+
+	if product.State == STATE_SHIPPING        &&
+		product.Custodian == caller                &&
+		caller_affiliation == SHIPPER                &&
+		recipient_affiliation == BUYER {
+
+		if product.BillOfLading != "" {
+
+			bill, err := t.retrieve_bill_of_lading(stub, product.BillOfLading)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if !bill.Surrendered || bill.Holder != recipient_name {
+				return nil, t.fail(ERR_INVALID_STATE, "The goods are only released to the holder surrendering bill of lading " + bill.BillID)
+			}
+		} else if recipient_name != product.Buyer {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "Product " + product.ProductID + " can only be handed over to its buyer " + product.Buyer)
+		}
+
+		err := t.record_custody(stub, &product, recipient_name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !t.milestone_reached(product, "DELIVERED") {
+
+			err = t.record_milestone(stub, &product, "DELIVERED", caller)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+	} else {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	_, err := t.save_transfer(stub, product)
+
+	if err != nil {
+		t.audit(stub, "HAND_OVER: Error saving changes: %s", err); return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 set_thresholds - The owner of a product sets the range each sensor type must stay within and the devices that
+//					  report it. The value is a JSON object mapping sensor types to thresholds, e.g.
+//					  {"temperature":{"min":2,"max":8,"devices":["sensor@Org1MSP"]}}, and replaces the thresholds
+//					  set before. Each device must be registered as PRODUCT. Readings already recorded aren't
+//					  checked again.
+//=================================================================================================================================
+func (t *SimpleChaincode) set_thresholds(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	if product.Owner != caller || product.State == STATE_SCRAPPED {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	var thresholds map[string]Threshold
+
+	err := json.Unmarshal([]byte(new_value), &thresholds)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "SET_THRESHOLDS: Invalid thresholds JSON")
+	}
+
+	for sensor, threshold := range thresholds {
+
+		if threshold.Min != nil && threshold.Max != nil && *threshold.Min > *threshold.Max {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "SET_THRESHOLDS: Minimum of " + sensor + " is above its maximum")
+		}
+
+		for _, device := range threshold.Devices {
+
+			participant, found, err := t.load_participant(stub, device)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if !found || participant.Revoked || participant.Role != PRODUCT {
+				return nil, t.fail(ERR_VALIDATION_FAILED, "SET_THRESHOLDS: " + device + " is not a registered device")
+			}
+		}
+	}
+
+	old_value := product.Thresholds
+	product.Thresholds = thresholds
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "SET_THRESHOLDS: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	err = t.emitFieldUpdate(stub, product.ProductID, "thresholds", old_value, product.Thresholds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 add_milestone - The shipper holding a product in shipping records a milestone of the shipment, passed as the value.
+//					 The milestone is located at the last position reported with update_location.
+//=================================================================================================================================
+func (t *SimpleChaincode) add_milestone(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, milestone string) ([]byte, error) {
+
+	if product.State != STATE_SHIPPING        ||
+		product.Custodian != caller                ||
+		caller_affiliation != SHIPPER {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	err := t.record_milestone(stub, &product, strings.ToUpper(strings.TrimSpace(milestone)), caller)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "ADD_MILESTONE: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 confirm_delivery - The buyer attests that it received a product the shipper handed over. Args are the product id
+//						and optionally the SHA-256 hash of a signed delivery receipt. Only the buyer of the product may
+//						confirm, or the holder of its bill of lading the shipper handed it to. The delivery time, the fingerprint
+//						of the buyer's certificate and the receipt hash are kept as proof of delivery, and only then does
+//						the product move on to payment.
+//=================================================================================================================================
+func (t *SimpleChaincode) confirm_delivery(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 1 && len(args) != 2 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "CONFIRM_DELIVERY: Incorrect number of arguments passed")
+	}
+
+	product, err := t.retrieve_product(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if product.Hold != nil {
+		return nil, t.hold_error(product)
+	}
+
+	if product.State != STATE_SHIPPING                                ||
+		product.Custodian != caller                                        ||
+		caller_affiliation != BUYER                                        ||
+		(product.BillOfLading == "" && caller != product.Buyer) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	receipt := ""
+
+	if len(args) == 2 {
+
+		receipt = strings.ToLower(strings.TrimSpace(args[1]))
+
+		if !HASH_PATTERN.MatchString(receipt) {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "CONFIRM_DELIVERY: The receipt hash must be a hex encoded SHA-256 hash")
+		}
+	}
+
+	fingerprint, err := t.get_cert_fingerprint(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	product.Delivery = &ProofOfDelivery{Recipient: caller, DeliveredAt: now, CertFingerprint: fingerprint, ReceiptHash: receipt}
+
+	err = t.record_transition(stub, &product, "transfer", caller, product.Owner, STATE_PAYMENT)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.save_transfer(stub, product)
+
+	if err != nil {
+		t.audit(stub, "CONFIRM_DELIVERY: Error saving changes: %s", err); return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 pay_partial - The buyer's bank pays part of the price of a delivered product. The amount is in the currency of the
+//				   product. See settle_payment.
+//=================================================================================================================================
+func (t *SimpleChaincode) pay_partial(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	amount, err := t.parse_money(new_value, product.Currency)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid amount " + new_value)
+	}
+
+	return t.settle_payment(stub, product, caller, caller_affiliation, amount)
+}
+
+//=================================================================================================================================
+//	 settle_payment - Records a payment from the buyer's bank to the manufacturer. pay_partial pays part of the price,
+//					  pay_full (or release_payment, its name before partial payments) pays whatever is outstanding.
+//					  Once nothing is outstanding the payment counts as released and the buyer can accept the
+//					  product with put_in_use. When the sales contract names the buyer's bank only that bank pays.
+//=================================================================================================================================
+func (t *SimpleChaincode) settle_payment(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, amount Money) ([]byte, error) {
+
+	buyer_bank := t.buyer_bank(product)
+
+	if product.State != STATE_PAYMENT                        ||
+		caller_affiliation != BUYER_BANK                        ||
+		(buyer_bank != "" && buyer_bank != caller)        ||
+		product.PaymentReleased {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if amount <= 0 || amount > t.outstanding(product) {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Payment must be positive and no more than the outstanding amount")
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	product.Payments = append(product.Payments, Payment{
+		Amount:    amount,
+		Currency:  product.Currency,
+		Payer:     caller,
+		Payee:     product.Manufacturer,
+		Timestamp: now,
+	})
+
+	if t.outstanding(product) == 0 {
+		product.PaymentReleased = true
+	}
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "SETTLE_PAYMENT: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 put_in_use - The buyer formally accepts a paid for product, becoming its owner.
+//=================================================================================================================================
+func (t *SimpleChaincode) put_in_use(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	if product.State != STATE_PAYMENT        ||
+		product.Buyer != caller                ||
+		caller_affiliation != BUYER {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if !product.PaymentReleased {
+		return nil, t.fail(ERR_INVALID_STATE, "Payment has not been released")
+	}
+
+	err := t.record_transition(stub, &product, "transfer", caller, caller, STATE_INUSE)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.save_transfer(stub, product)
+
+	if err != nil {
+		t.audit(stub, "PUT_IN_USE: Error saving changes: %s", err); return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 confirm_deliveries - Hands several products over to one buyer in a single call. Args are a JSON array of product
+//						  ids and the buyer. Each product is handled on its own by hand_over, so
+//						  products not held by the caller fail without stopping the others. Like hand_over it only
+//						  passes custody: the buyer moves the products on to payment with accept_deliveries.
+//=================================================================================================================================
+func (t *SimpleChaincode) confirm_deliveries(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "CONFIRM_DELIVERIES: Incorrect number of arguments passed")
+	}
+
+	var productIds []string
+
+	err := json.Unmarshal([]byte(args[0]), &productIds)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "CONFIRM_DELIVERIES: Product ids must be a JSON array of strings")
+	}
+
+	err = t.check_recipient(stub, args[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	rec_affiliation, err := t.get_affiliation(stub, args[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	results := []BatchResult{}
+
+	for _, productId := range productIds {
+
+		result := BatchResult{ProductID: productId}
+		queued := t.queued_events(stub)
+
+		product, err := t.retrieve_product(stub, productId)
+
+		if err == nil && product.Locked {
+			err = t.fail(ERR_INVALID_STATE, "product is locked")
+		}
+
+		if err == nil && product.Recalled {
+			err = t.recall_error(product)
+		}
+
+		if err == nil && product.Hold != nil {
+			err = t.hold_error(product)
+		}
+
+		if err == nil {
+
+			var pending *TransferProposal
+
+			pending, err = t.retrieve_transfer_proposal(stub, productId)
+
+			if err == nil && t.transfer_pending(pending, now) {
+				err = t.fail(ERR_INVALID_STATE, "A transfer of product " + productId + " to " + pending.To + " is pending")
+			}
+		}
+
+		if err == nil {
+			_, err = t.hand_over(stub, product, caller, caller_affiliation, args[1], rec_affiliation)
+		}
+
+		if err != nil {
+			t.discard_events(stub, queued)
+			result.Error = t.batch_error(err)
+		} else {
+			result.Success = true
+		}
+
+		results = append(results, result)
+	}
+
+	bytes, err := json.Marshal(results)
+
+	if err != nil {
+		return nil, errors.New("CONFIRM_DELIVERIES: Error creating response")
+	}
+
+	return bytes, nil
+
+}
+
+//=================================================================================================================================
+//	 accept_deliveries - The buyer confirms the delivery of several products handed to it in a single call, moving each
+//						 from shipping to payment. Args are a JSON array of product ids. Each product is confirmed on its
+//						 own by confirm_delivery, without a receipt hash, so products that can't be confirmed fail
+//						 without stopping the others.
+//=================================================================================================================================
+func (t *SimpleChaincode) accept_deliveries(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ACCEPT_DELIVERIES: Incorrect number of arguments passed")
+	}
+
+	var productIds []string
+
+	err := json.Unmarshal([]byte(args[0]), &productIds)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ACCEPT_DELIVERIES: Product ids must be a JSON array of strings")
+	}
+
+	results := []BatchResult{}
+	seen := make(map[string]bool)
+
+	for _, productId := range productIds {
+
+		result := BatchResult{ProductID: productId}
+		queued := t.queued_events(stub)
+
+		if seen[productId] {                                                                        // A second confirmation would be based on the state before the first
+			err = t.fail(ERR_VALIDATION_FAILED, "product " + productId + " is listed twice")
+		} else {
+			seen[productId] = true
+			_, err = t.confirm_delivery(stub, caller, caller_affiliation, []string{productId})
+		}
+
+		if err != nil {
+			t.discard_events(stub, queued)
+			result.Error = t.batch_error(err)
+		} else {
+			result.Success = true
+		}
+
+		results = append(results, result)
+	}
+
+	bytes, err := json.Marshal(results)
+
+	if err != nil {
+		return nil, errors.New("ACCEPT_DELIVERIES: Error creating response")
+	}
+
+	return bytes, nil
+
+}
+
+//=================================================================================================================================
+//	 batch_error - The code and message of the error a product of a batch reporting partial results failed with.
+//=================================================================================================================================
+func (t *SimpleChaincode) batch_error(err error) (*BatchError) {
+
+	failure := t.classify(err)
+
+	return &BatchError{Code: failure.Code, Message: failure.Message}
+}
+
+//=================================================================================================================================
+//	 transfer_products_bulk - Applies one transfer to several products, e.g. a whole container handed to a shipper.
+//							  Args are a JSON array of product ids, the recipient and optionally the transfer function,
+//							  start_shipping by default. Every product goes through the same checks as a single
+//							  transfer and the first one that fails rejects the whole transaction, so either all
+//							  products move or none do.
+//=================================================================================================================================
+func (t *SimpleChaincode) transfer_products_bulk(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 2 && len(args) != 3 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "TRANSFER_PRODUCTS_BULK: Incorrect number of arguments passed")
+	}
+
+	var productIds []string
+
+	err := json.Unmarshal([]byte(args[0]), &productIds)
+
+	if err != nil || len(productIds) == 0 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "TRANSFER_PRODUCTS_BULK: Product ids must be a non-empty JSON array of strings")
+	}
+
+	function := "start_shipping"
+
+	if len(args) == 3 {
+		function = args[2]
+	}
+
+	if !PROPOSABLE_TRANSFERS[function] || function == "transfer_share" {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "TRANSFER_PRODUCTS_BULK: " + function + " can't be applied in bulk")
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+
+	for _, productId := range productIds {
+
+		if seen[productId] {                                                                        // A second write would be based on the state before the first
+			return nil, t.fail(ERR_VALIDATION_FAILED, "TRANSFER_PRODUCTS_BULK: Product " + productId + " is listed twice")
+		}
+
+		seen[productId] = true
+
+		product, err := t.retrieve_product(stub, productId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pending, err := t.retrieve_transfer_proposal(stub, productId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if t.transfer_pending(pending, now) {
+			return nil, t.fail(ERR_INVALID_STATE, "TRANSFER_PRODUCTS_BULK: A transfer of product " + productId + " to " + pending.To + " is pending")
+		}
+
+		_, err = t.transfer(stub, product, function, caller, caller_affiliation, []string{args[1], productId})
+
+		if err != nil {
+			return nil, t.wrap_error("TRANSFER_PRODUCTS_BULK: Product " + productId + ": ", err)
+		}
+	}
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 set_fx_rate - The regulator adds an entry to the exchange rate table. Args are the pair, e.g. "EUR/USD", the amount
+//				   of the second currency one unit of the first buys and optionally the unix time the rate applies
+//				   from, the time of the transaction by default. Setting a pair again for the same time corrects it.
+//				   Earlier entries stay in the table, so conversions at a past time keep using the rate then in effect.
+//=================================================================================================================================
+func (t *SimpleChaincode) set_fx_rate(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 2 && len(args) != 3 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "SET_FX_RATE: Incorrect number of arguments passed")
+	}
+
+	if caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	currencies := strings.Split(args[0], "/")
+
+	if len(currencies) != 2 || !t.is_valid_currency(currencies[0]) || !t.is_valid_currency(currencies[1]) || currencies[0] == currencies[1] {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "SET_FX_RATE: Invalid currency pair " + args[0])
+	}
+
+	rate, err := strconv.ParseFloat(args[1], 64)
+
+	if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "SET_FX_RATE: Invalid rate " + args[1] + ", must be greater than 0")
+	}
+
+	effective, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) == 3 {
+
+		effective, err = strconv.ParseInt(args[2], 10, 64)
+
+		if err != nil || effective < 0 {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "SET_FX_RATE: Invalid effective time " + args[2])
+		}
+	}
+
+	key, err := stub.CreateCompositeKey(FX_RATE_INDEX, []string{args[0], fmt.Sprintf("%019d", effective)})
+
+	if err != nil {
+		return nil, errors.New("SET_FX_RATE: Unable to create exchange rate key")
+	}
+
+	bytes, err := json.Marshal(FXRate{Pair: args[0], Rate: rate, EffectiveFrom: effective, SetBy: caller, TxID: stub.GetTxID()})
+
+	if err != nil {
+		return nil, errors.New("SET_FX_RATE: Error creating exchange rate record")
+	}
+
+	err = stub.PutState(key, bytes)
+
+	if err != nil {
+		return nil, errors.New("SET_FX_RATE: Error storing exchange rate")
+	}
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 record_telemetry - A sensor reports a reading for a product. Args are the product id, the sensor type, e.g.
+//						"temperature", the value and optionally the unix time of the reading, the time of the
+//						transaction by default. Readings come from the custodian of the product or from the devices the
+//						owner bound to the sensor type with set_thresholds. A reading outside the threshold the
+//						product has for the sensor type flags the product as breached and sends a threshold_breached
+//						event, even while the product is on hold.
+//=================================================================================================================================
+func (t *SimpleChaincode) record_telemetry(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 3 && len(args) != 4 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "RECORD_TELEMETRY: Incorrect number of arguments passed")
+	}
+
+	product, err := t.retrieve_product(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	sensor := strings.TrimSpace(args[1])
+
+	bound := false
+
+	for _, device := range product.Thresholds[sensor].Devices {
+		if device == caller {
+			bound = true
+		}
+	}
+
+	if caller != product.Custodian && (caller_affiliation != PRODUCT || !bound) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if product.State == STATE_SCRAPPED {
+		return nil, t.fail(ERR_INVALID_STATE, "Product " + product.ProductID + " is scrapped")
+	}
+
+	if sensor == "" {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "RECORD_TELEMETRY: Expecting a sensor type")
+	}
+
+	value, err := strconv.ParseFloat(args[2], 64)
+
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "RECORD_TELEMETRY: Invalid value " + args[2])
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := now
+
+	if len(args) == 4 {
+
+		timestamp, err = strconv.ParseInt(args[3], 10, 64)
+
+		if err != nil || timestamp < 0 || timestamp > now {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "RECORD_TELEMETRY: Invalid timestamp " + args[3])
+		}
+	}
+
+	reading := TelemetryReading{ProductID: product.ProductID, SensorType: sensor, Value: value, Timestamp: timestamp, RecordedBy: caller, TxID: stub.GetTxID()}
+
+	if threshold, ok := product.Thresholds[sensor]; ok {
+		reading.Breach = (threshold.Min != nil && value < *threshold.Min) || (threshold.Max != nil && value > *threshold.Max)
+	}
+
+	key, err := stub.CreateCompositeKey(TELEMETRY_INDEX, []string{product.ProductID, sensor, fmt.Sprintf("%019d", timestamp), reading.TxID})
+
+	if err != nil {
+		return nil, errors.New("RECORD_TELEMETRY: Unable to create telemetry key")
+	}
+
+	bytes, err := json.Marshal(reading)
+
+	if err != nil {
+		return nil, errors.New("RECORD_TELEMETRY: Error creating telemetry record")
+	}
+
+	err = stub.PutState(key, bytes)
+
+	if err != nil {
+		return nil, errors.New("RECORD_TELEMETRY: Error storing telemetry record")
+	}
+
+	if !reading.Breach {
+		return nil, nil
+	}
+
+	product.Breached = true
+	product.Breaches = append(product.Breaches, reading)
+
+	_, err = t.write_product(stub, product)                                                          // A hold doesn't stop a breach being flagged
+
+	if err != nil {
+		t.audit(stub, "RECORD_TELEMETRY: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	t.emit(stub, "threshold_breached", bytes)
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 open_accreditive - The issuing bank opens a letter of credit. The arg is
+//						{"beneficiary":...,"amount":...,"currency":...,"expiry":...,"productIds":[...]} where expiry
+//						is optional. The amount must cover the prices of the products, see check_coverage. The id of
+//						the new accreditive, derived from the transaction id, is returned.
+//=================================================================================================================================
+func (t *SimpleChaincode) open_accreditive(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "OPEN_ACCREDITIVE: Incorrect number of arguments passed")
+	}
+
+	if caller_affiliation != SELLER_BANK {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	var credit Accreditive
+
+	err := json.Unmarshal([]byte(args[0]), &credit)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid accreditive JSON")
+	}
+
+	if credit.Amount <= 0 || !t.is_valid_currency(credit.Currency) {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Accreditive needs a positive amount and a valid currency")
+	}
+
+	err = t.check_recipient(stub, credit.Beneficiary)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if credit.Expiry != 0 && credit.Expiry <= now {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Accreditive expiry must be in the future")
+	}
+
+	var products []Product
+
+	for _, pid := range credit.ProductIDs {
+
+		p, err := t.retrieve_product(stub, pid)
+
+		if err != nil {
+			return nil, err
+		}
+
+		products = append(products, p)
+	}
+
+	err = t.check_coverage(stub, credit, products...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	credit = Accreditive{
+		AccreditiveID: "LC" + stub.GetTxID(),
+		ProductIDs:    credit.ProductIDs,
+		IssuingBank:   caller,
+		Beneficiary:   credit.Beneficiary,
+		Amount:        credit.Amount,
+		Currency:      credit.Currency,
+		IssuedAt:      now,
+		Expiry:        credit.Expiry,
+	}
+
+	err = t.save_accreditive(stub, credit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(credit.AccreditiveID), nil
+}
+
+//=================================================================================================================================
+//	 confirm_accreditive - The buyer's bank confirms an open accreditive, after which the beneficiary may draw on it.
+//						   Products whose sales contract names the buyer's bank can only be covered by that bank.
+//=================================================================================================================================
+func (t *SimpleChaincode) confirm_accreditive(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "CONFIRM_ACCREDITIVE: Incorrect number of arguments passed")
+	}
+
+	credit, err := t.retrieve_accreditive(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if caller_affiliation != BUYER_BANK || !t.accreditive_active(&credit, now) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	for _, pid := range credit.ProductIDs {
+
+		p, err := t.retrieve_product(stub, pid)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if buyer_bank := t.buyer_bank(p); buyer_bank != "" && buyer_bank != caller {
+			return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+		}
+	}
+
+	if credit.ConfirmedBy != "" {
+		return nil, t.fail(ERR_INVALID_STATE, "Accreditive is already confirmed")
+	}
+
+	credit.ConfirmedBy = caller
+
+	err = t.save_accreditive(stub, credit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 amend_accreditive - The issuing bank changes the amount or expiry of its accreditive. The arg is
+//						 {"amount":...,"expiry":...}; fields left out keep their value. The amount can't drop below
+//						 what has been drawn or the prices of the products covered, and an amended accreditive has
+//						 to be confirmed again.
+//=================================================================================================================================
+func (t *SimpleChaincode) amend_accreditive(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "AMEND_ACCREDITIVE: Incorrect number of arguments passed")
+	}
+
+	credit, err := t.retrieve_accreditive(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if caller_affiliation != SELLER_BANK || credit.IssuingBank != caller || !t.accreditive_active(&credit, now) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	amended := credit
+
+	err = json.Unmarshal([]byte(args[1]), &amended)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid amendment JSON")
+	}
+
+	if amended.Amount <= 0 || amended.Amount < credit.Drawn {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Amended amount must be positive and cover what has been drawn")
+	}
+
+	if amended.Expiry != 0 && amended.Expiry <= now {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Accreditive expiry must be in the future")
+	}
+
+	credit.Amount = amended.Amount
+	credit.Expiry = amended.Expiry
+	credit.ConfirmedBy = ""
+
+	var products []Product
+
+	for _, pid := range credit.ProductIDs {
+
+		p, err := t.retrieve_product(stub, pid)
+
+		if err != nil {
+			return nil, err
+		}
+
+		products = append(products, p)
+	}
+
+	err = t.check_coverage(stub, credit, products...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.save_accreditive(stub, credit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 draw_accreditive - The beneficiary draws an amount from a confirmed accreditive. Args are the accreditive id and
+//						the amount, which can't exceed what is left.
+//=================================================================================================================================
+func (t *SimpleChaincode) draw_accreditive(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "DRAW_ACCREDITIVE: Incorrect number of arguments passed")
+	}
+
+	credit, err := t.retrieve_accreditive(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if credit.Beneficiary != caller || credit.ConfirmedBy == "" || !t.accreditive_active(&credit, now) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	amount, err := t.parse_money(args[1], credit.Currency)
+
+	if err != nil || amount <= 0 || amount > credit.Amount - credit.Drawn {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid amount " + args[1])
+	}
+
+	credit.Drawn += amount
+
+	err = t.save_accreditive(stub, credit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 Bills of lading - Documents against payment: the shipper issues a bill of lading for the goods it carries to a
+//					   consignee, usually the seller or its bank, which endorses it on to the buyer once payment is
+//					   secured. The goods are only handed over to the holder who surrenders the bill to the shipper.
+//=================================================================================================================================
+//	 issue_bill_of_lading - The shipper holding a product in shipping issues a bill of lading for it. Args are the
+//							product id and the consignee, who becomes the first holder. A product has one bill of
+//							lading. Returns the id of the bill.
+//=================================================================================================================================
+func (t *SimpleChaincode) issue_bill_of_lading(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ISSUE_BILL_OF_LADING: Incorrect number of arguments passed")
+	}
+
+	product, err := t.retrieve_product(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if product.State != STATE_SHIPPING        ||
+		product.Custodian != caller                ||
+		caller_affiliation != SHIPPER {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if product.BillOfLading != "" {
+		return nil, t.fail(ERR_INVALID_STATE, "Bill of lading " + product.BillOfLading + " was already issued for product " + product.ProductID)
+	}
+
+	err = t.check_recipient(stub, args[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bill := BillOfLading{
+		BillID:    "BL" + stub.GetTxID(),
+		ProductID: product.ProductID,
+		Shipper:   caller,
+		Consignee: args[1],
+		Holder:    args[1],
+		IssuedAt:  now,
+	}
+
+	product.BillOfLading = bill.BillID
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "ISSUE_BILL_OF_LADING: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	err = t.save_bill_of_lading(stub, bill)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(bill.BillID), nil
+}
+
+//=================================================================================================================================
+//	 endorse_bill_of_lading - The holder of a bill of lading endorses it to someone else, who becomes the holder. Args
+//							  are the bill id and the endorsee.
+//=================================================================================================================================
+func (t *SimpleChaincode) endorse_bill_of_lading(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ENDORSE_BILL_OF_LADING: Incorrect number of arguments passed")
+	}
+
+	bill, err := t.retrieve_bill_of_lading(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if bill.Holder != caller {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if bill.Surrendered {
+		return nil, t.fail(ERR_INVALID_STATE, "Bill of lading " + bill.BillID + " has been surrendered")
+	}
+
+	if args[1] == caller {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ENDORSE_BILL_OF_LADING: Can't endorse a bill of lading to yourself")
+	}
+
+	err = t.check_recipient(stub, args[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bill.Endorsements = append(bill.Endorsements, Endorsement{From: caller, To: args[1], Timestamp: now})
+	bill.Holder = args[1]
+
+	err = t.save_bill_of_lading(stub, bill)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 surrender_bill_of_lading - The holder surrenders a bill of lading to the shipper to claim the goods, after which
+//								the shipper may hand the product over to them. A surrendered bill can't be endorsed.
+//=================================================================================================================================
+func (t *SimpleChaincode) surrender_bill_of_lading(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "SURRENDER_BILL_OF_LADING: Incorrect number of arguments passed")
+	}
+
+	bill, err := t.retrieve_bill_of_lading(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if bill.Holder != caller {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if bill.Surrendered {
+		return nil, t.fail(ERR_INVALID_STATE, "Bill of lading " + bill.BillID + " has already been surrendered")
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bill.Surrendered = true
+	bill.SurrenderedAt = now
+
+	err = t.save_bill_of_lading(stub, bill)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 execute_sales_contract - Executes a sales contract once both parties signed it. Args are the contract id, the hex
+//							  encoded SHA-256 hash of the contract document and the base64 encoded detached
+//							  signatures of the seller and the buyer over that hash. Each signature is verified
+//							  against the certificate the party is registered with. The hash must match the one on
+//							  the contract, or becomes it if the contract has none. Either party may submit.
+//=================================================================================================================================
+func (t *SimpleChaincode) execute_sales_contract(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 4 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "EXECUTE_SALES_CONTRACT: Incorrect number of arguments passed")
+	}
+
+	contract, err := t.retrieve_sales_contract(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if contract.Seller != caller && contract.Buyer != caller {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if contract.Status != CONTRACT_PENDING {
+		return nil, t.fail(ERR_INVALID_STATE, "Sales contract " + contract.ContractID + " is " + contract.Status)
+	}
+
+	hash := strings.ToLower(strings.TrimSpace(args[1]))
+
+	if !HASH_PATTERN.MatchString(hash) {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "EXECUTE_SALES_CONTRACT: The document hash must be a hex encoded SHA-256 hash")
+	}
+
+	if contract.DocumentHash != "" && contract.DocumentHash != hash {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "EXECUTE_SALES_CONTRACT: The document hash doesn't match sales contract " + contract.ContractID)
+	}
+
+	digest, _ := hex.DecodeString(hash)
+
+	signatures := map[string]string{contract.Seller: args[2], contract.Buyer: args[3]}
+
+	for _, party := range []string{contract.Seller, contract.Buyer} {
+
+		participant, found, err := t.load_participant(stub, party)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if !found || participant.Certificate == "" {
+			return nil, t.fail(ERR_INVALID_STATE, "EXECUTE_SALES_CONTRACT: No certificate is registered for " + party)
+		}
+
+		err = t.verify_signature(participant.Certificate, digest, signatures[party])
+
+		if err != nil {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "EXECUTE_SALES_CONTRACT: Signature of " + party + ": " + err.Error())
+		}
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	contract.DocumentHash = hash
+	contract.SellerSignature = args[2]
+	contract.BuyerSignature = args[3]
+	contract.Status = CONTRACT_EXECUTED
+	contract.ExecutedAt = now
+
+	err = t.save_sales_contract(stub, contract)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 issue_invoice - Bills a participant for a product. The arg is
+//					 {"debtor":...,"amount":...,"currency":...,"dueDate":...,"productId":...} with the amount in minor
+//					 units. The invoice is linked to the sales contract of the product, if it has one. The
+//					 manufacturer, the owner and anyone who had custody of the product may invoice for it. Returns the
+//					 id of the invoice.
+//=================================================================================================================================
+func (t *SimpleChaincode) issue_invoice(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ISSUE_INVOICE: Incorrect number of arguments passed")
+	}
+
+	var request Invoice
+
+	err := json.Unmarshal([]byte(args[0]), &request)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ISSUE_INVOICE: Invalid invoice JSON")
+	}
+
+	product, err := t.retrieve_product(stub, request.ProductID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	involved := product.Manufacturer == caller || product.Owner == caller
+
+	for _, entry := range product.CustodyHistory {
+		if entry.Custodian == caller {
+			involved = true
+		}
+	}
+
+	if !involved {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if request.Amount <= 0 || !t.is_valid_currency(request.Currency) {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ISSUE_INVOICE: Invoice needs a positive amount and a valid currency")
+	}
+
+	if request.Debtor == caller {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ISSUE_INVOICE: Can't invoice yourself")
+	}
+
+	err = t.check_recipient(stub, request.Debtor)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if request.DueDate <= now {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ISSUE_INVOICE: The due date must be in the future")
+	}
+
+	invoice := Invoice{
+		InvoiceID:  "IN" + stub.GetTxID(),
+		Issuer:     caller,
+		Debtor:     request.Debtor,
+		Amount:     request.Amount,
+		Currency:   request.Currency,
+		DueDate:    request.DueDate,
+		ProductID:  product.ProductID,
+		ContractID: product.SalesContract,
+		Status:     INVOICE_ISSUED,
+		IssuedAt:   now,
+	}
+
+	err = t.save_invoice(stub, invoice)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(invoice.InvoiceID), nil
+}
+
+//=================================================================================================================================
+//	 accept_invoice - The debtor accepts an issued invoice, acknowledging the debt.
+//=================================================================================================================================
+func (t *SimpleChaincode) accept_invoice(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ACCEPT_INVOICE: Incorrect number of arguments passed")
+	}
+
+	invoice, err := t.retrieve_invoice(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if invoice.Debtor != caller {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if invoice.Status != INVOICE_ISSUED {
+		return nil, t.fail(ERR_INVALID_STATE, "Invoice " + invoice.InvoiceID + " is " + invoice.Status)
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	invoice.Status = INVOICE_ACCEPTED
+	invoice.AcceptedAt = now
+
+	err = t.save_invoice(stub, invoice)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 mark_paid - Records that an accepted invoice has been paid. Called by the issuer once it received the money, or by
+//				 the bank paying for the product: the bank that issued its accreditive or the buyer's bank named in its
+//				 sales contract.
+//=================================================================================================================================
+func (t *SimpleChaincode) mark_paid(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "MARK_PAID: Incorrect number of arguments passed")
+	}
+
+	invoice, err := t.retrieve_invoice(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if invoice.Issuer != caller {
+
+		product, err := t.retrieve_product(stub, invoice.ProductID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		buyer_bank := t.buyer_bank(product)
+
+		if product.SalesContract != "" {
+
+			contract, err := t.retrieve_sales_contract(stub, product.SalesContract)
+
+			if err == nil {                                                                            // Peers outside the private collection don't hold it
+				buyer_bank = contract.BuyerBank
+			}
+		}
+
+		paying_bank := t.issuing_bank(product) == caller || (buyer_bank != "" && buyer_bank == caller)
+
+		if !paying_bank || (caller_affiliation != SELLER_BANK && caller_affiliation != BUYER_BANK) {
+			return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+		}
+	}
+
+	if invoice.Status != INVOICE_ACCEPTED {
+		return nil, t.fail(ERR_INVALID_STATE, "Invoice " + invoice.InvoiceID + " is " + invoice.Status)
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	invoice.Status = INVOICE_PAID
+	invoice.PaidAt = now
+	invoice.PaidBy = caller
+
+	err = t.save_invoice(stub, invoice)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 propose_transfer - Proposes a transfer instead of carrying it out. Args are the transfer function followed by its
+//						own args: the recipient, the product id and for some transfers a value. Nothing changes until
+//						the recipient calls accept_transfer, and other transfers of the product are refused meanwhile.
+//						Only the owner, the custodian or a shareholder may propose; the transfer function checks the
+//						rest when the proposal is accepted. An expired proposal is replaced by the next one.
+//=================================================================================================================================
+func (t *SimpleChaincode) propose_transfer(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) < 3 || len(args) > 4 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "PROPOSE_TRANSFER: Expecting a transfer function, a recipient, a product id and an optional value")
+	}
+
+	if !PROPOSABLE_TRANSFERS[args[0]] {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "PROPOSE_TRANSFER: " + args[0] + " can't be proposed")
+	}
+
+	product, err := t.retrieve_product(stub, args[2])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if product.Locked {
+		return nil, t.fail(ERR_INVALID_STATE, "product is locked")
+	}
+
+	if product.Hold != nil {
+		return nil, t.hold_error(product)
+	}
+
+	if product.Recalled && args[0] != "private_to_recycler" {
+		return nil, t.recall_error(product)
+	}
+
+	if caller != product.Owner && caller != product.Custodian && product.OwnershipShares[caller] <= 0 {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if args[1] == caller {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "PROPOSE_TRANSFER: Can't propose a transfer to yourself")
+	}
+
+	err = t.check_recipient(stub, args[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.get_affiliation(stub, args[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := t.retrieve_transfer_proposal(stub, product.ProductID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if t.transfer_pending(pending, now) {
+		return nil, t.fail(ERR_INVALID_STATE, "PROPOSE_TRANSFER: A transfer of product " + product.ProductID + " to " + pending.To + " is pending")
+	}
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	proposal := TransferProposal{ProductID: product.ProductID, Function: args[0], Args: args[1:], From: caller, To: args[1], Timestamp: now}
+
+	if config.TransferExpiry > 0 {
+		proposal.ExpiresAt = now + config.TransferExpiry
+	}
+
+	bytes, err := json.Marshal(proposal)
+
+	if err != nil {
+		return nil, errors.New("PROPOSE_TRANSFER: Error creating transfer proposal")
+	}
+
+	err = stub.PutState("transfer_" + product.ProductID, bytes)
+
+	if err != nil {
+		return nil, errors.New("PROPOSE_TRANSFER: Error storing transfer proposal")
+	}
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 accept_transfer - The recipient of a proposed transfer accepts it. The transfer is carried out as if the proposer
+//					   had called it now, so it fails if the proposer is no longer allowed to make it.
+//=================================================================================================================================
+func (t *SimpleChaincode) accept_transfer(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	pending, err := t.retrieve_transfer_proposal(stub, product.ProductID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if pending == nil {
+		return nil, t.fail(ERR_NOT_FOUND, "ACCEPT_TRANSFER: No transfer of product " + product.ProductID + " is pending")
+	}
+
+	if pending.To != caller {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !t.transfer_pending(pending, now) {
+		return nil, t.fail(ERR_INVALID_STATE, "ACCEPT_TRANSFER: The transfer of product " + product.ProductID + " has expired")
+	}
+
+	proposer_affiliation, err := t.get_affiliation(stub, pending.From)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.DelState("transfer_" + product.ProductID)
+
+	if err != nil {
+		return nil, errors.New("ACCEPT_TRANSFER: Error removing transfer proposal")
+	}
+
+	return t.transfer(stub, product, pending.Function, pending.From, proposer_affiliation, pending.Args)
+}
+
+//=================================================================================================================================
+//	 reject_transfer - The recipient of a proposed transfer turns it down. The product was left alone while the transfer
+//					   was pending, so removing the proposal is all it takes to restore it.
+//=================================================================================================================================
+func (t *SimpleChaincode) reject_transfer(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	pending, err := t.retrieve_transfer_proposal(stub, product.ProductID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if pending == nil {
+		return nil, t.fail(ERR_NOT_FOUND, "REJECT_TRANSFER: No transfer of product " + product.ProductID + " is pending")
+	}
+
+	if pending.To != caller {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	err = stub.DelState("transfer_" + product.ProductID)
+
+	if err != nil {
+		return nil, errors.New("REJECT_TRANSFER: Error removing transfer proposal")
+	}
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 cancel_transfer - The proposer withdraws a proposed transfer, expired or not.
+//=================================================================================================================================
+func (t *SimpleChaincode) cancel_transfer(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	pending, err := t.retrieve_transfer_proposal(stub, product.ProductID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if pending == nil {
+		return nil, t.fail(ERR_NOT_FOUND, "CANCEL_TRANSFER: No transfer of product " + product.ProductID + " is pending")
+	}
+
+	if pending.From != caller {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	err = stub.DelState("transfer_" + product.ProductID)
+
+	if err != nil {
+		return nil, errors.New("CANCEL_TRANSFER: Error removing transfer proposal")
+	}
+
+	return nil, nil
+}
+
+//=================================================================================================================================
+//	 swap_products - Exchanges two products in use between their owners. Args are the caller's product and the product
+//					 wanted in return. The first call records a proposal, the swap happens when the other owner makes
+//					 the matching call. Both products are checked again when the swap is carried out, and neither may
+//					 have a transfer to someone else pending.
+//=================================================================================================================================
+func (t *SimpleChaincode) swap_products(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 2 || args[0] == args[1] {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "SWAP_PRODUCTS: Expecting two different product ids")
+	}
+
+	mine, err := t.retrieve_product(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	theirs, err := t.retrieve_product(stub, args[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if mine.Owner != caller {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if mine.Owner == theirs.Owner {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "SWAP_PRODUCTS: Both products have the same owner")
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range []Product{mine, theirs} {
+		if p.Locked {
+			return nil, t.fail(ERR_INVALID_STATE, "product is locked")
+		}
+		if p.State != STATE_INUSE {
+			return nil, t.fail(ERR_INVALID_STATE, "SWAP_PRODUCTS: Product " + p.ProductID + " is not in use")
+		}
+		if p.Recalled {
+			return nil, t.recall_error(p)
+		}
+
+		pending, err := t.retrieve_transfer_proposal(stub, p.ProductID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if t.transfer_pending(pending, now) {
+			return nil, t.fail(ERR_INVALID_STATE, "SWAP_PRODUCTS: A transfer of product " + p.ProductID + " to " + pending.To + " is pending")
+		}
+	}
+
+	err = t.check_recipient(stub, theirs.Owner)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := stub.GetState("swap_" + theirs.ProductID + "_" + mine.ProductID)
+
+	if err != nil {
+		return nil, errors.New("SWAP_PRODUCTS: Unable to get swap proposal")
+	}
+
+	var proposal SwapProposal
+
+	if bytes != nil {
+		err = json.Unmarshal(bytes, &proposal)
+
+		if err != nil {
+			return nil, errors.New("SWAP_PRODUCTS: Corrupt swap proposal")
+		}
+	}
+
+	if bytes == nil || proposal.Proposer != theirs.Owner {
+
+		bytes, err = json.Marshal(SwapProposal{Proposer: caller, Offered: mine.ProductID, Requested: theirs.ProductID, Timestamp: now})
+
+		if err != nil {
+			return nil, errors.New("SWAP_PRODUCTS: Error creating swap proposal")
+		}
+
+		err = stub.PutState("swap_" + mine.ProductID + "_" + theirs.ProductID, bytes)
+
+		if err != nil {
+			return nil, errors.New("SWAP_PRODUCTS: Error storing swap proposal")
+		}
+
+		return nil, nil
+	}
+
+	previous_owner := mine.Owner
+
+	err = t.record_transition(stub, &mine, "swap", caller, theirs.Owner, STATE_INUSE)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.record_transition(stub, &theirs, "swap", caller, previous_owner, STATE_INUSE)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.save_transfer(stub, mine)
+
+	if err != nil {
+		t.audit(stub, "SWAP_PRODUCTS: Error saving changes: %s", err); return nil, err
+	}
+
+	_, err = t.save_transfer(stub, theirs)
+
+	if err != nil {
+		t.audit(stub, "SWAP_PRODUCTS: Error saving changes: %s", err); return nil, err
+	}
+
+	err = stub.DelState("swap_" + theirs.ProductID + "_" + mine.ProductID)
+
+	if err != nil {
+		return nil, errors.New("SWAP_PRODUCTS: Error removing swap proposal")
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 update_location - The shipper holding a product in shipping reports its position. The value is a JSON document
+//					   such as {"lat":53.55,"lon":9.99,"source":"tracker-17"}. recordedAt defaults to the transaction
+//					   time and may not be later than it. The position becomes the product's location and is added to
+//					   its location history.
+//=================================================================================================================================
+func (t *SimpleChaincode) update_location(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	if product.State != STATE_SHIPPING        ||
+		product.Custodian != caller                ||
+		caller_affiliation != SHIPPER {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	var location GeoLocation
+
+	err := json.Unmarshal([]byte(new_value), &location)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "UPDATE_LOCATION: Invalid location JSON")
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if location.RecordedAt == 0 {
+		location.RecordedAt = now
+	}
+
+	if location.RecordedAt > now {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "UPDATE_LOCATION: recordedAt may not be in the future")
+	}
+
+	old_value := product.Location
+	product.Location = &location
+	product.LocationHistory = append(product.LocationHistory, location)
+
+	if len(product.LocationHistory) > MAX_LOCATION_HISTORY {
+		product.LocationHistory = product.LocationHistory[len(product.LocationHistory) - MAX_LOCATION_HISTORY:]
+	}
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "UPDATE_LOCATION: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	err = t.emitFieldUpdate(stub, product.ProductID, "location", old_value, product.Location)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 update_batch - The manufacturer assigns a product to a manufacturing batch, which recalls may refer to. Only
+//					possible while the manufacturer still owns the product.
+//=================================================================================================================================
+func (t *SimpleChaincode) update_batch(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	if caller_affiliation != SELLER       ||
+		product.Manufacturer != caller       ||
+		product.Owner != caller {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	batch := strings.TrimSpace(new_value)
+
+	if batch == "" {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Batch may not be empty")
+	}
+
+	err := t.check_changed(product.Batch, batch)
+
+	if err != nil {
+		return nil, err
+	}
+
+	old_value := product.Batch
+	product.Batch = batch
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "UPDATE_BATCH: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	err = t.emitFieldUpdate(stub, product.ProductID, "batch", old_value, product.Batch)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 update_route - Sets the planned route of a product as a comma separated list of waypoints. See can_update_transit
+//					for who may do so.
+//=================================================================================================================================
+func (t *SimpleChaincode) update_route(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	if !t.can_update_transit(product, caller, caller_affiliation) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	waypoints := t.route_waypoints(new_value)
+
+	if len(waypoints) == 0 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Route must contain at least one waypoint")
+	}
+
+	err := t.check_changed(product.Route, strings.Join(waypoints, ","))
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.check_waypoints(stub, waypoints)
+
+	if err != nil {
+		return nil, err
+	}
+
+	old_value := product.Route
+	product.Route = strings.Join(waypoints, ",")
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "UPDATE_ROUTE: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	err = t.emitFieldUpdate(stub, product.ProductID, "route", old_value, product.Route)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 set_checksum - Sets the checksum identifying the physical product. A manufacturer can't use the same checksum for
+//					two products, which catches the same goods being entered twice. The pairs in use are indexed
+//					under the composite key checksum~manufacturer~checksum, see checksum_key.
+//=================================================================================================================================
+func (t *SimpleChaincode) set_checksum(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	if !t.can_update_manufacture(product, caller, caller_affiliation) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	checksum := strings.TrimSpace(new_value)
+
+	if checksum == "" || checksum == "UNDEFINED" {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid checksum")
+	}
+
+	err := t.check_changed(product.CheckID, checksum)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := t.checksum_key(stub, product.Manufacturer, checksum)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := stub.GetState(key)
+
+	if err != nil {
+		return nil, errors.New("Unable to get checksum index")
+	}
+
+	if bytes != nil && string(bytes) != product.ProductID {
+		return nil, t.fail(ERR_INVALID_STATE, "Checksum " + checksum + " is already used by product " + string(bytes))
+	}
+
+	if product.CheckID != "" && product.CheckID != "UNDEFINED" {
+
+		old_key, err := t.checksum_key(stub, product.Manufacturer, product.CheckID)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = stub.DelState(old_key)
+
+		if err != nil {
+			return nil, errors.New("Error removing old checksum")
+		}
+	}
+
+	err = stub.PutState(key, []byte(product.ProductID))
+
+	if err != nil {
+		return nil, errors.New("Error storing checksum index")
+	}
+
+	old_value := product.CheckID
+	product.CheckID = checksum
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "SET_CHECKSUM: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	err = t.emitFieldUpdate(stub, product.ProductID, "checksum", old_value, product.CheckID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 update_price - Lets the manufacturer correct the price of a product before manufacturing starts. Like create_product
+//					it takes the price from the transient field "terms" when none is passed. With a private collection
+//					configured the field_updated event leaves out the old and new price, as it goes to every listener.
+//=================================================================================================================================
+func (t *SimpleChaincode) update_price(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	var value Money
+	var err error
+
+	if new_value == "" {
+
+		terms, err := t.transient_terms(stub)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if terms.Currency != "" && terms.Currency != product.Currency {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "The price must be in the currency of the product, " + product.Currency)
+		}
+
+		value = terms.Price
+		new_value = t.format_money(terms.Price, product.Currency)
+	} else {
+		value, err = t.parse_money(new_value, product.Currency)
+	}
+
+	if err != nil || value <= 0 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid price " + new_value + ", must be greater than 0")
+	}
+
+	if !t.can_update_manufacture(product, caller, caller_affiliation) ||
+		product.State >= STATE_MANUFACTURE {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	err = t.check_changed(product.Price, value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	old_value := product.Price
+	product.Price = value
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "UPDATE_PRICE: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if config.PrivateCollection != "" {
+		err = t.emitFieldUpdate(stub, product.ProductID, "price", nil, nil)
+	} else {
+		err = t.emitFieldUpdate(stub, product.ProductID, "price", old_value, product.Price)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 update_width
+//=================================================================================================================================
+func (t *SimpleChaincode) update_width(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	value, err := t.parse_dimension(new_value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !t.can_update_manufacture(product, caller, caller_affiliation) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	err = t.check_changed(product.Width, value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	old_value := product.Width
+	product.Width = value
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "UPDATE_WIDTH: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	err = t.emitFieldUpdate(stub, product.ProductID, "width", old_value, product.Width)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 update_height
+//=================================================================================================================================
+func (t *SimpleChaincode) update_height(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	value, err := t.parse_dimension(new_value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !t.can_update_manufacture(product, caller, caller_affiliation) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	err = t.check_changed(product.Height, value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	old_value := product.Height
+	product.Height = value
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "UPDATE_HEIGHT: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	err = t.emitFieldUpdate(stub, product.ProductID, "height", old_value, product.Height)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 update_weight
+//=================================================================================================================================
+func (t *SimpleChaincode) update_weight(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	value, err := t.parse_dimension(new_value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !t.can_update_manufacture(product, caller, caller_affiliation) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	err = t.check_changed(product.Weight, value)
+
+	if err != nil {
+		return nil, err
+	}
+
+	old_value := product.Weight
+	product.Weight = value
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "UPDATE_WEIGHT: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	err = t.emitFieldUpdate(stub, product.ProductID, "weight", old_value, product.Weight)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 private_to_recycler - The owner of a product in use hands it over to a recycler for scrapping. The recycler becomes
+//						   owner and custodian, and scraps the product with confirm_scrapped.
+//=================================================================================================================================
+func (t *SimpleChaincode) private_to_recycler(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+
+	if product.State == STATE_INUSE        &&
+		product.Owner == caller                &&
+		caller_affiliation != RECYCLER        &&
+		recipient_affiliation == RECYCLER {
+
+		err := t.record_custody(stub, &product, recipient_name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = t.record_transition(stub, &product, "transfer", caller, recipient_name, STATE_INUSE)
+
+		if err != nil {
+			return nil, err
+		}
+
+	} else {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	_, err := t.save_transfer(stub, product)
+
+	if err != nil {
+		t.audit(stub, "PRIVATE_TO_RECYCLER: Error saving changes: %s", err); return nil, err
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 confirm_scrapped - The recycler owning a product confirms it has been destroyed, passing the reference of the
+//						certificate of destruction as the value. The certificate is kept on the product, which is
+//						scrapped.
+//=================================================================================================================================
+func (t *SimpleChaincode) confirm_scrapped(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, certificate string) ([]byte, error) {
+
+	if product.State != STATE_INUSE        ||
+		product.Owner != caller                ||
+		caller_affiliation != RECYCLER {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if strings.TrimSpace(certificate) == "" {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "CONFIRM_SCRAPPED: Expecting the reference of the certificate of destruction")
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	product.Destruction = &DestructionCertificate{Reference: certificate, Recycler: caller, IssuedAt: now}
+
+	err = t.record_transition(stub, &product, "scrap", caller, product.Owner, STATE_SCRAPPED)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "CONFIRM_SCRAPPED: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 scrap_product - Approves scrapping a product in use. The owner and the regulator may approve, each only once, and
+//					 the product is scrapped when the number of approvals configured at Init is reached. With the
+//					 default of one approval the first call scraps it.
+//=================================================================================================================================
+func (t *SimpleChaincode) scrap_product(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	if product.State != STATE_INUSE        ||
+		(product.Owner != caller && caller_affiliation != GOVERNMENT) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if product.Locked {
+		return nil, t.fail(ERR_INVALID_STATE, "product is locked")
+	}
+
+	for _, approver := range product.ScrapApprovals {
+		if approver == caller {
+			return nil, t.fail(ERR_INVALID_STATE, caller + " has already approved scrapping this product")
+		}
+	}
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	required := config.ScrapApprovals
+
+	if required == 0 {
+		required = 1
+	}
+
+	product.ScrapApprovals = append(product.ScrapApprovals, caller)
+
+	if len(product.ScrapApprovals) >= required {
+
+		err = t.record_transition(stub, &product, "scrap", caller, product.Owner, STATE_SCRAPPED)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "SCRAP_PRODUCT: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 revert_last_transition - Emergency undo for the regulator. Restores the owner and state the product had before its
+//							  most recent transition that has not already been reverted. Scrapped products are final.
+//=================================================================================================================================
+func (t *SimpleChaincode) revert_last_transition(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, nonce string) ([]byte, error) {
+
+	if caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	err := t.check_nonce(stub, "revert_last_transition", nonce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if product.State == STATE_SCRAPPED {
+		return nil, t.fail(ERR_INVALID_STATE, "Cannot revert a scrapped product")
+	}
+
+	last := -1
+
+	for i := len(product.OwnerHistory) - 1; i >= 0; i-- {
+		if product.OwnerHistory[i].Action != "revert" && !product.OwnerHistory[i].Reverted {
+			last = i
+			break
+		}
+	}
+
+	if last == -1 {
+		return nil, t.fail(ERR_INVALID_STATE, "No transition to revert")
+	}
+
+	change := product.OwnerHistory[last]
+
+	err = t.record_transition(stub, &product, "revert", caller, change.PreviousOwner, change.PreviousState)
+
+	if err != nil {
+		return nil, err
+	}
+
+	product.OwnerHistory[last].Reverted = true
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "REVERT_LAST_TRANSITION: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 record_inspection - The regulator records the outcome of inspecting a delivered product before payment is
+//						 released. The value is {"passed":true|false,"notes":"..."}.
+//=================================================================================================================================
+func (t *SimpleChaincode) record_inspection(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	if product.State != STATE_PAYMENT        ||
+		caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	var inspection Inspection
+
+	err := json.Unmarshal([]byte(new_value), &inspection)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid inspection JSON")
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	inspection.Inspector = caller
+	inspection.Timestamp = now
+	product.Inspection = &inspection
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "RECORD_INSPECTION: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 assign_shares - Splits a product between co-owners. The value is a JSON object mapping each holder to their share,
+//					 e.g. {"alice":0.6,"bob":0.4}. Only the owner may do this; Owner stays the party responsible for
+//					 the product in the lifecycle.
+//=================================================================================================================================
+func (t *SimpleChaincode) assign_shares(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+
+	if product.Owner != caller || product.State == STATE_SCRAPPED {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if product.Locked {
+		return nil, t.fail(ERR_INVALID_STATE, "product is locked")
+	}
+
+	var shares map[string]float64
+
+	err := json.Unmarshal([]byte(new_value), &shares)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid shares JSON")
+	}
+
+	err = t.check_shares(shares)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for holder := range shares {
+
+		err = t.check_recipient(stub, holder)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	product.OwnershipShares = shares
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "ASSIGN_SHARES: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 transfer_share - Moves part of the caller's share of a co-owned product to another participant.
+//=================================================================================================================================
+func (t *SimpleChaincode) transfer_share(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, recipient_name string, amount string) ([]byte, error) {
+
+	held, ok := product.OwnershipShares[caller]
+
+	if !ok || product.State == STATE_SCRAPPED || recipient_name == caller {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if product.Locked {
+		return nil, t.fail(ERR_INVALID_STATE, "product is locked")
+	}
+
+	share, err := strconv.ParseFloat(amount, 64)
+
+	if err != nil || share <= 0 || share > held + SHARE_TOLERANCE {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "Invalid share " + amount)
+	}
+
+	if held - share <= SHARE_TOLERANCE {
+		delete(product.OwnershipShares, caller)
+		share = held
+	} else {
+		product.OwnershipShares[caller] = held - share
+	}
+
+	product.OwnershipShares[recipient_name] += share
+
+	err = t.check_shares(product.OwnershipShares)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "TRANSFER_SHARE: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 set_lock - Lets the regulator lock a product while an inspection or dispute is open, and unlock it afterwards.
+//				A locked product refuses every transition.
+//=================================================================================================================================
+func (t *SimpleChaincode) set_lock(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, locked bool, nonce string) ([]byte, error) {
+
+	if caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	err := t.check_nonce(stub, "set_lock", nonce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if product.Locked == locked && locked {
+		return nil, t.fail(ERR_INVALID_STATE, "Product is already locked")
+	} else if product.Locked == locked {
+		return nil, t.fail(ERR_INVALID_STATE, "Product is not locked")
+	}
+
+	product.Locked = locked
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "SET_LOCK: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 place_hold - The regulator puts a product on hold, giving the reason as the value. Until the hold is lifted every
+//				  transfer and update of the product fails with HOLD_ACTIVE.
+//=================================================================================================================================
+func (t *SimpleChaincode) place_hold(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int, reason string) ([]byte, error) {
+
+	if caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if strings.TrimSpace(reason) == "" {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "PLACE_HOLD: Expecting the reason for the hold")
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	product.Hold = &Hold{PlacedBy: caller, Reason: reason, PlacedAt: now}
+
+	_, err = t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "PLACE_HOLD: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 lift_hold - The regulator lifts the hold on a product.
+//=================================================================================================================================
+func (t *SimpleChaincode) lift_hold(stub shim.ChaincodeStubInterface, product Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	if caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if product.Hold == nil {
+		return nil, t.fail(ERR_INVALID_STATE, "Product is not on hold")
+	}
+
+	product.Hold = nil
+
+	_, err := t.save_changes(stub, product)
+
+	if err != nil {
+		t.audit(stub, "LIFT_HOLD: Error saving changes: %s", err); return nil, t.save_error(err)
+	}
+
+	return nil, nil
+
+}
+
+//=================================================================================================================================
+//	 issue_recall - A manufacturer or the regulator recalls products. The value is a JSON document with the reason and
+//					either the product ids or the batch recalled, e.g. {"batch":"B-17","reason":"faulty brakes"}.
+//					Manufacturers may only recall their own products. A batch recall covers every product of the
+//					batch that isn't scrapped. Every product covered is flagged as recalled, after which it can't be
+//					transferred other than to a recycler. Products on hold can't be recalled until the hold is
+//					lifted. Returns the id of the recall.
+//=================================================================================================================================
+func (t *SimpleChaincode) issue_recall(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ISSUE_RECALL: Incorrect number of arguments passed")
+	}
+
+	if caller_affiliation != GOVERNMENT && caller_affiliation != SELLER {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	var request Recall
+
+	err := json.Unmarshal([]byte(args[0]), &request)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ISSUE_RECALL: Invalid recall JSON")
+	}
+
+	if strings.TrimSpace(request.Reason) == "" {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ISSUE_RECALL: Expecting the reason for the recall")
+	}
+
+	if (request.Batch == "") == (len(request.ProductIDs) == 0) {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "ISSUE_RECALL: Expecting either product ids or a batch")
+	}
+
+	var products []Product
+
+	if request.Batch != "" {
+
+		batch, err := t.retrieve_indexed_products(stub, [2]string{"batch", request.Batch})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, p := range batch {
+			if p.Batch == request.Batch && p.State != STATE_SCRAPPED && (caller_affiliation == GOVERNMENT || p.Manufacturer == caller) {
+				products = append(products, p)
+			}
+		}
+
+		if len(products) == 0 {
+			return nil, t.fail(ERR_NOT_FOUND, "No products of batch " + request.Batch + " to recall")
+		}
+
+	} else {
+
+		for _, pid := range request.ProductIDs {
+
+			p, err := t.retrieve_product(stub, pid)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if caller_affiliation != GOVERNMENT && p.Manufacturer != caller {
+				return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+			}
+
+			products = append(products, p)
+		}
+	}
+
+	now, err := t.get_tx_time(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	recall := Recall{
+		RecallID: "RC" + stub.GetTxID(),
+		Batch:    request.Batch,
+		Reason:   request.Reason,
+		IssuedBy: caller,
+		IssuedAt: now,
+	}
+
+	for _, p := range products {
+
+		p.Recalled = true
+		p.RecallID = recall.RecallID
+
+		_, err = t.save_changes(stub, p)
+
+		if err != nil {
+			t.audit(stub, "ISSUE_RECALL: Error saving changes: %s", err); return nil, t.save_error(err)
+		}
+
+		recall.ProductIDs = append(recall.ProductIDs, p.ProductID)
+	}
+
+	bytes, err := json.Marshal(recall)
+
+	if err != nil {
+		return nil, errors.New("ISSUE_RECALL: Error converting recall record")
+	}
+
+	err = stub.PutState("Recall_" + recall.RecallID, bytes)
+
+	if err != nil {
+		return nil, errors.New("ISSUE_RECALL: Error storing recall record")
+	}
+
+	t.emit(stub, "product_recalled", bytes)
+
+	return []byte(recall.RecallID), nil
+}
+
+//=================================================================================================================================
+//	 validate_and_repair_product - Maintenance function for the regulator. Reports the invariants a stored product
+//								   violates and, when called with {"repair":true}, fixes the ones that can be fixed
+//								   safely: the state is clamped into the lifecycle, missing names are set to UNDEFINED
+//								   and a negative weight is reset to 0. A bad price or currency can only be reported.
+//=================================================================================================================================
+func (t *SimpleChaincode) validate_and_repair_product(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 1 && len(args) != 2 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "VALIDATE_AND_REPAIR_PRODUCT: Incorrect number of arguments passed")
+	}
+
+	if caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	var options RepairOptions
+
+	if len(args) == 2 {
+		err := json.Unmarshal([]byte(args[1]), &options)
+		if err != nil {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "VALIDATE_AND_REPAIR_PRODUCT: Invalid options JSON")
+		}
+	}
+
+	product, err := t.retrieve_product(stub, args[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	report := RepairReport{ProductID: product.ProductID, Violations: []Violation{}}
+	unrepairable := false
+
+	if product.State < STATE_SALESCONTRACT || product.State > STATE_SCRAPPED {
+		report.Violations = append(report.Violations, Violation{Field: "state", Problem: "state " + strconv.Itoa(product.State) + " is outside the lifecycle", Repaired: options.Repair})
+		if product.State < STATE_SALESCONTRACT {
+			product.State = STATE_SALESCONTRACT
+		} else {
+			product.State = STATE_SCRAPPED
+		}
+	}
+
+	for field, value := range map[string]*string{"manufacturer": &product.Manufacturer, "owner": &product.Owner, "destination": &product.Destination} {
+		if strings.TrimSpace(*value) == "" {
+			report.Violations = append(report.Violations, Violation{Field: field, Problem: field + " is empty", Repaired: options.Repair})
+			*value = "UNDEFINED"
+		}
+	}
+
+	if product.Weight < 0 {
+		report.Violations = append(report.Violations, Violation{Field: "weight", Problem: "weight is negative", Repaired: options.Repair})
+		product.Weight = 0
+	}
+
+	if product.Price <= 0 {
+		report.Violations = append(report.Violations, Violation{Field: "price", Problem: "price is not greater than 0"})
+		unrepairable = true
+	}
+
+	if !t.is_valid_currency(product.Currency) {
+		report.Violations = append(report.Violations, Violation{Field: "currency", Problem: "currency '" + product.Currency + "' is not a valid ISO 4217 code"})
+		unrepairable = true
+	}
+
+	sort.Slice(report.Violations, func(i, j int) bool { return report.Violations[i].Field < report.Violations[j].Field })
+
+	if options.Repair && len(report.Violations) > 0 && !unrepairable {
+
+		_, err = t.save_changes(stub, product)
+
+		if err != nil {
+			t.audit(stub, "VALIDATE_AND_REPAIR_PRODUCT: Error saving changes: %s", err); return nil, t.save_error(err)
+		}
+
+		report.Saved = true
+
+	} else if unrepairable {
+		for i := range report.Violations {
+			report.Violations[i].Repaired = false
+		}
+	}
+
+	bytes, err := json.Marshal(report)
+
+	if err != nil {
+		return nil, errors.New("VALIDATE_AND_REPAIR_PRODUCT: Error creating response")
+	}
+
+	return bytes, nil
+
+}
+
+//=================================================================================================================================
+//	 Read Functions
+//=================================================================================================================================
+//	 get_vehicle_details
+//=================================================================================================================================
+func (t *SimpleChaincode) get_vehicle_details(stub shim.ChaincodeStubInterface, v Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	bytes, err := json.Marshal(t.view_for(v, caller, caller_affiliation))
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_VEHICLE_DETAILS: Invalid vehicle object")
+	}
+
+	if v.Owner == caller ||
+		caller_affiliation == GOVERNMENT {
+
+		return bytes, nil
+	} else {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+}
+
+//=================================================================================================================================
+//	 get_labelled_details - get_vehicle_details with the role names of the owner and manufacturer added, so clients
+//							don't have to map affiliation numbers themselves.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_labelled_details(stub shim.ChaincodeStubInterface, v Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	_, err := t.get_vehicle_details(stub, v, caller, caller_affiliation)
+
+	if err != nil {
+		return nil, err
+	}
+
+	labelled := LabelledProduct{Product: v, OwnerRole: t.role_name(stub, v.Owner), ManufacturerRole: t.role_name(stub, v.Manufacturer)}
+
+	bytes, err := json.Marshal(labelled)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_LABELLED_DETAILS: Invalid product object")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_vehicles - Returns every product the caller may view, as a JSON array or as newline-delimited JSON when the
+//					options argument asks for {"format":"ndjson"}. When a size cap is configured or requested the
+//					listing stops before the cap is reached. A listing also stops once it has read MAX_PAGE_READS
+//					products. JSON results are then wrapped in a ListPage and NDJSON results end with a
+//					{"truncated":true,"lastId":...} line if products were left out. Passing a page size and
+//					bookmark, either as arguments or as options, returns a RecordPage instead.
+//=================================================================================================================================
+
+func (t *SimpleChaincode) get_vehicles(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	var options ListOptions
+
+	if len(args) > 0 && strings.HasPrefix(strings.TrimSpace(args[0]), "{") {
+		err := json.Unmarshal([]byte(args[0]), &options)
+		if err != nil {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "GET_VEHICLES: Invalid options JSON")
+		}
+	} else if len(args) > 0 {
+
+		size, err := strconv.Atoi(args[0])
+
+		if err != nil || size <= 0 {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "GET_VEHICLES: Invalid page size " + args[0])
+		}
+
+		options.PageSize = size
+
+		if len(args) > 1 {
+			options.Bookmark = args[1]
+		}
+	}
+
+	if options.PageSize != 0 || options.Bookmark != "" {
+		return t.get_vehicles_page(stub, caller, caller_affiliation, options)
+	}
+
+	if options.Format != "" && options.Format != "json" && options.Format != "ndjson" {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_VEHICLES: Unknown format " + options.Format)
+	}
+
+	ndjson := options.Format == "ndjson"
+
+	if options.MaxBytes < 0 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_VEHICLES: Invalid maxBytes")
+	}
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	limit := config.MaxResultBytes
+
+	if options.MaxBytes > 0 && (limit == 0 || options.MaxBytes < limit) {
+		limit = options.MaxBytes
+	}
+
+	productIds, err := t.loadProductIndex(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := "["
+
+	if ndjson {
+		result = ""
+	}
+
+	var temp []byte
+	var v Product
+	var page ListPage
+
+	start := 0
+
+	if options.After != "" {
+
+		start = -1
+
+		for i, id := range productIds.ProductIDs {
+			if strconv.Itoa(id) == options.After {
+				start = i + 1
+			}
+		}
+
+		if start < 0 {
+			return nil, t.fail(ERR_NOT_FOUND, "GET_VEHICLES: Unknown product id " + options.After)
+		}
+	}
+
+	for reads, id := range productIds.ProductIDs[start:] {
+
+		if reads == MAX_PAGE_READS {
+			page.Truncated = true
+			break
+		}
+
+		v, err = t.retrieve_product(stub, strconv.Itoa(id))
+
+		if err != nil {
+			return nil, errors.New("Failed to retrieve product " + strconv.Itoa(id))
+		}
+
+		temp, err = t.get_vehicle_details(stub, v, caller, caller_affiliation)
+
+		if err != nil {
+			page.LastID = v.ProductID                                                      // Not visible to the caller, so the next page may start after it
+			continue
+		}
+
+		if limit > 0 && len(result) + len(temp) + len(page.LastID) + 64 > limit {			// Leave room for the envelope or trailing line
+			page.Truncated = true
+			break
+		}
+
+		if ndjson {
+			result += string(temp) + "\n"
+		} else {
+			result += string(temp) + ","
+			page.Products = append(page.Products, json.RawMessage(temp))
+		}
+
+		page.LastID = v.ProductID
+	}
+
+	if ndjson {
+		if page.Truncated {
+			result += fmt.Sprintf("{\"truncated\":true,\"lastId\":%q}\n", page.LastID)
+		}
+		return []byte(result), nil
+	}
+
+	if limit > 0 || page.Truncated {
+
+		if page.Products == nil {
+			page.Products = []json.RawMessage{}
+		}
+
+		bytes, err := json.Marshal(page)
+
+		if err != nil {
+			return nil, errors.New("GET_VEHICLES: Error creating list page")
+		}
+
+		return bytes, nil
+	}
+
+	if len(result) == 1 {
+		result = "[]"
+	} else {
+		result = result[:len(result) - 1] + "]"
+	}
+
+	return []byte(result), nil
+}
+
+//=================================================================================================================================
+//	 get_vehicles_page - Returns a page of the products the caller may view, starting at the bookmark. The pid index
+//						 is read with a paginated query, again while products the caller may not view leave the
+//						 page short. Pages are capped at MAX_PAGE_SIZE products and MAX_PAGE_READS reads, so a page
+//						 may hold fewer products than asked for while there are more to come.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_vehicles_page(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, options ListOptions) ([]byte, error) {
+
+	if options.PageSize < 0 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_VEHICLES: Invalid pageSize")
+	}
+
+	size := options.PageSize
+
+	if size == 0 || size > MAX_PAGE_SIZE {
+		size = MAX_PAGE_SIZE
+	}
+
+	page := RecordPage{Records: []json.RawMessage{}, NextBookmark: options.Bookmark}
+	reads := 0
+
+	for page.Count < size && reads < MAX_PAGE_READS {
+
+		want := size - page.Count
+
+		if want > MAX_PAGE_READS - reads {
+			want = MAX_PAGE_READS - reads
+		}
+
+		iter, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(PRODUCT_INDEX, []string{}, int32(want), page.NextBookmark)
+
+		if err != nil {
+			return nil, errors.New("GET_VEHICLES: Unable to query the product index")
+		}
+
+		var ids []string
+
+		for iter.HasNext() {
+
+			kv, err := iter.Next()
+
+			if err != nil {
+				iter.Close()
+				return nil, errors.New("GET_VEHICLES: Unable to read the product index")
+			}
+
+			_, attributes, err := stub.SplitCompositeKey(kv.Key)
+
+			if err != nil || len(attributes) != 1 {
+				iter.Close()
+				return nil, errors.New("GET_VEHICLES: Corrupt product index key")
+			}
+
+			ids = append(ids, attributes[0])
+		}
+
+		iter.Close()
+
+		for _, id := range ids {
+
+			p, err := t.retrieve_product(stub, id)
+
+			if err != nil {
+				return nil, errors.New("Failed to retrieve product " + id)
+			}
+
+			reads++
+
+			record, err := t.get_vehicle_details(stub, p, caller, caller_affiliation)
+
+			if err != nil {
+				continue
+			}
+
+			page.Records = append(page.Records, json.RawMessage(record))
+			page.Count++
+		}
+
+		page.NextBookmark = metadata.Bookmark
+
+		if page.NextBookmark == "" || len(ids) < want {
+			page.NextBookmark = ""
+			break
+		}
+	}
+
+	bytes, err := json.Marshal(page)
+
+	if err != nil {
+		return nil, errors.New("GET_VEHICLES: Error creating page")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_product_count - Returns how many products have been created, 0 on a fresh ledger.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_product_count(stub shim.ChaincodeStubInterface) ([]byte, error) {
+
+	productIds, err := t.loadProductIndex(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(strconv.Itoa(len(productIds.ProductIDs))), nil
+}
+
+//=================================================================================================================================
+//	 get_custody_chain - Returns the ordered list of custodians of a product, each with the time custody was taken.
+//						 Visible to the owner, the current custodian and the regulator.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_custody_chain(stub shim.ChaincodeStubInterface, p Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	if p.Owner != caller                        &&
+		p.Custodian != caller                &&
+		caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	chain := p.CustodyHistory
+
+	if chain == nil {
+		chain = []CustodyEntry{}
+	}
+
+	bytes, err := json.Marshal(chain)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_CUSTODY_CHAIN: Invalid custody history")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_state_transitions_log - Merges the creation time, owner history and custody history of a product into one
+//								 chronological log of who moved it where. Entries from the same transaction keep the
+//								 order creation, state change, custody change. Visible to the same parties as the
+//								 custody chain.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_state_transitions_log(stub shim.ChaincodeStubInterface, p Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	if p.Owner != caller                        &&
+		p.Custodian != caller                &&
+		caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	log := []TransitionLogEntry{}
+
+	if created, ok := p.StateTimestamps[STATE_SALESCONTRACT]; ok {
+		log = append(log, TransitionLogEntry{Timestamp: created, Type: "created", To: t.state_name(STATE_SALESCONTRACT), Actor: p.Manufacturer})
+	}
+
+	for _, change := range p.OwnerHistory {
+		log = append(log, TransitionLogEntry{
+			Timestamp: change.Timestamp,
+			Type:      "state",
+			From:      t.state_name(change.PreviousState),
+			To:        t.state_name(change.State),
+			Actor:     change.Actor,
+		})
+	}
+
+	for i := 1; i < len(p.CustodyHistory); i++ {                                        // The first entry is the owner the product started with
+		log = append(log, TransitionLogEntry{
+			Timestamp: p.CustodyHistory[i].Timestamp,
+			Type:      "custody",
+			From:      p.CustodyHistory[i - 1].Custodian,
+			To:        p.CustodyHistory[i].Custodian,
+			Actor:     p.CustodyHistory[i - 1].Custodian,
+		})
+	}
+
+	sort.SliceStable(log, func(i, j int) bool { return log[i].Timestamp < log[j].Timestamp })
+
+	bytes, err := json.Marshal(log)
+
+	if err != nil {
+		return nil, errors.New("GET_STATE_TRANSITIONS_LOG: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_products_requiring_inspection - The regulator's work queue: delivered products awaiting payment that have
+//										 not been inspected yet.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_products_requiring_inspection(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
+
+	if caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	products, err := t.retrieve_indexed_products(stub, [2]string{"state", strconv.Itoa(STATE_PAYMENT)})
+
+	if err != nil {
+		return nil, err
+	}
+
+	queue := []Product{}
+
+	for _, p := range products {
+		if p.State == STATE_PAYMENT && p.Inspection == nil {
+			queue = append(queue, p)
+		}
+	}
+
+	bytes, err := json.Marshal(queue)
+
+	if err != nil {
+		return nil, errors.New("GET_PRODUCTS_REQUIRING_INSPECTION: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_held_products - Lists the products on hold with who placed each hold, when and why. Regulator only.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_held_products(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
+
+	if caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	products, err := t.retrieve_indexed_products(stub, [2]string{"hold", ""})
+
+	if err != nil {
+		return nil, err
+	}
+
+	held := []HeldProduct{}
+
+	for _, p := range products {
+		if p.Hold != nil {
+			held = append(held, HeldProduct{ProductID: p.ProductID, Owner: p.Owner, State: p.State, PlacedBy: p.Hold.PlacedBy, Reason: p.Hold.Reason, PlacedAt: p.Hold.PlacedAt})
+		}
+	}
+
+	bytes, err := json.Marshal(held)
+
+	if err != nil {
+		return nil, errors.New("GET_HELD_PRODUCTS: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_recall - Returns a recall. Visible to the regulator and to whoever issued it.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_recall(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, id string) ([]byte, error) {
+
+	recall, err := t.retrieve_recall(stub, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if recall.IssuedBy != caller && caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	bytes, err := json.Marshal(recall)
+
+	if err != nil {
+		return nil, errors.New("GET_RECALL: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_recalled_owners - Lists the recalled products with their current owner and custodian, so they can be contacted.
+//						   Optionally restricted to the products of one recall. The regulator sees every recalled
+//						   product, a manufacturer only its own.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_recalled_owners(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if caller_affiliation != GOVERNMENT && caller_affiliation != SELLER {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	recallId := ""
+
+	if len(args) == 1 {
+		recallId = args[0]
+	}
+
+	products, err := t.retrieve_indexed_products(stub, [2]string{"recall", recallId})
+
+	if err != nil {
+		return nil, err
+	}
+
+	recalled := []RecalledProduct{}
+
+	for _, p := range products {
+
+		if !p.Recalled || (recallId != "" && p.RecallID != recallId) {
+			continue
+		}
+
+		if caller_affiliation != GOVERNMENT && p.Manufacturer != caller {
+			continue
+		}
+
+		recalled = append(recalled, RecalledProduct{ProductID: p.ProductID, RecallID: p.RecallID, Owner: p.Owner, Custodian: p.Custodian, State: p.State})
+	}
+
+	bytes, err := json.Marshal(recalled)
+
+	if err != nil {
+		return nil, errors.New("GET_RECALLED_OWNERS: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_products_by_currency - Returns all active products the caller may view that are priced in the currency passed,
+//								together with the summed price of those products. Reads the currency index, which
+//								isn't kept when the currency is a private term, so the query is refused then.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_products_by_currency(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_PRODUCTS_BY_CURRENCY: Incorrect number of arguments passed")
+	}
+
+	currency := strings.ToUpper(strings.TrimSpace(args[0]))
+
+	if !t.is_valid_currency(currency) {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_PRODUCTS_BY_CURRENCY: Unrecognised currency code " + args[0])
+	}
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if config.PrivateCollection != "" {
+		return nil, t.fail(ERR_INVALID_STATE, "GET_PRODUCTS_BY_CURRENCY: Currencies are kept in the private collection " + config.PrivateCollection + " and can't be queried")
+	}
+
+	products, err := t.retrieve_indexed_products(stub, [2]string{"currency", currency})
+
+	if err != nil {
+		return nil, err
+	}
+
+	exposure := CurrencyExposure{Currency: currency, Products: []Product{}}
+
+	for _, p := range t.visible_products(stub, products, caller, caller_affiliation) {
+		if p.Currency == currency && t.isActive(p) {
+			exposure.Products = append(exposure.Products, p)
+			exposure.Total += p.Price
+		}
+	}
+
+	exposure.Count = len(exposure.Products)
+
+	bytes, err := json.Marshal(exposure)
+
+	if err != nil {
+		return nil, errors.New("GET_PRODUCTS_BY_CURRENCY: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 convert_units - Returns the dimensions and weight of a product in the requested unit system ("metric" or
+//					 "imperial").
+//=================================================================================================================================
+func (t *SimpleChaincode) convert_units(stub shim.ChaincodeStubInterface, p Product, caller string, caller_affiliation int, system string) ([]byte, error) {
+
+	_, err := t.get_vehicle_details(stub, p, caller, caller_affiliation)
+
+	if err != nil {
+		return nil, err
+	}
+
+	target, ok := UNIT_SYSTEMS[system]
+
+	if !ok {
+		return nil, t.fail(ERR_NOT_FOUND, "CONVERT_UNITS: Unknown unit system " + system)
+	}
+
+	from_length, ok := LENGTH_UNITS[p.Units.Length]
+
+	if !ok {
+		return nil, t.fail(ERR_NOT_FOUND, "CONVERT_UNITS: Product has unknown length unit '" + p.Units.Length + "'")
+	}
+
+	from_mass, ok := MASS_UNITS[p.Units.Mass]
+
+	if !ok {
+		return nil, t.fail(ERR_NOT_FOUND, "CONVERT_UNITS: Product has unknown mass unit '" + p.Units.Mass + "'")
+	}
+
+	length_factor := from_length / LENGTH_UNITS[target.Length]
+	mass_factor := from_mass / MASS_UNITS[target.Mass]
+
+	converted := ConvertedDimensions{
+		ProductID: p.ProductID,
+		Units:     target,
+		Width:     float64(p.Width) * length_factor,
+		Height:    float64(p.Height) * length_factor,
+		Weight:    float64(p.Weight) * mass_factor,
+	}
+
+	bytes, err := json.Marshal(converted)
+
+	if err != nil {
+		return nil, errors.New("CONVERT_UNITS: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_supply_chain_view - Resolves every party involved with a product. The banks are taken from its sales
+//							 contract. Only the owner, the regulator and the banks involved may see it.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_supply_chain_view(stub shim.ChaincodeStubInterface, p Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	view := SupplyChainView{
+		ProductID:    p.ProductID,
+		Manufacturer: p.Manufacturer,
+		Owner:        p.Owner,
+		Custodian:    p.Custodian,
+		State:        p.State,
+		StateName:    t.state_name(p.State),
+		Milestones:   p.Milestones,
+	}
+
+	if view.Milestones == nil {
+		view.Milestones = []ShippingMilestone{}
+	}
+
+	if len(p.Contracts) > 0 {
+		contract := p.Contracts[len(p.Contracts) - 1]
+		view.IssuingBank = contract.Seller_Bank
+		view.BuyerBank = contract.Buyer_Bank
+	}
+
+	if p.SalesContract != "" {
+
+		contract, err := t.retrieve_sales_contract(stub, p.SalesContract)
+
+		if err == nil {                                                                                // Peers outside the private collection don't hold it
+			view.IssuingBank = contract.SellerBank
+			view.BuyerBank = contract.BuyerBank
+		}
+	}
+
+	if p.Owner != caller                                                        &&
+		caller_affiliation != GOVERNMENT                                        &&
+		(view.IssuingBank == "" || view.IssuingBank != caller)        &&
+		(view.BuyerBank == "" || view.BuyerBank != caller) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	bytes, err := json.Marshal(view)
+
+	if err != nil {
+		return nil, errors.New("GET_SUPPLY_CHAIN_VIEW: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_accreditive - Returns an accreditive to the banks involved, its beneficiary or the regulator.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_accreditive(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, id string) ([]byte, error) {
+
+	credit, err := t.retrieve_accreditive(stub, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if credit.IssuingBank != caller                &&
+		credit.ConfirmedBy != caller                &&
+		credit.Beneficiary != caller                &&
+		caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	bytes, err := json.Marshal(credit)
+
+	if err != nil {
+		return nil, errors.New("GET_ACCREDITIVE: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_bill_of_lading - Returns a bill of lading to the shipper, anyone who held it or the regulator.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_bill_of_lading(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, id string) ([]byte, error) {
+
+	bill, err := t.retrieve_bill_of_lading(stub, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := bill.Shipper == caller || bill.Consignee == caller || caller_affiliation == GOVERNMENT
+
+	for _, endorsement := range bill.Endorsements {
+		if endorsement.To == caller {
+			allowed = true
+		}
+	}
+
+	if !allowed {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	bytes, err := json.Marshal(bill)
+
+	if err != nil {
+		return nil, errors.New("GET_BILL_OF_LADING: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_sales_contract - Returns a sales contract to its parties, their banks and the regulator.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_sales_contract(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, id string) ([]byte, error) {
+
+	contract, err := t.retrieve_sales_contract(stub, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if contract.Seller != caller                        &&
+		contract.Buyer != caller                        &&
+		contract.SellerBank != caller                &&
+		contract.BuyerBank != caller                &&
+		caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	bytes, err := json.Marshal(contract)
+
+	if err != nil {
+		return nil, errors.New("GET_SALES_CONTRACT: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_invoice - Returns an invoice to its issuer, its debtor, the banks named by its product or sales contract and
+//				   the regulator.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_invoice(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, id string) ([]byte, error) {
+
+	invoice, err := t.retrieve_invoice(stub, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bank := caller_affiliation == SELLER_BANK || caller_affiliation == BUYER_BANK
+
+	if invoice.Issuer != caller                                                &&
+		invoice.Debtor != caller                                                &&
+		caller_affiliation != GOVERNMENT                                        &&
+		!(bank && t.invoice_bank(stub, invoice, caller)) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	bytes, err := json.Marshal(invoice)
+
+	if err != nil {
+		return nil, errors.New("GET_INVOICE: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_unpaid_invoices - Lists the invoices of the debtor passed that aren't paid yet, earliest due first, read from
+//						   INVOICE_INDEX. Visible to the debtor and the regulator. A bank gets the invoices whose
+//						   product or sales contract names it.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_unpaid_invoices(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, debtor string) ([]byte, error) {
+
+	bank := caller_affiliation == SELLER_BANK || caller_affiliation == BUYER_BANK
+
+	if debtor != caller                                &&
+		caller_affiliation != GOVERNMENT                &&
+		!bank {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	iter, err := stub.GetStateByPartialCompositeKey(INVOICE_INDEX, []string{debtor})
+
+	if err != nil {
+		return nil, errors.New("GET_UNPAID_INVOICES: Unable to query invoices")
+	}
+
+	defer iter.Close()
+
+	unpaid := []Invoice{}
+
+	for iter.HasNext() {
+
+		kv, err := iter.Next()
+
+		if err != nil {
+			return nil, errors.New("GET_UNPAID_INVOICES: Unable to read invoices")
+		}
+
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+
+		if err != nil || len(attributes) != 2 {
+			return nil, errors.New("GET_UNPAID_INVOICES: Corrupt invoice index key")
+		}
+
+		invoice, err := t.retrieve_invoice(stub, attributes[1])
+
+		if err != nil {
+			return nil, err
+		}
+
+		if invoice.Status == INVOICE_PAID {
+			continue
+		}
+
+		if debtor != caller && caller_affiliation != GOVERNMENT && !t.invoice_bank(stub, invoice, caller) {
+			continue
+		}
+
+		unpaid = append(unpaid, invoice)
+	}
+
+	sort.SliceStable(unpaid, func(i, j int) bool { return unpaid[i].DueDate < unpaid[j].DueDate })
+
+	bytes, err := json.Marshal(unpaid)
+
+	if err != nil {
+		return nil, errors.New("GET_UNPAID_INVOICES: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_trade_finance_status - Summarises the letter of credit process of a product as a set of flags plus the amounts
+//								involved. Visible to the owner, buyer, manufacturer, the banks involved and the
+//								regulator. The buyer's bank is taken from the sales contract where there is one.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_trade_finance_status(stub shim.ChaincodeStubInterface, p Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	issuing_bank := t.issuing_bank(p)
+
+	buyer_bank := t.buyer_bank(p)
+
+	if p.SalesContract != "" {
+
+		contract, err := t.retrieve_sales_contract(stub, p.SalesContract)
+
+		if err == nil {                                                                                // Peers outside the private collection don't hold it
+			buyer_bank = contract.BuyerBank
+		}
+	}
+
+	if p.Owner != caller                                                &&
+		p.Buyer != caller                                                &&
+		p.Manufacturer != caller                                        &&
+		caller_affiliation != GOVERNMENT                                &&
+		(issuing_bank == "" || issuing_bank != caller)                &&
+		(buyer_bank == "" || buyer_bank != caller) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	status := TradeFinanceStatus{
+		ProductID: p.ProductID,
+		StateName: t.state_name(p.State),
+		Inspected: p.Inspection != nil,
+		Paid:      p.PaymentReleased,
+		Price:     p.Price,
+		Currency:  p.Currency,
+	}
+
+	credit, err := t.product_accreditive(stub, p)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if credit != nil && !credit.Withdrawn && !credit.Rejected {
+		status.AccreditiveIssued = true
+		status.AccreditiveChecked = p.State > STATE_CHECK_ACCREDITIVE
+		status.AccreditiveAmount = credit.Amount
+		status.AccreditiveCurrency = credit.Currency
+	}
+
+	for _, change := range p.OwnerHistory {
+		if change.Action == "refund" && !change.Reverted {
+			status.Refunded = true
+		}
+	}
+
+	bytes, err := json.Marshal(status)
+
+	if err != nil {
+		return nil, errors.New("GET_TRADE_FINANCE_STATUS: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_fx_rates - Lists the exchange rate table, oldest entry first, for one pair when one is passed.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_fx_rates(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	pair := ""
+
+	if len(args) > 0 {
+		pair = args[0]
+	}
+
+	rates, err := LedgerFXProvider{Stub: stub}.Rates(pair)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bytes, err := json.Marshal(rates)
+
+	if err != nil {
+		return nil, errors.New("GET_FX_RATES: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_telemetry - Returns the sensor readings of a product in time order, optionally of one sensor type only. Visible
+//					 to the owner, the custodian, the manufacturer and the regulator.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_telemetry(stub shim.ChaincodeStubInterface, p Product, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if p.Owner != caller && p.Custodian != caller && p.Manufacturer != caller && caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	attributes := []string{p.ProductID}
+
+	if len(args) > 0 {
+		attributes = append(attributes, args[0])
+	}
+
+	iter, err := stub.GetStateByPartialCompositeKey(TELEMETRY_INDEX, attributes)
+
+	if err != nil {
+		return nil, errors.New("GET_TELEMETRY: Unable to query telemetry")
+	}
+
+	defer iter.Close()
+
+	readings := []TelemetryReading{}
+
+	for iter.HasNext() {
+
+		kv, err := iter.Next()
+
+		if err != nil {
+			return nil, errors.New("GET_TELEMETRY: Unable to read telemetry")
+		}
+
+		var reading TelemetryReading
+
+		err = json.Unmarshal(kv.Value, &reading)
+
+		if err != nil {
+			return nil, errors.New("GET_TELEMETRY: Corrupt telemetry record " + kv.Key)
+		}
+
+		readings = append(readings, reading)
+	}
+
+	sort.SliceStable(readings, func(i, j int) bool { return readings[i].Timestamp < readings[j].Timestamp })
+
+	bytes, err := json.Marshal(readings)
+
+	if err != nil {
+		return nil, errors.New("GET_TELEMETRY: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_product_price - Converts the price of a product into the currency passed at the rates in effect now. Visible to
+//						 those who may see the commercial terms of the product.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_product_price(stub shim.ChaincodeStubInterface, p Product, caller string, caller_affiliation int, currency string) ([]byte, error) {
+
+	if !t.can_view_terms(p, caller, caller_affiliation) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if p.TermsHash != "" && p.Currency == "" {
+		return nil, t.fail(ERR_INVALID_STATE, "GET_PRODUCT_PRICE: The terms of product " + p.ProductID + " are not held by this peer")
+	}
+
+	if !t.is_valid_currency(currency) {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_PRODUCT_PRICE: Invalid currency " + currency)
+	}
+
+	fx, err := t.get_fx_provider(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	converted, err := t.convert_money(fx, p.Price, p.Currency, currency)
+
+	if err != nil {
+		return nil, t.wrap_error("GET_PRODUCT_PRICE: ", err)
+	}
+
+	bytes, err := json.Marshal(PriceQuote{ProductID: p.ProductID, Price: p.Price, Currency: p.Currency, ConvertedPrice: converted, ConvertedCurrency: currency})
+
+	if err != nil {
+		return nil, errors.New("GET_PRODUCT_PRICE: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_estimated_shipping_cost - Quotes what start_shipping would charge for a product at the configured rate.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_estimated_shipping_cost(stub shim.ChaincodeStubInterface, p Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	_, err := t.get_vehicle_details(stub, p, caller, caller_affiliation)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cost, err := t.estimate_shipping_cost(config, p)
+
+	if err != nil {
+		return nil, t.wrap_error("GET_ESTIMATED_SHIPPING_COST: ", err)
+	}
+
+	return []byte(strconv.FormatFloat(cost, 'f', 2, 64)), nil
+}
+
+//=================================================================================================================================
+//	 get_stale_products - Returns the products the caller may view that have been in their current state for longer
+//						  than the configured dwell limit. Takes an optional epoch time to evaluate against,
+//						  defaulting to the transaction time when empty, and an optional bookmark. See
+//						  retrieve_visible_page.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_stale_products(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	var now int64
+	var err error
+
+	if len(args) > 0 && args[0] != "" {
+		now, err = strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "GET_STALE_PRODUCTS: Invalid time " + args[0])
+		}
+	} else {
+		now, err = t.get_tx_time(stub)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	config, err := t.get_config(stub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	bookmark := ""
+
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+
+	products, next, err := t.retrieve_visible_page(stub, caller, caller_affiliation, bookmark)
+
+	if err != nil {
+		return nil, err
+	}
+
+	stale := []Product{}
+
+	for _, p := range products {
+		if t.dwell_exceeded(config, p, now) {
+			stale = append(stale, p)
+		}
+	}
+
+	bytes, err := t.product_page(stale, bookmark, next)
+
+	if err != nil {
+		return nil, errors.New("GET_STALE_PRODUCTS: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 suggest_consolidations - Groups the un-shipped products of a manufacturer by destination and currency and returns
+//							  every group holding more than one product as a candidate for merging. Reads the
+//							  manufacturer index. Groups are returned in index order so every peer produces the
+//							  same result.
+//=================================================================================================================================
+func (t *SimpleChaincode) suggest_consolidations(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "SUGGEST_CONSOLIDATIONS: Incorrect number of arguments passed")
+	}
+
+	products, err := t.retrieve_indexed_products(stub, [2]string{"manufacturer", args[0]})
+
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []ConsolidationGroup
+	positions := make(map[string]int)
+
+	for _, p := range t.visible_products(stub, products, caller, caller_affiliation) {
+
+		if p.Manufacturer != args[0] || p.State >= STATE_SHIPPING {
+			continue
+		}
+
+		key := p.Destination + "|" + p.Currency
+		pos, ok := positions[key]
+
+		if !ok {
+			pos = len(groups)
+			positions[key] = pos
+			groups = append(groups, ConsolidationGroup{Destination: p.Destination, Currency: p.Currency})
+		}
+
+		groups[pos].ProductIDs = append(groups[pos].ProductIDs, p.ProductID)
+	}
+
+	candidates := []ConsolidationGroup{}
+
+	for _, g := range groups {
+		if len(g.ProductIDs) > 1 {
+			candidates = append(candidates, g)
+		}
+	}
+
+	bytes, err := json.Marshal(candidates)
+
+	if err != nil {
+		return nil, errors.New("SUGGEST_CONSOLIDATIONS: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_products_created_between - Returns the products the caller may view that were created within the inclusive
+//									range [from, to], both given in epoch seconds. Takes an optional bookmark, see
+//									retrieve_visible_page.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_products_created_between(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	bookmark := ""
+
+	if len(args) > 2 {
+		bookmark = args[2]
+		args = args[:2]
+	}
+
+	from, to, err := t.parse_time_range(args)
+
+	if err != nil {
+		return nil, t.wrap_error("GET_PRODUCTS_CREATED_BETWEEN: ", err)
+	}
+
+	products, next, err := t.retrieve_visible_page(stub, caller, caller_affiliation, bookmark)
+
+	if err != nil {
+		return nil, err
+	}
+
+	created := []Product{}
+
+	for _, p := range products {
+
+		at, ok := p.StateTimestamps[STATE_SALESCONTRACT]
+
+		if ok && at >= from && at <= to {
+			created = append(created, p)
+		}
+	}
+
+	bytes, err := t.product_page(created, bookmark, next)
+
+	if err != nil {
+		return nil, errors.New("GET_PRODUCTS_CREATED_BETWEEN: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_products_modified_since - Incremental feed for clients keeping a copy of the ledger. Returns the products the
+//								   caller may view that were written after the epoch time passed. Takes an optional
+//								   bookmark, see retrieve_visible_page.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_products_modified_since(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) < 1 || len(args) > 2 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_PRODUCTS_MODIFIED_SINCE: Incorrect number of arguments passed")
+	}
+
+	since, err := strconv.ParseInt(args[0], 10, 64)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_PRODUCTS_MODIFIED_SINCE: Invalid time " + args[0])
+	}
+
+	bookmark := ""
+
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+
+	products, next, err := t.retrieve_visible_page(stub, caller, caller_affiliation, bookmark)
+
+	if err != nil {
+		return nil, err
+	}
+
+	modified := []Product{}
+
+	for _, p := range products {
+		if p.LastModified > since {
+			modified = append(modified, p)
+		}
+	}
+
+	bytes, err := t.product_page(modified, bookmark, next)
+
+	if err != nil {
+		return nil, errors.New("GET_PRODUCTS_MODIFIED_SINCE: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_products_scrapped_between - Returns the products the caller may view that were scrapped within the inclusive
+//									 time window passed, together with their number. Reads the state index.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_products_scrapped_between(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	from, to, err := t.parse_time_range(args)
+
+	if err != nil {
+		return nil, t.wrap_error("GET_PRODUCTS_SCRAPPED_BETWEEN: ", err)
+	}
+
+	products, err := t.retrieve_indexed_products(stub, [2]string{"state", strconv.Itoa(STATE_SCRAPPED)})
+
+	if err != nil {
+		return nil, err
+	}
+
+	scrapped := ScrappedProducts{Products: []Product{}}
+
+	for _, p := range t.visible_products(stub, products, caller, caller_affiliation) {
+
+		at, ok := p.StateTimestamps[STATE_SCRAPPED]
+
+		if ok && p.State == STATE_SCRAPPED && at >= from && at <= to {
+			scrapped.Products = append(scrapped.Products, p)
+		}
+	}
+
+	scrapped.Count = len(scrapped.Products)
+
+	bytes, err := json.Marshal(scrapped)
+
+	if err != nil {
+		return nil, errors.New("GET_PRODUCTS_SCRAPPED_BETWEEN: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_product_diff - Compares two versions of a product and returns the fields that differ, keyed by field name,
+//						with their old and new values. Versions are numbered from 0, the creation, in the history of
+//						the product's key.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_product_diff(stub shim.ChaincodeStubInterface, p Product, caller string, caller_affiliation int, from string, to string) ([]byte, error) {
+
+	_, err := t.get_vehicle_details(stub, p, caller, caller_affiliation)
+
+	if err != nil {
+		return nil, err
+	}
+
+	from_index, err := strconv.Atoi(from)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_PRODUCT_DIFF: Invalid version index " + from)
+	}
+
+	to_index, err := strconv.Atoi(to)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_PRODUCT_DIFF: Invalid version index " + to)
+	}
+
+	history, err := t.retrieve_history(stub, p.ProductID)
+
+	if err != nil {
+		return nil, t.wrap_error("GET_PRODUCT_DIFF: ", err)
+	}
+
+	for _, n := range []int{from_index, to_index} {
+		if n < 0 || n >= len(history) {
+			return nil, t.fail(ERR_NOT_FOUND, "GET_PRODUCT_DIFF: Version " + strconv.Itoa(n) + " out of range, product " + p.ProductID + " has " + strconv.Itoa(len(history)) + " versions")
+		}
+	}
+
+	old_fields := make(map[string]interface{})
+	new_fields := make(map[string]interface{})
+
+	if (!history[from_index].IsDelete && json.Unmarshal(history[from_index].Value, &old_fields) != nil) ||
+		(!history[to_index].IsDelete && json.Unmarshal(history[to_index].Value, &new_fields) != nil) {
+		return nil, errors.New("GET_PRODUCT_DIFF: Corrupt product version")
+	}
+
+	diff := make(map[string]FieldChange)
+
+	for field, old_value := range old_fields {
+		if new_value := new_fields[field]; !reflect.DeepEqual(old_value, new_value) {
+			diff[field] = FieldChange{Old: old_value, New: new_value}
+		}
+	}
+
+	for field, new_value := range new_fields {
+		if _, ok := old_fields[field]; !ok {
+			diff[field] = FieldChange{Old: nil, New: new_value}
+		}
+	}
+
+	bytes, err := json.Marshal(diff)                                        // Map keys are marshalled in sorted order
+
+	if err != nil {
+		return nil, errors.New("GET_PRODUCT_DIFF: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_products_summary_csv - Returns a CSV summary of the products the caller may view, one product per row after a
+//								fixed header row. Fields containing commas, quotes or newlines are quoted. Takes an
+//								optional bookmark, see retrieve_visible_page. When products were left unread the last
+//								row holds "nextBookmark" and the bookmark of the next page.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_products_summary_csv(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	bookmark := ""
+
+	if len(args) > 0 {
+		bookmark = args[0]
+	}
+
+	products, next, err := t.retrieve_visible_page(stub, caller, caller_affiliation, bookmark)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer bytes.Buffer
+
+	writer := csv.NewWriter(&buffer)
+
+	writer.Write([]string{"productId", "manufacturer", "owner", "state", "price", "currency", "destination"})
+
+	for _, p := range products {
+		writer.Write([]string{
+			p.ProductID,
+			p.Manufacturer,
+			p.Owner,
+			strconv.Itoa(p.State),
+			t.format_money(p.Price, p.Currency),
+			p.Currency,
+			p.Destination,
+		})
+	}
+
+	if next != "" {
+		writer.Write([]string{"nextBookmark", next})
+	}
+
+	writer.Flush()
+
+	if writer.Error() != nil {
+		return nil, errors.New("GET_PRODUCTS_SUMMARY_CSV: Error creating response")
+	}
+
+	return buffer.Bytes(), nil
+}
+
+//=================================================================================================================================
+//	 get_high_velocity_products - Returns the products the caller may view that changed owner more often than the
+//								  threshold passed. Takes an optional bookmark, see retrieve_visible_page.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_high_velocity_products(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
+
+	if len(args) < 1 || len(args) > 2 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_HIGH_VELOCITY_PRODUCTS: Incorrect number of arguments passed")
+	}
+
+	threshold, err := strconv.Atoi(args[0])
+
+	if err != nil || threshold < 0 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_HIGH_VELOCITY_PRODUCTS: Invalid threshold " + args[0])
+	}
+
+	bookmark := ""
+
+	if len(args) > 1 {
+		bookmark = args[1]
+	}
+
+	products, next, err := t.retrieve_visible_page(stub, caller, caller_affiliation, bookmark)
+
+	if err != nil {
+		return nil, err
+	}
+
+	flagged := []Product{}
+
+	for _, p := range products {
+		if p.TransferCount > threshold {
+			flagged = append(flagged, p)
+		}
+	}
+
+	bytes, err := t.product_page(flagged, bookmark, next)
+
+	if err != nil {
+		return nil, errors.New("GET_HIGH_VELOCITY_PRODUCTS: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_product_as_of - Returns the version of a product that was current at the epoch time passed, i.e. the last
+//						 version in the history of its key written at or before that time.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_product_as_of(stub shim.ChaincodeStubInterface, p Product, caller string, caller_affiliation int, as_of string) ([]byte, error) {
+
+	_, err := t.get_vehicle_details(stub, p, caller, caller_affiliation)
+
+	if err != nil {
+		return nil, err
+	}
+
+	at, err := strconv.ParseInt(as_of, 10, 64)
+
+	if err != nil {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_PRODUCT_AS_OF: Invalid time " + as_of)
+	}
+
+	history, err := t.retrieve_history(stub, p.ProductID)
+
+	if err != nil {
+		return nil, t.wrap_error("GET_PRODUCT_AS_OF: ", err)
+	}
+
+	for n := len(history) - 1; n >= 0; n-- {
+		if history[n].Timestamp <= at && !history[n].IsDelete {
+			return history[n].Value, nil
+		}
+	}
+
+	return nil, t.fail(ERR_NOT_FOUND, "GET_PRODUCT_AS_OF: no version at that time")
+}
+
+//=================================================================================================================================
+//	 get_product_terms - The private view of a product: its price, currency, sales contracts and banks. Only for the
+//						 parties allowed by can_view_terms, and only on peers that hold the terms.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_product_terms(stub shim.ChaincodeStubInterface, p Product, caller string, caller_affiliation int) ([]byte, error) {
+
+	if !t.can_view_terms(p, caller, caller_affiliation) {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
+
+	if p.TermsHash != "" && p.Currency == "" {
+		return nil, t.fail(ERR_INVALID_STATE, "GET_PRODUCT_TERMS: The terms of product " + p.ProductID + " are not held by this peer")
+	}
+
+	bytes, err := json.Marshal(CommercialTerms{Price: p.Price, Currency: p.Currency, Contracts: p.Contracts, SellerBank: p.SellerBank, BuyerBank: p.BuyerBank, MinorUnits: true})
+
+	if err != nil {
+		return nil, errors.New("GET_PRODUCT_TERMS: Error creating response")
+	}
+
+	return bytes, nil
+}
+
+//=================================================================================================================================
+//	 get_product_history - Returns every version of a product written to the ledger, oldest first, with the transaction
+//						   that wrote it. Read from the history of the product's key.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_product_history(stub shim.ChaincodeStubInterface, p Product, caller string, caller_affiliation int) ([]byte, error) {
 
-	bytes, err := json.Marshal(product)
+	_, err := t.get_vehicle_details(stub, p, caller, caller_affiliation)
 
 	if err != nil {
-		fmt.Printf("SAVE_CHANGES: Error converting vehicle record: %s", err); return false, errors.New("Error converting vehicle record")
+		return nil, err
 	}
 
-	err = stub.PutState(product.ProductID, bytes)
+	history, err := t.retrieve_history(stub, p.ProductID)
 
 	if err != nil {
-		fmt.Printf("SAVE_CHANGES: Error storing vehicle record: %s", err); return false, errors.New("Error storing vehicle record")
+		return nil, t.wrap_error("GET_PRODUCT_HISTORY: ", err)
 	}
 
-	return true, nil
-}
-//==============================================================================================================================
-// createRandomId - Creates a random id for the product
-//
-//==============================================================================================================================
+	bytes, err := json.Marshal(history)
 
-func (t *SimpleChaincode) createRandomId(stub *shim.ChaincodeStub) (int) {
-	var randomId = 0
-	var low = 100000000
-	var high = 999999999
-	for {
-		randomId = rand.Intn(high - low) + low
-		if (t.isRandomIdUnused(stub, randomId)) {
-			break
-		}
+	if err != nil {
+		return nil, errors.New("GET_PRODUCT_HISTORY: Error creating response")
 	}
-	//TODO in createProduct() die ID zur ID-Liste hinzufügen
 
-	return randomId
+	return bytes, nil
 }
 
-//==============================================================================================================================
-// isRandomIdUnused - Checks if the randomly created id is already used by another product.
-//
-//==============================================================================================================================
-func (t *SimpleChaincode) isRandomIdUnused(stub *shim.ChaincodeStub, randomId int) (bool) {
-	usedIds := make([]int, 500)
-	usedIds = t.getAllUsedProductIds(stub)
-	for _, id := range usedIds {
-		if (id == randomId) {
-			return false
-		}
-	}
-
-	return true
-}
-//==============================================================================================================================
-// isRandomIdUnused - Checks if the randomly created id is already used by another product. TODO Check comment
-//
-//==============================================================================================================================
-func (t *SimpleChaincode) getAllUsedProductIds(stub *shim.ChaincodeStub) (bool) {
+//=================================================================================================================================
+//	 get_buyer_obligations - Returns the products a buyer will own once paid for, from the issuing of the accreditive
+//							 up to payment, with the total owed per currency. The buyer and the regulator see all of
+//							 them, a buyer's bank only the products it is named on.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_buyer_obligations(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
 
-	usedIds := make([]int, 500)
+	if len(args) != 1 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_BUYER_OBLIGATIONS: Incorrect number of arguments passed")
+	}
 
-	bytes, err := stub.GetState("productId")
+	buyer := args[0]
 
-	if err != nil {
-		return nil, errors.New("Unable to get productIds")
+	if caller != buyer && caller_affiliation != GOVERNMENT && caller_affiliation != BUYER_BANK {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
 	}
 
-	var productIds ProductID_Holder
-	err = json.Unmarshal(bytes, &productIds)
+	products, err := t.retrieve_indexed_products(stub, [2]string{"buyer", buyer})
 
 	if err != nil {
-		return nil, errors.New("Invalid JSON")
+		return nil, err
 	}
-	var product Product
 
-	for i, pid := range productIds.ProductIDs {
+	obligations := BuyerObligations{Buyer: buyer, Products: []Product{}, Totals: make(map[string]Money)}
 
-		product, err = t.retrieve_product(stub, pid)
+	for _, p := range products {
 
-		if err != nil {
-			return nil, errors.New("Failed to retrieve pid")
+		if p.Buyer != buyer || !t.isActive(p) || p.State < STATE_ACCREDITIVE || p.State > STATE_PAYMENT {
+			continue
 		}
-		if (product != nil || product != "[]") {
-			usedIds[i] = product.ProductID
+
+		if caller != buyer && caller_affiliation == BUYER_BANK && t.buyer_bank(p) != caller {
+			continue
 		}
-	}
 
-	return usedIds
-}
-//==============================================================================================================================
-//	 Router Functions
-//==============================================================================================================================
-//	Invoke - Called on chaincode invoke. Takes a function name passed and calls that function. Converts some
-//		  initial arguments passed to other things for use in the called function e.g. name -> ecert
-//==============================================================================================================================
-func (t *SimpleChaincode) Invoke(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
+		obligations.Products = append(obligations.Products, p)
+		obligations.Totals[p.Currency] += p.Price
+	}
 
-	caller1, caller2, caller1_affiliation, caller2_affiliation, destination, price, currency, contract, err := t.get_caller_data(stub)
+	bytes, err := json.Marshal(obligations)
 
 	if err != nil {
-		return nil, errors.New("Error retrieving caller information")
+		return nil, errors.New("GET_BUYER_OBLIGATIONS: Error creating response")
 	}
 
-	if function == "create_product" {
-		return t.create_product(stub, caller1, caller2, caller1_affiliation, caller2_affiliation, destination, price, currency, contract, args[0])
-	} else {
-		// If the function is not a create then there must be a car so we need to retrieve the car.
+	return bytes, nil
+}
 
-		argPos := 1
+//=================================================================================================================================
+//	 get_ownership_breakdown - Returns who holds which share of a product. Co-owners may view it as well as anyone who
+//							   can view the product.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_ownership_breakdown(stub shim.ChaincodeStubInterface, p Product, caller string, caller_affiliation int) ([]byte, error) {
 
-		if function == "scrap_vehicle" {
-			// If its a scrap vehicle then only two arguments are passed (no update value) all others have three arguments and the v5cID is expected in the last argument
-			argPos = 0
-		}
+	if _, holder := p.OwnershipShares[caller]; !holder {
 
-		product, err := t.retrieve_product(stub, args[argPos])
+		_, err := t.get_vehicle_details(stub, p, caller, caller_affiliation)
 
 		if err != nil {
-			fmt.Printf("INVOKE: Error retrieving v5c: %s", err); return nil, errors.New("Error retrieving v5c")
+			return nil, err
 		}
+	}
+
+	breakdown := OwnershipBreakdown{ProductID: p.ProductID, Owner: p.Owner, Shares: p.OwnershipShares}
 
-		if strings.Contains(function, "update") == false           &&
-			function != "scrap_vehicle" {
-			//If the function is not an update or a scrappage it must be a transfer so we need to get the ecert of the recipient.
+	if len(breakdown.Shares) == 0 {
+		breakdown.Shares = map[string]float64{p.Owner: 1.0}
+	}
 
-			ecert, err := t.get_ecert(stub, args[0]);
+	bytes, err := json.Marshal(breakdown)
 
-			if err != nil {
-				return nil, err
-			}
+	if err != nil {
+		return nil, errors.New("GET_OWNERSHIP_BREAKDOWN: Error creating response")
+	}
 
-			rec_affiliation, err := t.check_affiliation(stub, string(ecert));
+	return bytes, nil
+}
 
-			if err != nil {
-				return nil, err
-			}
-			fmt.Printf(rec_affiliation) //TODO remove
-			fmt.Printf(product)//TODO remove
-			//if function == "manufacturer_to_buyer" {
-			//	return t.manufacturer_to_buyer(stub, v, caller, caller_affiliation, args[0], rec_affiliation)
-			//} else if function == "manufacturer_to_bank" {
-			//	return t.manufacturer_to_bank(stub, v, caller, caller_affiliation, args[0], rec_affiliation)
-			//} else if function == "buyer_to_buyer" {
-			//	return t.buyer_to_buyer(stub, v, caller, caller_affiliation, args[0], rec_affiliation)
-			//} else if function == "private_to_lease_company" {
-			//	return t.private_to_lease_company(stub, v, caller, caller_affiliation, args[0], rec_affiliation)
-			//} else if function == "lease_company_to_private" {
-			//	return t.lease_company_to_private(stub, v, caller, caller_affiliation, args[0], rec_affiliation)
-			//} else if function == "private_to_scrap_merchant" {
-			//	return t.private_to_scrap_merchant(stub, v, caller, caller_affiliation, args[0], rec_affiliation)
-			//}
-
-			//} else if function == "update_make" {
-			//	return t.update_make(stub, v, caller, caller_affiliation, args[0])
-			//} else if function == "update_model" {
-			//	return t.update_model(stub, v, caller, caller_affiliation, args[0])
-			//} else if function == "update_registration" {
-			//	return t.update_registration(stub, v, caller, caller_affiliation, args[0])
-			//} else if function == "update_colour" {
-			//	return t.update_colour(stub, v, caller, caller_affiliation, args[0])
-			//} else if function == "scrap_vehicle" {
-			//	return t.scrap_vehicle(stub, v, caller, caller_affiliation)
-		}
-
-		return nil, errors.New("Function of that name doesn't exist.")
+//=================================================================================================================================
+//	 get_products_by_route_contains - Returns the products the caller may view whose route passes through the waypoint
+//									  passed. Waypoints are compared whole and ignoring case, so "Port" doesn't match
+//									  "Portsmouth". Takes an optional bookmark, see retrieve_visible_page.
+//=================================================================================================================================
+func (t *SimpleChaincode) get_products_by_route_contains(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
 
+	waypoint := strings.TrimSpace(args[0])
+
+	if waypoint == "" {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_PRODUCTS_BY_ROUTE_CONTAINS: Waypoint is required")
 	}
-}
-//=================================================================================================================================	
-//	Query - Called on chaincode query. Takes a function name passed and calls that function. Passes the
-//  		initial arguments passed are passed on to the called function.
-//=================================================================================================================================	
-func (t *SimpleChaincode) Query(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
 
-	caller, caller_affiliation, err := t.get_caller_data(stub)
+	bookmark := ""
 
-	if err != nil {
-		fmt.Printf("QUERY: Error retrieving caller details %s", err); return nil, errors.New("QUERY: Error retrieving caller details")
+	if len(args) > 1 {
+		bookmark = args[1]
 	}
 
-	if function == "get_vehicle_details" {
+	products, next, err := t.retrieve_visible_page(stub, caller, caller_affiliation, bookmark)
 
-		if len(args) != 1 {
-			fmt.Printf("Incorrect number of arguments passed: Should be 1 but is %s", args);
-			return nil, errors.New("QUERY: Incorrect number of arguments passed")
-		}
+	if err != nil {
+		return nil, err
+	}
 
-		v, err := t.retrieve_product(stub, args[0])
-		if err != nil {
-			fmt.Printf("QUERY: Error retrieving v5c: %s", err); return nil, errors.New("QUERY: Error retrieving v5c " + err.Error())
+	matching := []Product{}
+
+	for _, p := range products {
+		for _, w := range t.route_waypoints(p.Route) {
+			if strings.EqualFold(w, waypoint) {
+				matching = append(matching, p)
+				break
+			}
 		}
+	}
 
-		return t.get_vehicle_details(stub, v, caller, caller_affiliation)
+	bytes, err := t.product_page(matching, bookmark, next)
 
-	} else if function == "get_vehicles" {
-		return t.get_vehicles(stub, caller, caller_affiliation)
+	if err != nil {
+		return nil, errors.New("GET_PRODUCTS_BY_ROUTE_CONTAINS: Error creating response")
 	}
-	return nil, errors.New("Received unknown function invocation")
+
+	return bytes, nil
 }
 
 //=================================================================================================================================
-//	 Create Function
-//=================================================================================================================================									
-//	 Create Vehicle - Creates the initial JSON for the vehcile and then saves it to the ledger.
-// caller1 : Seller - caller2 : Buyer
+//	 get_products_grouped_by_manufacturer - Regulator overview of how many active products each manufacturer has and
+//											what they are worth in each currency, sorted by manufacturer. Walks the
+//											manufacturer index a page at a time. Args are an optional page size, the
+//											number of products read, capped at MAX_PAGE_READS, and the bookmark
+//											returned with the previous page. A manufacturer whose products run over
+//											the end of a page carries on in the first group of the next page.
 //=================================================================================================================================
-func (t *SimpleChaincode) create_product(stub *shim.ChaincodeStub, caller1 string, caller2 string, caller1_affiliation int, caller2_affiliation int, product_destination string, product_price float32, product_currency string, contract byte) ([]byte, error) {
-
-	var product Product
-	var productId = t.createRandomId(stub)
+func (t *SimpleChaincode) get_products_grouped_by_manufacturer(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
 
-	if (caller1_affiliation == 2 && caller2_affiliation == 3) {
-		pid := "\"productId\":\"" + productId + "\", "                                                       // Variables to define the JSON
-		checkId := "\"checksum\":\"UNDEFINED\", "
-		manufacturer := "\"manufacturer\":\"" + caller1 + "\", "
-		owner := "\"owner\":\"" + caller1 + "\", "
-		origin := "\"origin\":\"UNDEFINED\", "
-		current_location := "\"current_location\":\"UNDEFINED\", "
-		destination := "\"destination\":\"" + product_destination + "\", "
-		route := "\"route\":\"UNDEFINED\", "
-		state := "\"state\":0, "
-		price := "\"price\":\"" + product_price + "\","
-		currency := "\"currency\":\"" + product_currency + "\","
-		width := "\"width\":\"UNDEFINED\","
-		height := "\"height\":\"UNDEFINED\","
-		weight := "\"weight\":\"UNDEFINED\","
-		sales_contract := "\"sales_contract\":\"" + contract + "\""
+	if caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
 
-		product_json := "{" + pid + checkId + manufacturer + owner + origin + current_location + destination + route + state + price + currency + width + height + weight + sales_contract + "}"        // Concatenates the variables to create the total JSON object
+	size := MAX_PAGE_READS
 
+	if len(args) > 0 && args[0] != "" {
 
-		var err = json.Unmarshal([]byte(product_json), &product)                                                        // Convert the JSON defined above into a vehicle object for go
+		requested, err := strconv.Atoi(args[0])
 
-		if err != nil {
-			return nil, errors.New("Invalid JSON object")
+		if err != nil || requested <= 0 {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "GET_PRODUCTS_GROUPED_BY_MANUFACTURER: Invalid page size " + args[0])
 		}
 
-		record, err := stub.GetState(product.V5cID)                                                                // If not an error then a record exists so cant create a new car with this V5cID as it must be unique
-
-		if record != nil {
-			return nil, errors.New("Vehicle already exists")
+		if requested < size {
+			size = requested
 		}
+	}
 
-		if caller_affiliation != GOVERNMENT {
-			// Only the regulator can create a new v5c
+	start := ""
 
-			return nil, errors.New("Permission Denied")
-		}
+	if len(args) > 1 && args[1] != "" {
 
-		_, err = t.save_changes(stub, product)
+		p, err := t.retrieve_product(stub, args[1])
 
 		if err != nil {
-			fmt.Printf("CREATE_VEHICLE: Error saving changes: %s", err); return nil, errors.New("Error saving changes")
+			return nil, t.fail(ERR_VALIDATION_FAILED, "GET_PRODUCTS_GROUPED_BY_MANUFACTURER: Invalid bookmark " + args[1])
 		}
 
-		bytes, err := stub.GetState("v5cIDs")
+		start, err = t.index_key(stub, "manufacturer", p.Manufacturer, p.ProductID)
 
 		if err != nil {
-			return nil, errors.New("Unable to get v5cIDs")
+			return nil, err
 		}
+	}
 
-		var v5cIDs ProductID_Holder
+	iter, err := stub.GetStateByPartialCompositeKey("manufacturer", []string{})
 
-		err = json.Unmarshal(bytes, &v5cIDs)
+	if err != nil {
+		return nil, errors.New("Unable to query the manufacturer index")
+	}
 
-		if err != nil {
-			return nil, errors.New("Corrupt V5C_Holder record")
-		}
+	defer iter.Close()
 
-		v5cIDs.ProductIDs = append(v5cIDs.ProductIDs, productId)
+	page := ManufacturerPage{Groups: []ManufacturerGroup{}}
+	reads := 0
 
-		bytes, err = json.Marshal(v5cIDs)
+	for iter.HasNext() {
+
+		kv, err := iter.Next()
 
 		if err != nil {
-			fmt.Print("Error creating V5C_Holder record")
+			return nil, errors.New("Unable to read the manufacturer index")
+		}
+
+		// Only the index entries before the bookmark are read, not their products
+		if kv.Key < start {
+			continue
 		}
 
-		err = stub.PutState("v5cIDs", bytes)
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
 
-		if err != nil {
-			return nil, errors.New("Unable to put the state")
+		if err != nil || len(attributes) != 2 {
+			return nil, errors.New("Corrupt manufacturer index key")
 		}
-	}
-	return nil, nil
 
-}
+		if reads == size {
+			page.NextBookmark = attributes[1]
+			break
+		}
 
-//=================================================================================================================================
-//	 Transfer Functions
-//=================================================================================================================================
-//	 authority_to_manufacturer
-//=================================================================================================================================
-//noinspection GoPlaceholderCount
-func (t *SimpleChaincode) manufacturer_to_buyer(stub *shim.ChaincodeStub, v Product, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+		p, err := t.retrieve_product(stub, attributes[1])
 
-	if v.Status == STATE_PRODUCTPASSPORTADDED        &&
-		v.Owner == caller                        &&
-		caller_affiliation == GOVERNMENT                &&
-		recipient_affiliation == SELLER                &&
-		v.Scrapped == false {
-		// If the roles and users are ok
+		if err != nil {
+			return nil, errors.New("Failed to retrieve product " + attributes[1])
+		}
 
-		v.Owner = recipient_name                // then make the owner the new owner
-		v.Status = STATE_CONTRACTADDED                        // and mark it in the state of manufacture
+		reads++
 
-	} else {
-		// Otherwise if there is an error
+		if !t.isActive(p) {
+			continue
+		}
+
+		last := len(page.Groups) - 1
 
-		fmt.Printf("AUTHORITY_TO_MANUFACTURER: Permission Denied");
-		return nil, errors.New("Permission Denied")
+		if last < 0 || page.Groups[last].Manufacturer != p.Manufacturer {
+			page.Groups = append(page.Groups, ManufacturerGroup{Manufacturer: p.Manufacturer, TotalValuePerCurrency: make(map[string]Money)})
+			last++
+		}
 
+		page.Groups[last].Count++
+		page.Groups[last].TotalValuePerCurrency[p.Currency] += p.Price
 	}
 
-	_, err := t.save_changes(stub, v)                                                // Write new state
+	bytes, err := json.Marshal(page)
 
 	if err != nil {
-		fmt.Printf("AUTHORITY_TO_MANUFACTURER: Error saving changes: %s", err); return nil, errors.New("Error saving changes")
+		return nil, errors.New("GET_PRODUCTS_GROUPED_BY_MANUFACTURER: Error creating response")
 	}
 
-	return nil, nil                                                                        // We are Done
-
+	return bytes, nil
 }
 
 //=================================================================================================================================
-//	 manufacturer_to_private
+//	 get_pending_actions - The caller's to-do list: the products waiting for the next step their role takes in the
+//						   lifecycle.
 //=================================================================================================================================
-func (t *SimpleChaincode) manufacturer_to_bank(stub *shim.ChaincodeStub, product Product, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
-
-	if product.Make == "UNDEFINED" ||
-		product.Name == "UNDEFINED" ||
-		product.Reg == "UNDEFINED" ||
-		product.Colour == "UNDEFINED" ||
-		product.VIN == 0 {
-		//If any part of the car is undefined it has not bene fully manufacturered so cannot be sent
-		fmt.Printf("MANUFACTURER_TO_PRIVATE: Product not fully defined! Product: %s", product)
-		return nil, errors.New("Car not fully defined")
+func (t *SimpleChaincode) get_pending_actions(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
+
+	// Only the products that can be waiting for the caller's role are read
+	lookups := map[int][][2]string{
+		GOVERNMENT:  {{"state", strconv.Itoa(STATE_PAYMENT)}},
+		SELLER:      {{"manufacturer", caller}},
+		SELLER_BANK: {{"state", strconv.Itoa(STATE_SALESCONTRACT)}, {"state", strconv.Itoa(STATE_ACCREDITIVE)}},
+		BUYER_BANK:  {{"state", strconv.Itoa(STATE_CHECK_ACCREDITIVE)}, {"state", strconv.Itoa(STATE_PAYMENT)}},
+		SHIPPER:     {{"custodian", caller}},
+		BUYER:       {{"custodian", caller}, {"buyer", caller}},
 	}
 
-	if product.Status == STATE_CONTRACTADDED        &&
-		product.Owner == caller                                &&
-		caller_affiliation == SELLER                        &&
-		recipient_affiliation == BUYER                &&
-		product.Scrapped == false {
+	products, err := t.retrieve_indexed_products(stub, lookups[caller_affiliation]...)
+
+	if err != nil {
+		return nil, err
+	}
 
-		product.Owner = recipient_name
-		product.Status = STATE_PAYMENTANDPROPERTYPLANADDED
+	pending := []Product{}
+
+	for _, p := range products {
+
+		var waiting bool
+
+		switch caller_affiliation {
+		case GOVERNMENT:
+			waiting = p.State == STATE_PAYMENT && p.Inspection == nil                                        // Inspect before payment is released
+		case SELLER:
+			waiting = p.Manufacturer == caller && p.State == STATE_MANUFACTURE                                // Build and ship
+		case SELLER_BANK:
+			waiting = p.State == STATE_SALESCONTRACT || p.State == STATE_ACCREDITIVE                        // Issue an accreditive
+		case BUYER_BANK:
+			waiting = (t.buyer_bank(p) == caller || t.buyer_bank(p) == "")        &&
+				(p.State == STATE_CHECK_ACCREDITIVE || (p.State == STATE_PAYMENT && !p.PaymentReleased))        // Check credit or pay
+		case SHIPPER:
+			waiting = p.Custodian == caller && p.State == STATE_SHIPPING                                        // Deliver
+		case BUYER:
+			waiting = (p.Custodian == caller && p.State == STATE_SHIPPING)        ||                                // Confirm delivery
+				(p.Buyer == caller && p.State == STATE_PAYMENT && p.PaymentReleased)                        // Put in use
+		}
 
-	} else {
-		return nil, errors.New("Permission denied")
+		if waiting && !p.Locked {
+			pending = append(pending, t.view_for(p, caller, caller_affiliation))
+		}
 	}
 
-	_, err := t.save_changes(stub, product)
+	bytes, err := json.Marshal(pending)
 
 	if err != nil {
-		fmt.Printf("MANUFACTURER_TO_PRIVATE: Error saving changes: %s", err); return nil, errors.New("Error saving changes")
+		return nil, t.fail(ERR_INVALID_STATE, "GET_PENDING_ACTIONS: Error creating response")
 	}
 
-	return nil, nil
-
+	return bytes, nil
 }
 
 //=================================================================================================================================
-//	 private_to_private
+//	 get_audit_log - Returns the last AuditLogSize entries in the audit log, oldest first, including those of logs
+//					 written by older versions of this chaincode. The log is pruned to that size when written, see
+//					 prune_audit_log; entries left from a larger size set before are skipped. Regulator only.
 //=================================================================================================================================
-func (t *SimpleChaincode) buyer_to_buyer(stub *shim.ChaincodeStub, v Product, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+func (t *SimpleChaincode) get_audit_log(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
 
-	if v.Status == STATE_PAYMENTANDPROPERTYPLANADDED        &&
-		v.Owner == caller                                        &&
-		caller_affiliation == BUYER                        &&
-		recipient_affiliation == BUYER                        &&
-		v.Scrapped == false {
+	if caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
 
-		v.Owner = recipient_name
+	config, err := t.get_config(stub)
 
-	} else {
+	if err != nil {
+		return nil, err
+	}
 
-		return nil, errors.New("Permission denied")
+	size := config.AuditLogSize
 
+	if size == 0 {
+		size = DEFAULT_AUDIT_LOG_SIZE
 	}
 
-	_, err := t.save_changes(stub, v)
+	entries := []AuditEntry{}
+
+	bytes, err := stub.GetState("AuditLog")
 
 	if err != nil {
-		fmt.Printf("PRIVATE_TO_PRIVATE: Error saving changes: %s", err); return nil, errors.New("Error saving changes")
+		return nil, errors.New("GET_AUDIT_LOG: Unable to get audit log")
 	}
 
-	return nil, nil
+	if len(bytes) != 0 && json.Unmarshal(bytes, &entries) != nil {
+		return nil, errors.New("GET_AUDIT_LOG: Corrupt audit log")
+	}
 
-}
+	iter, err := stub.GetStateByPartialCompositeKey(AUDIT_INDEX, []string{})
 
-//=================================================================================================================================
-//	 private_to_lease_company
-//=================================================================================================================================
-func (t *SimpleChaincode) private_to_lease_company(stub *shim.ChaincodeStub, v Product, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+	if err != nil {
+		return nil, errors.New("GET_AUDIT_LOG: Unable to get audit log")
+	}
 
-	if v.Status == STATE_PAYMENTANDPROPERTYPLANADDED        &&
-		v.Owner == caller                                        &&
-		caller_affiliation == BUYER                        &&
-		recipient_affiliation == SELLER_BANK                        &&
-		v.Scrapped == false {
+	defer iter.Close()
 
-		v.Owner = recipient_name
+	for iter.HasNext() {
 
-	} else {
-		return nil, errors.New("Permission denied")
-	}
+		kv, err := iter.Next()
 
-	_, err := t.save_changes(stub, v)
-	if err != nil {
-		fmt.Printf("PRIVATE_TO_LEASE_COMPANY: Error saving changes: %s", err); return nil, errors.New("Error saving changes")
-	}
+		if err != nil {
+			return nil, errors.New("GET_AUDIT_LOG: Unable to read audit log")
+		}
 
-	return nil, nil
+		var entry AuditEntry
 
-}
+		err = json.Unmarshal(kv.Value, &entry)
 
-//=================================================================================================================================
-//	 lease_company_to_private
-//=================================================================================================================================
-func (t *SimpleChaincode) lease_company_to_private(stub *shim.ChaincodeStub, v Product, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+		if err != nil {
+			return nil, errors.New("GET_AUDIT_LOG: Corrupt audit log entry " + kv.Key)
+		}
 
-	if v.Status == STATE_PAYMENTANDPROPERTYPLANADDED        &&
-		v.Owner == caller                                        &&
-		caller_affiliation == SELLER_BANK                        &&
-		recipient_affiliation == BUYER                        &&
-		v.Scrapped == false {
+		entries = append(entries, entry)                                                             // The keys sort oldest first
 
-		v.Owner = recipient_name
+		if len(entries) > size {
+			entries = entries[1:]
+		}
+	}
 
-	} else {
-		return nil, errors.New("Permission denied")
+	if len(entries) > size {
+		entries = entries[len(entries) - size:]
 	}
 
-	_, err := t.save_changes(stub, v)
+	bytes, err = json.Marshal(entries)
+
 	if err != nil {
-		fmt.Printf("LEASE_COMPANY_TO_PRIVATE: Error saving changes: %s", err); return nil, errors.New("Error saving changes")
+		return nil, errors.New("GET_AUDIT_LOG: Error creating response")
 	}
 
-	return nil, nil
-
+	return bytes, nil
 }
 
 //=================================================================================================================================
-//	 private_to_scrap_merchant
+//	 get_audit_trail - Returns the entries of the audit trail matching the filter passed, oldest first. Regulator only.
+//					   Pages are capped at MAX_PAGE_SIZE entries and MAX_PAGE_READS reads like those of get_vehicles.
+//					   Only invocations that were committed appear: calls that failed or were denied left no entry.
 //=================================================================================================================================
-func (t *SimpleChaincode) private_to_scrap_merchant(stub *shim.ChaincodeStub, v Product, caller string, caller_affiliation int, recipient_name string, recipient_affiliation int) ([]byte, error) {
+func (t *SimpleChaincode) get_audit_trail(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
 
-	if v.Status == STATE_PAYMENTANDPROPERTYPLANADDED        &&
-		v.Owner == caller                                        &&
-		caller_affiliation == BUYER                        &&
-		recipient_affiliation == BUYER_BANK                        &&
-		v.Scrapped == false {
+	if caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
+	}
 
-		v.Owner = recipient_name
-		v.Status = STATE_PRODUCTPASSPORTCOMPLETE
+	var filter TrailFilter
 
-	} else {
+	if len(args) > 0 && args[0] != "" {
 
-		return nil, errors.New("Permission denied")
+		err := json.Unmarshal([]byte(args[0]), &filter)
 
+		if err != nil {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "GET_AUDIT_TRAIL: Invalid filter JSON")
+		}
 	}
 
-	_, err := t.save_changes(stub, v)
-
-	if err != nil {
-		fmt.Printf("PRIVATE_TO_SCRAP_MERCHANT: Error saving changes: %s", err); return nil, errors.New("Error saving changes")
+	if filter.From < 0 || filter.To < 0 || filter.PageSize < 0 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_AUDIT_TRAIL: Invalid filter, times and page size must not be negative")
 	}
 
-	return nil, nil
+	size := filter.PageSize
 
-}
+	if size == 0 || size > MAX_PAGE_SIZE {
+		size = MAX_PAGE_SIZE
+	}
 
+	start := TRAIL_PREFIX + fmt.Sprintf("%019d", filter.From)
+	end := TRAIL_PREFIX + "~"
 
-//=================================================================================================================================
-//	 update_registration
-//=================================================================================================================================
-func (t *SimpleChaincode) update_registration(stub *shim.ChaincodeStub, v Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	if filter.To > 0 {
+		end = TRAIL_PREFIX + fmt.Sprintf("%019d", filter.To + 1)
+	}
 
-	if v.Owner == caller                        &&
-		caller_affiliation != BUYER_BANK        &&
-		v.Scrapped == false {
+	if filter.Bookmark != "" {
 
-		v.Reg = new_value
+		if !strings.HasPrefix(filter.Bookmark, TRAIL_PREFIX) || filter.Bookmark < start {
+			return nil, t.fail(ERR_VALIDATION_FAILED, "GET_AUDIT_TRAIL: Invalid bookmark " + filter.Bookmark)
+		}
 
-	} else {
-		return nil, errors.New("Permission denied")
+		start = filter.Bookmark
 	}
 
-	_, err := t.save_changes(stub, v)
+	iter, err := stub.GetStateByRange(start, end)
 
 	if err != nil {
-		fmt.Printf("UPDATE_REGISTRATION: Error saving changes: %s", err); return nil, errors.New("Error saving changes")
+		return nil, errors.New("GET_AUDIT_TRAIL: Unable to query the audit trail")
 	}
 
-	return nil, nil
+	defer iter.Close()
 
-}
+	page := TrailPage{Entries: []TrailEntry{}}
 
-//=================================================================================================================================
-//	 update_colour
-//=================================================================================================================================
-func (t *SimpleChaincode) update_colour(stub *shim.ChaincodeStub, v Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+	for reads := 0; iter.HasNext(); reads++ {
 
-	if v.Owner == caller                                &&
-		caller_affiliation == SELLER                        &&/*((v.Owner				== caller			&&
-			caller_affiliation	== MANUFACTURER)		||
-			caller_affiliation	== AUTHORITY)			&&*/
-		v.Scrapped == false {
+		kv, err := iter.Next()
 
-		v.Colour = new_value
-	} else {
+		if err != nil {
+			return nil, errors.New("GET_AUDIT_TRAIL: Unable to read the audit trail")
+		}
+
+		if page.Count == size || reads == MAX_PAGE_READS {
+			page.NextBookmark = kv.Key
+			break
+		}
+
+		var entry TrailEntry
+
+		err = json.Unmarshal(kv.Value, &entry)
+
+		if err != nil {
+			return nil, errors.New("GET_AUDIT_TRAIL: Corrupt audit trail entry " + kv.Key)
+		}
+
+		if (filter.ProductID != "" && entry.ProductID != filter.ProductID) || (filter.Caller != "" && entry.Caller != filter.Caller) {
+			continue
+		}
 
-		return nil, errors.New("Permission denied")
+		page.Entries = append(page.Entries, entry)
+		page.Count++
 	}
 
-	_, err := t.save_changes(stub, v)
+	bytes, err := json.Marshal(page)
 
 	if err != nil {
-		fmt.Printf("UPDATE_COLOUR: Error saving changes: %s", err); return nil, errors.New("Error saving changes")
+		return nil, errors.New("GET_AUDIT_TRAIL: Error creating response")
 	}
 
-	return nil, nil
-
+	return bytes, nil
 }
 
 //=================================================================================================================================
-//	 update_make
+//	 get_products_by_custodian - Returns the products currently in the custody of the participant passed, including
+//								 where they are and where they are going. Shippers may only list their own
+//								 assignments, the regulator may list anyone's.
 //=================================================================================================================================
-func (t *SimpleChaincode) update_make(stub *shim.ChaincodeStub, v Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
-
-	if v.Status == STATE_CONTRACTADDED        &&
-		v.Owner == caller                                &&
-		caller_affiliation == SELLER                        &&
-		v.Scrapped == false {
+func (t *SimpleChaincode) get_products_by_custodian(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
 
-		v.Make = new_value
-	} else {
+	if len(args) != 1 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_PRODUCTS_BY_CUSTODIAN: Incorrect number of arguments passed")
+	}
 
-		return nil, errors.New("Permission denied")
+	custodian := args[0]
 
+	if caller != custodian && caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
 	}
 
-	_, err := t.save_changes(stub, v)
+	products, err := t.retrieve_indexed_products(stub, [2]string{"custodian", custodian})
 
 	if err != nil {
-		fmt.Printf("UPDATE_MAKE: Error saving changes: %s", err); return nil, errors.New("Error saving changes")
+		return nil, err
 	}
 
-	return nil, nil
+	assigned := []Product{}
+
+	for _, p := range products {
+		if p.Custodian == custodian {
+			assigned = append(assigned, t.view_for(p, caller, caller_affiliation))
+		}
+	}
+
+	bytes, err := json.Marshal(assigned)
+
+	if err != nil {
+		return nil, errors.New("GET_PRODUCTS_BY_CUSTODIAN: Error creating response")
+	}
 
+	return bytes, nil
 }
 
 //=================================================================================================================================
-//	 update_model
+//	 get_products_for_bank - Returns the products a bank is exposed to, either as the issuer of the accreditive or as
+//							 the buyer's bank named in the sales contract. The amount is the accreditive when one has
+//							 been issued and the price otherwise; nothing is outstanding once payment is released.
 //=================================================================================================================================
-func (t *SimpleChaincode) update_model(stub *shim.ChaincodeStub, v Product, caller string, caller_affiliation int, new_value string) ([]byte, error) {
+func (t *SimpleChaincode) get_products_for_bank(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
 
-	if v.Status == STATE_CONTRACTADDED        &&
-		v.Owner == caller                                &&
-		caller_affiliation == SELLER                        &&
-		v.Scrapped == false {
+	if len(args) != 1 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_PRODUCTS_FOR_BANK: Incorrect number of arguments passed")
+	}
 
-		v.Name = new_value
+	bank := args[0]
 
-	} else {
-		return nil, errors.New("Permission denied")
+	if caller != bank && caller_affiliation != GOVERNMENT {
+		return nil, t.fail(ERR_PERMISSION_DENIED, "Permission denied")
 	}
 
-	_, err := t.save_changes(stub, v)
+	products, err := t.retrieve_indexed_products(stub, [2]string{"issuing_bank", bank}, [2]string{"buyer_bank", bank})
 
 	if err != nil {
-		fmt.Printf("UPDATE_MODEL: Error saving changes: %s", err); return nil, errors.New("Error saving changes")
+		return nil, err
 	}
 
-	return nil, nil
+	exposure := BankExposure{Bank: bank, Products: []BankExposureEntry{}, Outstanding: make(map[string]Money)}
 
-}
+	for _, p := range products {
 
-//=================================================================================================================================
-//	 scrap_vehicle
-//=================================================================================================================================
-func (t *SimpleChaincode) scrap_vehicle(stub *shim.ChaincodeStub, v Product, caller string, caller_affiliation int) ([]byte, error) {
+		if !t.isActive(p) {
+			continue
+		}
 
-	if v.Status == STATE_PRODUCTPASSPORTCOMPLETE        &&
-		v.Owner == caller                                &&
-		caller_affiliation == BUYER_BANK                &&
-		v.Scrapped == false {
+		entry := BankExposureEntry{ProductID: p.ProductID, State: p.State, Amount: p.Price, Currency: p.Currency}
 
-		v.Scrapped = true
+		if t.issuing_bank(p) == bank {
+			entry.Role = "issuing"
+		} else if t.buyer_bank(p) == bank {
+			entry.Role = "confirming"
+		} else {
+			continue
+		}
 
-	} else {
-		return nil, errors.New("Permission denied")
+		credit, err := t.product_accreditive(stub, p)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if credit != nil {
+			entry.Amount = credit.Amount
+			entry.Currency = credit.Currency
+		}
+
+		if !p.PaymentReleased && p.State < STATE_INUSE {
+			entry.Outstanding = entry.Amount
+		}
+
+		exposure.Products = append(exposure.Products, entry)
+		exposure.Outstanding[entry.Currency] += entry.Outstanding
 	}
 
-	_, err := t.save_changes(stub, v)
+	bytes, err := json.Marshal(exposure)
 
 	if err != nil {
-		fmt.Printf("SCRAP_VEHICLE: Error saving changes: %s", err); return nil, errors.New("SCRAP_VEHICLError saving changes")
+		return nil, errors.New("GET_PRODUCTS_FOR_BANK: Error creating response")
 	}
 
-	return nil, nil
-
+	return bytes, nil
 }
 
 //=================================================================================================================================
-//	 Read Functions
-//=================================================================================================================================
-//	 get_vehicle_details
+//	 get_products_by_owner - Returns the products owned by the caller. Looked up through the owner index, so only the
+//							 caller's own products are read.
 //=================================================================================================================================
-func (t *SimpleChaincode) get_vehicle_details(stub *shim.ChaincodeStub, v Product, caller string, caller_affiliation int) ([]byte, error) {
+func (t *SimpleChaincode) get_products_by_owner(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int) ([]byte, error) {
 
-	bytes, err := json.Marshal(v)
+	ids, err := t.index_lookup(stub, "owner", caller)
 
 	if err != nil {
-		return nil, errors.New("GET_VEHICLE_DETAILS: Invalid vehicle object")
+		return nil, err
 	}
 
-	if v.Owner == caller ||
-		caller_affiliation == GOVERNMENT {
+	owned := []Product{}
 
-		return bytes, nil
-	} else {
-		return nil, errors.New("Permission Denied")
+	for _, id := range ids {
+
+		p, err := t.retrieve_product(stub, id)
+
+		if err != nil {
+			return nil, errors.New("Failed to retrieve product " + id)
+		}
+
+		owned = append(owned, p)
+	}
+
+	bytes, err := json.Marshal(owned)
+
+	if err != nil {
+		return nil, errors.New("GET_PRODUCTS_BY_OWNER: Error creating response")
 	}
 
+	return bytes, nil
 }
 
 //=================================================================================================================================
-//	 get_vehicle_details
+//	 get_products_by_state - Returns the products in the state passed, as a number or a name such as SHIPPING. Looked up
+//							 through the state index. Banks see every product in the state they may act on, shippers
+//							 the ones in their custody and everyone else the products they own, make or buy.
 //=================================================================================================================================
+func (t *SimpleChaincode) get_products_by_state(stub shim.ChaincodeStubInterface, caller string, caller_affiliation int, args []string) ([]byte, error) {
 
-func (t *SimpleChaincode) get_vehicles(stub *shim.ChaincodeStub, caller string, caller_affiliation int) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, t.fail(ERR_VALIDATION_FAILED, "GET_PRODUCTS_BY_STATE: Incorrect number of arguments passed")
+	}
 
-	bytes, err := stub.GetState("v5cIDs")
+	state, err := strconv.Atoi(args[0])
 
 	if err != nil {
-		return nil, errors.New("Unable to get v5cIDs")
+
+		state = -1
+
+		for i, name := range STATE_NAMES {
+			if name == strings.ToUpper(args[0]) {
+				state = i
+			}
+		}
 	}
 
-	var v5cIDs ProductID_Holder
+	if state < STATE_SALESCONTRACT || state > STATE_SCRAPPED {
+		return nil, t.fail(ERR_NOT_FOUND, "GET_PRODUCTS_BY_STATE: Unknown state " + args[0])
+	}
 
-	err = json.Unmarshal(bytes, &v5cIDs)
+	ids, err := t.index_lookup(stub, "state", strconv.Itoa(state))
 
 	if err != nil {
-		return nil, errors.New("Corrupt V5C_Holder")
+		return nil, err
 	}
 
-	result := "["
-
-	var temp []byte
-	var v Product
+	matching := []Product{}
 
-	for _, v5c := range v5cIDs.ProductIDs {
+	for _, id := range ids {
 
-		v, err = t.retrieve_product(stub, v5c)
+		p, err := t.retrieve_product(stub, id)
 
 		if err != nil {
-			return nil, errors.New("Failed to retrieve V5C")
+			return nil, errors.New("Failed to retrieve product " + id)
 		}
 
-		temp, err = t.get_vehicle_details(stub, v, caller, caller_affiliation)
+		var visible bool
+
+		switch caller_affiliation {
+		case GOVERNMENT, SELLER_BANK:
+			visible = true
+		case BUYER_BANK:
+			visible = t.buyer_bank(p) == caller || t.buyer_bank(p) == ""
+		case SHIPPER:
+			visible = p.Custodian == caller
+		default:
+			visible = p.Owner == caller || p.Manufacturer == caller || p.Buyer == caller
+		}
 
-		if err == nil {
-			result += string(temp) + ","
+		if visible {
+			matching = append(matching, t.view_for(p, caller, caller_affiliation))
 		}
 	}
 
-	if len(result) == 1 {
-		result = "[]"
-	} else {
-		result = result[:len(result) - 1] + "]"
+	bytes, err := json.Marshal(matching)
+
+	if err != nil {
+		return nil, errors.New("GET_PRODUCTS_BY_STATE: Error creating response")
 	}
 
-	return []byte(result), nil
+	return bytes, nil
 }
 
 //=================================================================================================================================
@@ -0,0 +1,7503 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math"
+	"math/big"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+//==============================================================================================================================
+//	 testStub - A MockStub that also gives the chaincode a caller, transient data, a transaction time the test controls,
+//				the history of every key and the events set by the transaction. MockStub has none of these. writes
+//				counts the calls to PutState and DelState, including those of transactions that failed. While
+//				committed is set GetState reads from it instead, so like on a peer a transaction doesn't see its
+//				own writes. Paginated partial key queries work like on a peer with LevelDB, which MockStub leaves
+//				unimplemented.
+//==============================================================================================================================
+type testStub struct {
+	*shim.MockStub
+
+	args      [][]byte
+	creator   []byte
+	transient map[string][]byte
+	now       int64
+	history   map[string][]*queryresult.KeyModification
+	events    []*pb.ChaincodeEvent
+	writes    int
+	committed map[string][]byte
+}
+
+func newTestStub(cc *SimpleChaincode) *testStub {
+	return &testStub{
+		MockStub: shim.NewMockStub("vehicles", cc),
+		now:      1500000000,
+		history:  make(map[string][]*queryresult.KeyModification),
+	}
+}
+
+func (s *testStub) GetArgs() [][]byte { return s.args }
+
+func (s *testStub) GetStringArgs() []string {
+	args := make([]string, len(s.args))
+	for i, arg := range s.args {
+		args[i] = string(arg)
+	}
+	return args
+}
+
+func (s *testStub) GetFunctionAndParameters() (string, []string) {
+	args := s.GetStringArgs()
+	if len(args) == 0 {
+		return "", []string{}
+	}
+	return args[0], args[1:]
+}
+
+func (s *testStub) GetCreator() ([]byte, error) { return s.creator, nil }
+
+func (s *testStub) GetTransient() (map[string][]byte, error) { return s.transient, nil }
+
+func (s *testStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.now}, nil
+}
+
+func (s *testStub) GetState(key string) ([]byte, error) {
+	if s.committed != nil {
+		return s.committed[key], nil
+	}
+	return s.MockStub.GetState(key)
+}
+
+func (s *testStub) PutState(key string, value []byte) error {
+	s.writes++
+	err := s.MockStub.PutState(key, value)
+	if err == nil {
+		s.record(key, &queryresult.KeyModification{TxId: s.TxID, Value: value, Timestamp: &timestamp.Timestamp{Seconds: s.now}})
+	}
+	return err
+}
+
+func (s *testStub) DelState(key string) error {
+	s.writes++
+	err := s.MockStub.DelState(key)
+	if err == nil {
+		s.record(key, &queryresult.KeyModification{TxId: s.TxID, Timestamp: &timestamp.Timestamp{Seconds: s.now}, IsDelete: true})
+	}
+	return err
+}
+
+// record - Adds a modification to the history of a key. Like the peer, only the last write of a transaction is kept.
+func (s *testStub) record(key string, modification *queryresult.KeyModification) {
+
+	modifications := s.history[key]
+
+	if n := len(modifications); n > 0 && modifications[n-1].TxId == modification.TxId {
+		modifications = modifications[:n-1]
+	}
+
+	s.history[key] = append(modifications, modification)
+}
+
+func (s *testStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	return &historyIterator{modifications: s.history[key]}, nil
+}
+
+func (s *testStub) GetStateByPartialCompositeKeyWithPagination(objectType string, attributes []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+
+	iter, err := s.MockStub.GetStateByPartialCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iter.Close()
+
+	page := &kvIterator{}
+	metadata := &pb.QueryResponseMetadata{}
+
+	for iter.HasNext() {
+
+		kv, err := iter.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if kv.Key < bookmark {
+			continue
+		}
+
+		if len(page.kvs) == int(pageSize) {
+			metadata.Bookmark = kv.Key
+			break
+		}
+
+		page.kvs = append(page.kvs, kv)
+	}
+
+	metadata.FetchedRecordsCount = int32(len(page.kvs))
+
+	return page, metadata, nil
+}
+
+func (s *testStub) SetEvent(name string, payload []byte) error {
+	s.events = append(s.events, &pb.ChaincodeEvent{TxId: s.TxID, EventName: name, Payload: payload})
+	return nil
+}
+
+//==============================================================================================================================
+//	 snapshot - The world state, private data and history as they are, so the writes of a failed transaction can be
+//				discarded like the peer does with restore.
+//==============================================================================================================================
+type snapshot struct {
+	state   map[string][]byte
+	private map[string]map[string][]byte
+	history map[string][]*queryresult.KeyModification
+}
+
+func (s *testStub) snapshot() snapshot {
+
+	saved := snapshot{
+		state:   make(map[string][]byte),
+		private: make(map[string]map[string][]byte),
+		history: make(map[string][]*queryresult.KeyModification),
+	}
+
+	for key, value := range s.State {
+		saved.state[key] = value
+	}
+
+	for collection, values := range s.PvtState {
+		saved.private[collection] = make(map[string][]byte)
+		for key, value := range values {
+			saved.private[collection][key] = value
+		}
+	}
+
+	for key, modifications := range s.history {
+		saved.history[key] = modifications
+	}
+
+	return saved
+}
+
+func (s *testStub) restore(saved snapshot) {
+
+	for key := range s.State {
+		if _, ok := saved.state[key]; !ok {
+			s.MockStub.DelState(key)
+		}
+	}
+
+	for key, value := range saved.state {
+		if _, ok := s.State[key]; !ok {
+			s.MockStub.PutState(key, value)
+		}
+	}
+
+	s.State = saved.state
+	s.PvtState = saved.private
+	s.history = saved.history
+}
+
+//==============================================================================================================================
+//	 historyIterator - Iterates over the modifications of a key, oldest first.
+//==============================================================================================================================
+type historyIterator struct {
+	modifications []*queryresult.KeyModification
+	next          int
+}
+
+func (i *historyIterator) HasNext() bool { return i.next < len(i.modifications) }
+
+func (i *historyIterator) Next() (*queryresult.KeyModification, error) {
+	i.next++
+	return i.modifications[i.next-1], nil
+}
+
+func (i *historyIterator) Close() error { return nil }
+
+//==============================================================================================================================
+//	 kvIterator - Iterates over a page of query results.
+//==============================================================================================================================
+type kvIterator struct {
+	kvs  []*queryresult.KV
+	next int
+}
+
+func (i *kvIterator) HasNext() bool { return i.next < len(i.kvs) }
+
+func (i *kvIterator) Next() (*queryresult.KV, error) {
+	i.next++
+	return i.kvs[i.next-1], nil
+}
+
+func (i *kvIterator) Close() error { return nil }
+
+//==============================================================================================================================
+//	 identity - A participant calling the chaincode. Name is the username the chaincode knows them by and creator the
+//				serialized identity the peer would pass, holding a certificate with the role attribute. certificate is
+//				that certificate PEM encoded and key its private key, which the participant signs documents with.
+//==============================================================================================================================
+type identity struct {
+	Name        string
+	Role        int
+	creator     []byte
+	certificate string
+	key         *ecdsa.PrivateKey
+}
+
+var identities = map[string]identity{}
+var identities_lock sync.Mutex
+
+func newIdentity(t *testing.T, cn string, role int) identity {
+
+	identities_lock.Lock()
+	defer identities_lock.Unlock()
+
+	key := cn + "/" + strconv.Itoa(role)
+
+	if id, ok := identities[key]; ok {
+		return id
+	}
+
+	id := issueIdentity(t, cn, role)
+	identities[key] = id
+
+	return id
+}
+
+//==============================================================================================================================
+//	 issueIdentity - A new certificate and key for the participant, e.g. as they would get renewing their certificate.
+//					 newIdentity returns the same identity each time it's asked for one. issueIdentityValid issues a
+//					 certificate valid for the period passed.
+//==============================================================================================================================
+func issueIdentity(t *testing.T, cn string, role int) identity {
+	return issueIdentityValid(t, cn, role, time.Unix(0, 0), time.Unix(1<<32, 0))
+}
+
+func issueIdentityValid(t *testing.T, cn string, role int, notBefore time.Time, notAfter time.Time) identity {
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+
+	attrs := []byte(`{"attrs":{"` + ROLE_ATTRIBUTE + `":"` + strconv.Itoa(role) + `"}}`)
+
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(time.Now().UnixNano()),
+		Subject:         pkix.Name{CommonName: cn},
+		NotBefore:       notBefore,
+		NotAfter:        notAfter,
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}, Value: attrs}},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &private.PublicKey, private)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	creator, err := proto.Marshal(&msp.SerializedIdentity{Mspid: "Org1MSP", IdBytes: certificate})
+	if err != nil {
+		t.Fatalf("serializing identity: %v", err)
+	}
+
+	return identity{Name: cn + "@Org1MSP", Role: role, creator: creator, certificate: string(certificate), key: private}
+}
+
+//==============================================================================================================================
+//	 sign - The base64 encoded detached ECDSA signature of the participant over a digest, as execute_sales_contract
+//			takes them.
+//==============================================================================================================================
+func (id identity) sign(t *testing.T, digest []byte) string {
+
+	r, s, err := ecdsa.Sign(rand.Reader, id.key, digest)
+	if err != nil {
+		t.Fatalf("signing: %v", err)
+	}
+
+	signature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatalf("encoding signature: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+//==============================================================================================================================
+//	 fixture - A deployed chaincode with a cast of registered participants, one of each role plus a second shipper,
+//			   buyer and bank.
+//==============================================================================================================================
+type fixture struct {
+	t     *testing.T
+	cc    *SimpleChaincode
+	stub  *testStub
+	tx    int
+	last  Envelope
+	event []*pb.ChaincodeEvent
+
+	gov, maker, buyer, sbank, bbank, shipper, recycler identity
+	maker2, buyer2, shipper2, bbank2                   identity
+}
+
+func newFixture(t *testing.T, config string) *fixture {
+
+	f := &fixture{t: t, cc: new(SimpleChaincode)}
+	f.stub = newTestStub(f.cc)
+
+	args := [][]byte{[]byte("init")}
+
+	if config != "" {
+		args = append(args, []byte(config))
+	}
+
+	f.stub.args = args
+	f.stub.MockTransactionStart("init")
+	response := f.cc.Init(f.stub)
+	f.stub.MockTransactionEnd("init")
+
+	if response.Status != shim.OK {
+		t.Fatalf("Init failed: %s", response.Message)
+	}
+
+	f.gov = newIdentity(t, "regulator", GOVERNMENT)
+	f.maker = newIdentity(t, "maker", SELLER)
+	f.maker2 = newIdentity(t, "maker2", SELLER)
+	f.buyer = newIdentity(t, "buyer", BUYER)
+	f.buyer2 = newIdentity(t, "buyer2", BUYER)
+	f.sbank = newIdentity(t, "sellerbank", SELLER_BANK)
+	f.bbank = newIdentity(t, "buyerbank", BUYER_BANK)
+	f.bbank2 = newIdentity(t, "buyerbank2", BUYER_BANK)
+	f.shipper = newIdentity(t, "shipper", SHIPPER)
+	f.shipper2 = newIdentity(t, "shipper2", SHIPPER)
+	f.recycler = newIdentity(t, "recycler", RECYCLER)
+
+	for _, id := range []identity{f.maker, f.maker2, f.buyer, f.buyer2, f.sbank, f.bbank, f.bbank2, f.shipper, f.shipper2, f.recycler} {
+		f.ok(f.gov, "register_participant", id.Name, strconv.Itoa(id.Role))
+	}
+
+	return f
+}
+
+//==============================================================================================================================
+//	 invoke - Calls the chaincode as the caller passed and returns the envelope of its response. A second later than the
+//			  previous transaction. Like the peer, the writes of a transaction that fails are discarded.
+//==============================================================================================================================
+func (f *fixture) invoke(caller identity, function string, args ...string) Envelope {
+
+	f.tx++
+	f.stub.now++
+
+	txid := "tx" + strconv.Itoa(f.tx)
+	saved := f.stub.snapshot()
+
+	f.stub.args = [][]byte{[]byte(function)}
+	for _, arg := range args {
+		f.stub.args = append(f.stub.args, []byte(arg))
+	}
+
+	f.stub.creator = caller.creator
+	f.stub.events = nil
+
+	f.stub.MockTransactionStart(txid)
+	response := f.cc.Invoke(f.stub)
+
+	body := response.Payload
+	f.event = f.stub.events
+
+	if response.Status != shim.OK {
+		body = []byte(response.Message)
+		f.stub.restore(saved)
+		f.event = nil
+	}
+
+	f.stub.MockTransactionEnd(txid)
+	f.stub.transient = nil
+
+	var envelope Envelope
+
+	err := json.Unmarshal(body, &envelope)
+	if err != nil {
+		f.t.Fatalf("%s: response isn't an envelope: %s", function, body)
+	}
+
+	f.last = envelope
+
+	return envelope
+}
+
+//==============================================================================================================================
+//	 ok - invoke for calls that must succeed. Returns the data of the response.
+//==============================================================================================================================
+func (f *fixture) ok(caller identity, function string, args ...string) json.RawMessage {
+
+	f.t.Helper()
+
+	envelope := f.invoke(caller, function, args...)
+
+	if !envelope.OK {
+		f.t.Fatalf("%s(%s) by %s failed: %s %s", function, strings.Join(args, ", "), caller.Name, envelope.Code, envelope.Message)
+	}
+
+	return envelope.Data
+}
+
+//==============================================================================================================================
+//	 fails - invoke for calls that must fail with the code passed. Returns the message of the response.
+//==============================================================================================================================
+func (f *fixture) fails(code string, caller identity, function string, args ...string) string {
+
+	f.t.Helper()
+
+	envelope := f.invoke(caller, function, args...)
+
+	if envelope.OK || envelope.Code != code {
+		f.t.Fatalf("%s(%s) by %s: expected %s, got %s %s", function, strings.Join(args, ", "), caller.Name, code, envelope.Code, envelope.Message)
+	}
+
+	return envelope.Message
+}
+
+//==============================================================================================================================
+//	 run - Runs a subtest with the fixture reporting to it.
+//==============================================================================================================================
+func (f *fixture) run(name string, test func(t *testing.T)) {
+
+	parent := f.t
+
+	parent.Run(name, func(t *testing.T) {
+		f.t = t
+		defer func() { f.t = parent }()
+		test(t)
+	})
+}
+
+//==============================================================================================================================
+//	 decode - Unmarshals the data of a response into v.
+//==============================================================================================================================
+func (f *fixture) decode(data json.RawMessage, v interface{}) {
+
+	f.t.Helper()
+
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		f.t.Fatalf("decoding %s: %v", data, err)
+	}
+}
+
+//==============================================================================================================================
+//	 product - Reads a product straight from the world state.
+//==============================================================================================================================
+func (f *fixture) product(pid string) Product {
+
+	f.t.Helper()
+
+	var product Product
+
+	bytes := f.stub.State[pid]
+	if len(bytes) == 0 {
+		f.t.Fatalf("product %s not found", pid)
+	}
+
+	f.decode(bytes, &product)
+
+	return product
+}
+
+//==============================================================================================================================
+//	 credit - The accreditive a product links to, as stored on the public ledger.
+//==============================================================================================================================
+func (f *fixture) credit(pid string) Accreditive {
+
+	f.t.Helper()
+
+	var credit Accreditive
+
+	bytes := f.stub.State["Accreditive_"+f.product(pid).AccreditiveID]
+	if len(bytes) == 0 {
+		f.t.Fatalf("no accreditive for product %s", pid)
+	}
+
+	f.decode(bytes, &credit)
+
+	return credit
+}
+
+//==============================================================================================================================
+//	 upgrade - Runs Init again, as upgrading the chaincode does, without a config unless one is passed.
+//==============================================================================================================================
+func (f *fixture) upgrade(config ...string) {
+
+	f.t.Helper()
+
+	if response := f.reinit(config...); response.Status != shim.OK {
+		f.t.Fatalf("Init failed: %s", response.Message)
+	}
+}
+
+//==============================================================================================================================
+//	 reinit - upgrade for upgrades that may fail. Returns the response of Init. Transient data set before is passed to
+//			  Init and cleared like after an invoke.
+//==============================================================================================================================
+func (f *fixture) reinit(config ...string) pb.Response {
+
+	f.t.Helper()
+
+	f.stub.args = [][]byte{[]byte("init")}
+
+	for _, c := range config {
+		f.stub.args = append(f.stub.args, []byte(c))
+	}
+
+	f.stub.MockTransactionStart("upgrade")
+	response := f.cc.Init(f.stub)
+	f.stub.MockTransactionEnd("upgrade")
+	f.stub.transient = nil
+
+	return response
+}
+
+//==============================================================================================================================
+//	 store - Writes a product straight to the world state, e.g. to set up a record older versions of the chaincode left.
+//==============================================================================================================================
+func (f *fixture) store(p Product) {
+
+	f.t.Helper()
+
+	bytes, err := json.Marshal(p)
+	if err != nil {
+		f.t.Fatalf("encoding product: %v", err)
+	}
+
+	f.stub.MockTransactionStart("store")
+	defer f.stub.MockTransactionEnd("store")
+
+	err = f.stub.PutState(p.ProductID, bytes)
+	if err != nil {
+		f.t.Fatalf("storing product: %v", err)
+	}
+}
+
+//==============================================================================================================================
+//	 create - The manufacturer creates a product for the buyer priced 100.00 USD, shipped to the destination passed.
+//			  Returns its id.
+//==============================================================================================================================
+func (f *fixture) create(maker identity, buyer identity, destination string) string {
+	return f.create_priced(maker, buyer, destination, "100.00", "USD")
+}
+
+func (f *fixture) create_priced(maker identity, buyer identity, destination string, price string, currency string) string {
+
+	f.t.Helper()
+
+	data := f.ok(maker, "create_product", buyer.Name, destination, price, currency, "")
+
+	return strings.Trim(string(data), "\"")
+}
+
+//==============================================================================================================================
+//	 create_contracted - Creates a product at the default price whose sales contract names f.sbank and the buyer's bank
+//						 passed.
+//==============================================================================================================================
+func (f *fixture) create_contracted(maker identity, buyer identity, destination string, bank identity) string {
+
+	f.t.Helper()
+
+	terms := `{"sellerBank":"` + f.sbank.Name + `","buyerBank":"` + bank.Name + `"}`
+	data := f.ok(maker, "create_product", buyer.Name, destination, "100.00", "USD", terms)
+
+	return strings.Trim(string(data), "\"")
+}
+
+//==============================================================================================================================
+//	 advance - Takes a product from its sales contract through the lifecycle up to the state passed, with the fixture's
+//			   banks and shipper. The product must be owned by f.maker and sold to f.buyer.
+//==============================================================================================================================
+func (f *fixture) advance(pid string, state int) {
+
+	f.t.Helper()
+
+	p := f.product(pid)
+
+	if p.State < STATE_CHECK_ACCREDITIVE && state >= STATE_CHECK_ACCREDITIVE {
+		f.ok(f.sbank, "bank_issue_accreditive", `{"Amount":`+strconv.FormatInt(int64(p.Price), 10)+`,"Currency":"`+p.Currency+`"}`, pid)
+	}
+
+	if p.State < STATE_MANUFACTURE && state >= STATE_MANUFACTURE {
+		f.ok(f.bbank, "check_accreditive", pid)
+	}
+
+	if p.State < STATE_SHIPPING && state >= STATE_SHIPPING {
+		f.ok(f.maker, "start_shipping", f.shipper.Name, pid)
+	}
+
+	if p.State < STATE_PAYMENT && state >= STATE_PAYMENT {
+		f.ok(f.shipper, "shipper_to_buyer", f.buyer.Name, pid)
+		f.ok(f.buyer, "confirm_delivery", pid)
+	}
+
+	if p.State < STATE_INUSE && state >= STATE_INUSE {
+		f.ok(f.bbank, "pay_full", pid)
+		f.ok(f.buyer, "put_in_use", pid)
+	}
+
+	if p.State < STATE_SCRAPPED && state >= STATE_SCRAPPED {
+		f.ok(f.buyer, "scrap_product", pid)
+	}
+}
+
+//==============================================================================================================================
+//	 emitted - The payloads of the events of the name passed sent by the last transaction, unpacking the "events" event
+//			   a transaction emitting several events sends.
+//==============================================================================================================================
+func (f *fixture) emitted(name string) []json.RawMessage {
+
+	f.t.Helper()
+
+	payloads := []json.RawMessage{}
+
+	for _, event := range f.event {
+
+		if event.EventName != "events" {
+			if event.EventName == name {
+				payloads = append(payloads, json.RawMessage(event.Payload))
+			}
+			continue
+		}
+
+		var events []Event
+		f.decode(event.Payload, &events)
+
+		for _, e := range events {
+			if e.Name == name {
+				payloads = append(payloads, e.Payload)
+			}
+		}
+	}
+
+	return payloads
+}
+
+//==============================================================================================================================
+//	 Tests
+//==============================================================================================================================
+func TestGetProductsByCurrency(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	usd1 := f.create_priced(f.maker, f.buyer, "London", "100.00", "USD")
+	usd2 := f.create_priced(f.maker, f.buyer, "Paris", "250.50", "USD")
+	f.create_priced(f.maker, f.buyer, "Berlin", "75.00", "EUR")
+	f.create_priced(f.maker2, f.buyer, "Rome", "10.00", "USD")
+
+	tests := []struct {
+		name     string
+		caller   identity
+		currency string
+		code     string
+		ids      []string
+		total    Money
+	}{
+		{"matching products of the caller", f.maker, "USD", "", []string{usd1, usd2}, 35050},
+		{"lower case code", f.maker, "usd", "", []string{usd1, usd2}, 35050},
+		{"no products in currency", f.maker, "GBP", "", []string{}, 0},
+		{"unrecognised currency", f.maker, "XYZ", ERR_VALIDATION_FAILED, nil, 0},
+		{"empty currency", f.maker, "", ERR_VALIDATION_FAILED, nil, 0},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, tt.caller, "get_products_by_currency", tt.currency)
+				return
+			}
+
+			var exposure CurrencyExposure
+			f.decode(f.ok(tt.caller, "get_products_by_currency", tt.currency), &exposure)
+
+			if exposure.Total != tt.total || exposure.Count != len(tt.ids) || len(exposure.Products) != len(tt.ids) {
+				t.Fatalf("expected %d products totalling %d, got %d totalling %d", len(tt.ids), tt.total, exposure.Count, exposure.Total)
+			}
+
+			for i, id := range ids_of(exposure.Products) {
+				if !contains(tt.ids, id) {
+					t.Errorf("product %d: unexpected product %s", i, id)
+				}
+			}
+		})
+	}
+}
+
+//==============================================================================================================================
+//	 ids_of - The ids of the products passed.
+//==============================================================================================================================
+func ids_of(products []Product) []string {
+
+	ids := []string{}
+
+	for _, p := range products {
+		ids = append(ids, p.ProductID)
+	}
+
+	return ids
+}
+
+func contains(values []string, value string) bool {
+
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestCreateProductValidation(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	tests := []struct {
+		name    string
+		caller  identity
+		args    []string
+		code    string
+		message string
+	}{
+		{"valid request", f.maker, []string{`{"buyer":"buyer@Org1MSP","destination":"London","price":10000,"currency":"USD"}`}, "", ""},
+		{"valid positional request", f.maker, []string{f.buyer.Name, "London", "100.00", "USD", ""}, "", ""},
+		{"missing arguments", f.maker, []string{f.buyer.Name, "London", "100.00", "USD"}, ERR_VALIDATION_FAILED, "Incorrect number of arguments"},
+		{"invalid price", f.maker, []string{f.buyer.Name, "London", "ten", "USD", ""}, ERR_VALIDATION_FAILED, "Invalid price"},
+		{"missing destination", f.maker, []string{`{"buyer":"buyer@Org1MSP","price":10000,"currency":"USD"}`}, ERR_VALIDATION_FAILED, "missing buyer or destination"},
+		{"blank destination", f.maker, []string{`{"buyer":"buyer@Org1MSP","destination":"  ","price":10000,"currency":"USD"}`}, ERR_VALIDATION_FAILED, "destination is required"},
+		{"zero price", f.maker, []string{`{"buyer":"buyer@Org1MSP","destination":"London","price":0,"currency":"USD"}`}, ERR_VALIDATION_FAILED, "price must be greater than 0"},
+		{"negative price", f.maker, []string{`{"buyer":"buyer@Org1MSP","destination":"London","price":-100,"currency":"USD"}`}, ERR_VALIDATION_FAILED, "price must be greater than 0"},
+		{"invalid currency", f.maker, []string{`{"buyer":"buyer@Org1MSP","destination":"London","price":10000,"currency":"XYZ"}`}, ERR_VALIDATION_FAILED, "not a valid ISO 4217 code"},
+		{"missing currency", f.maker, []string{`{"buyer":"buyer@Org1MSP","destination":"London","price":10000}`}, ERR_VALIDATION_FAILED, "not a valid ISO 4217 code"},
+		{"unknown field", f.maker, []string{`{"buyer":"buyer@Org1MSP","destination":"London","price":10000,"currency":"USD","colour":"red"}`}, ERR_VALIDATION_FAILED, "unknown field"},
+		{"caller isn't a manufacturer", f.buyer, []string{`{"buyer":"buyer@Org1MSP","destination":"London","price":10000,"currency":"USD"}`}, ERR_PERMISSION_DENIED, "only manufacturers"},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				if message := f.fails(tt.code, tt.caller, "create_product", tt.args...); !strings.Contains(message, tt.message) {
+					t.Errorf("expected a message about %q, got %q", tt.message, message)
+				}
+				return
+			}
+
+			pid := strings.Trim(string(f.ok(tt.caller, "create_product", tt.args...)), "\"")
+			p := f.product(pid)
+
+			if p.Destination != "London" || p.Price != 10000 || p.Currency != "USD" || p.Manufacturer != tt.caller.Name {
+				t.Errorf("product stored as %+v", p)
+			}
+		})
+	}
+}
+
+func TestProductRequest(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	shipped := f.create(f.maker, f.buyer, "London")
+	f.advance(shipped, STATE_MANUFACTURE)
+
+	f.ok(f.maker, "start_shipping", `{"productId":"`+shipped+`","recipient":"`+f.shipper.Name+`"}`)
+
+	if p := f.product(shipped); p.Custodian != f.shipper.Name || p.State != STATE_SHIPPING {
+		t.Errorf("expected custodian %s in shipping, got custodian %s, state %d", f.shipper.Name, p.Custodian, p.State)
+	}
+
+	priced := f.create(f.maker, f.buyer, "London")
+
+	f.ok(f.maker, "update_price", `{"productId":"`+priced+`","newValue":"120.50","nonce":"n1"}`)
+
+	if p := f.product(priced); p.Price != 12050 {
+		t.Errorf("expected a price of 12050, got %d", p.Price)
+	}
+
+	tests := []struct {
+		name     string
+		function string
+		request  string
+		message  string
+	}{
+		{"transfer missing productId", "start_shipping", `{"recipient":"` + f.shipper.Name + `"}`, "missing productId"},
+		{"transfer missing recipient", "start_shipping", `{"productId":"` + priced + `"}`, "missing recipient"},
+		{"update missing productId", "update_price", `{"newValue":"99.00"}`, "missing productId"},
+		{"update missing newValue", "update_price", `{"productId":"` + priced + `"}`, "missing newValue"},
+		{"unknown field", "update_price", `{"productId":"` + priced + `","newValue":"99.00","colour":"red"}`, "unknown field"},
+		{"not a document", "update_price", `{"productId":`, "Invalid request"},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if message := f.fails(ERR_VALIDATION_FAILED, f.maker, tt.function, tt.request); !strings.Contains(message, tt.message) {
+				t.Errorf("expected a message about %q, got %q", tt.message, message)
+			}
+		})
+	}
+
+	if p := f.product(priced); p.Price != 12050 || p.State != STATE_SALESCONTRACT {
+		t.Errorf("expected the refused requests to leave the product alone, got %+v", p)
+	}
+}
+
+func TestStartShippingRecordsCustody(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_MANUFACTURE)
+
+	f.fails(ERR_PERMISSION_DENIED, f.maker, "start_shipping", f.buyer.Name, pid)
+	f.ok(f.maker, "start_shipping", f.shipper.Name, pid)
+
+	p := f.product(pid)
+
+	if p.Owner != f.maker.Name || p.Custodian != f.shipper.Name || p.State != STATE_SHIPPING {
+		t.Fatalf("expected owner %s and custodian %s in shipping, got owner %s, custodian %s, state %d", f.maker.Name, f.shipper.Name, p.Owner, p.Custodian, p.State)
+	}
+
+	location := `{"lat":51.5,"lon":-0.1}`
+
+	tests := []struct {
+		name   string
+		caller identity
+		code   string
+	}{
+		{"owner may not move a product in transit", f.maker, ERR_PERMISSION_DENIED},
+		{"other shipper may not move it", f.shipper2, ERR_PERMISSION_DENIED},
+		{"custodian moves it", f.shipper, ""},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, tt.caller, "update_location", location, pid)
+				return
+			}
+
+			f.ok(tt.caller, "update_location", location, pid)
+
+			if p := f.product(pid); p.Location == nil || p.Location.Lat != 51.5 || p.Owner != f.maker.Name {
+				t.Errorf("location not updated by the custodian: %+v", p.Location)
+			}
+		})
+	}
+}
+
+func TestLocationHistory(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_SHIPPING)
+
+	source := func(i int) string {
+		return "tracker-" + strconv.Itoa(i)
+	}
+
+	for i := 0; i < MAX_LOCATION_HISTORY+2; i++ {
+		f.ok(f.shipper, "update_location", `{"lat":51.5,"lon":-0.1,"source":"`+source(i)+`"}`, pid)
+	}
+
+	p := f.product(pid)
+
+	if len(p.LocationHistory) != MAX_LOCATION_HISTORY {
+		t.Fatalf("expected %d positions in the history, got %d", MAX_LOCATION_HISTORY, len(p.LocationHistory))
+	}
+
+	if first, last := p.LocationHistory[0], p.LocationHistory[MAX_LOCATION_HISTORY-1]; first.Source != source(2) || last.Source != source(MAX_LOCATION_HISTORY+1) {
+		t.Errorf("expected the two oldest positions dropped, got history from %s to %s", first.Source, last.Source)
+	}
+
+	if p.Location == nil || p.Location.Source != source(MAX_LOCATION_HISTORY+1) {
+		t.Errorf("expected the latest position as location, got %+v", p.Location)
+	}
+
+	tests := []struct {
+		name     string
+		location string
+		code     string
+	}{
+		{"latitude above 90", `{"lat":90.5,"lon":0}`, ERR_VALIDATION_FAILED},
+		{"latitude below -90", `{"lat":-91,"lon":0}`, ERR_VALIDATION_FAILED},
+		{"longitude above 180", `{"lat":0,"lon":180.5}`, ERR_VALIDATION_FAILED},
+		{"longitude below -180", `{"lat":0,"lon":-181}`, ERR_VALIDATION_FAILED},
+		{"on the bounds", `{"lat":-90,"lon":180,"source":"bounds"}`, ""},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code == "" {
+				f.ok(f.shipper, "update_location", tt.location, pid)
+
+				if p := f.product(pid); p.Location == nil || p.Location.Source != "bounds" {
+					t.Errorf("expected the position on the bounds to be kept, got %+v", p.Location)
+				}
+				return
+			}
+
+			before := string(f.stub.State[pid])
+
+			f.fails(tt.code, f.shipper, "update_location", tt.location, pid)
+
+			if len(f.last.Errors) != 1 || f.last.Errors[0].Field != "location" {
+				t.Errorf("expected an error for the location, got %+v", f.last.Errors)
+			}
+
+			if string(f.stub.State[pid]) != before {
+				t.Errorf("expected the position out of range not to be stored")
+			}
+		})
+	}
+}
+
+func TestGetCustodyChain(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_MANUFACTURE)
+
+	var chain []CustodyEntry
+	f.decode(f.ok(f.maker, "get_custody_chain", pid), &chain)
+
+	if len(chain) != 0 {
+		t.Fatalf("expected no custody chain before shipping, got %+v", chain)
+	}
+
+	f.ok(f.maker, "start_shipping", f.shipper.Name, pid)
+	shipped := f.stub.now
+	f.ok(f.maker, "reassign_shipper", f.shipper2.Name, pid)
+	reassigned := f.stub.now
+	f.ok(f.shipper2, "shipper_to_buyer", f.buyer.Name, pid)
+	handed := f.stub.now
+	f.ok(f.buyer, "confirm_delivery", pid)
+
+	expected := []CustodyEntry{
+		{Custodian: f.maker.Name, Timestamp: shipped},
+		{Custodian: f.shipper.Name, Timestamp: shipped},
+		{Custodian: f.shipper2.Name, Timestamp: reassigned},
+		{Custodian: f.buyer.Name, Timestamp: handed},
+	}
+
+	tests := []struct {
+		name   string
+		caller identity
+		code   string
+	}{
+		{"owner", f.maker, ""},
+		{"custodian", f.buyer, ""},
+		{"regulator", f.gov, ""},
+		{"earlier shipper", f.shipper, ERR_PERMISSION_DENIED},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, tt.caller, "get_custody_chain", pid)
+				return
+			}
+
+			var chain []CustodyEntry
+			f.decode(f.ok(tt.caller, "get_custody_chain", pid), &chain)
+
+			if len(chain) != len(expected) {
+				t.Fatalf("expected %+v, got %+v", expected, chain)
+			}
+
+			for i := range expected {
+				if chain[i] != expected[i] {
+					t.Errorf("entry %d: expected %+v, got %+v", i, expected[i], chain[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRevertLastTransition(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		state  int
+		caller func(f *fixture) identity
+		code   string
+		owner  func(f *fixture) string
+		after  int
+	}{
+		{"reverts the payment that put a product in use", STATE_INUSE, func(f *fixture) identity { return f.gov }, "", func(f *fixture) string { return f.maker.Name }, STATE_PAYMENT},
+		{"reverts the start of shipping", STATE_SHIPPING, func(f *fixture) identity { return f.gov }, "", func(f *fixture) string { return f.maker.Name }, STATE_MANUFACTURE},
+		{"only the regulator may revert", STATE_INUSE, func(f *fixture) identity { return f.buyer }, ERR_PERMISSION_DENIED, nil, 0},
+		{"scrapped products are final", STATE_SCRAPPED, func(f *fixture) identity { return f.gov }, ERR_INVALID_STATE, nil, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, "")
+
+			pid := f.create(f.maker, f.buyer, "London")
+			f.advance(pid, tt.state)
+
+			before := f.product(pid)
+
+			if tt.code != "" {
+				f.fails(tt.code, tt.caller(f), "revert_last_transition", pid)
+
+				if p := f.product(pid); p.State != before.State || p.Owner != before.Owner {
+					t.Errorf("failed revert changed the product to state %d owned by %s", p.State, p.Owner)
+				}
+				return
+			}
+
+			f.ok(tt.caller(f), "revert_last_transition", pid)
+
+			p := f.product(pid)
+
+			if p.State != tt.after || p.Owner != tt.owner(f) {
+				t.Fatalf("expected state %d owned by %s, got state %d owned by %s", tt.after, tt.owner(f), p.State, p.Owner)
+			}
+
+			last := p.OwnerHistory[len(p.OwnerHistory)-1]
+
+			if last.Action != "revert" || last.Actor != f.gov.Name || !p.OwnerHistory[len(p.OwnerHistory)-2].Reverted {
+				t.Errorf("revert not recorded in the owner history: %+v", p.OwnerHistory)
+			}
+		})
+	}
+}
+
+func TestDwellTimeLimits(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		wait     int64
+		exceeded bool
+	}{
+		{"within the limit", 30, false},
+		{"at the limit", 60, false},
+		{"over the limit", 3600, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, `{"dwellLimits":{"0":60}}`)
+
+			pid := f.create(f.maker, f.buyer, "London")
+			at := f.stub.now + tt.wait
+
+			var stale []Product
+			f.decode(f.ok(f.maker, "get_stale_products", strconv.FormatInt(at, 10)), &stale)
+
+			if (len(stale) == 1) != tt.exceeded || (tt.exceeded && stale[0].ProductID != pid) {
+				t.Fatalf("expected exceeded %v, get_stale_products returned %v", tt.exceeded, ids_of(stale))
+			}
+
+			f.stub.now = at - 1
+			f.advance(pid, STATE_CHECK_ACCREDITIVE)
+
+			events := f.emitted("dwell_exceeded")
+
+			if (len(events) == 1) != tt.exceeded {
+				t.Fatalf("expected exceeded %v, got dwell_exceeded events %s", tt.exceeded, events)
+			}
+
+			if p := f.product(pid); p.State != STATE_CHECK_ACCREDITIVE {
+				t.Errorf("transition was blocked, product is in state %d", p.State)
+			}
+
+			if tt.exceeded {
+
+				var payload map[string]interface{}
+				f.decode(events[0], &payload)
+
+				if payload["productId"] != pid || payload["state"] != float64(STATE_SALESCONTRACT) || payload["limit"] != float64(60) {
+					t.Errorf("unexpected dwell_exceeded payload %s", events[0])
+				}
+			}
+		})
+	}
+}
+
+func TestCreateProductReturnsId(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"positional args", []string{f.buyer.Name, "London", "100.00", "USD", ""}},
+		{"positional args with a nonce", []string{f.buyer.Name, "London", "100.00", "USD", "", "", "n1"}},
+		{"JSON request", []string{`{"buyer":"buyer@Org1MSP","destination":"London","price":10000,"currency":"USD"}`}},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			var id int
+			f.decode(f.ok(f.maker, "create_product", tt.args...), &id)
+
+			pid := strconv.Itoa(id)
+
+			if p := f.product(pid); p.ProductID != pid {
+				t.Fatalf("product stored under %s has id %s", pid, p.ProductID)
+			}
+
+			key, _ := f.stub.CreateCompositeKey(PRODUCT_INDEX, []string{pid})
+
+			if _, ok := f.stub.State[key]; !ok {
+				t.Errorf("product %s returned before it was indexed", pid)
+			}
+
+			f.ok(f.maker, "get_vehicle_details", pid)
+		})
+	}
+}
+
+func TestSuggestConsolidations(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	first := f.create(f.maker, f.buyer, "London")
+	second := f.create(f.maker, f.buyer, "London")
+	f.create(f.maker, f.buyer, "Paris")
+	f.create_priced(f.maker, f.buyer, "London", "100.00", "EUR")
+	shipped := f.create(f.maker, f.buyer, "London")
+	f.advance(shipped, STATE_SHIPPING)
+	f.create(f.maker2, f.buyer, "London")
+
+	tests := []struct {
+		name         string
+		manufacturer string
+		groups       []ConsolidationGroup
+	}{
+		{"groups the un-shipped products by destination and currency", f.maker.Name, []ConsolidationGroup{{Destination: "London", Currency: "USD", ProductIDs: []string{first, second}}}},
+		{"no candidates for another manufacturer", f.maker2.Name, []ConsolidationGroup{}},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			var groups []ConsolidationGroup
+			f.decode(f.ok(f.maker, "suggest_consolidations", tt.manufacturer), &groups)
+
+			if len(groups) != len(tt.groups) {
+				t.Fatalf("expected %+v, got %+v", tt.groups, groups)
+			}
+
+			for i, g := range tt.groups {
+
+				sort.Strings(g.ProductIDs)
+				sort.Strings(groups[i].ProductIDs)
+
+				if groups[i].Destination != g.Destination || groups[i].Currency != g.Currency || strings.Join(groups[i].ProductIDs, ",") != strings.Join(g.ProductIDs, ",") {
+					t.Errorf("group %d: expected %+v, got %+v", i, g, groups[i])
+				}
+			}
+		})
+	}
+}
+
+func TestManufacturerUpdatesWhileBankOwns(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		state  int
+		caller func(f *fixture) identity
+		code   string
+	}{
+		{"manufacturer updates while the bank owns the product", STATE_MANUFACTURE, func(f *fixture) identity { return f.maker }, ""},
+		{"owning bank may not update", STATE_MANUFACTURE, func(f *fixture) identity { return f.sbank }, ERR_PERMISSION_DENIED},
+		{"another manufacturer may not update", STATE_MANUFACTURE, func(f *fixture) identity { return f.maker2 }, ERR_PERMISSION_DENIED},
+		{"no updates once shipped", STATE_SHIPPING, func(f *fixture) identity { return f.maker }, ERR_PERMISSION_DENIED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, "")
+
+			pid := f.create(f.maker, f.buyer, "London")
+			f.advance(pid, tt.state)
+
+			p := f.product(pid)
+			p.Owner = f.sbank.Name
+			f.store(p)
+
+			for _, function := range []string{"update_width", "update_height", "update_weight"} {
+
+				if tt.code != "" {
+					f.fails(tt.code, tt.caller(f), function, "12.5", pid)
+					continue
+				}
+
+				f.ok(tt.caller(f), function, "12.5", pid)
+			}
+
+			if p := f.product(pid); tt.code == "" && (p.Width != 12.5 || p.Height != 12.5 || p.Weight != 12.5 || p.Owner != f.sbank.Name) {
+				t.Errorf("dimensions not updated: %+v", p)
+			}
+		})
+	}
+}
+
+func TestGetVehiclesNDJSON(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	first := f.create(f.maker, f.buyer, "London")
+	second := f.create(f.maker, f.buyer, "Paris")
+	f.create(f.maker2, f.buyer, "Rome")
+
+	expected := []string{first, second}
+	sort.Strings(expected)
+
+	tests := []struct {
+		name    string
+		options []string
+		ndjson  bool
+		code    string
+	}{
+		{"newline delimited JSON", []string{`{"format":"ndjson"}`}, true, ""},
+		{"array by default", nil, false, ""},
+		{"array when asked for JSON", []string{`{"format":"json"}`}, false, ""},
+		{"unknown format", []string{`{"format":"xml"}`}, false, ERR_VALIDATION_FAILED},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, f.maker, "get_vehicles", tt.options...)
+				return
+			}
+
+			data := f.ok(f.maker, "get_vehicles", tt.options...)
+
+			var products []Product
+
+			if tt.ndjson {
+
+				var stream string
+				f.decode(data, &stream)
+
+				if !strings.HasSuffix(stream, "\n") {
+					t.Fatalf("stream doesn't end with a newline: %q", stream)
+				}
+
+				for _, line := range strings.Split(strings.TrimSuffix(stream, "\n"), "\n") {
+					var p Product
+					f.decode(json.RawMessage(line), &p)
+					products = append(products, p)
+				}
+			} else {
+				f.decode(data, &products)
+			}
+
+			if ids := ids_of(products); strings.Join(ids, ",") != strings.Join(expected, ",") {
+				t.Errorf("expected products %v, got %v", expected, ids)
+			}
+		})
+	}
+}
+
+func TestUnits(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.ok(f.maker, "update_width", "254", pid)
+	f.ok(f.maker, "update_height", "30.48", pid)
+	f.ok(f.maker, "update_weight", "45.359237", pid)
+
+	if p := f.product(pid); p.Units != (Units{Length: "cm", Mass: "kg"}) {
+		t.Fatalf("expected metric units by default, got %+v", p.Units)
+	}
+
+	f.run("metric to imperial", func(t *testing.T) {
+
+		var converted ConvertedDimensions
+		f.decode(f.ok(f.maker, "convert_units", pid, "imperial"), &converted)
+
+		expected := ConvertedDimensions{ProductID: pid, Units: Units{Length: "in", Mass: "lb"}, Width: 100, Height: 12, Weight: 100}
+
+		if converted.Units != expected.Units || math.Abs(converted.Width-expected.Width) > 0.001 || math.Abs(converted.Height-expected.Height) > 0.001 || math.Abs(converted.Weight-expected.Weight) > 0.001 {
+			t.Errorf("expected %+v, got %+v", expected, converted)
+		}
+	})
+
+	tests := []struct {
+		name     string
+		function string
+		args     []string
+		code     string
+	}{
+		{"unknown unit system", "convert_units", []string{pid, "cubits"}, ERR_NOT_FOUND},
+		{"unknown length unit at creation", "create_product", []string{f.buyer.Name, "London", "100.00", "USD", "", `{"Length":"furlong","Mass":"kg"}`}, ERR_VALIDATION_FAILED},
+		{"unknown mass unit at creation", "create_product", []string{f.buyer.Name, "London", "100.00", "USD", "", `{"Length":"cm","Mass":"stone"}`}, ERR_VALIDATION_FAILED},
+		{"invalid units JSON", "create_product", []string{f.buyer.Name, "London", "100.00", "USD", "", `{"Length":`}, ERR_VALIDATION_FAILED},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+			f.fails(tt.code, f.maker, tt.function, tt.args...)
+		})
+	}
+
+	f.run("imperial units at creation", func(t *testing.T) {
+
+		var id int
+		f.decode(f.ok(f.maker, "create_product", f.buyer.Name, "London", "100.00", "USD", "", `{"Length":"in","Mass":"lb"}`), &id)
+
+		if p := f.product(strconv.Itoa(id)); p.Units != (Units{Length: "in", Mass: "lb"}) {
+			t.Errorf("expected imperial units, got %+v", p.Units)
+		}
+	})
+}
+
+func TestCheckProgression(t *testing.T) {
+
+	cc := new(SimpleChaincode)
+
+	tests := []struct {
+		name   string
+		from   int
+		to     int
+		action string
+		code   string
+	}{
+		{"forward transfer", STATE_MANUFACTURE, STATE_SHIPPING, "transfer", ""},
+		{"same state", STATE_SHIPPING, STATE_SHIPPING, "transfer", ""},
+		{"withdrawal moves back", STATE_CHECK_ACCREDITIVE, STATE_ACCREDITIVE, "withdraw", ""},
+		{"revert moves back", STATE_INUSE, STATE_PAYMENT, "revert", ""},
+		{"rejection moves back", STATE_CHECK_ACCREDITIVE, STATE_SALESCONTRACT, "reject", ""},
+		{"transfer may not move back", STATE_SHIPPING, STATE_MANUFACTURE, "transfer", ERR_INVALID_STATE},
+		{"scrap may not move back", STATE_SCRAPPED, STATE_INUSE, "scrap", ERR_INVALID_STATE},
+		{"state outside the lifecycle", STATE_INUSE, STATE_SCRAPPED + 1, "transfer", ERR_VALIDATION_FAILED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			err := cc.check_progression(tt.from, tt.to, tt.action)
+
+			if tt.code == "" && err != nil {
+				t.Fatalf("expected the transition to be allowed, got %v", err)
+			}
+
+			if tt.code != "" && (err == nil || cc.classify(err).Code != tt.code) {
+				t.Fatalf("expected %s, got %v", tt.code, err)
+			}
+		})
+	}
+}
+
+func TestWithdrawIsAReversal(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_CHECK_ACCREDITIVE)
+
+	f.ok(f.sbank, "withdraw_accreditive", pid)
+
+	p := f.product(pid)
+
+	if p.State != STATE_ACCREDITIVE || p.OwnerHistory[len(p.OwnerHistory)-1].Action != "withdraw" {
+		t.Fatalf("expected the withdrawal to move the product back to state %d, got %d", STATE_ACCREDITIVE, p.State)
+	}
+}
+
+func TestGetProductsCreatedBetween(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	early := f.create(f.maker, f.buyer, "London")
+	early_at := f.stub.now
+	f.stub.now += 100
+	late := f.create(f.maker, f.buyer, "Paris")
+	late_at := f.stub.now
+
+	at := func(seconds int64) string { return strconv.FormatInt(seconds, 10) }
+
+	tests := []struct {
+		name string
+		from string
+		to   string
+		code string
+		ids  []string
+	}{
+		{"range holding one product", at(early_at - 10), at(early_at + 10), "", []string{early}},
+		{"range holding both", at(early_at), at(late_at), "", []string{early, late}},
+		{"bounds are inclusive", at(late_at), at(late_at), "", []string{late}},
+		{"range just after a product", at(early_at + 1), at(late_at - 1), "", []string{}},
+		{"from after to", at(late_at), at(early_at), ERR_VALIDATION_FAILED, nil},
+		{"not a time", "yesterday", at(late_at), ERR_VALIDATION_FAILED, nil},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, f.maker, "get_products_created_between", tt.from, tt.to)
+				return
+			}
+
+			var products []Product
+			f.decode(f.ok(f.maker, "get_products_created_between", tt.from, tt.to), &products)
+
+			ids := ids_of(products)
+			sort.Strings(ids)
+			sort.Strings(tt.ids)
+
+			if strings.Join(ids, ",") != strings.Join(tt.ids, ",") {
+				t.Errorf("expected %v, got %v", tt.ids, ids)
+			}
+		})
+	}
+}
+
+func TestRemovedAndMalformedInvocations(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+
+	tests := []struct {
+		name     string
+		function string
+		args     []string
+		code     string
+	}{
+		{"set_peer_address is gone with the registrar", "set_peer_address", []string{"registrar.example.com:7054"}, ERR_NOT_FOUND},
+		{"unknown function on a product", "set_peer_address", []string{f.buyer.Name, pid}, ERR_NOT_FOUND},
+		{"no args", "update_route", nil, ERR_VALIDATION_FAILED},
+		{"update without the product id", "update_route", []string{"London"}, ERR_VALIDATION_FAILED},
+		{"transfer without the product id", "start_shipping", []string{f.shipper.Name}, ERR_VALIDATION_FAILED},
+		{"product only function without args", "scrap_product", nil, ERR_VALIDATION_FAILED},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+			f.fails(tt.code, f.gov, tt.function, tt.args...)
+		})
+	}
+
+	f.run("unknown function isn't taken for a transfer", func(t *testing.T) {
+
+		for _, args := range [][]string{{f.buyer.Name, pid}, {f.buyer.Name, "999999999"}, {"nobody", pid}} {
+			if message := f.fails(ERR_NOT_FOUND, f.maker, "sell_to_buyer", args...); message != "Function of that name doesn't exist." {
+				t.Errorf("%v: expected the function refused before the product or recipient is looked up, got %q", args, message)
+			}
+		}
+	})
+}
+
+func TestGetProductDiff(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	created := f.stub.now
+	f.ok(f.maker, "update_batch", "B-17", pid)
+	updated := f.stub.now
+
+	tests := []struct {
+		name    string
+		from    string
+		to      string
+		code    string
+		changes map[string]FieldChange
+	}{
+		{"batch set", "0", "1", "", map[string]FieldChange{
+			"Batch":        {Old: "", New: "B-17"},
+			"LastModified": {Old: float64(created), New: float64(updated)},
+		}},
+		{"reversed", "1", "0", "", map[string]FieldChange{
+			"Batch":        {Old: "B-17", New: ""},
+			"LastModified": {Old: float64(updated), New: float64(created)},
+		}},
+		{"same version", "1", "1", "", map[string]FieldChange{}},
+		{"index past the last version", "0", "2", ERR_NOT_FOUND, nil},
+		{"negative index", "-1", "1", ERR_NOT_FOUND, nil},
+		{"index isn't a number", "first", "1", ERR_VALIDATION_FAILED, nil},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, f.maker, "get_product_diff", pid, tt.from, tt.to)
+				return
+			}
+
+			var diff map[string]FieldChange
+			f.decode(f.ok(f.maker, "get_product_diff", pid, tt.from, tt.to), &diff)
+
+			if !reflect.DeepEqual(diff, tt.changes) {
+				t.Errorf("expected %+v, got %+v", tt.changes, diff)
+			}
+		})
+	}
+}
+
+func TestSaveChangesInvariants(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	stored := string(f.stub.State[pid])
+
+	tests := []struct {
+		name   string
+		change func(p *Product)
+		code   string
+	}{
+		{"negative price", func(p *Product) { p.Price = -100 }, ERR_VALIDATION_FAILED},
+		{"zero price", func(p *Product) { p.Price = 0 }, ERR_VALIDATION_FAILED},
+		{"negative weight", func(p *Product) { p.Weight = -1 }, ERR_VALIDATION_FAILED},
+		{"state before the lifecycle", func(p *Product) { p.State = STATE_SALESCONTRACT - 1 }, ERR_VALIDATION_FAILED},
+		{"state after the lifecycle", func(p *Product) { p.State = STATE_SCRAPPED + 1 }, ERR_VALIDATION_FAILED},
+		{"valid product", func(p *Product) { p.Weight = 10 }, ""},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			p := f.product(pid)
+			tt.change(&p)
+
+			f.stub.MockTransactionStart("save")
+			saved, err := f.cc.save_changes(f.stub, p)
+			f.stub.MockTransactionEnd("save")
+
+			if tt.code == "" {
+				if err != nil || !saved || f.product(pid).Weight != 10 {
+					t.Fatalf("expected the product to be saved, got %v", err)
+				}
+				return
+			}
+
+			if err == nil || saved || f.cc.classify(err).Code != tt.code {
+				t.Fatalf("expected %s, got saved %v, %v", tt.code, saved, err)
+			}
+
+			if string(f.stub.State[pid]) != stored {
+				t.Errorf("refused product was written")
+			}
+		})
+	}
+}
+
+func TestGetSupplyChainView(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	terms := `{"sellerBank":"` + f.sbank.Name + `","buyerBank":"` + f.bbank.Name + `"}`
+	pid := strings.Trim(string(f.ok(f.maker, "create_product", f.buyer.Name, "London", "100.00", "USD", terms)), "\"")
+
+	f.advance(pid, STATE_SHIPPING)
+
+	want := SupplyChainView{
+		ProductID:    pid,
+		Manufacturer: f.maker.Name,
+		Owner:        f.maker.Name,
+		Custodian:    f.shipper.Name,
+		IssuingBank:  f.sbank.Name,
+		BuyerBank:    f.bbank.Name,
+		State:        STATE_SHIPPING,
+		StateName:    "SHIPPING",
+	}
+
+	for _, caller := range []identity{f.maker, f.gov, f.sbank, f.bbank} {
+		f.run(caller.Name, func(t *testing.T) {
+
+			var view SupplyChainView
+			f.decode(f.ok(caller, "get_supply_chain_view", pid), &view)
+			view.Milestones = nil
+
+			if !reflect.DeepEqual(view, want) {
+				t.Errorf("expected %+v, got %+v", want, view)
+			}
+		})
+	}
+
+	for _, caller := range []identity{f.buyer2, f.bbank2, f.shipper2} {
+		f.run(caller.Name+" is refused", func(t *testing.T) {
+			f.fails(ERR_PERMISSION_DENIED, caller, "get_supply_chain_view", pid)
+		})
+	}
+}
+
+func TestConfirmDeliveries(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	first := f.create(f.maker, f.buyer, "London")
+	second := f.create(f.maker, f.buyer, "London")
+	elsewhere := f.create(f.maker, f.buyer, "London")
+	proposed := f.create(f.maker, f.buyer, "London")
+
+	f.advance(first, STATE_SHIPPING)
+	f.advance(second, STATE_SHIPPING)
+	f.advance(proposed, STATE_SHIPPING)
+	f.advance(elsewhere, STATE_MANUFACTURE)
+	f.ok(f.maker, "start_shipping", f.shipper2.Name, elsewhere)
+	f.ok(f.shipper, "propose_transfer", "shipper_to_buyer", f.buyer2.Name, proposed)
+
+	ids, _ := json.Marshal([]string{first, elsewhere, "999999999", proposed, second})
+
+	var results []BatchResult
+	f.decode(f.ok(f.shipper, "confirm_deliveries", string(ids), f.buyer.Name), &results)
+
+	tests := []struct {
+		pid       string
+		success   bool
+		code      string
+		custodian string
+	}{
+		{first, true, "", f.buyer.Name},
+		{elsewhere, false, ERR_PERMISSION_DENIED, f.shipper2.Name},
+		{"999999999", false, ERR_NOT_FOUND, ""},
+		{proposed, false, ERR_INVALID_STATE, f.shipper.Name},
+		{second, true, "", f.buyer.Name},
+	}
+
+	if len(results) != len(tests) {
+		t.Fatalf("expected %d results, got %+v", len(tests), results)
+	}
+
+	for i, tt := range tests {
+		f.run(tt.pid, func(t *testing.T) {
+
+			if results[i].ProductID != tt.pid || results[i].Success != tt.success {
+				t.Fatalf("expected %s to succeed: %v, got %+v", tt.pid, tt.success, results[i])
+			}
+
+			if !tt.success && (results[i].Error == nil || results[i].Error.Code != tt.code || results[i].Error.Message == "") {
+				t.Errorf("expected the failure to be explained with %s, got %+v", tt.code, results[i].Error)
+			}
+
+			if tt.custodian != "" && f.product(tt.pid).Custodian != tt.custodian {
+				t.Errorf("expected %s in the custody of %s, got %s", tt.pid, tt.custodian, f.product(tt.pid).Custodian)
+			}
+
+			if tt.success && f.product(tt.pid).State != STATE_SHIPPING {
+				t.Errorf("expected %s to stay in shipping until the buyer accepts it", tt.pid)
+			}
+		})
+	}
+
+	f.fails(ERR_VALIDATION_FAILED, f.shipper, "confirm_deliveries", first, f.buyer.Name)
+	f.fails(ERR_VALIDATION_FAILED, f.shipper, "confirm_deliveries", string(ids))
+}
+
+func TestConfirmDeliveriesOnHold(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	held := f.create(f.maker, f.buyer, "London")
+	free := f.create(f.maker, f.buyer, "London")
+
+	f.advance(held, STATE_SHIPPING)
+	f.advance(free, STATE_SHIPPING)
+	f.ok(f.gov, "place_hold", "customs inspection", held)
+
+	ids, _ := json.Marshal([]string{held, free})
+
+	var results []BatchResult
+	f.decode(f.ok(f.shipper, "confirm_deliveries", string(ids), f.buyer.Name), &results)
+
+	if len(results) != 2 || results[0].Success || results[0].Error == nil || results[0].Error.Code != ERR_HOLD_ACTIVE || !results[1].Success {
+		t.Fatalf("expected only the product on hold to fail, got %+v", results)
+	}
+
+	events := f.emitted("milestone_reached")
+
+	if len(events) != 1 {
+		t.Fatalf("expected a single milestone_reached event, got %d", len(events))
+	}
+
+	var event MilestoneEvent
+	f.decode(events[0], &event)
+
+	if event.ProductID != free || event.Milestone != "DELIVERED" {
+		t.Errorf("expected the delivery of %s only, got %+v", free, event)
+	}
+
+	if p := f.product(held); p.Custodian != f.shipper.Name || f.cc.milestone_reached(p, "DELIVERED") {
+		t.Errorf("expected the product on hold to stay with the shipper, got %s", p.Custodian)
+	}
+}
+
+func TestAcceptDeliveries(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	first := f.create(f.maker, f.buyer, "London")
+	second := f.create(f.maker, f.buyer, "London")
+	undelivered := f.create(f.maker, f.buyer, "London")
+	other := f.create(f.maker, f.buyer2, "London")
+
+	for _, pid := range []string{first, second, undelivered, other} {
+		f.advance(pid, STATE_SHIPPING)
+	}
+
+	f.ok(f.shipper, "shipper_to_buyer", f.buyer.Name, first)
+	f.ok(f.shipper, "shipper_to_buyer", f.buyer.Name, second)
+	f.ok(f.shipper, "shipper_to_buyer", f.buyer2.Name, other)
+
+	ids, _ := json.Marshal([]string{first, undelivered, other, "999999999", second, first})
+
+	var results []BatchResult
+	f.decode(f.ok(f.buyer, "accept_deliveries", string(ids)), &results)
+
+	tests := []struct {
+		pid   string
+		code  string
+		state int
+	}{
+		{first, "", STATE_PAYMENT},
+		{undelivered, ERR_PERMISSION_DENIED, STATE_SHIPPING},
+		{other, ERR_PERMISSION_DENIED, STATE_SHIPPING},
+		{"999999999", ERR_NOT_FOUND, -1},
+		{second, "", STATE_PAYMENT},
+		{first, ERR_VALIDATION_FAILED, STATE_PAYMENT},
+	}
+
+	if len(results) != len(tests) {
+		t.Fatalf("expected %d results, got %+v", len(tests), results)
+	}
+
+	for i, tt := range tests {
+		f.run(strconv.Itoa(i)+" "+tt.pid, func(t *testing.T) {
+
+			if results[i].ProductID != tt.pid || results[i].Success != (tt.code == "") {
+				t.Fatalf("expected %s to fail with %q, got %+v", tt.pid, tt.code, results[i])
+			}
+
+			if tt.code != "" && (results[i].Error == nil || results[i].Error.Code != tt.code) {
+				t.Errorf("expected %s, got %+v", tt.code, results[i].Error)
+			}
+
+			if tt.state >= 0 && f.product(tt.pid).State != tt.state {
+				t.Errorf("expected %s in state %d, got %d", tt.pid, tt.state, f.product(tt.pid).State)
+			}
+		})
+	}
+
+	if delivery := f.product(first).Delivery; delivery == nil || delivery.Recipient != f.buyer.Name {
+		t.Errorf("expected the proof of delivery to name the buyer, got %+v", delivery)
+	}
+
+	f.fails(ERR_VALIDATION_FAILED, f.buyer, "accept_deliveries", first)
+	f.fails(ERR_VALIDATION_FAILED, f.buyer, "accept_deliveries", string(ids), "extra")
+}
+
+func TestRouteWaypoints(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		route  string
+		code   string
+		want   string
+	}{
+		{"configured waypoint", `{"waypoints":["Hamburg","Rotterdam","London"]}`, "Hamburg, rotterdam", "", "Hamburg,rotterdam"},
+		{"unknown waypoint", `{"waypoints":["Hamburg","Rotterdam","London"]}`, "Hamburg,Atlantis", ERR_VALIDATION_FAILED, "UNDEFINED"},
+		{"no list configured", "", "Atlantis", "", "Atlantis"},
+		{"empty route", "", " , ", ERR_VALIDATION_FAILED, "UNDEFINED"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, tt.config)
+
+			pid := f.create(f.maker, f.buyer, "London")
+
+			if tt.code != "" {
+				f.fails(tt.code, f.maker, "update_route", tt.route, pid)
+			} else {
+				f.ok(f.maker, "update_route", tt.route, pid)
+			}
+
+			if route := f.product(pid).Route; route != tt.want {
+				t.Errorf("expected route %q, got %q", tt.want, route)
+			}
+		})
+	}
+}
+
+func TestLockProduct(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_MANUFACTURE)
+
+	steps := []struct {
+		name     string
+		caller   identity
+		function string
+		args     []string
+		code     string
+	}{
+		{"only the regulator locks", f.maker, "lock_product", []string{pid}, ERR_PERMISSION_DENIED},
+		{"lock", f.gov, "lock_product", []string{pid, "n1"}, ""},
+		{"lock twice", f.gov, "lock_product", []string{pid, "n2"}, ERR_INVALID_STATE},
+		{"transfer while locked", f.maker, "start_shipping", []string{f.shipper.Name, pid}, ERR_INVALID_STATE},
+		{"only the regulator unlocks", f.maker, "unlock_product", []string{pid}, ERR_PERMISSION_DENIED},
+		{"unlock", f.gov, "unlock_product", []string{pid, "n3"}, ""},
+		{"unlock twice", f.gov, "unlock_product", []string{pid, "n4"}, ERR_INVALID_STATE},
+		{"transfer once unlocked", f.maker, "start_shipping", []string{f.shipper.Name, pid}, ""},
+		{"lock in shipping", f.gov, "lock_product", []string{pid, "n5"}, ""},
+		{"hand over while locked", f.shipper, "shipper_to_buyer", []string{f.buyer.Name, pid}, ERR_INVALID_STATE},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+
+			if step.code == "" {
+				f.ok(step.caller, step.function, step.args...)
+				return
+			}
+
+			message := f.fails(step.code, step.caller, step.function, step.args...)
+
+			if (step.function == "start_shipping" || step.function == "shipper_to_buyer") && message != "product is locked" {
+				t.Errorf("expected the product to be locked, got %q", message)
+			}
+		})
+	}
+
+	var results []BatchResult
+	f.decode(f.ok(f.shipper, "confirm_deliveries", `["`+pid+`"]`, f.buyer.Name), &results)
+
+	if len(results) != 1 || results[0].Success || results[0].Error == nil || results[0].Error.Code != ERR_INVALID_STATE || results[0].Error.Message != "product is locked" {
+		t.Errorf("expected the delivery of the locked product to be refused, got %+v", results)
+	}
+
+	f.ok(f.gov, "unlock_product", pid, "n6")
+
+	if p := f.product(pid); p.Locked || p.State != STATE_SHIPPING || p.Custodian != f.shipper.Name {
+		t.Errorf("expected an unlocked product in shipping held by the shipper, got locked %v in state %d held by %s", p.Locked, p.State, p.Custodian)
+	}
+}
+
+func TestGetProductsSummaryCSV(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	plain := f.create(f.maker, f.buyer, "London")
+	comma := f.create(f.maker, f.buyer, "London, UK")
+	other := f.create(f.maker2, f.buyer2, "Paris")
+
+	var csv string
+	f.decode(f.ok(f.maker, "get_products_summary_csv"), &csv)
+
+	lines := strings.Split(strings.TrimSuffix(csv, "\n"), "\n")
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"header", "productId,manufacturer,owner,state,price,currency,destination"},
+		{"plain row", plain + ",maker@Org1MSP,maker@Org1MSP,0,100.00,USD,London"},
+		{"embedded comma", comma + `,maker@Org1MSP,maker@Org1MSP,0,100.00,USD,"London, UK"`},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+			if !contains(lines, tt.want) {
+				t.Errorf("expected the line %q in %q", tt.want, csv)
+			}
+		})
+	}
+
+	if len(lines) != len(tests) || lines[0] != tests[0].want {
+		t.Errorf("expected the header and 2 rows, got %q", csv)
+	}
+
+	if strings.Contains(csv, other) {
+		t.Errorf("product %s of another manufacturer was exported", other)
+	}
+}
+
+func TestBlacklist(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_MANUFACTURE)
+
+	steps := []struct {
+		name     string
+		caller   identity
+		function string
+		args     []string
+		code     string
+	}{
+		{"only the regulator blacklists", f.maker, "add_to_blacklist", []string{f.shipper.Name}, ERR_PERMISSION_DENIED},
+		{"blacklist", f.gov, "add_to_blacklist", []string{f.shipper.Name}, ""},
+		{"blacklist twice", f.gov, "add_to_blacklist", []string{f.shipper.Name}, ERR_INVALID_STATE},
+		{"transfer to a blacklisted party", f.maker, "start_shipping", []string{f.shipper.Name, pid}, ERR_PERMISSION_DENIED},
+		{"remove", f.gov, "remove_from_blacklist", []string{f.shipper.Name}, ""},
+		{"remove twice", f.gov, "remove_from_blacklist", []string{f.shipper.Name}, ERR_NOT_FOUND},
+		{"transfer after removal", f.maker, "start_shipping", []string{f.shipper.Name, pid}, ""},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+			if step.code == "" {
+				f.ok(step.caller, step.function, step.args...)
+			} else {
+				f.fails(step.code, step.caller, step.function, step.args...)
+			}
+		})
+	}
+
+	if custodian := f.product(pid).Custodian; custodian != f.shipper.Name {
+		t.Errorf("expected %s to hold the product, got %s", f.shipper.Name, custodian)
+	}
+}
+
+func TestConfirmScrapped(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_INUSE)
+
+	f.fails(ERR_PERMISSION_DENIED, f.recycler, "confirm_scrapped", "DC-1", pid)
+
+	f.ok(f.buyer, "private_to_recycler", f.recycler.Name, pid)
+
+	tests := []struct {
+		name        string
+		caller      identity
+		certificate string
+		code        string
+	}{
+		{"previous owner", f.buyer, "DC-1", ERR_PERMISSION_DENIED},
+		{"not a recycler", f.shipper, "DC-1", ERR_PERMISSION_DENIED},
+		{"missing certificate", f.recycler, "  ", ERR_VALIDATION_FAILED},
+		{"recycler confirms", f.recycler, "DC-1", ""},
+		{"already scrapped", f.recycler, "DC-2", ERR_PERMISSION_DENIED},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, tt.caller, "confirm_scrapped", tt.certificate, pid)
+				return
+			}
+
+			f.ok(tt.caller, "confirm_scrapped", tt.certificate, pid)
+
+			p := f.product(pid)
+
+			if p.State != STATE_SCRAPPED {
+				t.Errorf("expected the product to be scrapped, got state %d", p.State)
+			}
+
+			want := DestructionCertificate{Reference: "DC-1", Recycler: f.recycler.Name, IssuedAt: f.stub.now}
+
+			if p.Destruction == nil || *p.Destruction != want {
+				t.Errorf("expected certificate %+v, got %+v", want, p.Destruction)
+			}
+		})
+	}
+
+	if p := f.product(pid); p.Destruction == nil || p.Destruction.Reference != "DC-1" {
+		t.Errorf("expected the certificate of the confirmation to be kept, got %+v", p.Destruction)
+	}
+}
+
+func TestHighVelocityProducts(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	fresh := f.create(f.maker, f.buyer, "London")
+
+	sold := f.create(f.maker, f.buyer, "London")
+	f.advance(sold, STATE_INUSE)
+
+	recycled := f.create(f.maker, f.buyer, "London")
+	f.advance(recycled, STATE_INUSE)
+	f.ok(f.buyer, "private_to_recycler", f.recycler.Name, recycled)
+
+	counts := map[string]int{fresh: 0, sold: 1, recycled: 2}
+
+	for pid, count := range counts {
+		if p := f.product(pid); p.TransferCount != count {
+			t.Errorf("expected %s to have changed hands %d times, got %d", pid, count, p.TransferCount)
+		}
+	}
+
+	tests := []struct {
+		threshold string
+		want      []string
+	}{
+		{"0", []string{sold, recycled}},
+		{"1", []string{recycled}},
+		{"2", []string{}},
+	}
+
+	for _, tt := range tests {
+		f.run("threshold "+tt.threshold, func(t *testing.T) {
+
+			var products []Product
+			f.decode(f.ok(f.gov, "get_high_velocity_products", tt.threshold), &products)
+
+			got := ids_of(products)
+			sort.Strings(got)
+			sort.Strings(tt.want)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	f.fails(ERR_VALIDATION_FAILED, f.gov, "get_high_velocity_products", "-1")
+	f.fails(ERR_VALIDATION_FAILED, f.gov, "get_high_velocity_products", "many")
+}
+
+func TestValidateAndRepairProduct(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		damage  func(p *Product)
+		options []string
+		want    []Violation
+		saved   bool
+	}{
+		{"healthy product", func(p *Product) {}, nil, []Violation{}, false},
+		{"detection only", func(p *Product) { p.State = 9; p.Manufacturer = ""; p.Weight = -3 }, nil, []Violation{
+			{Field: "manufacturer", Problem: "manufacturer is empty"},
+			{Field: "state", Problem: "state 9 is outside the lifecycle"},
+			{Field: "weight", Problem: "weight is negative"},
+		}, false},
+		{"repair", func(p *Product) { p.State = 9; p.Manufacturer = ""; p.Weight = -3 }, []string{`{"repair":true}`}, []Violation{
+			{Field: "manufacturer", Problem: "manufacturer is empty", Repaired: true},
+			{Field: "state", Problem: "state 9 is outside the lifecycle", Repaired: true},
+			{Field: "weight", Problem: "weight is negative", Repaired: true},
+		}, true},
+		{"unrepairable price", func(p *Product) { p.State = -1; p.Price = 0 }, []string{`{"repair":true}`}, []Violation{
+			{Field: "price", Problem: "price is not greater than 0"},
+			{Field: "state", Problem: "state -1 is outside the lifecycle"},
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, "")
+
+			pid := f.create(f.maker, f.buyer, "London")
+
+			p := f.product(pid)
+			tt.damage(&p)
+			f.store(p)
+
+			stored := string(f.stub.State[pid])
+
+			f.fails(ERR_PERMISSION_DENIED, f.maker, "validate_and_repair_product", append([]string{pid}, tt.options...)...)
+
+			var report RepairReport
+			f.decode(f.ok(f.gov, "validate_and_repair_product", append([]string{pid}, tt.options...)...), &report)
+
+			if !reflect.DeepEqual(report.Violations, tt.want) || report.Saved != tt.saved {
+				t.Fatalf("expected %+v saved %v, got %+v", tt.want, tt.saved, report)
+			}
+
+			if !tt.saved {
+				if string(f.stub.State[pid]) != stored {
+					t.Errorf("product changed without being repaired")
+				}
+				return
+			}
+
+			repaired := f.product(pid)
+
+			if repaired.State != STATE_SCRAPPED || repaired.Manufacturer != "UNDEFINED" || repaired.Weight != 0 {
+				t.Errorf("expected the product to be repaired, got state %d, manufacturer %q, weight %v", repaired.State, repaired.Manufacturer, repaired.Weight)
+			}
+		})
+	}
+}
+
+func TestFieldErrors(t *testing.T) {
+
+	hash := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name   string
+		damage func(p *Product)
+		want   []FieldError
+	}{
+		{"product id", func(p *Product) { p.ProductID = "12" }, []FieldError{
+			{Field: "productId", Message: "must be a nine digit number"},
+		}},
+		{"location", func(p *Product) { p.Location = &GeoLocation{Lat: 91, Lon: -181} }, []FieldError{
+			{Field: "location", Message: "must have a latitude between -90 and 90 and a longitude between -180 and 180"},
+		}},
+		{"hashes", func(p *Product) { p.Delivery = &ProofOfDelivery{Recipient: "buyer", CertFingerprint: "abc", ReceiptHash: "xyz"} }, []FieldError{
+			{Field: "delivery.certFingerprint", Message: "must be a hex encoded SHA-256 hash"},
+			{Field: "delivery.receiptHash", Message: "must be a hex encoded SHA-256 hash"},
+		}},
+		{"valid hashes", func(p *Product) { p.Delivery = &ProofOfDelivery{Recipient: "buyer", CertFingerprint: hash, ReceiptHash: hash} }, nil},
+		{"dimensions and weight", func(p *Product) { p.Width = -1; p.Weight = -2 }, []FieldError{
+			{Field: "width", Message: "must not be negative"},
+			{Field: "weight", Message: "must not be negative"},
+		}},
+		{"several fields in one write", func(p *Product) { p.ProductID = "12"; p.Location = &GeoLocation{Lat: 91}; p.Delivery = &ProofOfDelivery{ReceiptHash: "xyz"}; p.Height = -1; p.Weight = -2 }, []FieldError{
+			{Field: "productId", Message: "must be a nine digit number"},
+			{Field: "location", Message: "must have a latitude between -90 and 90 and a longitude between -180 and 180"},
+			{Field: "delivery.receiptHash", Message: "must be a hex encoded SHA-256 hash"},
+			{Field: "height", Message: "must not be negative"},
+			{Field: "weight", Message: "must not be negative"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, "")
+
+			pid := f.create(f.maker, f.buyer, "London")
+
+			p := f.product(pid)
+			tt.damage(&p)
+
+			bytes, err := json.Marshal(p)
+			if err != nil {
+				t.Fatalf("encoding product: %v", err)
+			}
+
+			f.stub.State[pid] = bytes // Under its own key whatever its id says
+
+			if tt.want == nil {
+				f.ok(f.maker, "update_price", "120.50", pid)
+				return
+			}
+
+			f.fails(ERR_VALIDATION_FAILED, f.maker, "update_price", "120.50", pid)
+
+			if !reflect.DeepEqual(f.last.Errors, tt.want) {
+				t.Errorf("expected errors %+v, got %+v", tt.want, f.last.Errors)
+			}
+
+			if string(f.stub.State[pid]) != string(bytes) {
+				t.Errorf("expected the invalid product not to be stored")
+			}
+		})
+	}
+}
+
+func TestProductIdReservation(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	f.run("same transaction id", func(t *testing.T) {
+
+		first := f.create(f.maker, f.buyer, "London")
+		f.tx--
+		second := f.create(f.maker, f.buyer, "Paris")
+
+		if first == second {
+			t.Fatalf("both creations were given id %s", first)
+		}
+
+		if f.product(first).Destination != "London" || f.product(second).Destination != "Paris" {
+			t.Errorf("expected both products to be kept")
+		}
+
+		var products []Product
+		f.decode(f.ok(f.gov, "get_vehicles"), &products)
+
+		if ids := ids_of(products); !contains(ids, first) || !contains(ids, second) || len(ids) != 2 {
+			t.Errorf("expected %s and %s to be indexed once, got %v", first, second, ids)
+		}
+	})
+
+	f.run("id claimed by another transaction", func(t *testing.T) {
+
+		next := f.tx + 1
+		txid := "tx" + strconv.Itoa(next)
+
+		f.stub.MockTransactionStart(txid)
+		id, err := f.cc.generate_product_id(f.stub, "")
+		f.stub.MockTransactionEnd(txid)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pid := strconv.Itoa(id)
+		f.store(Product{ProductID: pid, Manufacturer: f.maker2.Name, Owner: f.maker2.Name, Destination: "Rome", Price: 100, Currency: "USD"})
+
+		f.tx = next - 1
+		f.fails(ERR_INVALID_STATE, f.maker, "create_product", f.buyer.Name, "London", "100.00", "USD", "")
+
+		if f.product(pid).Destination != "Rome" {
+			t.Errorf("the reservation overwrote product %s", pid)
+		}
+	})
+
+	f.run("placeholder is replaced", func(t *testing.T) {
+
+		pid := f.create(f.maker, f.buyer, "London")
+
+		if strings.Contains(string(f.stub.State[pid]), "reserved") {
+			t.Errorf("the placeholder of %s was kept: %s", pid, f.stub.State[pid])
+		}
+	})
+}
+
+func TestGetProductAsOf(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	created := f.stub.now
+
+	f.stub.now += 100
+	f.ok(f.maker, "update_route", "Hamburg,London", pid)
+	updated := f.stub.now
+
+	tests := []struct {
+		name  string
+		at    int64
+		route string
+		code  string
+	}{
+		{"before creation", created - 1, "", ERR_NOT_FOUND},
+		{"at creation", created, "UNDEFINED", ""},
+		{"before the second write", updated - 1, "UNDEFINED", ""},
+		{"at the second write", updated, "Hamburg,London", ""},
+		{"after the second write", updated + 1000, "Hamburg,London", ""},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			at := strconv.FormatInt(tt.at, 10)
+
+			if tt.code != "" {
+				if message := f.fails(tt.code, f.maker, "get_product_as_of", pid, at); !strings.Contains(message, "no version at that time") {
+					t.Errorf("unexpected message %q", message)
+				}
+				return
+			}
+
+			var p Product
+			f.decode(f.ok(f.maker, "get_product_as_of", pid, at), &p)
+
+			if p.Route != tt.route {
+				t.Errorf("expected route %q, got %q", tt.route, p.Route)
+			}
+		})
+	}
+
+	f.fails(ERR_VALIDATION_FAILED, f.maker, "get_product_as_of", pid, "yesterday")
+	f.fails(ERR_PERMISSION_DENIED, f.maker2, "get_product_as_of", pid, strconv.FormatInt(updated, 10))
+}
+
+//==============================================================================================================================
+//	 fixedFX - FXProvider with a fixed table of rates, or failing every conversion when err is set.
+//==============================================================================================================================
+type fixedFX struct {
+	rates map[string]float64
+	err   error
+}
+
+func (p fixedFX) Convert(amount float64, from string, to string) (float64, error) {
+
+	if p.err != nil {
+		return 0, p.err
+	}
+
+	return ConfigFXProvider{Rates: p.rates}.Convert(amount, from, to)
+}
+
+func TestCheckAccreditiveCurrency(t *testing.T) {
+
+	rates := fixedFX{rates: map[string]float64{"USD/EUR": 0.9}}
+	broken := fixedFX{err: errors.New("rates unavailable")}
+
+	tests := []struct {
+		name   string
+		credit string
+		fx     FXProvider
+		code   string
+	}{
+		{"same currency", `{"Amount":10000,"Currency":"USD"}`, rates, ""},
+		{"converted", `{"Amount":9000,"Currency":"EUR"}`, rates, ""},
+		{"converted short", `{"Amount":8999,"Currency":"EUR"}`, rates, ERR_VALIDATION_FAILED},
+		{"no rate", `{"Amount":9000,"Currency":"EUR"}`, broken, ERR_INTERNAL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, "")
+
+			pid := f.create(f.maker, f.buyer, "London")
+
+			f.cc.FX = rates
+			f.ok(f.sbank, "bank_issue_accreditive", tt.credit, pid)
+
+			f.cc.FX = tt.fx
+
+			if tt.code != "" {
+				f.fails(tt.code, f.bbank, "check_accreditive", pid)
+				return
+			}
+
+			f.ok(f.bbank, "check_accreditive", pid)
+
+			if state := f.product(pid).State; state != STATE_MANUFACTURE {
+				t.Errorf("expected the product in manufacture, got state %d", state)
+			}
+		})
+	}
+}
+
+func TestGetBuyerObligations(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	credited := f.create_priced(f.maker, f.buyer, "London", "100.00", "USD")
+	f.advance(credited, STATE_CHECK_ACCREDITIVE)
+
+	terms := `{"sellerBank":"` + f.sbank.Name + `","buyerBank":"` + f.bbank.Name + `"}`
+	shipping := strings.Trim(string(f.ok(f.maker, "create_product", f.buyer.Name, "London", "250.50", "USD", terms)), "\"")
+	f.advance(shipping, STATE_SHIPPING)
+
+	delivered := f.create_priced(f.maker, f.buyer, "London", "80.00", "EUR")
+	f.advance(delivered, STATE_PAYMENT)
+
+	f.create(f.maker, f.buyer, "London")
+
+	paid := f.create(f.maker, f.buyer, "London")
+	f.advance(paid, STATE_INUSE)
+
+	others := f.create(f.maker, f.buyer2, "London")
+	f.ok(f.sbank, "bank_issue_accreditive", `{"Amount":10000,"Currency":"USD"}`, others)
+
+	everything := BuyerObligations{
+		Buyer:    f.buyer.Name,
+		Products: []Product{{ProductID: credited}, {ProductID: shipping}, {ProductID: delivered}},
+		Totals:   map[string]Money{"USD": 35050, "EUR": 8000},
+	}
+
+	tests := []struct {
+		name   string
+		caller identity
+		want   BuyerObligations
+	}{
+		{"buyer", f.buyer, everything},
+		{"regulator", f.gov, everything},
+		{"buyer's bank", f.bbank, BuyerObligations{Buyer: f.buyer.Name, Products: []Product{{ProductID: shipping}}, Totals: map[string]Money{"USD": 25050}}},
+		{"other bank", f.bbank2, BuyerObligations{Buyer: f.buyer.Name, Products: []Product{}, Totals: map[string]Money{}}},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			var got BuyerObligations
+			f.decode(f.ok(tt.caller, "get_buyer_obligations", f.buyer.Name), &got)
+
+			want, ids := ids_of(tt.want.Products), ids_of(got.Products)
+			sort.Strings(want)
+			sort.Strings(ids)
+
+			if got.Buyer != tt.want.Buyer || !reflect.DeepEqual(ids, want) || !reflect.DeepEqual(got.Totals, tt.want.Totals) {
+				t.Errorf("expected %v owing %v, got %v owing %v", want, tt.want.Totals, ids, got.Totals)
+			}
+		})
+	}
+
+	f.fails(ERR_PERMISSION_DENIED, f.buyer2, "get_buyer_obligations", f.buyer.Name)
+	f.fails(ERR_PERMISSION_DENIED, f.maker, "get_buyer_obligations", f.buyer.Name)
+}
+
+func TestPutInUse(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_PAYMENT)
+
+	steps := []struct {
+		name     string
+		caller   identity
+		function string
+		code     string
+		state    int
+	}{
+		{"accept before payment", f.buyer, "put_in_use", ERR_INVALID_STATE, STATE_PAYMENT},
+		{"release by the buyer", f.buyer, "release_payment", ERR_PERMISSION_DENIED, STATE_PAYMENT},
+		{"release", f.bbank, "release_payment", "", STATE_PAYMENT},
+		{"release twice", f.bbank, "release_payment", ERR_PERMISSION_DENIED, STATE_PAYMENT},
+		{"accept by another buyer", f.buyer2, "put_in_use", ERR_PERMISSION_DENIED, STATE_PAYMENT},
+		{"accept by the buyer's bank", f.bbank, "put_in_use", ERR_PERMISSION_DENIED, STATE_PAYMENT},
+		{"accept after payment", f.buyer, "put_in_use", "", STATE_INUSE},
+		{"accept twice", f.buyer, "put_in_use", ERR_PERMISSION_DENIED, STATE_INUSE},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+
+			if step.code == "" {
+				f.ok(step.caller, step.function, pid)
+			} else {
+				f.fails(step.code, step.caller, step.function, pid)
+			}
+
+			if p := f.product(pid); p.State != step.state {
+				t.Errorf("expected state %d, got %d", step.state, p.State)
+			}
+		})
+	}
+
+	if p := f.product(pid); p.Owner != f.buyer.Name || !p.PaymentReleased || len(p.Payments) != 1 || p.Payments[0].Amount != p.Price {
+		t.Errorf("expected the buyer to own the paid for product, got %s, released %v, payments %+v", p.Owner, p.PaymentReleased, p.Payments)
+	}
+}
+
+func TestFieldUpdatedEvents(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	priced := f.create(f.maker, f.buyer, "London")
+
+	shipped := f.create(f.maker, f.buyer, "London")
+	f.advance(shipped, STATE_SHIPPING)
+
+	first := `{"lat":53.55,"lon":9.99,"recordedAt":1400000000,"source":"tracker-17"}`
+	second := `{"lat":51.5,"lon":-0.1,"recordedAt":1400000100,"source":"tracker-17"}`
+
+	tests := []struct {
+		name   string
+		caller identity
+		update string
+		value  string
+		pid    string
+		want   string
+	}{
+		{"price", f.maker, "update_price", "120.50", priced, `{"productId":"` + priced + `","field":"price","oldValue":10000,"newValue":12050}`},
+		{"first location", f.shipper, "update_location", first, shipped, `{"productId":"` + shipped + `","field":"location","oldValue":null,"newValue":` + first + `}`},
+		{"second location", f.shipper, "update_location", second, shipped, `{"productId":"` + shipped + `","field":"location","oldValue":` + first + `,"newValue":` + second + `}`},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			f.ok(tt.caller, tt.update, tt.value, tt.pid)
+
+			payloads := f.emitted("field_updated")
+
+			if len(payloads) != 1 {
+				t.Fatalf("expected one field_updated event, got %d", len(payloads))
+			}
+
+			var got, want interface{}
+			f.decode(payloads[0], &got)
+			f.decode(json.RawMessage(tt.want), &want)
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("expected %s, got %s", tt.want, payloads[0])
+			}
+		})
+	}
+
+	f.fails(ERR_VALIDATION_FAILED, f.maker, "update_price", "-1", priced)
+
+	if len(f.emitted("field_updated")) != 0 {
+		t.Errorf("a refused update emitted field_updated")
+	}
+}
+
+func TestUnchangedUpdates(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+
+	f.ok(f.maker, "update_route", "Hamburg,London", pid)
+	f.ok(f.maker, "update_width", "180", pid)
+	f.ok(f.maker, "update_batch", "B-7", pid)
+
+	tests := []struct {
+		update string
+		value  string
+	}{
+		{"update_route", "Hamburg,London"},
+		{"update_route", " Hamburg , London "},
+		{"update_price", "100.00"},
+		{"update_width", "180"},
+		{"update_batch", "B-7"},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.update+" "+tt.value, func(t *testing.T) {
+
+			writes := f.stub.writes
+
+			if message := f.fails(ERR_VALIDATION_FAILED, f.maker, tt.update, tt.value, pid); message != "no change" {
+				t.Errorf("expected no change, got %q", message)
+			}
+
+			if f.stub.writes != writes {
+				t.Errorf("an unchanged update wrote %d keys", f.stub.writes-writes)
+			}
+		})
+	}
+}
+
+func TestGetStateTransitionsLog(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	created := f.stub.now
+
+	f.advance(pid, STATE_INUSE)
+
+	want := []TransitionLogEntry{
+		{created, "created", "", "SALESCONTRACT", f.maker.Name},
+		{created + 1, "state", "SALESCONTRACT", "CHECK_ACCREDITIVE", f.sbank.Name},
+		{created + 2, "state", "CHECK_ACCREDITIVE", "MANUFACTURE", f.bbank.Name},
+		{created + 3, "state", "MANUFACTURE", "SHIPPING", f.maker.Name},
+		{created + 3, "custody", f.maker.Name, f.shipper.Name, f.maker.Name},
+		{created + 4, "custody", f.shipper.Name, f.buyer.Name, f.shipper.Name},
+		{created + 5, "state", "SHIPPING", "PAYMENT", f.buyer.Name},
+		{created + 7, "state", "PAYMENT", "INUSE", f.buyer.Name},
+	}
+
+	tests := []struct {
+		name   string
+		caller identity
+		code   string
+	}{
+		{"owner", f.buyer, ""},
+		{"regulator", f.gov, ""},
+		{"former custodian", f.shipper, ERR_PERMISSION_DENIED},
+		{"manufacturer", f.maker, ERR_PERMISSION_DENIED},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, tt.caller, "get_state_transitions_log", pid)
+				return
+			}
+
+			var log []TransitionLogEntry
+			f.decode(f.ok(tt.caller, "get_state_transitions_log", pid), &log)
+
+			if !reflect.DeepEqual(log, want) {
+				t.Errorf("expected %+v, got %+v", want, log)
+			}
+		})
+	}
+}
+
+func TestShippingCost(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		weight string
+		cost   []string
+		quote  string
+		code   string
+		want   Money
+	}{
+		{"computed from the weight", `{"shippingRatePerKg":2.5}`, "1200", nil, "3000.00", "", 300000},
+		{"explicit cost", `{"shippingRatePerKg":2.5}`, "1200", []string{"150.00"}, "3000.00", "", 15000},
+		{"unknown weight", `{"shippingRatePerKg":2.5}`, "", nil, "", ERR_INVALID_STATE, 0},
+		{"no rate configured", "", "1200", nil, "", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, tt.config)
+
+			pid := f.create(f.maker, f.buyer, "London")
+
+			if tt.weight != "" {
+				f.ok(f.maker, "update_weight", tt.weight, pid)
+			}
+
+			f.advance(pid, STATE_MANUFACTURE)
+
+			if tt.quote != "" {
+				if quote := string(f.ok(f.maker, "get_estimated_shipping_cost", pid)); quote != tt.quote {
+					t.Errorf("expected a quote of %s, got %s", tt.quote, quote)
+				}
+			} else {
+				f.fails(ERR_INVALID_STATE, f.maker, "get_estimated_shipping_cost", pid)
+			}
+
+			args := append([]string{f.shipper.Name, pid}, tt.cost...)
+
+			if tt.code != "" {
+				f.fails(tt.code, f.maker, "start_shipping", args...)
+				return
+			}
+
+			f.ok(f.maker, "start_shipping", args...)
+
+			if cost := f.product(pid).ShippingCost; cost != tt.want {
+				t.Errorf("expected a shipping cost of %d, got %d", tt.want, cost)
+			}
+		})
+	}
+}
+
+func TestGetVehiclesSizeCap(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		config  string
+		options string
+		cap     int
+	}{
+		{"configured cap", `{"maxResultBytes":8000}`, `{}`, 8000},
+		{"requested cap", "", `{"maxBytes":5000}`, 5000},
+		{"requested cap above the configured one", `{"maxResultBytes":8000}`, `{"maxBytes":20000}`, 8000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, tt.config)
+
+			var created []string
+
+			for i := 0; i < 5; i++ {
+
+				pid := f.create(f.maker, f.buyer, "London")
+
+				p := f.product(pid)
+				p.Route = strings.Repeat("Hamburg,", 400)
+				f.store(p)
+
+				created = append(created, pid)
+			}
+
+			var listed []string
+			options := tt.options
+
+			for pages := 1; ; pages++ {
+
+				data := f.ok(f.maker, "get_vehicles", options)
+
+				if len(data) > tt.cap {
+					t.Fatalf("page %d is %d bytes, over the cap of %d", pages, len(data), tt.cap)
+				}
+
+				var page ListPage
+				f.decode(data, &page)
+
+				if len(page.Products) == 0 {
+					t.Fatalf("page %d is empty", pages)
+				}
+
+				for _, raw := range page.Products {
+					var p Product
+					f.decode(raw, &p)
+					listed = append(listed, p.ProductID)
+				}
+
+				if page.LastID != listed[len(listed)-1] {
+					t.Errorf("expected page %d to end at %s, got %s", pages, listed[len(listed)-1], page.LastID)
+				}
+
+				if !page.Truncated {
+					if pages == 1 {
+						t.Errorf("expected the oversized products to be truncated")
+					}
+					break
+				}
+
+				options = `{"maxBytes":` + strconv.Itoa(tt.cap) + `,"after":"` + page.LastID + `"}`
+			}
+
+			sort.Strings(created)
+			sort.Strings(listed)
+
+			if !reflect.DeepEqual(listed, created) {
+				t.Errorf("expected %v across the pages, got %v", created, listed)
+			}
+		})
+	}
+}
+
+func TestProductsRequiringInspection(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	waiting := f.create(f.maker, f.buyer, "London")
+	f.advance(waiting, STATE_PAYMENT)
+
+	inspected := f.create(f.maker, f.buyer, "London")
+	f.advance(inspected, STATE_PAYMENT)
+
+	failed := f.create(f.maker, f.buyer, "London")
+	f.advance(failed, STATE_PAYMENT)
+
+	shipping := f.create(f.maker, f.buyer, "London")
+	f.advance(shipping, STATE_SHIPPING)
+
+	paid := f.create(f.maker, f.buyer, "London")
+	f.advance(paid, STATE_INUSE)
+
+	f.ok(f.gov, "record_inspection", `{"passed":true,"notes":"ok"}`, inspected)
+	f.ok(f.gov, "record_inspection", `{"passed":false,"notes":"dented"}`, failed)
+
+	f.fails(ERR_PERMISSION_DENIED, f.gov, "record_inspection", `{"passed":true}`, shipping)
+
+	tests := []struct {
+		name   string
+		caller identity
+		code   string
+	}{
+		{"regulator", f.gov, ""},
+		{"buyer", f.buyer, ERR_PERMISSION_DENIED},
+		{"buyer's bank", f.bbank, ERR_PERMISSION_DENIED},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, tt.caller, "get_products_requiring_inspection")
+				return
+			}
+
+			var queue []Product
+			f.decode(f.ok(tt.caller, "get_products_requiring_inspection"), &queue)
+
+			if ids := ids_of(queue); !reflect.DeepEqual(ids, []string{waiting}) {
+				t.Errorf("expected only %s to await inspection, got %v", waiting, ids)
+			}
+		})
+	}
+}
+
+func TestSwapProducts(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		prepare func(f *fixture, mine string, theirs string)
+		code    string
+	}{
+		{"swap", func(f *fixture, mine string, theirs string) {}, ""},
+		{"offered product locked", func(f *fixture, mine string, theirs string) { f.ok(f.gov, "lock_product", mine) }, ERR_INVALID_STATE},
+		{"requested product locked", func(f *fixture, mine string, theirs string) { f.ok(f.gov, "lock_product", theirs) }, ERR_INVALID_STATE},
+		{"requested product not in use", func(f *fixture, mine string, theirs string) {
+			p := f.product(theirs)
+			p.State = STATE_PAYMENT
+			f.store(p)
+		}, ERR_INVALID_STATE},
+		{"offered product proposed to a recycler", func(f *fixture, mine string, theirs string) {
+			f.ok(f.buyer, "propose_transfer", "private_to_recycler", f.recycler.Name, mine)
+		}, ERR_INVALID_STATE},
+		{"requested product proposed to a recycler", func(f *fixture, mine string, theirs string) {
+			f.ok(f.buyer2, "propose_transfer", "private_to_recycler", f.recycler.Name, theirs)
+		}, ERR_INVALID_STATE},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, "")
+
+			mine := f.create(f.maker, f.buyer, "London")
+			f.advance(mine, STATE_INUSE)
+
+			theirs := f.create(f.maker, f.buyer, "Paris")
+			f.advance(theirs, STATE_INUSE)
+
+			p := f.product(theirs)
+			p.Owner, p.Buyer = f.buyer2.Name, f.buyer2.Name
+			f.store(p)
+
+			f.fails(ERR_PERMISSION_DENIED, f.buyer2, "swap_products", mine, theirs)
+			f.ok(f.buyer, "swap_products", mine, theirs)
+
+			tt.prepare(f, mine, theirs)
+
+			if tt.code != "" {
+
+				f.fails(tt.code, f.buyer2, "swap_products", theirs, mine)
+
+				if f.product(mine).Owner != f.buyer.Name || f.product(theirs).Owner != f.buyer2.Name {
+					t.Errorf("a rejected swap changed the owners")
+				}
+				return
+			}
+
+			f.ok(f.buyer2, "swap_products", theirs, mine)
+
+			if f.product(mine).Owner != f.buyer2.Name || f.product(theirs).Owner != f.buyer.Name {
+				t.Errorf("expected the owners to be swapped, got %s and %s", f.product(mine).Owner, f.product(theirs).Owner)
+			}
+
+			if _, ok := f.stub.State["swap_"+mine+"_"+theirs]; ok {
+				t.Errorf("the swap proposal was kept")
+			}
+		})
+	}
+}
+
+func TestCreateProductRoles(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	tests := []struct {
+		name    string
+		caller  identity
+		buyer   identity
+		code    string
+		message string
+	}{
+		{"manufacturer", f.maker, f.buyer, "", ""},
+		{"buyer", f.buyer, f.buyer2, ERR_PERMISSION_DENIED, "only manufacturers may create products"},
+		{"regulator", f.gov, f.buyer, ERR_PERMISSION_DENIED, "only manufacturers may create products"},
+		{"bank", f.sbank, f.buyer, ERR_PERMISSION_DENIED, "only manufacturers may create products"},
+		{"shipper", f.shipper, f.buyer, ERR_PERMISSION_DENIED, "only manufacturers may create products"},
+		{"sold to a manufacturer", f.maker, f.maker2, ERR_VALIDATION_FAILED, "the buyer " + f.maker2.Name + " is not registered as a buyer"},
+		{"sold to the regulator", f.maker, f.gov, ERR_VALIDATION_FAILED, "the buyer " + f.gov.Name + " is not registered as a buyer"},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code == "" {
+				pid := f.create(tt.caller, tt.buyer, "London")
+				if p := f.product(pid); p.Manufacturer != tt.caller.Name || p.Buyer != tt.buyer.Name {
+					t.Errorf("expected %s selling to %s, got %s selling to %s", tt.caller.Name, tt.buyer.Name, p.Manufacturer, p.Buyer)
+				}
+				return
+			}
+
+			if message := f.fails(tt.code, tt.caller, "create_product", tt.buyer.Name, "London", "100.00", "USD", ""); message != tt.message {
+				t.Errorf("expected %q, got %q", tt.message, message)
+			}
+		})
+	}
+}
+
+func TestGetProductsForBank(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	shipping := f.create_contracted(f.maker, f.buyer, "London", f.bbank)
+	f.advance(shipping, STATE_SHIPPING)
+
+	paid := f.create(f.maker, f.buyer, "London")
+	f.advance(paid, STATE_INUSE)
+
+	terms := `{"sellerBank":"` + f.sbank.Name + `","buyerBank":"` + f.bbank.Name + `"}`
+	contracted := strings.Trim(string(f.ok(f.maker, "create_product", f.buyer.Name, "London", "50.00", "EUR", terms)), "\"")
+
+	f.create_contracted(f.maker, f.buyer, "London", f.bbank2)
+
+	issuing := BankExposure{
+		Bank: f.sbank.Name,
+		Products: []BankExposureEntry{
+			{ProductID: shipping, Role: "issuing", State: STATE_SHIPPING, Amount: 10000, Currency: "USD", Outstanding: 10000},
+			{ProductID: paid, Role: "issuing", State: STATE_INUSE, Amount: 10000, Currency: "USD"},
+		},
+		Outstanding: map[string]Money{"USD": 10000},
+	}
+
+	confirming := BankExposure{
+		Bank: f.bbank.Name,
+		Products: []BankExposureEntry{
+			{ProductID: shipping, Role: "confirming", State: STATE_SHIPPING, Amount: 10000, Currency: "USD", Outstanding: 10000},
+			{ProductID: contracted, Role: "confirming", State: STATE_SALESCONTRACT, Amount: 5000, Currency: "EUR", Outstanding: 5000},
+		},
+		Outstanding: map[string]Money{"USD": 10000, "EUR": 5000},
+	}
+
+	tests := []struct {
+		name   string
+		caller identity
+		bank   identity
+		code   string
+		want   BankExposure
+	}{
+		{"issuing bank", f.sbank, f.sbank, "", issuing},
+		{"confirming bank", f.bbank, f.bbank, "", confirming},
+		{"regulator", f.gov, f.bbank, "", confirming},
+		{"other bank", f.bbank, f.sbank, ERR_PERMISSION_DENIED, BankExposure{}},
+		{"buyer", f.buyer, f.bbank, ERR_PERMISSION_DENIED, BankExposure{}},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, tt.caller, "get_products_for_bank", tt.bank.Name)
+				return
+			}
+
+			var got BankExposure
+			f.decode(f.ok(tt.caller, "get_products_for_bank", tt.bank.Name), &got)
+
+			for _, entries := range [][]BankExposureEntry{got.Products, tt.want.Products} {
+				sort.Slice(entries, func(i, j int) bool { return entries[i].ProductID < entries[j].ProductID })
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRejectAccreditive(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_CHECK_ACCREDITIVE)
+
+	reason := "Expiry date precedes the shipping date"
+
+	steps := []struct {
+		name     string
+		caller   identity
+		function string
+		args     []string
+		code     string
+		state    int
+	}{
+		{"by the issuing bank", f.sbank, "reject_accreditive", []string{reason, pid}, ERR_PERMISSION_DENIED, STATE_CHECK_ACCREDITIVE},
+		{"by the buyer", f.buyer, "reject_accreditive", []string{reason, pid}, ERR_PERMISSION_DENIED, STATE_CHECK_ACCREDITIVE},
+		{"without a reason", f.bbank, "reject_accreditive", []string{" ", pid}, ERR_VALIDATION_FAILED, STATE_CHECK_ACCREDITIVE},
+		{"reject", f.bbank, "reject_accreditive", []string{reason, pid}, "", STATE_ACCREDITIVE},
+		{"reject twice", f.bbank, "reject_accreditive", []string{reason, pid}, ERR_PERMISSION_DENIED, STATE_ACCREDITIVE},
+		{"accept once rejected", f.bbank, "check_accreditive", []string{pid}, ERR_PERMISSION_DENIED, STATE_ACCREDITIVE},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+
+			if step.code == "" {
+				f.ok(step.caller, step.function, step.args...)
+			} else {
+				f.fails(step.code, step.caller, step.function, step.args...)
+			}
+
+			if state := f.product(pid).State; state != step.state {
+				t.Errorf("expected state %d, got %d", step.state, state)
+			}
+		})
+	}
+
+	p := f.product(pid)
+
+	if credit := f.credit(pid); !credit.Rejected || credit.RejectedBy != f.bbank.Name || credit.Reason != reason {
+		t.Errorf("expected the rejection by %s to be recorded, got %+v", f.bbank.Name, credit)
+	}
+
+	if last := p.OwnerHistory[len(p.OwnerHistory)-1]; last.Action != "reject" || last.Actor != f.bbank.Name {
+		t.Errorf("expected the rejection in the owner history, got %+v", last)
+	}
+}
+
+func TestOneActiveAccreditive(t *testing.T) {
+
+	credit := `{"Amount":10000,"Currency":"USD"}`
+	larger := `{"Amount":12000,"Currency":"USD"}`
+
+	t.Run("second issuance", func(t *testing.T) {
+
+		f := newFixture(t, "")
+
+		pid := f.create(f.maker, f.buyer, "London")
+
+		f.ok(f.sbank, "bank_issue_accreditive", credit, pid)
+		f.fails(ERR_PERMISSION_DENIED, f.sbank, "bank_issue_accreditive", larger, pid)
+
+		if amount := f.credit(pid).Amount; amount != 10000 {
+			t.Errorf("the second issuance replaced the accreditive with %d", amount)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		credit Accreditive
+		code   string
+	}{
+		{"active accreditive", Accreditive{Amount: 10000, Currency: "USD"}, ERR_INVALID_STATE},
+		{"withdrawn accreditive", Accreditive{Amount: 10000, Currency: "USD", Withdrawn: true}, ""},
+		{"rejected accreditive", Accreditive{Amount: 10000, Currency: "USD", Rejected: true}, ""},
+		{"expired accreditive", Accreditive{Amount: 10000, Currency: "USD", Expiry: 1400000000}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, "")
+
+			pid := f.create(f.maker, f.buyer, "London")
+
+			p := f.product(pid)
+			p.State = STATE_ACCREDITIVE
+			p.Accreditive = &tt.credit
+			f.store(p)
+
+			if tt.code != "" {
+				f.fails(tt.code, f.sbank, "bank_issue_accreditive", larger, pid)
+				return
+			}
+
+			f.ok(f.sbank, "bank_issue_accreditive", larger, pid)
+
+			// The copy the product held is replaced by the accreditive of its own
+			if p := f.product(pid); f.credit(pid).Amount != 12000 || p.Accreditive != nil || p.State != STATE_CHECK_ACCREDITIVE {
+				t.Errorf("expected the new accreditive to be checked, got %+v in state %d", f.credit(pid), p.State)
+			}
+		})
+	}
+
+	t.Run("reissue after withdrawal", func(t *testing.T) {
+
+		f := newFixture(t, "")
+
+		pid := f.create(f.maker, f.buyer, "London")
+
+		f.ok(f.sbank, "bank_issue_accreditive", credit, pid)
+		f.ok(f.sbank, "withdraw_accreditive", pid)
+		f.ok(f.sbank, "bank_issue_accreditive", larger, pid)
+
+		if credit := f.credit(pid); credit.Amount != 12000 || credit.Withdrawn {
+			t.Errorf("expected the new accreditive to replace the withdrawn one, got %+v", credit)
+		}
+	})
+}
+
+func TestGetProductsScrappedBetween(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	early := f.create(f.maker, f.buyer, "London")
+	f.advance(early, STATE_SCRAPPED)
+	scrapped := f.stub.now
+
+	f.stub.now += 1000
+
+	late := f.create(f.maker, f.buyer, "London")
+	f.advance(late, STATE_SCRAPPED)
+	rescrapped := f.stub.now
+
+	inuse := f.create(f.maker, f.buyer, "London")
+	f.advance(inuse, STATE_INUSE)
+
+	at := func(n int64) string { return strconv.FormatInt(n, 10) }
+
+	tests := []struct {
+		name string
+		from string
+		to   string
+		want []string
+	}{
+		{"exactly when scrapped", at(scrapped), at(scrapped), []string{early}},
+		{"between the two", at(scrapped + 1), at(rescrapped - 1), []string{}},
+		{"both", at(scrapped), at(rescrapped), []string{early, late}},
+		{"after the first", at(rescrapped), at(rescrapped + 100), []string{late}},
+		{"before either", "0", at(scrapped - 1), []string{}},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			var got ScrappedProducts
+			f.decode(f.ok(f.gov, "get_products_scrapped_between", tt.from, tt.to), &got)
+
+			ids := ids_of(got.Products)
+			sort.Strings(ids)
+			sort.Strings(tt.want)
+
+			if !reflect.DeepEqual(ids, tt.want) || got.Count != len(tt.want) {
+				t.Errorf("expected %v, got %d products %v", tt.want, got.Count, ids)
+			}
+		})
+	}
+
+	f.fails(ERR_VALIDATION_FAILED, f.gov, "get_products_scrapped_between", at(rescrapped), at(scrapped))
+	f.fails(ERR_VALIDATION_FAILED, f.gov, "get_products_scrapped_between", "last week", at(scrapped))
+}
+
+func TestDefaultCurrency(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		config   string
+		price    string
+		currency string
+		want     string
+		minor    Money
+		code     string
+	}{
+		{"inherits the default", `{"defaultCurrency":"EUR"}`, "100", "", "EUR", 10000, ""},
+		{"overrides the default", `{"defaultCurrency":"EUR"}`, "100", "GBP", "GBP", 10000, ""},
+		{"inherits a default without minor units", `{"defaultCurrency":"JPY"}`, "1000", "", "JPY", 1000, ""},
+		{"fraction of a default without minor units", `{"defaultCurrency":"JPY"}`, "1000.50", "", "", 0, ERR_VALIDATION_FAILED},
+		{"no default", "", "100", "JPY", "JPY", 100, ""},
+		{"no default and no currency", "", "100", "", "", 0, ERR_VALIDATION_FAILED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, tt.config)
+
+			if tt.code != "" {
+				f.fails(tt.code, f.maker, "create_product", f.buyer.Name, "London", tt.price, tt.currency, "")
+				return
+			}
+
+			pid := f.create_priced(f.maker, f.buyer, "London", tt.price, tt.currency)
+			product := f.product(pid)
+
+			if product.Currency != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, product.Currency)
+			}
+
+			if product.Price != tt.minor {
+				t.Errorf("expected a price of %d minor units, got %d", tt.minor, product.Price)
+			}
+		})
+	}
+
+	for _, currency := range []string{"XYZ", "eur", "Euro"} {
+		t.Run("invalid default "+currency, func(t *testing.T) {
+
+			cc := new(SimpleChaincode)
+			stub := newTestStub(cc)
+			stub.args = [][]byte{[]byte("init"), []byte(`{"defaultCurrency":"` + currency + `"}`)}
+
+			stub.MockTransactionStart("init")
+			response := cc.Init(stub)
+			stub.MockTransactionEnd("init")
+
+			if response.Status == shim.OK {
+				t.Errorf("Init accepted the default currency %s", currency)
+			}
+		})
+	}
+}
+
+func TestGetProductsByCustodian(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	tracked := f.create(f.maker, f.buyer, "London")
+	f.advance(tracked, STATE_SHIPPING)
+	f.ok(f.shipper, "update_location", `{"lat":53.55,"lon":9.99}`, tracked)
+
+	untracked := f.create(f.maker, f.buyer, "Paris")
+	f.advance(untracked, STATE_SHIPPING)
+
+	other := f.create(f.maker, f.buyer, "Rome")
+	f.advance(other, STATE_MANUFACTURE)
+	f.ok(f.maker, "start_shipping", f.shipper2.Name, other)
+
+	delivered := f.create(f.maker, f.buyer, "Oslo")
+	f.advance(delivered, STATE_PAYMENT)
+
+	tests := []struct {
+		name      string
+		caller    identity
+		custodian identity
+		code      string
+		want      map[string]string
+	}{
+		{"shipper", f.shipper, f.shipper, "", map[string]string{tracked: "London", untracked: "Paris"}},
+		{"other shipper", f.shipper2, f.shipper2, "", map[string]string{other: "Rome"}},
+		{"regulator", f.gov, f.shipper, "", map[string]string{tracked: "London", untracked: "Paris"}},
+		{"buyer", f.buyer, f.buyer, "", map[string]string{delivered: "Oslo"}},
+		{"another shipper's assignments", f.shipper, f.shipper2, ERR_PERMISSION_DENIED, nil},
+		{"manufacturer", f.maker, f.shipper, ERR_PERMISSION_DENIED, nil},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, tt.caller, "get_products_by_custodian", tt.custodian.Name)
+				return
+			}
+
+			var products []Product
+			f.decode(f.ok(tt.caller, "get_products_by_custodian", tt.custodian.Name), &products)
+
+			got := make(map[string]string)
+
+			for _, p := range products {
+				got[p.ProductID] = p.Destination
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+
+			for _, p := range products {
+				if located := p.ProductID == tracked; located != (p.Location != nil) {
+					t.Errorf("expected product %s to be located: %v, got %+v", p.ProductID, located, p.Location)
+				}
+			}
+		})
+	}
+}
+
+func TestScrappedProductsLeftOutOfAggregates(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	live := f.create(f.maker, f.buyer, "London")
+	f.advance(live, STATE_SHIPPING)
+
+	scrapped := f.create_priced(f.maker, f.buyer, "London", "900.00", "USD")
+	f.advance(scrapped, STATE_SCRAPPED)
+
+	tests := []struct {
+		name  string
+		query func() (ids []string, total Money)
+	}{
+		{"products by currency", func() ([]string, Money) {
+			var exposure CurrencyExposure
+			f.decode(f.ok(f.gov, "get_products_by_currency", "USD"), &exposure)
+			return ids_of(exposure.Products), exposure.Total
+		}},
+		{"products grouped by manufacturer", func() ([]string, Money) {
+			var page ManufacturerPage
+			f.decode(f.ok(f.gov, "get_products_grouped_by_manufacturer"), &page)
+			if len(page.Groups) != 1 || page.Groups[0].Count != 1 {
+				return nil, 0
+			}
+			return []string{live}, page.Groups[0].TotalValuePerCurrency["USD"]
+		}},
+		{"products for bank", func() ([]string, Money) {
+			var exposure BankExposure
+			f.decode(f.ok(f.sbank, "get_products_for_bank", f.sbank.Name), &exposure)
+			var ids []string
+			var total Money
+			for _, entry := range exposure.Products {
+				ids = append(ids, entry.ProductID)
+				total += entry.Amount
+			}
+			return ids, total
+		}},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+			if ids, total := tt.query(); !reflect.DeepEqual(ids, []string{live}) || total != 10000 {
+				t.Errorf("expected only %s worth 10000, got %v worth %d", live, ids, total)
+			}
+		})
+	}
+}
+
+func TestNonceReplay(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_CHECK_ACCREDITIVE)
+
+	steps := []struct {
+		name     string
+		function string
+		args     []string
+		code     string
+	}{
+		{"blacklist", "add_to_blacklist", []string{f.shipper2.Name, "n1"}, ""},
+		{"replayed blacklist", "remove_from_blacklist", []string{f.shipper2.Name, "n1"}, ERR_INVALID_STATE},
+		{"blacklist removal", "remove_from_blacklist", []string{f.shipper2.Name, "n2"}, ""},
+		{"override", "revert_last_transition", []string{pid, "n1"}, ""},
+		{"replayed override", "revert_last_transition", []string{pid, "n1"}, ERR_INVALID_STATE},
+		{"lock with a nonce of another action", "lock_product", []string{pid, "n1"}, ""},
+		{"replayed unlock", "unlock_product", []string{pid, "n1"}, ERR_INVALID_STATE},
+		{"unlock", "unlock_product", []string{pid, "n3"}, ""},
+		{"lock without a nonce", "lock_product", []string{pid}, ""},
+		{"unlock without a nonce", "unlock_product", []string{pid}, ""},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+
+			if step.code == "" {
+				f.ok(f.gov, step.function, step.args...)
+				return
+			}
+
+			if message := f.fails(step.code, f.gov, step.function, step.args...); message != "duplicate request" {
+				t.Errorf("expected a duplicate request, got %q", message)
+			}
+		})
+	}
+
+	if p := f.product(pid); p.State != STATE_SALESCONTRACT || p.Locked {
+		t.Errorf("expected an unlocked product reverted once, got state %d, locked %v", p.State, p.Locked)
+	}
+}
+
+func TestOwnershipShares(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_INUSE)
+
+	breakdown := func(caller identity) map[string]float64 {
+		var b OwnershipBreakdown
+		f.decode(f.ok(caller, "get_ownership_breakdown", pid), &b)
+		return b.Shares
+	}
+
+	if shares := breakdown(f.buyer); !reflect.DeepEqual(shares, map[string]float64{f.buyer.Name: 1}) {
+		t.Errorf("expected the owner to hold the whole product, got %v", shares)
+	}
+
+	assignments := []struct {
+		name   string
+		caller identity
+		shares string
+		code   string
+	}{
+		{"shares below one", f.buyer, `{"` + f.buyer.Name + `":0.6,"` + f.buyer2.Name + `":0.3}`, ERR_VALIDATION_FAILED},
+		{"shares above one", f.buyer, `{"` + f.buyer.Name + `":0.6,"` + f.buyer2.Name + `":0.5}`, ERR_VALIDATION_FAILED},
+		{"negative share", f.buyer, `{"` + f.buyer.Name + `":1.2,"` + f.buyer2.Name + `":-0.2}`, ERR_VALIDATION_FAILED},
+		{"not JSON", f.buyer, `60/40`, ERR_VALIDATION_FAILED},
+		{"by someone else", f.buyer2, `{"` + f.buyer.Name + `":0.6,"` + f.buyer2.Name + `":0.4}`, ERR_PERMISSION_DENIED},
+		{"60/40", f.buyer, `{"` + f.buyer.Name + `":0.6,"` + f.buyer2.Name + `":0.4}`, ""},
+	}
+
+	for _, tt := range assignments {
+		f.run(tt.name, func(t *testing.T) {
+			if tt.code == "" {
+				f.ok(tt.caller, "assign_shares", tt.shares, pid)
+			} else {
+				f.fails(tt.code, tt.caller, "assign_shares", tt.shares, pid)
+			}
+		})
+	}
+
+	transfers := []struct {
+		name   string
+		caller identity
+		share  string
+		code   string
+		want   map[string]float64
+	}{
+		{"more than held", f.buyer2, "0.5", ERR_VALIDATION_FAILED, map[string]float64{f.buyer.Name: 0.6, f.buyer2.Name: 0.4}},
+		{"part of a share", f.buyer, "0.2", "", map[string]float64{f.buyer.Name: 0.4, f.buyer2.Name: 0.6}},
+		{"a whole share", f.buyer2, "0.6", "", map[string]float64{f.buyer.Name: 1}},
+	}
+
+	for _, tt := range transfers {
+		f.run(tt.name, func(t *testing.T) {
+
+			other := f.buyer2
+
+			if tt.caller.Name == f.buyer2.Name {
+				other = f.buyer
+			}
+
+			if tt.code == "" {
+				f.ok(tt.caller, "transfer_share", other.Name, pid, tt.share)
+			} else {
+				f.fails(tt.code, tt.caller, "transfer_share", other.Name, pid, tt.share)
+			}
+
+			shares := breakdown(f.gov)
+
+			if len(shares) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, shares)
+			}
+
+			for holder, share := range tt.want {
+				if math.Abs(shares[holder]-share) > SHARE_TOLERANCE {
+					t.Errorf("expected %v, got %v", tt.want, shares)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		want   int
+	}{
+		{"off by default", "", 0},
+		{"disabled", `{"auditLog":false}`, 0},
+		{"enabled", `{"auditLog":true}`, 3},
+		{"capped", `{"auditLog":true,"auditLogSize":2}`, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, tt.config)
+
+			var pids []string
+
+			for i := 0; i < 3; i++ {
+				pids = append(pids, f.create(f.maker, f.buyer, "London"))
+			}
+
+			f.fails(ERR_PERMISSION_DENIED, f.maker, "get_audit_log")
+
+			var entries []AuditEntry
+			f.decode(f.ok(f.gov, "get_audit_log"), &entries)
+
+			var stored []AuditEntry
+
+			for _, entry := range entries {
+				if strings.HasPrefix(entry.Message, "SAVE_CHANGES: Stored product") {
+					stored = append(stored, entry)
+				}
+			}
+
+			if len(stored) != tt.want {
+				t.Fatalf("expected %d entries for the products stored, got %+v", tt.want, entries)
+			}
+
+			for i, entry := range stored {
+
+				pid := pids[len(pids)-len(stored)+i]
+
+				if !strings.Contains(entry.Message, pid) || entry.TxID == "" || entry.Timestamp == 0 {
+					t.Errorf("expected entry %d to record product %s, got %+v", i, pid, entry)
+				}
+			}
+
+			for i := 1; i < len(entries); i++ {
+				if entries[i].Timestamp < entries[i-1].Timestamp {
+					t.Errorf("expected entries oldest first, got %+v", entries)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditLogKeys(t *testing.T) {
+
+	f := newFixture(t, `{"auditLog":true}`)
+
+	f.create(f.maker, f.buyer, "London")
+	f.create(f.maker, f.buyer, "London")
+
+	txids := make(map[string]bool)
+
+	for key, value := range f.stub.State {
+
+		if !strings.HasPrefix(key, "\x00"+AUDIT_INDEX+"\x00") {
+			continue
+		}
+
+		_, attributes, err := f.stub.SplitCompositeKey(key)
+
+		if err != nil || len(attributes) != 3 {
+			t.Fatalf("expected an audit log key of time, transaction and seq, got %q", key)
+		}
+
+		var entry AuditEntry
+		f.decode(value, &entry)
+
+		if attributes[1] != entry.TxID {
+			t.Errorf("expected the entry of %s under a key of its transaction, got %q", entry.TxID, key)
+		}
+
+		txids[entry.TxID] = true
+	}
+
+	if len(txids) < 2 {
+		t.Errorf("expected entries of both transactions, got %v", txids)
+	}
+
+	if _, ok := f.stub.State["AuditLog_Seq"]; ok {
+		t.Errorf("expected no counter shared by the transactions that log")
+	}
+}
+
+func TestAuditLogCap(t *testing.T) {
+
+	f := newFixture(t, `{"auditLog":true,"auditLogSize":2}`)
+
+	var pids []string
+
+	for i := 0; i < 5; i++ {
+		pids = append(pids, f.create(f.maker, f.buyer, "London"))
+	}
+
+	var messages []string
+
+	for key, value := range f.stub.State {
+
+		if !strings.HasPrefix(key, "\x00"+AUDIT_INDEX+"\x00") {
+			continue
+		}
+
+		var entry AuditEntry
+		f.decode(value, &entry)
+
+		messages = append(messages, entry.Message)
+	}
+
+	if len(messages) != 2 {
+		t.Fatalf("expected the log to keep 2 entries, got %d: %v", len(messages), messages)
+	}
+
+	for _, pid := range pids[:3] {
+		for _, message := range messages {
+			if strings.Contains(message, pid) {
+				t.Errorf("expected the entry of product %s to be deleted, got %v", pid, messages)
+			}
+		}
+	}
+}
+
+func TestUniqueChecksum(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	first := f.create(f.maker, f.buyer, "London")
+	second := f.create(f.maker, f.buyer, "London")
+	other := f.create(f.maker2, f.buyer, "London")
+
+	steps := []struct {
+		name     string
+		caller   identity
+		pid      string
+		checksum string
+		code     string
+	}{
+		{"unique checksum", f.maker, first, "CS-1", ""},
+		{"duplicate checksum", f.maker, second, "CS-1", ERR_INVALID_STATE},
+		{"same checksum of another manufacturer", f.maker2, other, "CS-1", ""},
+		{"checksum changed", f.maker, first, "CS-2", ""},
+		{"released checksum reused", f.maker, second, "CS-1", ""},
+		{"unchanged checksum", f.maker, first, "CS-2", ERR_VALIDATION_FAILED},
+		{"empty checksum", f.maker, first, " ", ERR_VALIDATION_FAILED},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+
+			if step.code != "" {
+				f.fails(step.code, step.caller, "set_checksum", step.checksum, step.pid)
+				return
+			}
+
+			f.ok(step.caller, "set_checksum", step.checksum, step.pid)
+
+			if checksum := f.product(step.pid).CheckID; checksum != step.checksum {
+				t.Errorf("expected checksum %s, got %s", step.checksum, checksum)
+			}
+		})
+	}
+
+	index := map[[2]string]string{
+		{f.maker.Name, "CS-1"}:  second,
+		{f.maker.Name, "CS-2"}:  first,
+		{f.maker2.Name, "CS-1"}: other,
+	}
+
+	check := func() {
+
+		t.Helper()
+
+		for pair, pid := range index {
+
+			key, _ := f.stub.CreateCompositeKey(CHECKSUM_INDEX, pair[:])
+
+			if got := string(f.stub.State[key]); got != pid {
+				t.Errorf("expected %v to index product %s, got %q", pair, pid, got)
+			}
+		}
+	}
+
+	check()
+
+	// A checksum claimed by an older version, under a key that doesn't tell the manufacturer from the checksum
+	legacy := f.create(f.maker, f.buyer, "London")
+
+	p := f.product(legacy)
+	p.CheckID = "CS-3"
+	f.store(p)
+
+	f.stub.MockTransactionStart("legacy")
+	f.stub.MockStub.PutState("Checksum_"+f.maker.Name+"_CS-3", []byte(legacy))
+	f.stub.MockTransactionEnd("legacy")
+
+	f.upgrade()
+
+	index[[2]string{f.maker.Name, "CS-3"}] = legacy
+	check()
+
+	if _, ok := f.stub.State["Checksum_"+f.maker.Name+"_CS-3"]; ok {
+		t.Errorf("legacy checksum key not deleted")
+	}
+
+	f.fails(ERR_INVALID_STATE, f.maker, "set_checksum", "CS-3", first)
+}
+
+func TestLabelledDetails(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	created := f.create(f.maker, f.buyer, "London")
+
+	sold := f.create(f.maker, f.buyer, "London")
+	f.advance(sold, STATE_INUSE)
+
+	recycled := f.create(f.maker, f.buyer, "London")
+	f.advance(recycled, STATE_INUSE)
+	f.ok(f.buyer, "private_to_recycler", f.recycler.Name, recycled)
+
+	unknown := f.create(f.maker, f.buyer, "London")
+	p := f.product(unknown)
+	p.Manufacturer = "ghost@Org1MSP"
+	f.store(p)
+
+	tests := []struct {
+		name         string
+		pid          string
+		owner        string
+		manufacturer string
+	}{
+		{"new product", created, "MANUFACTURER", "MANUFACTURER"},
+		{"sold product", sold, "BUYER", "MANUFACTURER"},
+		{"recycled product", recycled, "RECYCLER", "MANUFACTURER"},
+		{"unregistered manufacturer", unknown, "MANUFACTURER", "UNKNOWN"},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			var labelled LabelledProduct
+			f.decode(f.ok(f.gov, "get_vehicle_details", tt.pid, `{"labels":true}`), &labelled)
+
+			if labelled.ProductID != tt.pid || labelled.OwnerRole != tt.owner || labelled.ManufacturerRole != tt.manufacturer {
+				t.Errorf("expected %s owned by a %s and made by a %s, got %s owned by a %s and made by a %s",
+					tt.pid, tt.owner, tt.manufacturer, labelled.ProductID, labelled.OwnerRole, labelled.ManufacturerRole)
+			}
+
+			var plain map[string]interface{}
+			f.decode(f.ok(f.gov, "get_vehicle_details", tt.pid), &plain)
+
+			if _, ok := plain["ownerRole"]; ok {
+				t.Errorf("labels returned without being asked for")
+			}
+		})
+	}
+
+	f.fails(ERR_VALIDATION_FAILED, f.gov, "get_vehicle_details", created, "labels")
+	f.fails(ERR_PERMISSION_DENIED, f.maker2, "get_vehicle_details", created, `{"labels":true}`)
+}
+
+func TestSaveTransferInvariants(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create_priced(f.maker, f.buyer, "London", "250.00", "EUR")
+	stored := string(f.stub.State[pid])
+
+	tests := []struct {
+		name   string
+		change func(p *Product)
+		fails  bool
+	}{
+		{"price", func(p *Product) { p.Price = 1 }, true},
+		{"currency", func(p *Product) { p.Currency = "USD" }, true},
+		{"id", func(p *Product) { p.ProductID = "100000000" }, true},
+		{"owner and state", func(p *Product) { p.Owner = f.buyer.Name; p.State = STATE_INUSE }, false},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			p := f.product(pid)
+			tt.change(&p)
+
+			saved := f.stub.snapshot()
+
+			f.stub.MockTransactionStart("transfer")
+			ok, err := f.cc.save_transfer(f.stub, p)
+			f.stub.MockTransactionEnd("transfer")
+
+			if !tt.fails {
+				if err != nil || !ok {
+					t.Errorf("expected the transfer to be saved, got %v", err)
+				}
+				f.stub.restore(saved)
+				return
+			}
+
+			if err == nil || ok {
+				t.Fatalf("expected a transfer changing the %s to be refused", tt.name)
+			}
+
+			if string(f.stub.State[pid]) != stored {
+				t.Errorf("refused transfer was written")
+			}
+		})
+	}
+
+	f.advance(pid, STATE_INUSE)
+
+	if p := f.product(pid); p.Price != 25000 || p.Currency != "EUR" || p.ProductID != pid {
+		t.Errorf("the lifecycle changed the product to %s at %d %s", p.ProductID, p.Price, p.Currency)
+	}
+}
+
+func TestGetPendingActions(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	contract := f.create(f.maker, f.buyer, "London")
+
+	credited := f.create_contracted(f.maker, f.buyer, "London", f.bbank)
+	f.advance(credited, STATE_CHECK_ACCREDITIVE)
+
+	// Named in another buyer's sales contract, so only that buyer's bank has to act
+	elsewhere_credited := f.create_contracted(f.maker, f.buyer, "London", f.bbank2)
+	f.advance(elsewhere_credited, STATE_CHECK_ACCREDITIVE)
+
+	building := f.create(f.maker, f.buyer, "London")
+	f.advance(building, STATE_MANUFACTURE)
+
+	shipping := f.create(f.maker, f.buyer, "London")
+	f.advance(shipping, STATE_SHIPPING)
+
+	elsewhere := f.create(f.maker, f.buyer, "London")
+	f.advance(elsewhere, STATE_MANUFACTURE)
+	f.ok(f.maker, "start_shipping", f.shipper2.Name, elsewhere)
+
+	delivered := f.create(f.maker, f.buyer, "London")
+	f.advance(delivered, STATE_PAYMENT)
+
+	locked := f.create(f.maker, f.buyer, "London")
+	f.advance(locked, STATE_CHECK_ACCREDITIVE)
+	f.ok(f.gov, "lock_product", locked)
+
+	tests := []struct {
+		name   string
+		caller identity
+		want   []string
+	}{
+		{"regulator", f.gov, []string{delivered}},
+		{"manufacturer", f.maker, []string{building}},
+		{"other manufacturer", f.maker2, []string{}},
+		{"seller's bank", f.sbank, []string{contract}},
+		{"buyer's bank", f.bbank, []string{credited, delivered}},
+		{"other buyer's bank", f.bbank2, []string{elsewhere_credited, delivered}},
+		{"shipper", f.shipper, []string{shipping}},
+		{"other shipper", f.shipper2, []string{elsewhere}},
+		{"buyer", f.buyer, []string{}},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			var pending []Product
+			f.decode(f.ok(tt.caller, "get_pending_actions"), &pending)
+
+			ids := ids_of(pending)
+			sort.Strings(ids)
+			sort.Strings(tt.want)
+
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, ids)
+			}
+		})
+	}
+
+	f.ok(f.bbank, "release_payment", delivered)
+
+	var pending []Product
+	f.decode(f.ok(f.buyer, "get_pending_actions"), &pending)
+
+	if ids := ids_of(pending); !reflect.DeepEqual(ids, []string{delivered}) {
+		t.Errorf("expected the buyer to put %s in use, got %v", delivered, ids)
+	}
+}
+
+func TestReissueAccreditive(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_CHECK_ACCREDITIVE)
+	f.ok(f.maker, "update_price", "150.00", pid)
+
+	before := f.credit(pid)
+	history := len(f.product(pid).OwnerHistory)
+
+	steps := []struct {
+		name   string
+		caller identity
+		credit string
+		code   string
+	}{
+		{"by another party", f.bbank, `{"amount":15000}`, ERR_PERMISSION_DENIED},
+		{"underfunded", f.sbank, `{"amount":12000}`, ERR_VALIDATION_FAILED},
+		{"invalid currency", f.sbank, `{"amount":15000,"currency":"dollars"}`, ERR_VALIDATION_FAILED},
+		{"reissue", f.sbank, `{"amount":15000,"issuingBank":"` + f.bbank2.Name + `","beneficiary":"` + f.buyer2.Name + `","confirmedBy":"` + f.bbank.Name + `","drawn":15000}`, ""},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+			if step.code == "" {
+				f.ok(step.caller, "reissue_accreditive", step.credit, pid)
+			} else {
+				f.fails(step.code, step.caller, "reissue_accreditive", step.credit, pid)
+			}
+		})
+	}
+
+	p := f.product(pid)
+	credit := f.credit(pid)
+
+	if p.State != STATE_CHECK_ACCREDITIVE || credit.Amount != 15000 || credit.Currency != "USD" || credit.Withdrawn {
+		t.Errorf("expected an active accreditive of 15000 USD to check, got %+v in state %d", credit, p.State)
+	}
+
+	if credit.IssuingBank != before.IssuingBank || credit.Beneficiary != before.Beneficiary || credit.ConfirmedBy != "" || credit.Drawn != before.Drawn {
+		t.Errorf("expected only the amount, currency and expiry to be taken from the request, got %+v", credit)
+	}
+
+	var old Accreditive
+	f.decode(f.stub.State["Accreditive_"+before.AccreditiveID], &old)
+
+	if credit.AccreditiveID == before.AccreditiveID || old.Amount != 10000 || !old.Withdrawn {
+		t.Errorf("expected the old accreditive to be kept withdrawn, got %+v", old)
+	}
+
+	var actions []string
+
+	for _, change := range p.OwnerHistory[history:] {
+		actions = append(actions, change.Action)
+	}
+
+	if !reflect.DeepEqual(actions, []string{"withdraw", "transfer"}) {
+		t.Errorf("expected the withdrawal and the new issue in the history, got %v", actions)
+	}
+
+	f.ok(f.bbank, "check_accreditive", pid)
+}
+
+func TestStrictMode(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		strict bool
+	}{
+		{"strict", `{"strict":true}`, true},
+		{"lenient", `{"strict":false}`, false},
+		{"default", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, tt.config)
+
+			expect := func(function string, caller identity, args ...string) {
+				t.Helper()
+				if tt.strict {
+					if message := f.fails(ERR_VALIDATION_FAILED, caller, function, args...); !strings.HasPrefix(message, "Strict mode:") {
+						t.Errorf("expected strict mode to refuse %s, got %q", function, message)
+					}
+				} else {
+					f.ok(caller, function, args...)
+				}
+			}
+
+			expect("create_product", f.maker, f.buyer.Name, "UNDEFINED", "100.00", "USD", "")
+
+			pid := f.create(f.maker, f.buyer, "London")
+
+			placeholder := "UNDEFINED"
+			if tt.strict {
+				placeholder = ""
+			}
+
+			if p := f.product(pid); p.CheckID != placeholder || p.Origin != placeholder || p.Route != placeholder {
+				t.Errorf("expected unknown fields to be %q, got %q, %q and %q", placeholder, p.CheckID, p.Origin, p.Route)
+			}
+
+			legacy := f.create(f.maker, f.buyer, "London")
+			p := f.product(legacy)
+			p.Route = "UNDEFINED"
+			f.store(p)
+
+			expect("update_batch", f.maker, "B-1", legacy)
+
+			f.advance(pid, STATE_MANUFACTURE)
+			expect("start_shipping", f.maker, f.shipper.Name, pid)
+
+			if tt.strict {
+				f.ok(f.maker, "update_width", "180", pid)
+				f.ok(f.maker, "update_height", "150", pid)
+				f.ok(f.maker, "update_weight", "1200", pid)
+				f.ok(f.maker, "start_shipping", f.shipper.Name, pid)
+			}
+		})
+	}
+}
+
+func TestGetProductsGroupedByManufacturer(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	f.create_priced(f.maker, f.buyer, "London", "100.00", "USD")
+	f.create_priced(f.maker, f.buyer, "London", "250.50", "USD")
+	f.create_priced(f.maker, f.buyer, "London", "80.00", "EUR")
+	f.create_priced(f.maker2, f.buyer, "London", "1000", "JPY")
+	f.create_priced(f.maker2, f.buyer2, "London", "40.00", "USD")
+
+	scrapped := f.create_priced(f.maker, f.buyer, "London", "999.00", "USD")
+	f.advance(scrapped, STATE_SCRAPPED)
+
+	// Groups are sorted by manufacturer, and "maker2@" sorts before "maker@"
+	want := []ManufacturerGroup{
+		{Manufacturer: f.maker2.Name, Count: 2, TotalValuePerCurrency: map[string]Money{"JPY": 1000, "USD": 4000}},
+		{Manufacturer: f.maker.Name, Count: 3, TotalValuePerCurrency: map[string]Money{"USD": 35050, "EUR": 8000}},
+	}
+
+	var page ManufacturerPage
+	f.decode(f.ok(f.gov, "get_products_grouped_by_manufacturer"), &page)
+
+	if !reflect.DeepEqual(page.Groups, want) || page.NextBookmark != "" {
+		t.Errorf("expected %+v on a single page, got %+v", want, page)
+	}
+
+	f.run("paged", func(t *testing.T) {
+
+		var groups []ManufacturerGroup
+		bookmark := ""
+
+		for pages := 1; ; pages++ {
+
+			if pages > 6 {
+				t.Fatal("paging doesn't end")
+			}
+
+			var page ManufacturerPage
+			f.decode(f.ok(f.gov, "get_products_grouped_by_manufacturer", "2", bookmark), &page)
+
+			// A manufacturer carried over from the previous page is merged into its group
+			for _, group := range page.Groups {
+
+				last := len(groups) - 1
+
+				if last < 0 || groups[last].Manufacturer != group.Manufacturer {
+					groups = append(groups, group)
+					continue
+				}
+
+				groups[last].Count += group.Count
+				for currency, value := range group.TotalValuePerCurrency {
+					groups[last].TotalValuePerCurrency[currency] += value
+				}
+			}
+
+			bookmark = page.NextBookmark
+
+			if bookmark == "" {
+				if pages != 3 {
+					t.Errorf("expected the 6 products read 2 a page on 3 pages, got %d", pages)
+				}
+				break
+			}
+		}
+
+		if !reflect.DeepEqual(groups, want) {
+			t.Errorf("expected %+v, got %+v", want, groups)
+		}
+	})
+
+	f.fails(ERR_VALIDATION_FAILED, f.gov, "get_products_grouped_by_manufacturer", "0")
+	f.fails(ERR_VALIDATION_FAILED, f.gov, "get_products_grouped_by_manufacturer", "two")
+	f.fails(ERR_VALIDATION_FAILED, f.gov, "get_products_grouped_by_manufacturer", "2", "999999999")
+
+	for _, caller := range []identity{f.maker, f.buyer, f.sbank} {
+		f.fails(ERR_PERMISSION_DENIED, caller, "get_products_grouped_by_manufacturer")
+	}
+}
+
+func TestUpdateLocationByCustodian(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_MANUFACTURE)
+
+	location := `{"lat":51.5,"lon":-0.1}`
+
+	steps := []struct {
+		name   string
+		caller identity
+		action func()
+		code   string
+	}{
+		{"owner before shipping", f.maker, nil, ERR_PERMISSION_DENIED},
+		{"shipper before shipping", f.shipper, nil, ERR_PERMISSION_DENIED},
+		{"owner while shipping", f.maker, func() { f.ok(f.maker, "start_shipping", f.shipper.Name, pid) }, ERR_PERMISSION_DENIED},
+		{"regulator while shipping", f.gov, nil, ERR_PERMISSION_DENIED},
+		{"other shipper", f.shipper2, nil, ERR_PERMISSION_DENIED},
+		{"custodian", f.shipper, nil, ""},
+		{"former custodian", f.shipper, func() { f.ok(f.shipper, "shipper_to_buyer", f.buyer.Name, pid) }, ERR_PERMISSION_DENIED},
+		{"buyer holding the product", f.buyer, nil, ERR_PERMISSION_DENIED},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+
+			if step.action != nil {
+				step.action()
+			}
+
+			if step.code != "" {
+				f.fails(step.code, step.caller, "update_location", location, pid)
+				return
+			}
+
+			f.ok(step.caller, "update_location", location, pid)
+		})
+	}
+
+	if p := f.product(pid); len(p.LocationHistory) != 1 || p.Owner != f.maker.Name {
+		t.Errorf("expected one location recorded by the custodian, got %+v", p.LocationHistory)
+	}
+}
+
+func TestGetProductsModifiedSince(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	older := f.create(f.maker, f.buyer, "London")
+	created := f.stub.now
+
+	updated := f.create(f.maker, f.buyer, "London")
+
+	f.stub.now += 100
+	f.ok(f.maker, "update_route", "Hamburg,London", updated)
+	modified := f.stub.now
+
+	hidden := f.create(f.maker2, f.buyer2, "London")
+
+	if p := f.product(updated); p.LastModified != modified {
+		t.Errorf("expected product %s last modified at %d, got %d", updated, modified, p.LastModified)
+	}
+
+	at := func(n int64) string { return strconv.FormatInt(n, 10) }
+
+	tests := []struct {
+		name   string
+		caller identity
+		since  string
+		want   []string
+	}{
+		{"before every change", f.maker, at(created - 1), []string{older, updated}},
+		{"after the creation", f.maker, at(created), []string{updated}},
+		{"at the update", f.maker, at(modified), []string{}},
+		{"other manufacturer", f.maker2, at(created - 1), []string{hidden}},
+		{"regulator", f.gov, at(created), []string{updated, hidden}},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			var products []Product
+			f.decode(f.ok(tt.caller, "get_products_modified_since", tt.since), &products)
+
+			ids := ids_of(products)
+			sort.Strings(ids)
+			sort.Strings(tt.want)
+
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, ids)
+			}
+		})
+	}
+
+	f.fails(ERR_VALIDATION_FAILED, f.maker, "get_products_modified_since", "yesterday")
+}
+
+func TestScrapApprovals(t *testing.T) {
+
+	type approval struct {
+		caller identity
+		code   string
+		state  int
+	}
+
+	f := newFixture(t, "")
+
+	tests := []struct {
+		name      string
+		config    string
+		approvals []approval
+	}{
+		{"default", "", []approval{
+			{f.buyer, "", STATE_SCRAPPED},
+		}},
+		{"single approval by the regulator", `{"scrapApprovalsRequired":1}`, []approval{
+			{f.gov, "", STATE_SCRAPPED},
+		}},
+		{"two approvals", `{"scrapApprovalsRequired":2}`, []approval{
+			{f.buyer2, ERR_PERMISSION_DENIED, STATE_INUSE},
+			{f.buyer, "", STATE_INUSE},
+			{f.buyer, ERR_INVALID_STATE, STATE_INUSE},
+			{f.gov, "", STATE_SCRAPPED},
+			{f.gov, ERR_PERMISSION_DENIED, STATE_SCRAPPED},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, tt.config)
+
+			pid := f.create(f.maker, f.buyer, "London")
+			f.advance(pid, STATE_INUSE)
+
+			var approvers []string
+
+			for i, a := range tt.approvals {
+
+				if a.code != "" {
+					f.fails(a.code, a.caller, "scrap_product", pid)
+				} else {
+					f.ok(a.caller, "scrap_product", pid)
+					approvers = append(approvers, a.caller.Name)
+				}
+
+				p := f.product(pid)
+
+				if p.State != a.state {
+					t.Fatalf("expected state %d after approval %d, got %d", a.state, i, p.State)
+				}
+
+				if !reflect.DeepEqual(p.ScrapApprovals, approvers) {
+					t.Fatalf("expected approvals %v after approval %d, got %v", approvers, i, p.ScrapApprovals)
+				}
+			}
+		})
+	}
+
+	cc := new(SimpleChaincode)
+	stub := newTestStub(cc)
+	stub.args = [][]byte{[]byte("init"), []byte(`{"scrapApprovalsRequired":-1}`)}
+
+	stub.MockTransactionStart("init")
+	response := cc.Init(stub)
+	stub.MockTransactionEnd("init")
+
+	if response.Status == shim.OK {
+		t.Errorf("Init accepted a negative number of approvals")
+	}
+}
+
+func TestCloneProduct(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_SHIPPING)
+
+	p := f.product(pid)
+	p.Origin = "Hamburg"
+	p.Route = "Hamburg,Rotterdam"
+	p.Units = Units{Length: "in", Mass: "lb"}
+	p.Width, p.Height, p.Weight = 12.5, 8, 300
+	f.store(p)
+
+	tests := []struct {
+		name   string
+		caller identity
+		buyer  identity
+		code   string
+	}{
+		{"not the manufacturer", f.buyer, f.buyer2, ERR_PERMISSION_DENIED},
+		{"buyer not registered as one", f.maker, f.shipper, ERR_VALIDATION_FAILED},
+		{"manufacturer", f.maker, f.buyer2, ""},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, tt.caller, "clone_product", tt.buyer.Name, pid)
+				return
+			}
+
+			data := f.ok(tt.caller, "clone_product", tt.buyer.Name, pid)
+			clone := f.product(strings.Trim(string(data), "\""))
+
+			if clone.ProductID == pid {
+				t.Fatalf("clone reuses the id of the original %s", pid)
+			}
+
+			if clone.Origin != p.Origin || clone.Destination != p.Destination || clone.Route != p.Route || clone.Units != p.Units ||
+				clone.Width != p.Width || clone.Height != p.Height || clone.Weight != p.Weight || clone.Price != p.Price || clone.Currency != p.Currency {
+				t.Errorf("descriptive fields not copied: %+v", clone)
+			}
+
+			if clone.Manufacturer != f.maker.Name || clone.Owner != f.maker.Name || clone.Buyer != f.buyer2.Name {
+				t.Errorf("expected a fresh owner and the new buyer, got %+v", clone)
+			}
+
+			if clone.State != STATE_SALESCONTRACT || len(clone.StateHistory) != 1 {
+				t.Errorf("expected a new sales contract, got state %d with history %+v", clone.State, clone.StateHistory)
+			}
+
+			if clone.AccreditiveID != "" || clone.IssuingBank != "" || clone.Custodian != "" || len(clone.CustodyHistory) != 0 ||
+				len(clone.Milestones) != 0 || len(clone.OwnerHistory) != 0 || len(clone.Payments) != 0 {
+				t.Errorf("trade data copied into the clone: %+v", clone)
+			}
+
+			if original := f.product(pid); original.State != STATE_SHIPPING || original.AccreditiveID == "" {
+				t.Errorf("original changed by cloning: %+v", original)
+			}
+		})
+	}
+}
+
+func TestQueryArgumentCounts(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+
+	var functions []string
+	for function := range QUERY_ARGS {
+		functions = append(functions, function)
+	}
+	sort.Strings(functions)
+
+	for _, function := range functions {
+
+		bounds := QUERY_ARGS[function]
+
+		f.run(function, func(t *testing.T) {
+
+			if bounds[0] > 0 {
+				f.fails(ERR_VALIDATION_FAILED, f.gov, function, make([]string, bounds[0]-1)...)
+			}
+
+			args := make([]string, bounds[1]+1)
+			for i := range args {
+				args[i] = pid
+			}
+
+			f.fails(ERR_VALIDATION_FAILED, f.gov, function, args...)
+		})
+	}
+}
+
+func TestGetProductsByRouteContains(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	routes := []string{"Hamburg,Portsmouth,London", "Rotterdam, port ,Antwerp", "Port"}
+	var pids []string
+
+	for _, route := range routes {
+
+		pid := f.create(f.maker, f.buyer, "London")
+
+		p := f.product(pid)
+		p.Route = route
+		f.store(p)
+
+		pids = append(pids, pid)
+	}
+
+	tests := []struct {
+		name     string
+		caller   identity
+		waypoint string
+		want     []string
+		code     string
+	}{
+		{"whole waypoint", f.maker, "Portsmouth", []string{pids[0]}, ""},
+		{"ignoring case and spaces", f.maker, "PORT", []string{pids[1], pids[2]}, ""},
+		{"partial name", f.maker, "Ports", []string{}, ""},
+		{"not visible to the caller", f.maker2, "Port", []string{}, ""},
+		{"empty waypoint", f.maker, " ", nil, ERR_VALIDATION_FAILED},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, tt.caller, "get_products_by_route_contains", tt.waypoint)
+				return
+			}
+
+			var products []Product
+			f.decode(f.ok(tt.caller, "get_products_by_route_contains", tt.waypoint), &products)
+
+			if ids := ids_of(products); !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, ids)
+			}
+		})
+	}
+}
+
+func TestListQueriesOnEmptyLedger(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	tests := []struct {
+		function string
+		args     []string
+		want     string
+	}{
+		{"get_vehicles", nil, `[]`},
+		{"get_product_count", nil, `0`},
+		{"get_products_summary_csv", nil, `"productId,manufacturer,owner,state,price,currency,destination\n"`},
+		{"get_products_requiring_inspection", nil, `[]`},
+		{"get_pending_actions", nil, `[]`},
+		{"get_products_grouped_by_manufacturer", nil, `{"groups":[],"nextBookmark":""}`},
+		{"get_products_by_owner", nil, `[]`},
+		{"get_held_products", nil, `[]`},
+		{"get_stale_products", nil, `[]`},
+		{"get_products_by_state", []string{strconv.Itoa(STATE_SALESCONTRACT)}, `[]`},
+		{"get_products_by_currency", []string{"USD"}, `{"currency":"USD","total":0,"count":0,"products":[]}`},
+		{"get_products_by_custodian", []string{f.shipper.Name}, `[]`},
+		{"get_products_by_route_contains", []string{"Hamburg"}, `[]`},
+		{"get_products_modified_since", []string{"0"}, `[]`},
+		{"get_products_created_between", []string{"0", "100000"}, `[]`},
+		{"get_products_scrapped_between", []string{"0", "100000"}, `{"count":0,"products":[]}`},
+		{"get_high_velocity_products", []string{"1"}, `[]`},
+		{"get_products_for_bank", []string{f.sbank.Name}, `{"bank":"` + f.sbank.Name + `","products":[],"outstanding":{}}`},
+		{"get_buyer_obligations", []string{f.buyer.Name}, `{"buyer":"` + f.buyer.Name + `","products":[],"totals":{}}`},
+		{"suggest_consolidations", []string{"London"}, `[]`},
+		{"get_recalled_owners", nil, `[]`},
+		{"get_unpaid_invoices", []string{f.buyer.Name}, `[]`},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.function, func(t *testing.T) {
+
+			if data := f.ok(f.gov, tt.function, tt.args...); string(data) != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, data)
+			}
+		})
+	}
+}
+
+func TestTransferCooldown(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		wait   int64
+		code   string
+	}{
+		{"no cooldown", "", 0, ""},
+		{"rapid transfer", `{"transferCooldown":3600}`, 0, ERR_INVALID_STATE},
+		{"just inside the cooldown", `{"transferCooldown":3600}`, 3598, ERR_INVALID_STATE},
+		{"after the cooldown", `{"transferCooldown":3600}`, 3600, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, tt.config)
+
+			pid := f.create(f.maker, f.buyer, "London")
+			f.advance(pid, STATE_PAYMENT)
+			f.ok(f.bbank, "pay_full", pid)
+
+			// The maker has only just become the owner
+			p := f.product(pid)
+			p.OwnerHistory = append(p.OwnerHistory, OwnerChange{Action: "transfer", PreviousOwner: f.maker2.Name, Owner: p.Owner, State: p.State, Timestamp: f.stub.now})
+			f.store(p)
+
+			f.stub.now += tt.wait
+
+			if tt.code != "" {
+
+				if message := f.fails(tt.code, f.buyer, "put_in_use", pid); message != "transfer cooldown active" {
+					t.Errorf("expected the cooldown to be reported, got %q", message)
+				}
+
+				return
+			}
+
+			f.ok(f.buyer, "put_in_use", pid)
+
+			if p := f.product(pid); p.Owner != f.buyer.Name {
+				t.Fatalf("expected %s to own the product, got %s", f.buyer.Name, p.Owner)
+			}
+
+			// The regulator can undo the transfer straight away
+			f.ok(f.gov, "revert_last_transition", pid)
+
+			if p := f.product(pid); p.Owner != f.maker.Name {
+				t.Errorf("expected the transfer to be reverted, got owner %s", p.Owner)
+			}
+		})
+	}
+
+	t.Run("regulator", func(t *testing.T) {
+
+		f := newFixture(t, `{"transferCooldown":3600}`)
+
+		pid := f.create(f.maker, f.buyer, "London")
+		f.advance(pid, STATE_INUSE)
+
+		// The buyer has only just been paid for it
+		f.fails(ERR_INVALID_STATE, f.buyer, "private_to_recycler", f.recycler.Name, pid)
+
+		p := f.product(pid)
+		p.Owner = f.gov.Name
+		f.store(p)
+
+		f.ok(f.gov, "private_to_recycler", f.recycler.Name, pid)
+
+		if p := f.product(pid); p.Owner != f.recycler.Name {
+			t.Errorf("expected the regulator's transfer to skip the cooldown, got owner %s", p.Owner)
+		}
+	})
+}
+
+func TestGetTradeFinanceStatus(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	terms := `{"sellerBank":"` + f.sbank.Name + `","buyerBank":"` + f.bbank.Name + `"}`
+	pid := strings.Trim(string(f.ok(f.maker, "create_product", f.buyer.Name, "London", "100.00", "USD", terms)), "\"")
+
+	steps := []struct {
+		name    string
+		advance func()
+		want    TradeFinanceStatus
+	}{
+		{"sales contract", func() {}, TradeFinanceStatus{StateName: "SALESCONTRACT"}},
+		{"accreditive issued", func() { f.advance(pid, STATE_CHECK_ACCREDITIVE) },
+			TradeFinanceStatus{StateName: "CHECK_ACCREDITIVE", AccreditiveIssued: true, AccreditiveAmount: 10000, AccreditiveCurrency: "USD"}},
+		{"accreditive checked", func() { f.advance(pid, STATE_MANUFACTURE) },
+			TradeFinanceStatus{StateName: "MANUFACTURE", AccreditiveIssued: true, AccreditiveChecked: true, AccreditiveAmount: 10000, AccreditiveCurrency: "USD"}},
+		{"delivered", func() { f.advance(pid, STATE_PAYMENT) },
+			TradeFinanceStatus{StateName: "PAYMENT", AccreditiveIssued: true, AccreditiveChecked: true, AccreditiveAmount: 10000, AccreditiveCurrency: "USD"}},
+		{"inspected", func() { f.ok(f.gov, "record_inspection", `{"passed":true,"notes":"ok"}`, pid) },
+			TradeFinanceStatus{StateName: "PAYMENT", AccreditiveIssued: true, AccreditiveChecked: true, Inspected: true, AccreditiveAmount: 10000, AccreditiveCurrency: "USD"}},
+		{"paid", func() { f.advance(pid, STATE_INUSE) },
+			TradeFinanceStatus{StateName: "INUSE", AccreditiveIssued: true, AccreditiveChecked: true, Inspected: true, Paid: true, AccreditiveAmount: 10000, AccreditiveCurrency: "USD"}},
+		{"refunded", func() {
+			p := f.product(pid)
+			p.OwnerHistory = append(p.OwnerHistory, OwnerChange{Action: "refund", PreviousOwner: p.Owner, PreviousState: p.State, Owner: p.Owner, State: p.State, Timestamp: f.stub.now})
+			f.store(p)
+		}, TradeFinanceStatus{StateName: "INUSE", AccreditiveIssued: true, AccreditiveChecked: true, Inspected: true, Paid: true, Refunded: true, AccreditiveAmount: 10000, AccreditiveCurrency: "USD"}},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+
+			step.advance()
+
+			want := step.want
+			want.ProductID, want.Price, want.Currency = pid, 10000, "USD"
+
+			var status TradeFinanceStatus
+			f.decode(f.ok(f.buyer, "get_trade_finance_status", pid), &status)
+
+			if status != want {
+				t.Errorf("expected %+v, got %+v", want, status)
+			}
+		})
+	}
+
+	callers := []struct {
+		caller identity
+		code   string
+	}{
+		{f.maker, ""},
+		{f.sbank, ""},
+		{f.bbank, ""},
+		{f.gov, ""},
+		{f.buyer2, ERR_PERMISSION_DENIED},
+		{f.bbank2, ERR_PERMISSION_DENIED},
+		{f.shipper, ERR_PERMISSION_DENIED},
+	}
+
+	for _, c := range callers {
+		f.run("called by "+c.caller.Name, func(t *testing.T) {
+
+			if c.code != "" {
+				f.fails(c.code, c.caller, "get_trade_finance_status", pid)
+				return
+			}
+
+			f.ok(c.caller, "get_trade_finance_status", pid)
+		})
+	}
+}
+
+func TestReindexOnInit(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	indexed := f.create(f.maker, f.buyer, "London")
+
+	legacy := map[string]string{}
+
+	for _, key := range []string{"v5cIDs", "productId"} {
+
+		pid := f.create(f.maker, f.buyer, "Paris")
+
+		// Take the product out of the pid index and list it under the legacy key instead
+		index, err := f.stub.CreateCompositeKey(PRODUCT_INDEX, []string{pid})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		delete(f.stub.State, index)
+		f.stub.State[key] = []byte(`{"productIds":[` + pid + `]}`)
+
+		legacy[key] = pid
+	}
+
+	f.upgrade()
+
+	var products []Product
+	f.decode(f.ok(f.gov, "get_vehicles"), &products)
+
+	ids := ids_of(products)
+	sort.Strings(ids)
+
+	want := []string{indexed, legacy["v5cIDs"], legacy["productId"]}
+	sort.Strings(want)
+
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("expected %v after migrating, got %v", want, ids)
+	}
+
+	for key := range legacy {
+		if _, ok := f.stub.State[key]; ok {
+			t.Errorf("legacy key %s not deleted", key)
+		}
+	}
+
+	migrated := f.stub.snapshot().state
+
+	f.upgrade()
+
+	if !reflect.DeepEqual(f.stub.snapshot().state, migrated) {
+		t.Errorf("running Init again changed the world state")
+	}
+}
+
+func TestCreateProductHostileInput(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	tests := []struct {
+		name        string
+		buyer       string
+		destination string
+		price       string
+		currency    string
+		terms       string
+		code        string
+	}{
+		{"apostrophe", f.buyer.Name, "St. John's", "100", "USD", "", ""},
+		{"punctuation and accents", f.buyer.Name, "Zürich (Höngg) / Lake & Co", "100", "USD", "", ""},
+		{"field injected in destination", f.buyer.Name, `London","Owner":"` + f.buyer.Name, "100", "USD", "", ERR_VALIDATION_FAILED},
+		{"escaped quotes in destination", f.buyer.Name, `London\",\"State\":6`, "100", "USD", "", ERR_VALIDATION_FAILED},
+		{"control character in destination", f.buyer.Name, "London\x00", "100", "USD", "", ERR_VALIDATION_FAILED},
+		{"field injected in currency", f.buyer.Name, "London", "100", `USD","Price":1`, "", ERR_VALIDATION_FAILED},
+		{"field injected in price", f.buyer.Name, "London", `100,"Owner":"x"`, "USD", "", ERR_VALIDATION_FAILED},
+		{"field injected in buyer", f.buyer.Name + `","Owner":"x`, "London", "100", "USD", "", ERR_NOT_FOUND},
+		{"field injected in terms", f.buyer.Name, "London", "100", "USD", `{"sellerBank":"` + f.sbank.Name + `\",\"x\":\"y"}`, ERR_NOT_FOUND},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, f.maker, "create_product", tt.buyer, tt.destination, tt.price, tt.currency, tt.terms)
+				return
+			}
+
+			pid := strings.Trim(string(f.ok(f.maker, "create_product", tt.buyer, tt.destination, tt.price, tt.currency, tt.terms)), "\"")
+
+			if !json.Valid(f.stub.State[pid]) {
+				t.Fatalf("stored record isn't valid JSON: %s", f.stub.State[pid])
+			}
+
+			p := f.product(pid)
+
+			if p.Destination != tt.destination || p.Owner != f.maker.Name || p.Buyer != f.buyer.Name || p.State != STATE_SALESCONTRACT || p.Price != 10000 {
+				t.Errorf("product not stored as given: %+v", p)
+			}
+		})
+	}
+}
+
+func TestExecuteSalesContract(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	document := sha256.Sum256([]byte("sales contract for one vehicle"))
+	other := sha256.Sum256([]byte("another sales contract"))
+	hash, other_hash := hex.EncodeToString(document[:]), hex.EncodeToString(other[:])
+
+	create := func(buyer identity) string {
+		terms := `{"terms":"FOB Hamburg","documentHash":"` + hash + `"}`
+		return strings.Trim(string(f.ok(f.maker, "create_product", buyer.Name, "London", "100.00", "USD", terms)), "\"")
+	}
+
+	status := func(pid string) string {
+
+		var contract SalesContract
+		f.decode(f.ok(f.gov, "get_sales_contract", "SC"+pid), &contract)
+
+		return contract.Status
+	}
+
+	pid := create(f.buyer)
+
+	// The maker's certificate was pinned with its first transaction, the buyer's is registered by the regulator
+	f.ok(f.gov, "register_participant", f.buyer.Name, strconv.Itoa(BUYER), f.buyer.certificate)
+
+	seller, buyer := f.maker.sign(t, document[:]), f.buyer.sign(t, document[:])
+
+	tampered, _ := base64.StdEncoding.DecodeString(seller)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tests := []struct {
+		name    string
+		caller  identity
+		hash    string
+		seller  string
+		buyer   string
+		code    string
+		message string
+	}{
+		{"not a party", f.shipper, hash, seller, buyer, ERR_PERMISSION_DENIED, ""},
+		{"tampered signature", f.maker, hash, base64.StdEncoding.EncodeToString(tampered), buyer, ERR_VALIDATION_FAILED, "Signature of " + f.maker.Name},
+		{"wrong signer", f.maker, hash, seller, f.buyer2.sign(t, document[:]), ERR_VALIDATION_FAILED, "Signature of " + f.buyer.Name},
+		{"signatures swapped", f.maker, hash, buyer, seller, ERR_VALIDATION_FAILED, "Signature of " + f.maker.Name},
+		{"mismatched hash", f.maker, other_hash, f.maker.sign(t, other[:]), f.buyer.sign(t, other[:]), ERR_VALIDATION_FAILED, "doesn't match"},
+		{"malformed hash", f.maker, "abc", seller, buyer, ERR_VALIDATION_FAILED, ""},
+		{"both signatures valid", f.buyer, hash, seller, buyer, "", ""},
+		{"already executed", f.maker, hash, seller, buyer, ERR_INVALID_STATE, ""},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+
+				message := f.fails(tt.code, tt.caller, "execute_sales_contract", "SC"+pid, tt.hash, tt.seller, tt.buyer)
+
+				if !strings.Contains(message, tt.message) {
+					t.Errorf("expected %q in %q", tt.message, message)
+				}
+
+				if s := status(pid); tt.code != ERR_INVALID_STATE && s != CONTRACT_PENDING {
+					t.Errorf("expected the contract to stay %s, got %s", CONTRACT_PENDING, s)
+				}
+
+				return
+			}
+
+			f.ok(tt.caller, "execute_sales_contract", "SC"+pid, tt.hash, tt.seller, tt.buyer)
+
+			var contract SalesContract
+			f.decode(f.ok(f.gov, "get_sales_contract", "SC"+pid), &contract)
+
+			if contract.Status != CONTRACT_EXECUTED || contract.SellerSignature != tt.seller || contract.BuyerSignature != tt.buyer || contract.ExecutedAt != f.stub.now-1 {
+				t.Errorf("contract not executed: %+v", contract)
+			}
+		})
+	}
+
+	f.run("no certificate registered for the buyer", func(t *testing.T) {
+
+		// buyer2 has been registered by the regulator but never invoked the chaincode
+		unpinned := create(f.buyer2)
+
+		message := f.fails(ERR_INVALID_STATE, f.maker, "execute_sales_contract", "SC"+unpinned, hash, seller, f.buyer2.sign(t, document[:]))
+
+		if !strings.Contains(message, "No certificate is registered for "+f.buyer2.Name) {
+			t.Errorf("expected the missing certificate to be reported, got %q", message)
+		}
+
+		if s := status(unpinned); s != CONTRACT_PENDING {
+			t.Errorf("expected the contract to stay %s, got %s", CONTRACT_PENDING, s)
+		}
+	})
+
+	f.run("second certificate for a pinned participant", func(t *testing.T) {
+
+		pinned := func() string {
+
+			var participant Participant
+			f.decode(f.stub.State["Participant_"+f.maker.Name], &participant)
+
+			return participant.Certificate
+		}
+
+		// Re-enrolled with the same common name, so the new certificate is pinned
+		renewed := issueIdentityValid(t, "maker", SELLER, time.Unix(1000, 0), time.Unix(1<<32, 0))
+		f.ok(renewed, "create_product", f.buyer.Name, "London", "100.00", "USD", "")
+
+		if pinned() != renewed.certificate {
+			t.Errorf("expected the renewed certificate to be pinned")
+		}
+
+		// The old certificate is still valid, so it may call but doesn't replace the newer one
+		f.ok(f.maker, "create_product", f.buyer.Name, "London", "100.00", "USD", "")
+
+		if pinned() != renewed.certificate {
+			t.Errorf("expected the renewed certificate to stay pinned")
+		}
+
+		signed := create(f.buyer)
+		f.fails(ERR_VALIDATION_FAILED, f.maker, "execute_sales_contract", "SC"+signed, hash, seller, buyer)
+		f.ok(f.maker, "execute_sales_contract", "SC"+signed, hash, renewed.sign(t, document[:]), buyer)
+	})
+
+	f.run("pinned certificate expired", func(t *testing.T) {
+
+		expired := issueIdentityValid(t, "maker", SELLER, time.Unix(2000, 0), time.Unix(f.stub.now-1, 0))
+		f.ok(expired, "create_product", f.buyer.Name, "London", "100.00", "USD", "")
+		f.ok(f.maker, "create_product", f.buyer.Name, "London", "100.00", "USD", "")
+
+		var participant Participant
+		f.decode(f.stub.State["Participant_"+f.maker.Name], &participant)
+
+		if participant.Certificate != f.maker.certificate {
+			t.Errorf("expected the certificate in use to replace the expired one")
+		}
+	})
+}
+
+func TestMigrateMoney(t *testing.T) {
+
+	cc := new(SimpleChaincode)
+	stub := newTestStub(cc)
+
+	legacy := map[string]string{
+		"v5cIDs": `{"productIds":[100000001,100000002]}`,
+		"100000001": `{"ProductID":"100000001","Owner":"maker@Org1MSP","State":4,"Currency":"USD","Price":12.5,"ShippingCost":3.2,` +
+			`"Accreditive":{"AccreditiveID":"LC1","Amount":12.5,"Drawn":2.25,"Currency":"USD"},` +
+			`"PastAccreditives":[{"AccreditiveID":"LC0","Amount":10,"Drawn":0.01,"Currency":"USD"}],` +
+			`"Payments":[{"Amount":1.99,"Currency":"USD"}],"Contracts":[{"Price":12.5,"Currency":"USD"}]}`,
+		"100000002":       `{"ProductID":"100000002","Owner":"maker@Org1MSP","State":5,"Currency":"JPY","Price":1500,"Payments":[{"Amount":500,"Currency":"JPY"}]}`,
+		"Accreditive_LC1": `{"AccreditiveID":"LC1","Amount":99.99,"Drawn":10.5,"Currency":"EUR"}`,
+		"Accreditive_LC2": `{"AccreditiveID":"LC2","Amount":250000,"Currency":"JPY"}`,
+	}
+
+	stub.MockTransactionStart("seed")
+	for key, value := range legacy {
+		stub.PutState(key, []byte(value))
+	}
+	stub.MockTransactionEnd("seed")
+
+	init := func() {
+
+		stub.args = [][]byte{[]byte("init")}
+
+		stub.MockTransactionStart("init")
+		response := cc.Init(stub)
+		stub.MockTransactionEnd("init")
+
+		if response.Status != shim.OK {
+			t.Fatalf("Init failed: %s", response.Message)
+		}
+	}
+
+	init()
+
+	var usd, jpy Product
+	json.Unmarshal(stub.State["100000001"], &usd)
+	json.Unmarshal(stub.State["100000002"], &jpy)
+
+	var lc1, lc2 Accreditive
+	json.Unmarshal(stub.State["Accreditive_LC1"], &lc1)
+	json.Unmarshal(stub.State["Accreditive_LC2"], &lc2)
+
+	tests := []struct {
+		name string
+		got  Money
+		want Money
+	}{
+		{"price", usd.Price, 1250},
+		{"shipping cost", usd.ShippingCost, 320},
+		{"accreditive amount", usd.Accreditive.Amount, 1250},
+		{"accreditive drawn", usd.Accreditive.Drawn, 225},
+		{"past accreditive amount", usd.PastAccreditives[0].Amount, 1000},
+		{"past accreditive drawn", usd.PastAccreditives[0].Drawn, 1},
+		{"payment", usd.Payments[0].Amount, 199},
+		{"contract price", usd.Contracts[0].Price, 1250},
+		{"JPY price", jpy.Price, 1500},
+		{"JPY payment", jpy.Payments[0].Amount, 500},
+		{"accreditive record amount", lc1.Amount, 9999},
+		{"accreditive record drawn", lc1.Drawn, 1050},
+		{"JPY accreditive record", lc2.Amount, 250000},
+	}
+
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.want, tt.got)
+		}
+	}
+
+	if marker := string(stub.State[MONEY_UNITS_KEY]); marker != "minor" {
+		t.Fatalf("expected %s to be set after migrating, got %q", MONEY_UNITS_KEY, marker)
+	}
+
+	migrated := stub.snapshot().state
+
+	init()
+
+	if !reflect.DeepEqual(stub.snapshot().state, migrated) {
+		t.Errorf("running Init again converted the amounts again")
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+
+	cc := new(SimpleChaincode)
+
+	tests := []struct {
+		value    string
+		currency string
+		want     Money
+		code     string
+	}{
+		{"12.50", "USD", 1250, ""},
+		{"12.5", "USD", 1250, ""},
+		{"12", "USD", 1200, ""},
+		{"-1.05", "EUR", -105, ""},
+		{"1500", "JPY", 1500, ""},
+		{"92233720368547758.07", "USD", 9223372036854775807, ""},
+		{"12.505", "USD", 0, ERR_VALIDATION_FAILED},
+		{"12.5", "JPY", 0, ERR_VALIDATION_FAILED},
+		{"92233720368547758.08", "USD", 0, ERR_VALIDATION_FAILED},
+		{"9223372036854775808", "JPY", 0, ERR_VALIDATION_FAILED},
+		{"1e5", "USD", 0, ERR_VALIDATION_FAILED},
+		{"12.", "USD", 0, ERR_VALIDATION_FAILED},
+		{"", "USD", 0, ERR_VALIDATION_FAILED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value+" "+tt.currency, func(t *testing.T) {
+
+			amount, err := cc.parse_money(tt.value, tt.currency)
+
+			if tt.code != "" {
+
+				if failure, ok := err.(*ChaincodeError); !ok || failure.Code != tt.code {
+					t.Errorf("expected %s, got %v", tt.code, err)
+				}
+
+				return
+			}
+
+			if err != nil || amount != tt.want {
+				t.Errorf("expected %d, got %d (%v)", tt.want, amount, err)
+			}
+		})
+	}
+}
+
+func TestTwoPhaseTransfer(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_MANUFACTURE)
+
+	unchanged := func(t *testing.T) {
+		if p := f.product(pid); p.State != STATE_MANUFACTURE || p.Owner != f.maker.Name || p.Custodian != "" {
+			t.Errorf("product changed before the transfer was accepted: %+v", p)
+		}
+	}
+
+	pending := func() bool {
+		return len(f.stub.State["transfer_"+pid]) > 0
+	}
+
+	steps := []struct {
+		name     string
+		caller   identity
+		function string
+		args     []string
+		code     string
+		pending  bool
+	}{
+		{"propose", f.maker, "propose_transfer", []string{"start_shipping", f.shipper.Name, pid}, "", true},
+		{"second proposal", f.maker, "propose_transfer", []string{"start_shipping", f.shipper2.Name, pid}, ERR_INVALID_STATE, true},
+		{"direct transfer", f.maker, "start_shipping", []string{f.shipper2.Name, pid}, ERR_INVALID_STATE, true},
+		{"accepted by someone else", f.shipper2, "accept_transfer", []string{pid}, ERR_PERMISSION_DENIED, true},
+		{"accepted by the proposer", f.maker, "accept_transfer", []string{pid}, ERR_PERMISSION_DENIED, true},
+		{"rejected by someone else", f.shipper2, "reject_transfer", []string{pid}, ERR_PERMISSION_DENIED, true},
+		{"rejected", f.shipper, "reject_transfer", []string{pid}, "", false},
+		{"rejected again", f.shipper, "reject_transfer", []string{pid}, ERR_NOT_FOUND, false},
+		{"proposed again", f.maker, "propose_transfer", []string{"start_shipping", f.shipper.Name, pid}, "", true},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+
+			if step.code != "" {
+				f.fails(step.code, step.caller, step.function, step.args...)
+			} else {
+				f.ok(step.caller, step.function, step.args...)
+			}
+
+			if pending() != step.pending {
+				t.Errorf("expected a pending proposal: %v", step.pending)
+			}
+
+			unchanged(t)
+		})
+	}
+
+	f.run("accepted", func(t *testing.T) {
+
+		f.ok(f.shipper, "accept_transfer", pid)
+
+		if p := f.product(pid); p.State != STATE_SHIPPING || p.Custodian != f.shipper.Name {
+			t.Errorf("transfer not carried out: %+v", p)
+		}
+
+		if pending() {
+			t.Errorf("proposal left behind after it was accepted")
+		}
+	})
+
+	f.run("proposer no longer allowed to transfer", func(t *testing.T) {
+
+		other := f.create(f.maker, f.buyer, "Paris")
+		f.advance(other, STATE_MANUFACTURE)
+
+		f.ok(f.maker, "propose_transfer", "start_shipping", f.shipper.Name, other)
+
+		// start_shipping is checked as the proposer, who is no longer a seller when the proposal is accepted
+		f.ok(f.gov, "set_role", f.maker.Name, strconv.Itoa(BUYER))
+		f.fails(ERR_PERMISSION_DENIED, f.shipper, "accept_transfer", other)
+
+		if p := f.product(other); p.State != STATE_MANUFACTURE || p.Custodian != "" {
+			t.Errorf("transfer carried out without the proposer's permission: %+v", p)
+		}
+	})
+}
+
+func TestTransferExpiry(t *testing.T) {
+
+	tests := []struct {
+		name string
+		wait int64
+		code string
+	}{
+		{"accepted in time", 3600, ""},
+		{"expired", 3601, ERR_INVALID_STATE},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			f := newFixture(t, `{"transferExpiry":3600}`)
+
+			pid := f.create(f.maker, f.buyer, "London")
+			f.advance(pid, STATE_MANUFACTURE)
+
+			f.ok(f.maker, "propose_transfer", "start_shipping", f.shipper.Name, pid)
+
+			var proposal TransferProposal
+			f.decode(f.stub.State["transfer_"+pid], &proposal)
+
+			if proposal.ExpiresAt != proposal.Timestamp+3600 {
+				t.Fatalf("expected the proposal to expire an hour after %d, got %d", proposal.Timestamp, proposal.ExpiresAt)
+			}
+
+			f.stub.now = proposal.Timestamp + tt.wait - 1
+
+			if tt.code == "" {
+
+				f.ok(f.shipper, "accept_transfer", pid)
+
+				if p := f.product(pid); p.Custodian != f.shipper.Name {
+					t.Errorf("transfer not carried out: %+v", p)
+				}
+
+				return
+			}
+
+			if message := f.fails(tt.code, f.shipper, "accept_transfer", pid); !strings.Contains(message, "expired") {
+				t.Errorf("expected the expiry to be reported, got %q", message)
+			}
+
+			if p := f.product(pid); p.Custodian != "" {
+				t.Errorf("expired transfer carried out: %+v", p)
+			}
+
+			// The expired proposal no longer blocks the product and is replaced by the next one
+			f.ok(f.maker, "propose_transfer", "start_shipping", f.shipper2.Name, pid)
+			f.fails(ERR_PERMISSION_DENIED, f.shipper, "accept_transfer", pid)
+			f.ok(f.shipper2, "accept_transfer", pid)
+
+			if p := f.product(pid); p.Custodian != f.shipper2.Name {
+				t.Errorf("replacing proposal not carried out: %+v", p)
+			}
+		})
+	}
+}
+
+func TestCancelTransfer(t *testing.T) {
+
+	f := newFixture(t, `{"transferExpiry":3600}`)
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_MANUFACTURE)
+
+	f.fails(ERR_NOT_FOUND, f.maker, "cancel_transfer", pid)
+
+	f.ok(f.maker, "propose_transfer", "start_shipping", f.shipper.Name, pid)
+
+	tests := []struct {
+		name   string
+		caller identity
+		code   string
+	}{
+		{"by the recipient", f.shipper, ERR_PERMISSION_DENIED},
+		{"by the regulator", f.gov, ERR_PERMISSION_DENIED},
+		{"by the buyer", f.buyer, ERR_PERMISSION_DENIED},
+		{"by the proposer", f.maker, ""},
+		{"twice", f.maker, ERR_NOT_FOUND},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, tt.caller, "cancel_transfer", pid)
+			} else {
+				f.ok(tt.caller, "cancel_transfer", pid)
+			}
+
+			if cancelled := len(f.stub.State["transfer_"+pid]) == 0; cancelled != (tt.caller.Name == f.maker.Name) {
+				t.Errorf("expected the proposal to be cancelled: %v", !cancelled)
+			}
+		})
+	}
+
+	f.run("expired proposal", func(t *testing.T) {
+
+		f.ok(f.maker, "propose_transfer", "start_shipping", f.shipper.Name, pid)
+		f.stub.now += 7200
+
+		f.ok(f.maker, "cancel_transfer", pid)
+		f.fails(ERR_NOT_FOUND, f.shipper, "accept_transfer", pid)
+
+		if p := f.product(pid); p.Custodian != "" {
+			t.Errorf("cancelled transfer carried out: %+v", p)
+		}
+	})
+}
+
+func TestTransferProductsBulk(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	var ready []string
+
+	for i := 0; i < 3; i++ {
+		pid := f.create(f.maker, f.buyer, "London")
+		f.advance(pid, STATE_MANUFACTURE)
+		ready = append(ready, pid)
+	}
+
+	unready := f.create(f.maker, f.buyer, "London")
+
+	foreign := f.create(f.maker, f.buyer, "London")
+	f.advance(foreign, STATE_MANUFACTURE)
+
+	p := f.product(foreign)
+	p.Owner = f.maker2.Name
+	f.store(p)
+
+	proposed := f.create(f.maker, f.buyer, "London")
+	f.advance(proposed, STATE_MANUFACTURE)
+	f.ok(f.maker, "propose_transfer", "start_shipping", f.shipper2.Name, proposed)
+
+	list := func(ids ...string) string {
+		bytes, _ := json.Marshal(ids)
+		return string(bytes)
+	}
+
+	tests := []struct {
+		name     string
+		ids      []string
+		function string
+		code     string
+	}{
+		{"last product in the wrong state", append(ready[:2:2], unready), "", ERR_PERMISSION_DENIED},
+		{"last product owned by someone else", append(ready[:2:2], foreign), "", ERR_PERMISSION_DENIED},
+		{"product listed twice", []string{ready[0], ready[1], ready[0]}, "", ERR_VALIDATION_FAILED},
+		{"transfer pending", []string{ready[0], proposed}, "", ERR_INVALID_STATE},
+		{"unknown product", []string{ready[0], "999999999"}, "", ERR_NOT_FOUND},
+		{"not a bulk transfer", ready, "transfer_share", ERR_VALIDATION_FAILED},
+		{"empty list", []string{}, "", ERR_VALIDATION_FAILED},
+		{"all products ready", ready, "", ""},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			args := []string{list(tt.ids...), f.shipper.Name}
+
+			if tt.function != "" {
+				args = append(args, tt.function)
+			}
+
+			if tt.code != "" {
+
+				f.fails(tt.code, f.maker, "transfer_products_bulk", args...)
+
+				// None of the products listed before the one that failed moved
+				for _, pid := range tt.ids {
+
+					if len(f.stub.State[pid]) == 0 {
+						continue
+					}
+
+					if p := f.product(pid); p.State == STATE_SHIPPING || p.Custodian != "" {
+						t.Errorf("product %s moved although the batch failed: %+v", pid, p)
+					}
+				}
+
+				return
+			}
+
+			f.ok(f.maker, "transfer_products_bulk", args...)
+
+			for _, pid := range tt.ids {
+				if p := f.product(pid); p.State != STATE_SHIPPING || p.Custodian != f.shipper.Name {
+					t.Errorf("product %s not handed to the shipper: %+v", pid, p)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateProductsBulk(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	definitions := func(n int) []ProductDefinition {
+
+		batch := []ProductDefinition{}
+
+		for i := 0; i < n; i++ {
+			batch = append(batch, ProductDefinition{Buyer: f.buyer.Name, Destination: "London", Price: 10000, Currency: "USD"})
+		}
+
+		return batch
+	}
+
+	count := func() string {
+		return string(f.ok(f.gov, "get_product_count"))
+	}
+
+	tests := []struct {
+		name  string
+		batch []ProductDefinition
+		code  string
+	}{
+		{"empty batch", definitions(0), ERR_VALIDATION_FAILED},
+		{"too many products", definitions(MAX_BULK_PRODUCTS + 1), ERR_VALIDATION_FAILED},
+		{"last product invalid", append(definitions(2), ProductDefinition{Buyer: f.buyer.Name, Destination: "London", Price: 10000, Currency: "usd"}), ERR_VALIDATION_FAILED},
+		{"unknown buyer", append(definitions(2), ProductDefinition{Buyer: "nobody@Org1MSP", Destination: "London", Price: 10000, Currency: "USD"}), ERR_NOT_FOUND},
+		{"buyer isn't a buyer", append(definitions(2), ProductDefinition{Buyer: f.shipper.Name, Destination: "London", Price: 10000, Currency: "USD"}), ERR_VALIDATION_FAILED},
+		{"one product", definitions(1), ""},
+		{"largest batch", definitions(MAX_BULK_PRODUCTS), ""},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			bytes, _ := json.Marshal(tt.batch)
+			before := count()
+
+			if tt.code != "" {
+
+				f.fails(tt.code, f.maker, "create_products_bulk", string(bytes))
+
+				if after := count(); after != before {
+					t.Errorf("expected no product to be created, count went from %s to %s", before, after)
+				}
+
+				return
+			}
+
+			var created []string
+			f.decode(f.ok(f.maker, "create_products_bulk", string(bytes)), &created)
+
+			if len(created) != len(tt.batch) {
+				t.Fatalf("expected %d products, got %d", len(tt.batch), len(created))
+			}
+
+			for _, pid := range created {
+				if p := f.product(pid); p.Owner != f.maker.Name || p.Buyer != f.buyer.Name || p.State != STATE_SALESCONTRACT {
+					t.Errorf("product %s not created as defined: %+v", pid, p)
+				}
+			}
+
+			if after, _ := strconv.Atoi(count()); strconv.Itoa(after-len(created)) != before {
+				t.Errorf("expected %d more products than %s, got %d", len(created), before, after)
+			}
+		})
+	}
+
+	f.run("duplicate id in the batch", func(t *testing.T) {
+
+		before := count()
+
+		// Look for a nonce that gives two products of the batch the same id in the next transaction, as
+		// generate_product_id would
+		txid := "tx" + strconv.Itoa(f.tx+1)
+		nonce, size := "", 0
+
+		for n := 0; size == 0; n++ {
+
+			ids := make(map[uint64]bool)
+
+			for i := 0; i < MAX_BULK_PRODUCTS; i++ {
+
+				sum := sha256.Sum256([]byte(txid + "|" + strconv.Itoa(n) + "|" + strconv.Itoa(i) + "|0"))
+				id := binary.BigEndian.Uint64(sum[:8]) % uint64(PRODUCT_ID_MAX-PRODUCT_ID_MIN)
+
+				if ids[id] {
+					nonce, size = strconv.Itoa(n), i+1
+					break
+				}
+
+				ids[id] = true
+			}
+		}
+
+		bytes, _ := json.Marshal(definitions(size))
+
+		// Like on a peer, the id reserved for the first product isn't visible when the second is built
+		f.stub.committed = f.stub.snapshot().state
+		defer func() { f.stub.committed = nil }()
+
+		if message := f.fails(ERR_INVALID_STATE, f.maker, "create_products_bulk", string(bytes), nonce); !strings.Contains(message, "duplicate id") {
+			t.Errorf("expected the duplicate id to be reported, got %q", message)
+		}
+
+		f.stub.committed = nil
+
+		if after := count(); after != before {
+			t.Errorf("expected no product to be created, count went from %s to %s", before, after)
+		}
+	})
+}
+
+func TestSetFXRate(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	tests := []struct {
+		name   string
+		caller identity
+		args   []string
+		code   string
+	}{
+		{"not the regulator", f.sbank, []string{"EUR/USD", "1.1"}, ERR_PERMISSION_DENIED},
+		{"no separator", f.gov, []string{"EURUSD", "1.1"}, ERR_VALIDATION_FAILED},
+		{"same currency", f.gov, []string{"EUR/EUR", "1"}, ERR_VALIDATION_FAILED},
+		{"lower case", f.gov, []string{"EUR/usd", "1.1"}, ERR_VALIDATION_FAILED},
+		{"unknown currency", f.gov, []string{"EUR/XYZ", "1.1"}, ERR_VALIDATION_FAILED},
+		{"zero rate", f.gov, []string{"EUR/USD", "0"}, ERR_VALIDATION_FAILED},
+		{"negative rate", f.gov, []string{"EUR/USD", "-1.1"}, ERR_VALIDATION_FAILED},
+		{"infinite rate", f.gov, []string{"EUR/USD", "Inf"}, ERR_VALIDATION_FAILED},
+		{"not a number", f.gov, []string{"EUR/USD", "one"}, ERR_VALIDATION_FAILED},
+		{"negative effective time", f.gov, []string{"EUR/USD", "1.1", "-5"}, ERR_VALIDATION_FAILED},
+		{"invalid effective time", f.gov, []string{"EUR/USD", "1.1", "soon"}, ERR_VALIDATION_FAILED},
+		{"valid", f.gov, []string{"EUR/USD", "1.1"}, ""},
+		{"valid with effective time", f.gov, []string{"EUR/USD", "1.2", "1600000000"}, ""},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, tt.caller, "set_fx_rate", tt.args...)
+				return
+			}
+
+			f.ok(tt.caller, "set_fx_rate", tt.args...)
+		})
+	}
+
+	var rates []FXRate
+	f.decode(f.ok(f.gov, "get_fx_rates", "EUR/USD"), &rates)
+
+	if len(rates) != 2 || rates[0].Rate != 1.1 || rates[1].Rate != 1.2 || rates[1].EffectiveFrom != 1600000000 || rates[0].SetBy != f.gov.Name {
+		t.Errorf("expected the two valid rates, oldest first, got %+v", rates)
+	}
+}
+
+func TestFXRateInEffect(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	start := f.stub.now
+
+	// Rates are set out of order: a future rate first, then a correction of the past
+	f.ok(f.gov, "set_fx_rate", "EUR/USD", "1.1", strconv.FormatInt(start-1000, 10))
+	f.ok(f.gov, "set_fx_rate", "EUR/USD", "1.3", strconv.FormatInt(start+1000, 10))
+	f.ok(f.gov, "set_fx_rate", "EUR/USD", "1.05", strconv.FormatInt(start-2000, 10))
+
+	eur := f.create_priced(f.maker, f.buyer, "London", "100.00", "EUR")
+	usd := f.create_priced(f.maker, f.buyer, "London", "110.00", "USD")
+	short := f.create_priced(f.maker, f.buyer, "London", "100.00", "EUR")
+
+	quote := func(pid string, currency string) Money {
+
+		var price PriceQuote
+		f.decode(f.ok(f.maker, "get_product_price", pid, currency), &price)
+
+		return price.ConvertedPrice
+	}
+
+	f.run("rate in effect now", func(t *testing.T) {
+
+		if price := quote(eur, "USD"); price != 11000 {
+			t.Errorf("expected 100.00 EUR at 1.1 to be 11000, got %d", price)
+		}
+
+		if price := quote(usd, "EUR"); price != 10000 {
+			t.Errorf("expected 110.00 USD at 1/1.1 to be 10000, got %d", price)
+		}
+	})
+
+	f.run("cross currency coverage", func(t *testing.T) {
+
+		// The buyer's bank checks the credit covers the price at the rate in effect
+		f.ok(f.sbank, "bank_issue_accreditive", `{"Amount":10999,"Currency":"USD"}`, short)
+		f.fails(ERR_VALIDATION_FAILED, f.bbank, "check_accreditive", short)
+
+		f.ok(f.sbank, "bank_issue_accreditive", `{"Amount":11000,"Currency":"USD"}`, eur)
+		f.ok(f.bbank, "check_accreditive", eur)
+
+		f.ok(f.sbank, "bank_issue_accreditive", `{"Amount":10000,"Currency":"EUR"}`, usd)
+		f.ok(f.bbank, "check_accreditive", usd)
+	})
+
+	f.run("later rate once in effect", func(t *testing.T) {
+
+		f.stub.now = start + 1000
+
+		if price := quote(eur, "USD"); price != 13000 {
+			t.Errorf("expected 100.00 EUR at 1.3 to be 13000, got %d", price)
+		}
+	})
+
+	f.run("no rate", func(t *testing.T) {
+		if envelope := f.invoke(f.maker, "get_product_price", eur, "GBP"); envelope.OK {
+			t.Errorf("converted to GBP without a rate: %s", envelope.Data)
+		}
+	})
+}
+
+func TestInvoices(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	terms := `{"sellerBank":"` + f.sbank.Name + `","buyerBank":"` + f.bbank.Name + `"}`
+	pid := strings.Trim(string(f.ok(f.maker, "create_product", f.buyer.Name, "London", "100.00", "USD", terms)), "\"")
+
+	f.advance(pid, STATE_SHIPPING)
+
+	invoice := func(debtor identity, amount int, due int64) string {
+		return `{"debtor":"` + debtor.Name + `","amount":` + strconv.Itoa(amount) + `,"currency":"USD","dueDate":` + strconv.FormatInt(due, 10) + `,"productId":"` + pid + `"}`
+	}
+
+	status := func(id string) Invoice {
+
+		var inv Invoice
+		f.decode(f.ok(f.gov, "get_invoice", id), &inv)
+
+		return inv
+	}
+
+	unpaid := func() []string {
+
+		var invoices []Invoice
+		f.decode(f.ok(f.buyer, "get_unpaid_invoices", f.buyer.Name), &invoices)
+
+		ids := []string{}
+		for _, inv := range invoices {
+			ids = append(ids, inv.InvoiceID)
+		}
+
+		return ids
+	}
+
+	f.run("issue", func(t *testing.T) {
+
+		due := f.stub.now + 3600
+
+		f.fails(ERR_PERMISSION_DENIED, f.buyer2, "issue_invoice", invoice(f.buyer, 10000, due))
+		f.fails(ERR_VALIDATION_FAILED, f.maker, "issue_invoice", invoice(f.buyer, 0, due))
+		f.fails(ERR_VALIDATION_FAILED, f.maker, "issue_invoice", invoice(f.buyer, 10000, f.stub.now))
+		f.fails(ERR_VALIDATION_FAILED, f.maker, "issue_invoice", invoice(f.maker, 10000, due))
+	})
+
+	// The maker bills the price and the shipper, who has had custody, the freight, due first
+	goods := strings.Trim(string(f.ok(f.maker, "issue_invoice", invoice(f.buyer, 10000, f.stub.now+7200))), "\"")
+	freight := strings.Trim(string(f.ok(f.shipper, "issue_invoice", invoice(f.buyer, 500, f.stub.now+3600))), "\"")
+
+	steps := []struct {
+		name     string
+		caller   identity
+		function string
+		invoice  string
+		code     string
+		status   string
+		unpaid   []string
+	}{
+		{"paid before it was accepted", f.maker, "mark_paid", goods, ERR_INVALID_STATE, INVOICE_ISSUED, []string{freight, goods}},
+		{"accepted by the issuer", f.maker, "accept_invoice", goods, ERR_PERMISSION_DENIED, INVOICE_ISSUED, []string{freight, goods}},
+		{"accepted by the debtor", f.buyer, "accept_invoice", goods, "", INVOICE_ACCEPTED, []string{freight, goods}},
+		{"accepted twice", f.buyer, "accept_invoice", goods, ERR_INVALID_STATE, INVOICE_ACCEPTED, []string{freight, goods}},
+		{"paid by the debtor", f.buyer, "mark_paid", goods, ERR_PERMISSION_DENIED, INVOICE_ACCEPTED, []string{freight, goods}},
+		{"paid by another buyer", f.buyer2, "mark_paid", goods, ERR_PERMISSION_DENIED, INVOICE_ACCEPTED, []string{freight, goods}},
+		{"paid by a bank not paying for the product", f.bbank2, "mark_paid", goods, ERR_PERMISSION_DENIED, INVOICE_ACCEPTED, []string{freight, goods}},
+		{"paid by the shipper", f.shipper, "mark_paid", goods, ERR_PERMISSION_DENIED, INVOICE_ACCEPTED, []string{freight, goods}},
+		{"paid by the buyer's bank", f.bbank, "mark_paid", goods, "", INVOICE_PAID, []string{freight}},
+		{"paid twice", f.maker, "mark_paid", goods, ERR_INVALID_STATE, INVOICE_PAID, []string{freight}},
+		{"freight accepted", f.buyer, "accept_invoice", freight, "", INVOICE_ACCEPTED, []string{freight}},
+		{"freight paid by the issuing bank", f.sbank, "mark_paid", freight, "", INVOICE_PAID, []string{}},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+
+			if step.code != "" {
+				f.fails(step.code, step.caller, step.function, step.invoice)
+			} else {
+				f.ok(step.caller, step.function, step.invoice)
+			}
+
+			if inv := status(step.invoice); inv.Status != step.status {
+				t.Errorf("expected %s, got %s", step.status, inv.Status)
+			} else if step.status == INVOICE_PAID && step.code == "" && inv.PaidBy != step.caller.Name {
+				t.Errorf("expected the invoice to be paid by %s, got %s", step.caller.Name, inv.PaidBy)
+			}
+
+			if ids := unpaid(); !reflect.DeepEqual(ids, step.unpaid) {
+				t.Errorf("expected unpaid invoices %v, got %v", step.unpaid, ids)
+			}
+		})
+	}
+
+	f.run("unpaid invoices of someone else", func(t *testing.T) {
+
+		due := f.stub.now + 3600
+		open := strings.Trim(string(f.ok(f.maker, "issue_invoice", invoice(f.buyer, 100, due))), "\"")
+
+		f.fails(ERR_PERMISSION_DENIED, f.buyer2, "get_unpaid_invoices", f.buyer.Name)
+
+		// Banks only see the invoices of products naming them
+		var invoices []Invoice
+		f.decode(f.ok(f.bbank, "get_unpaid_invoices", f.buyer.Name), &invoices)
+
+		if len(invoices) != 1 || invoices[0].InvoiceID != open {
+			t.Errorf("expected the buyer's bank to see %s, got %+v", open, invoices)
+		}
+
+		f.decode(f.ok(f.bbank2, "get_unpaid_invoices", f.buyer.Name), &invoices)
+
+		if len(invoices) != 0 {
+			t.Errorf("expected another bank to see no invoices, got %+v", invoices)
+		}
+
+		f.ok(f.bbank, "get_invoice", open)
+		f.fails(ERR_PERMISSION_DENIED, f.bbank2, "get_invoice", open)
+	})
+
+	f.run("indexed on upgrade", func(t *testing.T) {
+
+		// An invoice issued before the debtor index existed
+		bytes, _ := json.Marshal(Invoice{InvoiceID: "INlegacy", Issuer: f.maker.Name, Debtor: f.buyer2.Name, Amount: 100, Currency: "USD", ProductID: pid, Status: INVOICE_ISSUED})
+
+		f.stub.MockTransactionStart("legacy")
+		f.stub.MockStub.PutState("Invoice_INlegacy", bytes)
+		f.stub.MockStub.DelState(INVOICE_INDEX_KEY)
+		f.stub.MockTransactionEnd("legacy")
+
+		var invoices []Invoice
+		f.decode(f.ok(f.buyer2, "get_unpaid_invoices", f.buyer2.Name), &invoices)
+
+		if len(invoices) != 0 {
+			t.Fatalf("expected the invoice not to be indexed yet, got %+v", invoices)
+		}
+
+		f.upgrade()
+
+		f.decode(f.ok(f.buyer2, "get_unpaid_invoices", f.buyer2.Name), &invoices)
+
+		if len(invoices) != 1 || invoices[0].InvoiceID != "INlegacy" {
+			t.Errorf("expected the invoice to be indexed, got %+v", invoices)
+		}
+	})
+}
+
+func TestParticipantRegistry(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	carrier := "carrier@Org1MSP"
+
+	registered := func(name string) (Participant, bool) {
+
+		var participant Participant
+
+		bytes := f.stub.State["Participant_"+name]
+		if len(bytes) == 0 {
+			return participant, false
+		}
+
+		f.decode(bytes, &participant)
+
+		return participant, true
+	}
+
+	tests := []struct {
+		name     string
+		caller   identity
+		function string
+		args     []string
+		code     string
+	}{
+		{"register by a manufacturer", f.maker, "register_participant", []string{carrier, "SHIPPER"}, ERR_PERMISSION_DENIED},
+		{"register by a bank", f.sbank, "register_participant", []string{carrier, "SHIPPER"}, ERR_PERMISSION_DENIED},
+		{"register with an unknown role", f.gov, "register_participant", []string{carrier, "PIRATE"}, ERR_VALIDATION_FAILED},
+		{"register", f.gov, "register_participant", []string{carrier, "SHIPPER"}, ""},
+		{"set role by a shipper", f.shipper, "set_role", []string{carrier, "BUYER"}, ERR_PERMISSION_DENIED},
+		{"set role of an unknown participant", f.gov, "set_role", []string{"nobody@Org1MSP", "BUYER"}, ERR_NOT_FOUND},
+		{"set role", f.gov, "set_role", []string{carrier, strconv.Itoa(RECYCLER)}, ""},
+		{"revoke by a buyer", f.buyer, "revoke_participant", []string{carrier}, ERR_PERMISSION_DENIED},
+		{"revoke", f.gov, "revoke_participant", []string{carrier}, ""},
+		{"revoke twice", f.gov, "revoke_participant", []string{carrier}, ERR_INVALID_STATE},
+		{"set role of a revoked participant", f.gov, "set_role", []string{carrier, "SHIPPER"}, ERR_INVALID_STATE},
+		{"regulator revoking themselves", f.gov, "revoke_participant", []string{f.gov.Name}, ERR_PERMISSION_DENIED},
+		{"regulator giving up their role", f.gov, "set_role", []string{f.gov.Name, "BUYER"}, ERR_PERMISSION_DENIED},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			before, _ := registered(carrier)
+
+			if tt.code != "" {
+
+				f.fails(tt.code, tt.caller, tt.function, tt.args...)
+
+				if after, _ := registered(carrier); !reflect.DeepEqual(after, before) {
+					t.Errorf("registry changed by a failed call: %+v", after)
+				}
+
+				return
+			}
+
+			f.ok(tt.caller, tt.function, tt.args...)
+
+			participant, found := registered(carrier)
+
+			if !found || !participant.Managed || participant.UpdatedBy != f.gov.Name {
+				t.Errorf("expected a managed entry updated by the regulator, got %+v", participant)
+			}
+		})
+	}
+
+	if participant, _ := registered(carrier); participant.Role != RECYCLER || !participant.Revoked {
+		t.Errorf("expected a revoked recycler, got %+v", participant)
+	}
+
+	f.run("revoked recipient", func(t *testing.T) {
+
+		pid := f.create(f.maker, f.buyer, "London")
+		f.advance(pid, STATE_MANUFACTURE)
+
+		f.ok(f.gov, "revoke_participant", f.shipper2.Name)
+
+		if message := f.fails(ERR_INVALID_STATE, f.maker, "start_shipping", f.shipper2.Name, pid); !strings.Contains(message, "revoked") {
+			t.Errorf("expected the revocation to be reported, got %q", message)
+		}
+
+		f.fails(ERR_INVALID_STATE, f.maker, "create_product", f.shipper2.Name, "London", "100.00", "USD", "")
+	})
+
+	f.run("revoked caller", func(t *testing.T) {
+
+		f.ok(f.gov, "revoke_participant", f.buyer2.Name)
+		f.fails(ERR_PERMISSION_DENIED, f.buyer2, "get_vehicles")
+
+		// Registering the participant again reinstates them
+		f.ok(f.gov, "register_participant", f.buyer2.Name, "BUYER")
+		f.ok(f.buyer2, "get_vehicles")
+	})
+}
+
+func TestAccreditiveAsset(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	first := f.create(f.maker, f.buyer, "London")
+	second := f.create(f.maker, f.buyer, "Paris")
+
+	expiry := f.stub.now + 3600
+
+	credit := func(amount int, expiry int64) string {
+		return `{"beneficiary":"` + f.maker.Name + `","amount":` + strconv.Itoa(amount) + `,"currency":"USD","expiry":` + strconv.FormatInt(expiry, 10) + `,"productIds":["` + first + `","` + second + `"]}`
+	}
+
+	f.run("open", func(t *testing.T) {
+		f.fails(ERR_PERMISSION_DENIED, f.maker, "open_accreditive", credit(25000, expiry))
+		f.fails(ERR_PERMISSION_DENIED, f.bbank, "open_accreditive", credit(25000, expiry))
+		f.fails(ERR_VALIDATION_FAILED, f.sbank, "open_accreditive", credit(19999, expiry))
+		f.fails(ERR_VALIDATION_FAILED, f.sbank, "open_accreditive", credit(25000, f.stub.now))
+		f.fails(ERR_VALIDATION_FAILED, f.sbank, "open_accreditive", credit(0, expiry))
+	})
+
+	id := strings.Trim(string(f.ok(f.sbank, "open_accreditive", credit(25000, expiry))), "\"")
+
+	steps := []struct {
+		name      string
+		caller    identity
+		function  string
+		args      []string
+		code      string
+		amount    Money
+		drawn     Money
+		confirmed bool
+	}{
+		{"drawn before it is confirmed", f.maker, "draw_accreditive", []string{id, "10.00"}, ERR_PERMISSION_DENIED, 25000, 0, false},
+		{"confirmed by the issuing bank", f.sbank, "confirm_accreditive", []string{id}, ERR_PERMISSION_DENIED, 25000, 0, false},
+		{"confirmed", f.bbank, "confirm_accreditive", []string{id}, "", 25000, 0, true},
+		{"confirmed twice", f.bbank2, "confirm_accreditive", []string{id}, ERR_INVALID_STATE, 25000, 0, true},
+		{"drawn by someone else", f.buyer, "draw_accreditive", []string{id, "10.00"}, ERR_PERMISSION_DENIED, 25000, 0, true},
+		{"drawn", f.maker, "draw_accreditive", []string{id, "150.00"}, "", 25000, 15000, true},
+		{"over-drawn", f.maker, "draw_accreditive", []string{id, "100.01"}, ERR_VALIDATION_FAILED, 25000, 15000, true},
+		{"nothing drawn", f.maker, "draw_accreditive", []string{id, "0"}, ERR_VALIDATION_FAILED, 25000, 15000, true},
+		{"drawn in full", f.maker, "draw_accreditive", []string{id, "100.00"}, "", 25000, 25000, true},
+		{"drawn when nothing is left", f.maker, "draw_accreditive", []string{id, "0.01"}, ERR_VALIDATION_FAILED, 25000, 25000, true},
+		{"amended by another bank", f.bbank, "amend_accreditive", []string{id, `{"amount":30000}`}, ERR_PERMISSION_DENIED, 25000, 25000, true},
+		{"amended below what was drawn", f.sbank, "amend_accreditive", []string{id, `{"amount":24999}`}, ERR_VALIDATION_FAILED, 25000, 25000, true},
+		{"amended", f.sbank, "amend_accreditive", []string{id, `{"amount":30000}`}, "", 30000, 25000, false},
+		{"drawn before the amendment is confirmed", f.maker, "draw_accreditive", []string{id, "10.00"}, ERR_PERMISSION_DENIED, 30000, 25000, false},
+		{"amendment confirmed", f.bbank, "confirm_accreditive", []string{id}, "", 30000, 25000, true},
+		{"drawn after the amendment", f.maker, "draw_accreditive", []string{id, "10.00"}, "", 30000, 26000, true},
+	}
+
+	check := func(t *testing.T, amount Money, drawn Money, confirmed bool) {
+
+		var credit Accreditive
+		f.decode(f.ok(f.gov, "get_accreditive", id), &credit)
+
+		if credit.Amount != amount || credit.Drawn != drawn || (credit.ConfirmedBy != "") != confirmed {
+			t.Errorf("expected amount %d, drawn %d and confirmed %v, got %+v", amount, drawn, confirmed, credit)
+		}
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+
+			if step.code != "" {
+				f.fails(step.code, step.caller, step.function, step.args...)
+			} else {
+				f.ok(step.caller, step.function, step.args...)
+			}
+
+			check(t, step.amount, step.drawn, step.confirmed)
+		})
+	}
+
+	f.run("expired", func(t *testing.T) {
+
+		f.stub.now = expiry - 1
+
+		f.fails(ERR_PERMISSION_DENIED, f.maker, "draw_accreditive", id, "10.00")
+		f.fails(ERR_PERMISSION_DENIED, f.sbank, "amend_accreditive", id, `{"amount":40000}`)
+
+		check(t, 30000, 26000, true)
+	})
+}
+
+func TestPartialPayments(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create_contracted(f.maker, f.buyer, "London", f.bbank)
+	f.advance(pid, STATE_SHIPPING)
+
+	f.fails(ERR_PERMISSION_DENIED, f.bbank, "pay_partial", "10.00", pid)
+
+	f.advance(pid, STATE_PAYMENT)
+
+	steps := []struct {
+		name     string
+		caller   identity
+		amount   string
+		code     string
+		payments []Money
+		released bool
+	}{
+		{"paid by the buyer", f.buyer, "10.00", ERR_PERMISSION_DENIED, nil, false},
+		{"paid by another buyer's bank", f.bbank2, "10.00", ERR_PERMISSION_DENIED, nil, false},
+		{"nothing", f.bbank, "0", ERR_VALIDATION_FAILED, nil, false},
+		{"negative", f.bbank, "-10.00", ERR_VALIDATION_FAILED, nil, false},
+		{"fraction of a cent", f.bbank, "10.001", ERR_VALIDATION_FAILED, nil, false},
+		{"more than the price", f.bbank, "100.01", ERR_VALIDATION_FAILED, nil, false},
+		{"first instalment", f.bbank, "30.00", "", []Money{3000}, false},
+		{"more than is outstanding", f.bbank, "70.01", ERR_VALIDATION_FAILED, []Money{3000}, false},
+		{"second instalment", f.bbank, "45.50", "", []Money{3000, 4550}, false},
+		{"last instalment", f.bbank, "24.50", "", []Money{3000, 4550, 2450}, true},
+		{"paid once settled", f.bbank, "0.01", ERR_PERMISSION_DENIED, []Money{3000, 4550, 2450}, true},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+
+			if step.code != "" {
+				f.fails(step.code, step.caller, "pay_partial", step.amount, pid)
+			} else {
+				f.ok(step.caller, "pay_partial", step.amount, pid)
+			}
+
+			p := f.product(pid)
+
+			var payments []Money
+			for _, payment := range p.Payments {
+				payments = append(payments, payment.Amount)
+			}
+
+			if !reflect.DeepEqual(payments, step.payments) {
+				t.Errorf("expected payments %v, got %v", step.payments, payments)
+			}
+
+			// The buyer accepts the product with put_in_use once it is paid for
+			if p.State != STATE_PAYMENT || p.PaymentReleased != step.released || p.Owner != f.maker.Name {
+				t.Errorf("expected the payment released only once paid in full, got %+v", p)
+			}
+		})
+	}
+
+	f.ok(f.buyer, "put_in_use", pid)
+
+	if p := f.product(pid); p.State != STATE_INUSE || p.Owner != f.buyer.Name {
+		t.Errorf("expected the buyer to own the paid for product, got %s in state %d", p.Owner, p.State)
+	}
+
+	f.run("paid in full after an instalment", func(t *testing.T) {
+
+		other := f.create(f.maker, f.buyer, "Paris")
+		f.advance(other, STATE_PAYMENT)
+
+		f.ok(f.bbank, "pay_partial", "40.00", other)
+		f.ok(f.bbank, "pay_full", other)
+
+		p := f.product(other)
+
+		if len(p.Payments) != 2 || p.Payments[1].Amount != 6000 || !p.PaymentReleased {
+			t.Errorf("expected the remaining 60.00 to be paid and the payment released, got %+v", p)
+		}
+	})
+}
+
+func TestProductHold(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_SHIPPING)
+
+	f.fails(ERR_PERMISSION_DENIED, f.maker, "place_hold", "customs inspection", pid)
+	f.fails(ERR_VALIDATION_FAILED, f.gov, "place_hold", " ", pid)
+	f.fails(ERR_INVALID_STATE, f.gov, "lift_hold", pid)
+
+	f.ok(f.gov, "place_hold", "customs inspection", pid)
+
+	p := f.product(pid)
+
+	if p.Hold == nil || p.Hold.PlacedBy != f.gov.Name || p.Hold.Reason != "customs inspection" {
+		t.Fatalf("expected the product on hold by the regulator, got %+v", p.Hold)
+	}
+
+	held := f.stub.State[pid]
+
+	// Each of these would go through were the product not on hold
+	tests := []struct {
+		name     string
+		caller   identity
+		function string
+		args     []string
+	}{
+		{"transfer", f.shipper, "shipper_to_buyer", []string{f.buyer.Name, pid}},
+		{"transfer proposal", f.shipper, "propose_transfer", []string{"shipper_to_buyer", f.buyer.Name, pid}},
+		{"bulk transfer", f.shipper, "transfer_products_bulk", []string{`["` + pid + `"]`, f.buyer.Name, "shipper_to_buyer"}},
+		{"delivery", f.buyer, "confirm_delivery", []string{pid}},
+		{"location update", f.shipper, "update_location", []string{"Calais", pid}},
+		{"batch update", f.maker, "update_batch", []string{"B-7", pid}},
+		{"price update", f.maker, "update_price", []string{"120.00", pid}},
+		{"scrappage", f.shipper, "scrap_product", []string{pid}},
+		{"lock", f.maker, "lock_product", []string{pid}},
+		{"second hold", f.gov, "place_hold", []string{"another reason", pid}},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			message := f.fails(ERR_HOLD_ACTIVE, tt.caller, tt.function, tt.args...)
+
+			if !strings.Contains(message, "customs inspection") {
+				t.Errorf("expected the reason for the hold in %q", message)
+			}
+
+			if !bytes.Equal(f.stub.State[pid], held) {
+				t.Errorf("expected the product left unchanged, got %s", f.stub.State[pid])
+			}
+		})
+	}
+
+	f.run("listed as held", func(t *testing.T) {
+
+		var listed []HeldProduct
+		f.decode(f.ok(f.gov, "get_held_products"), &listed)
+
+		if len(listed) != 1 || listed[0].ProductID != pid || listed[0].Reason != "customs inspection" {
+			t.Errorf("expected %s listed as held, got %+v", pid, listed)
+		}
+	})
+
+	f.run("lifted", func(t *testing.T) {
+
+		f.fails(ERR_PERMISSION_DENIED, f.shipper, "lift_hold", pid)
+		f.ok(f.gov, "lift_hold", pid)
+
+		if f.product(pid).Hold != nil {
+			t.Fatal("expected the hold lifted")
+		}
+
+		f.ok(f.shipper, "shipper_to_buyer", f.buyer.Name, pid)
+
+		if p := f.product(pid); p.Custodian != f.buyer.Name {
+			t.Errorf("expected the transfer to go through once the hold was lifted, got %+v", p)
+		}
+	})
+}
+
+func TestIssueRecall(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	batched := func(maker identity, batch string, state int) string {
+
+		f.t.Helper()
+
+		pid := f.create(maker, f.buyer, "London")
+		f.ok(maker, "update_batch", batch, pid)
+
+		if state != STATE_SALESCONTRACT {
+			f.advance(pid, state)
+		}
+
+		return pid
+	}
+
+	inUse := batched(f.maker, "B-1", STATE_INUSE)
+	shipping := batched(f.maker, "B-1", STATE_SHIPPING)
+	scrapped := batched(f.maker, "B-1", STATE_SCRAPPED)
+	otherBatch := batched(f.maker, "B-2", STATE_SALESCONTRACT)
+	otherMaker := batched(f.maker2, "B-1", STATE_SALESCONTRACT)
+
+	recalled := func(caller identity, args ...string) []string {
+
+		f.t.Helper()
+
+		var entries []RecalledProduct
+		f.decode(f.ok(caller, "get_recalled_owners", args...), &entries)
+
+		ids := []string{}
+		for _, entry := range entries {
+			ids = append(ids, entry.ProductID)
+		}
+
+		sort.Strings(ids)
+
+		return ids
+	}
+
+	sorted := func(ids ...string) []string {
+		sort.Strings(ids)
+		return ids
+	}
+
+	f.run("refused", func(t *testing.T) {
+
+		tests := []struct {
+			name   string
+			caller identity
+			recall string
+			code   string
+		}{
+			{"by a buyer", f.buyer, `{"reason":"faulty brakes","batch":"B-1"}`, ERR_PERMISSION_DENIED},
+			{"of another manufacturer's product", f.maker, `{"reason":"faulty brakes","productIds":["` + otherMaker + `"]}`, ERR_PERMISSION_DENIED},
+			{"without a reason", f.maker, `{"batch":"B-1"}`, ERR_VALIDATION_FAILED},
+			{"of a batch and products", f.maker, `{"reason":"faulty brakes","batch":"B-1","productIds":["` + inUse + `"]}`, ERR_VALIDATION_FAILED},
+			{"of nothing", f.maker, `{"reason":"faulty brakes"}`, ERR_VALIDATION_FAILED},
+			{"of a batch with none of the manufacturer's products", f.maker2, `{"reason":"faulty brakes","batch":"B-2"}`, ERR_NOT_FOUND},
+			{"as invalid JSON", f.maker, `{"reason":`, ERR_VALIDATION_FAILED},
+		}
+
+		for _, tt := range tests {
+			f.run(tt.name, func(t *testing.T) {
+				f.fails(tt.code, tt.caller, "issue_recall", tt.recall)
+			})
+		}
+	})
+
+	var batchRecall string
+
+	f.run("batch recalled by the manufacturer", func(t *testing.T) {
+
+		f.decode(f.ok(f.maker, "issue_recall", `{"reason":"faulty brakes","batch":"B-1"}`), &batchRecall)
+
+		if len(f.emitted("product_recalled")) != 1 {
+			t.Errorf("expected a product_recalled event")
+		}
+
+		// Neither the scrapped product nor the other manufacturer's product of the batch is recalled
+		for pid, expected := range map[string]bool{inUse: true, shipping: true, scrapped: false, otherBatch: false, otherMaker: false} {
+			if p := f.product(pid); p.Recalled != expected || (expected && p.RecallID != batchRecall) {
+				t.Errorf("%s: expected recalled %t under %s, got %t under %s", pid, expected, batchRecall, p.Recalled, p.RecallID)
+			}
+		}
+
+		var recall Recall
+		f.decode(f.ok(f.maker, "get_recall", batchRecall), &recall)
+
+		if recall.Batch != "B-1" || recall.IssuedBy != f.maker.Name || !reflect.DeepEqual(sorted(recall.ProductIDs...), sorted(inUse, shipping)) {
+			t.Errorf("unexpected recall %+v", recall)
+		}
+	})
+
+	var regulatorRecall string
+
+	f.run("product recalled by the regulator", func(t *testing.T) {
+
+		f.decode(f.ok(f.gov, "issue_recall", `{"reason":"missing certification","productIds":["`+otherMaker+`"]}`), &regulatorRecall)
+
+		if p := f.product(otherMaker); !p.Recalled || p.RecallID != regulatorRecall {
+			t.Errorf("expected %s recalled under %s, got %+v", otherMaker, regulatorRecall, p)
+		}
+
+		f.fails(ERR_PERMISSION_DENIED, f.maker, "get_recall", regulatorRecall)
+	})
+
+	f.run("recalled owners", func(t *testing.T) {
+
+		tests := []struct {
+			name     string
+			caller   identity
+			args     []string
+			expected []string
+		}{
+			{"regulator", f.gov, nil, sorted(inUse, shipping, otherMaker)},
+			{"regulator by recall", f.gov, []string{regulatorRecall}, []string{otherMaker}},
+			{"manufacturer", f.maker, nil, sorted(inUse, shipping)},
+			{"other manufacturer", f.maker2, nil, []string{otherMaker}},
+			{"manufacturer by another's recall", f.maker, []string{regulatorRecall}, []string{}},
+		}
+
+		for _, tt := range tests {
+			f.run(tt.name, func(t *testing.T) {
+				if ids := recalled(tt.caller, tt.args...); !reflect.DeepEqual(ids, tt.expected) {
+					t.Errorf("expected %v, got %v", tt.expected, ids)
+				}
+			})
+		}
+
+		f.fails(ERR_PERMISSION_DENIED, f.buyer, "get_recalled_owners")
+	})
+
+	f.run("only sent to a recycler", func(t *testing.T) {
+
+		f.fails(ERR_INVALID_STATE, f.shipper, "shipper_to_buyer", f.buyer.Name, shipping)
+		f.fails(ERR_INVALID_STATE, f.maker, "reassign_shipper", f.shipper2.Name, shipping)
+		f.fails(ERR_INVALID_STATE, f.shipper, "propose_transfer", "shipper_to_buyer", f.buyer.Name, shipping)
+
+		f.ok(f.buyer, "private_to_recycler", f.recycler.Name, inUse)
+
+		if p := f.product(inUse); p.Owner != f.recycler.Name || p.Custodian != f.recycler.Name {
+			t.Errorf("expected the recalled product handed to the recycler, got %+v", p)
+		}
+	})
+}
+
+func TestShippingMilestones(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_MANUFACTURE)
+
+	f.fails(ERR_PERMISSION_DENIED, f.shipper, "add_milestone", "LOADED", pid)
+
+	f.advance(pid, STATE_SHIPPING)
+	f.ok(f.shipper, "update_location", `{"lat":51.5,"lon":-0.1}`, pid)
+
+	milestones := func(pid string) []string {
+
+		names := []string{}
+		for _, m := range f.product(pid).Milestones {
+			names = append(names, m.Milestone)
+		}
+
+		return names
+	}
+
+	steps := []struct {
+		name      string
+		caller    identity
+		milestone string
+		code      string
+		expected  []string
+	}{
+		{"by the owner", f.maker, "LOADED", ERR_PERMISSION_DENIED, []string{}},
+		{"by a shipper without custody", f.shipper2, "LOADED", ERR_PERMISSION_DENIED, []string{}},
+		{"unknown", f.shipper, "SUNK", ERR_VALIDATION_FAILED, []string{}},
+		{"first", f.shipper, " loaded ", "", []string{"LOADED"}},
+		{"skipping one", f.shipper, "CUSTOMS_CLEARED", "", []string{"LOADED", "CUSTOMS_CLEARED"}},
+		{"out of order", f.shipper, "DEPARTED_ORIGIN", ERR_INVALID_STATE, []string{"LOADED", "CUSTOMS_CLEARED"}},
+		{"repeated", f.shipper, "CUSTOMS_CLEARED", ERR_INVALID_STATE, []string{"LOADED", "CUSTOMS_CLEARED"}},
+		{"arrived", f.shipper, "ARRIVED_DESTINATION", "", []string{"LOADED", "CUSTOMS_CLEARED", "ARRIVED_DESTINATION"}},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+
+			if step.code != "" {
+				f.fails(step.code, step.caller, "add_milestone", step.milestone, pid)
+			} else {
+
+				f.ok(step.caller, "add_milestone", step.milestone, pid)
+
+				var event MilestoneEvent
+				if events := f.emitted("milestone_reached"); len(events) == 1 {
+					f.decode(events[0], &event)
+				}
+
+				if event.ProductID != pid || event.RecordedBy != f.shipper.Name || event.Location == nil || event.Location.Lat != 51.5 {
+					t.Errorf("expected a milestone_reached event located at the last position, got %+v", event)
+				}
+			}
+
+			if names := milestones(pid); !reflect.DeepEqual(names, step.expected) {
+				t.Errorf("expected milestones %v, got %v", step.expected, names)
+			}
+		})
+	}
+
+	f.run("delivered on hand over", func(t *testing.T) {
+
+		f.ok(f.shipper, "shipper_to_buyer", f.buyer.Name, pid)
+
+		expected := []string{"LOADED", "CUSTOMS_CLEARED", "ARRIVED_DESTINATION", "DELIVERED"}
+
+		if names := milestones(pid); !reflect.DeepEqual(names, expected) {
+			t.Errorf("expected milestones %v, got %v", expected, names)
+		}
+
+		if len(f.emitted("milestone_reached")) != 1 {
+			t.Error("expected a milestone_reached event for the delivery")
+		}
+
+		if p := f.product(pid); p.Milestones[3].RecordedBy != f.shipper.Name {
+			t.Errorf("expected the delivery recorded by the shipper, got %+v", p.Milestones[3])
+		}
+
+		f.fails(ERR_PERMISSION_DENIED, f.shipper, "add_milestone", "DELIVERED", pid)
+	})
+
+	f.run("delivered once", func(t *testing.T) {
+
+		other := f.create(f.maker, f.buyer, "Paris")
+		f.advance(other, STATE_SHIPPING)
+
+		f.ok(f.shipper, "add_milestone", "DELIVERED", other)
+		f.ok(f.shipper, "shipper_to_buyer", f.buyer.Name, other)
+
+		if names := milestones(other); !reflect.DeepEqual(names, []string{"DELIVERED"}) {
+			t.Errorf("expected DELIVERED recorded once, got %v", names)
+		}
+
+		if len(f.emitted("milestone_reached")) != 0 {
+			t.Error("expected no milestone_reached event for a delivery already recorded")
+		}
+	})
+}
+
+func TestTelemetryThresholds(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_SHIPPING)
+
+	device := newIdentity(t, "sensor", PRODUCT)
+	f.ok(f.gov, "register_participant", device.Name, strconv.Itoa(PRODUCT))
+
+	other := newIdentity(t, "sensor2", PRODUCT)
+	f.ok(f.gov, "register_participant", other.Name, strconv.Itoa(PRODUCT))
+
+	thresholds := `{"temperature":{"min":2,"max":8,"devices":["` + device.Name + `"]},"humidity":{"max":60}}`
+
+	f.fails(ERR_PERMISSION_DENIED, f.shipper, "set_thresholds", thresholds, pid)
+	f.fails(ERR_VALIDATION_FAILED, f.maker, "set_thresholds", `{"temperature":{"min":8,"max":2}}`, pid)
+	f.fails(ERR_VALIDATION_FAILED, f.maker, "set_thresholds", `{"temperature":`, pid)
+	f.fails(ERR_VALIDATION_FAILED, f.maker, "set_thresholds", `{"temperature":{"devices":["`+f.shipper.Name+`"]}}`, pid)
+	f.fails(ERR_VALIDATION_FAILED, f.maker, "set_thresholds", `{"temperature":{"devices":["nobody@Org1MSP"]}}`, pid)
+
+	f.ok(f.maker, "set_thresholds", thresholds, pid)
+
+	if p := f.product(pid); len(p.Thresholds) != 2 || *p.Thresholds["temperature"].Max != 8 || p.Thresholds["humidity"].Min != nil {
+		t.Fatalf("unexpected thresholds %+v", p.Thresholds)
+	}
+
+	f.fails(ERR_PERMISSION_DENIED, f.maker, "record_telemetry", pid, "temperature", "5")
+
+	// Devices only report the sensor types of the products they are bound to
+	f.fails(ERR_PERMISSION_DENIED, other, "record_telemetry", pid, "temperature", "5")
+	f.fails(ERR_PERMISSION_DENIED, device, "record_telemetry", pid, "humidity", "50")
+	f.fails(ERR_PERMISSION_DENIED, device, "record_telemetry", f.create(f.maker, f.buyer, "Paris"), "temperature", "5")
+
+	steps := []struct {
+		name     string
+		caller   identity
+		sensor   string
+		value    string
+		breach   bool
+		breaches int
+	}{
+		{"within range", f.shipper, "temperature", "5", false, 0},
+		{"on the minimum", f.shipper, "temperature", "2", false, 0},
+		{"without a threshold", f.shipper, "pressure", "1013", false, 0},
+		{"by the device", device, "temperature", "7.5", false, 0},
+		{"above a maximum only", f.shipper, "humidity", "61", true, 1},
+		{"below the minimum", device, "temperature", "1.5", true, 2},
+		{"above the maximum", f.shipper, "temperature", "8.1", true, 3},
+		{"back in range", f.shipper, "temperature", "6", false, 3},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+
+			f.ok(step.caller, "record_telemetry", pid, step.sensor, step.value)
+
+			events := f.emitted("threshold_breached")
+
+			if step.breach {
+
+				var reading TelemetryReading
+
+				if len(events) != 1 {
+					t.Fatalf("expected a threshold_breached event, got %d", len(events))
+				}
+
+				f.decode(events[0], &reading)
+
+				if !reading.Breach || reading.SensorType != step.sensor || strconv.FormatFloat(reading.Value, 'f', -1, 64) != step.value || reading.RecordedBy != step.caller.Name {
+					t.Errorf("unexpected breach %+v", reading)
+				}
+
+			} else if len(events) != 0 {
+				t.Errorf("expected no threshold_breached event, got %d", len(events))
+			}
+
+			p := f.product(pid)
+
+			if p.Breached != (step.breaches > 0) || len(p.Breaches) != step.breaches {
+				t.Errorf("expected %d breaches flagged, got %t with %d", step.breaches, p.Breached, len(p.Breaches))
+			}
+		})
+	}
+
+	f.run("readings kept", func(t *testing.T) {
+
+		var readings []TelemetryReading
+		f.decode(f.ok(f.maker, "get_telemetry", pid, "temperature"), &readings)
+
+		breaches := 0
+		for _, r := range readings {
+			if r.Breach {
+				breaches++
+			}
+		}
+
+		if len(readings) != 6 || breaches != 2 {
+			t.Errorf("expected 6 temperature readings with 2 breaches, got %d with %d", len(readings), breaches)
+		}
+	})
+}
+
+func TestTelemetryOnHold(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_SHIPPING)
+
+	f.ok(f.maker, "set_thresholds", `{"temperature":{"min":2,"max":8}}`, pid)
+	f.ok(f.gov, "place_hold", "customs inspection", pid)
+
+	f.ok(f.shipper, "record_telemetry", pid, "temperature", "5")
+	f.ok(f.shipper, "record_telemetry", pid, "temperature", "9")
+
+	if events := f.emitted("threshold_breached"); len(events) != 1 {
+		t.Errorf("expected a threshold_breached event, got %d", len(events))
+	}
+
+	if p := f.product(pid); p.Hold == nil || !p.Breached || len(p.Breaches) != 1 {
+		t.Errorf("expected the breach flagged on the product still on hold, got hold %+v and %d breaches", p.Hold, len(p.Breaches))
+	}
+
+	var readings []TelemetryReading
+	f.decode(f.ok(f.maker, "get_telemetry", pid, "temperature"), &readings)
+
+	if len(readings) != 2 {
+		t.Errorf("expected both readings kept, got %d", len(readings))
+	}
+
+	f.fails(ERR_HOLD_ACTIVE, f.maker, "set_thresholds", `{"temperature":{"max":20}}`, pid)
+}
+
+func TestBillOfLading(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_SHIPPING)
+
+	bill := func(id string) BillOfLading {
+
+		f.t.Helper()
+
+		var b BillOfLading
+		f.decode(f.stub.State["BillOfLading_"+id], &b)
+
+		return b
+	}
+
+	f.fails(ERR_PERMISSION_DENIED, f.maker, "issue_bill_of_lading", pid, f.sbank.Name)
+	f.fails(ERR_PERMISSION_DENIED, f.shipper2, "issue_bill_of_lading", pid, f.sbank.Name)
+
+	var id string
+	f.decode(f.ok(f.shipper, "issue_bill_of_lading", pid, f.sbank.Name), &id)
+
+	if b := bill(id); b.ProductID != pid || b.Shipper != f.shipper.Name || b.Consignee != f.sbank.Name || b.Holder != f.sbank.Name || f.product(pid).BillOfLading != id {
+		t.Fatalf("unexpected bill of lading %+v", b)
+	}
+
+	f.fails(ERR_INVALID_STATE, f.shipper, "issue_bill_of_lading", pid, f.bbank.Name)
+
+	steps := []struct {
+		name     string
+		caller   identity
+		function string
+		args     []string
+		code     string
+	}{
+		{"goods held before the bill is surrendered", f.shipper, "shipper_to_buyer", []string{f.buyer.Name, pid}, ERR_INVALID_STATE},
+		{"endorsed by someone not holding it", f.buyer, "endorse_bill_of_lading", []string{id, f.buyer2.Name}, ERR_PERMISSION_DENIED},
+		{"endorsed to the holder", f.sbank, "endorse_bill_of_lading", []string{id, f.sbank.Name}, ERR_VALIDATION_FAILED},
+		{"endorsed to the buyer", f.sbank, "endorse_bill_of_lading", []string{id, f.buyer.Name}, ""},
+		{"goods held before the holder surrenders it", f.shipper, "shipper_to_buyer", []string{f.buyer.Name, pid}, ERR_INVALID_STATE},
+		{"surrendered by its former holder", f.sbank, "surrender_bill_of_lading", []string{id}, ERR_PERMISSION_DENIED},
+		{"surrendered by the holder", f.buyer, "surrender_bill_of_lading", []string{id}, ""},
+		{"surrendered twice", f.buyer, "surrender_bill_of_lading", []string{id}, ERR_INVALID_STATE},
+		{"endorsed once surrendered", f.buyer, "endorse_bill_of_lading", []string{id, f.buyer2.Name}, ERR_INVALID_STATE},
+		{"goods held from another buyer", f.shipper, "shipper_to_buyer", []string{f.buyer2.Name, pid}, ERR_INVALID_STATE},
+		{"goods released to the holder", f.shipper, "shipper_to_buyer", []string{f.buyer.Name, pid}, ""},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+			if step.code != "" {
+				f.fails(step.code, step.caller, step.function, step.args...)
+			} else {
+				f.ok(step.caller, step.function, step.args...)
+			}
+		})
+	}
+
+	b := bill(id)
+
+	if b.Holder != f.buyer.Name || !b.Surrendered || b.SurrenderedAt == 0 || len(b.Endorsements) != 1 || b.Endorsements[0].From != f.sbank.Name || b.Endorsements[0].To != f.buyer.Name {
+		t.Errorf("unexpected bill of lading %+v", b)
+	}
+
+	if p := f.product(pid); p.Custodian != f.buyer.Name {
+		t.Errorf("expected the goods released to %s, got custodian %s", f.buyer.Name, p.Custodian)
+	}
+}
+
+func TestAuditTrail(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	trail := func(filter string) TrailPage {
+
+		f.t.Helper()
+
+		var page TrailPage
+		f.decode(f.ok(f.gov, "get_audit_trail", filter), &page)
+
+		return page
+	}
+
+	functions := func(entries []TrailEntry) []string {
+
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Function)
+		}
+
+		return names
+	}
+
+	start := f.stub.now + 1
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.ok(f.maker, "update_price", "120.00", pid)
+	f.fails(ERR_PERMISSION_DENIED, f.buyer, "update_price", "130.00", pid)
+	f.ok(f.sbank, "bank_issue_accreditive", `{"Amount":12000,"Currency":"USD"}`, pid)
+
+	f.run("successful invocations of a product", func(t *testing.T) {
+
+		page := trail(`{"productId":"` + pid + `"}`)
+
+		expected := []string{"create_product", "update_price", "bank_issue_accreditive"}
+
+		if names := functions(page.Entries); !reflect.DeepEqual(names, expected) {
+			t.Fatalf("expected %v, got %v", expected, names)
+		}
+
+		first := page.Entries[0]
+
+		if first.Caller != f.maker.Name || first.Affiliation != SELLER || first.Timestamp != start || first.TxID == "" {
+			t.Errorf("unexpected entry %+v", first)
+		}
+	})
+
+	f.run("by caller", func(t *testing.T) {
+
+		page := trail(`{"caller":"` + f.maker.Name + `"}`)
+
+		if names := functions(page.Entries); !reflect.DeepEqual(names, []string{"create_product", "update_price"}) {
+			t.Errorf("expected the maker's invocations, got %v", names)
+		}
+	})
+
+	f.run("by time", func(t *testing.T) {
+
+		page := trail(`{"from":` + strconv.FormatInt(start+1, 10) + `,"to":` + strconv.FormatInt(start+2, 10) + `}`)
+
+		// The failed update in between isn't recorded
+		if names := functions(page.Entries); !reflect.DeepEqual(names, []string{"update_price"}) {
+			t.Errorf("expected the invocations of the time range, got %v", names)
+		}
+	})
+
+	f.run("paged", func(t *testing.T) {
+
+		all := trail("")
+
+		var paged []TrailEntry
+		bookmark := ""
+
+		for pages := 0; pages == 0 || bookmark != ""; pages++ {
+
+			if pages > len(all.Entries) {
+				t.Fatal("paging doesn't end")
+			}
+
+			page := trail(`{"pageSize":2,"bookmark":"` + bookmark + `"}`)
+
+			if page.Count > 2 || page.Count != len(page.Entries) {
+				t.Fatalf("unexpected page %+v", page)
+			}
+
+			paged = append(paged, page.Entries...)
+			bookmark = page.NextBookmark
+		}
+
+		if !reflect.DeepEqual(paged, all.Entries) {
+			t.Errorf("expected the pages to hold the whole trail of %d entries, got %d", len(all.Entries), len(paged))
+		}
+	})
+
+	f.run("failure not written", func(t *testing.T) {
+
+		count := func() int {
+
+			n := 0
+			for key := range f.stub.State {
+				if strings.HasPrefix(key, TRAIL_PREFIX) {
+					n++
+				}
+			}
+
+			return n
+		}
+
+		before := count()
+		saved := f.stub.snapshot()
+
+		// Called without the fixture, which discards the writes of a failed transaction like the peer does
+		f.stub.now++
+		f.stub.args = [][]byte{[]byte("update_price"), []byte("130.00"), []byte(pid)}
+		f.stub.creator = f.buyer.creator
+
+		f.stub.MockTransactionStart("failed")
+		response := f.cc.Invoke(f.stub)
+		after := count()
+		f.stub.MockTransactionEnd("failed")
+
+		f.stub.restore(saved)
+
+		if response.Status == shim.OK {
+			t.Fatal("expected the update to fail")
+		}
+
+		if after != before {
+			t.Errorf("expected the failed invocation left out of the trail, got %d entries written", after-before)
+		}
+	})
+
+	f.run("refused", func(t *testing.T) {
+
+		f.fails(ERR_PERMISSION_DENIED, f.maker, "get_audit_trail", "")
+		f.fails(ERR_VALIDATION_FAILED, f.gov, "get_audit_trail", `{"pageSize":`)
+		f.fails(ERR_VALIDATION_FAILED, f.gov, "get_audit_trail", `{"pageSize":-1}`)
+		f.fails(ERR_VALIDATION_FAILED, f.gov, "get_audit_trail", `{"bookmark":"Product_1"}`)
+	})
+}
+
+func TestSecondaryIndexes(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	other := f.create(f.maker2, f.buyer2, "Paris")
+
+	lookup := func(index string, attribute string) []string {
+
+		f.t.Helper()
+
+		ids, err := f.cc.index_lookup(f.stub, index, attribute)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+
+		if ids == nil {
+			ids = []string{}
+		}
+
+		sort.Strings(ids)
+
+		return ids
+	}
+
+	expect := func(index string, attribute string, ids ...string) {
+
+		f.t.Helper()
+
+		if ids == nil {
+			ids = []string{}
+		}
+
+		sort.Strings(ids)
+
+		if found := lookup(index, attribute); !reflect.DeepEqual(found, ids) {
+			f.t.Errorf("%s index, %q: expected %v, got %v", index, attribute, ids, found)
+		}
+	}
+
+	f.run("created", func(t *testing.T) {
+		expect("manufacturer", f.maker.Name, pid)
+		expect("manufacturer", "", pid, other)
+		expect("buyer", f.buyer.Name, pid)
+		expect("custodian", "")
+		expect("batch", "")
+		expect("hold", "")
+		expect("recall", "")
+		expect("issuing_bank", "")
+	})
+
+	f.run("moved with the product", func(t *testing.T) {
+
+		f.advance(pid, STATE_SHIPPING)
+
+		expect("custodian", f.shipper.Name, pid)
+		expect("custodian", "", pid)
+		expect("issuing_bank", f.sbank.Name, pid)
+
+		f.ok(f.maker, "update_batch", "B-1", pid)
+		f.ok(f.maker, "update_batch", "B-2", pid)
+
+		expect("batch", "B-1")
+		expect("batch", "B-2", pid)
+	})
+
+	f.run("only while set", func(t *testing.T) {
+
+		f.ok(f.gov, "place_hold", "customs inspection", pid)
+		expect("hold", "", pid)
+
+		f.ok(f.gov, "lift_hold", pid)
+		expect("hold", "")
+
+		var recall string
+		f.decode(f.ok(f.gov, "issue_recall", `{"reason":"faulty brakes","productIds":["`+pid+`"]}`), &recall)
+
+		expect("recall", recall, pid)
+		expect("recall", "", pid)
+	})
+
+	f.run("rebuilt on upgrade", func(t *testing.T) {
+
+		// The indexes are only rebuilt once
+		key, _ := f.cc.index_key(f.stub, "manufacturer", f.maker.Name, pid)
+
+		f.stub.MockTransactionStart("unindex")
+		f.stub.MockStub.DelState(key)
+		f.stub.MockTransactionEnd("unindex")
+
+		f.upgrade()
+
+		expect("manufacturer", f.maker.Name)
+
+		// A product held under an older version, before the hold index existed
+		p := f.product(other)
+		p.Hold = &Hold{PlacedBy: f.gov.Name, Reason: "customs inspection"}
+		f.store(p)
+		f.stub.State[INDEXES_KEY] = []byte("buyer,manufacturer")
+
+		expect("hold", "")
+
+		f.upgrade()
+
+		expect("hold", f.gov.Name, other)
+		expect("manufacturer", f.maker.Name, pid)
+		expect("batch", "", pid)
+		expect("recall", "", pid)
+	})
+}
+
+func TestPrivatePriceUpdates(t *testing.T) {
+
+	f := newFixture(t, `{"privateCollection":"terms"}`)
+
+	salt := []byte("0123456789abcdef")
+
+	f.fails(ERR_VALIDATION_FAILED, f.maker, "create_product", f.buyer.Name, "London", "100.00", "USD", "")
+
+	f.stub.transient = map[string][]byte{"salt": salt[:8]}
+	f.fails(ERR_VALIDATION_FAILED, f.maker, "create_product", f.buyer.Name, "London", "100.00", "USD", "")
+
+	f.stub.transient = map[string][]byte{"salt": salt}
+	pid := f.create(f.maker, f.buyer, "London")
+
+	private := f.stub.PvtState["terms"][pid]
+
+	var stored CommercialTerms
+	f.decode(private, &stored)
+
+	sum := sha256.Sum256(private)
+
+	if stored.Salt != hex.EncodeToString(salt) || f.product(pid).TermsHash != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected the terms to be hashed with the salt, got %s", private)
+	}
+
+	f.fails(ERR_VALIDATION_FAILED, f.maker, "update_price", "", pid)
+
+	f.stub.transient = map[string][]byte{"terms": []byte(`{"Price":12050,"Currency":"EUR"}`)}
+	f.fails(ERR_VALIDATION_FAILED, f.maker, "update_price", "", pid)
+
+	f.stub.transient = map[string][]byte{"terms": []byte(`{"Price":12050}`)}
+	f.ok(f.maker, "update_price", "", pid)
+
+	want := `{"productId":"` + pid + `","field":"price","oldValue":null,"newValue":null}`
+
+	if payloads := f.emitted("field_updated"); len(payloads) != 1 || string(payloads[0]) != want {
+		t.Errorf("expected a field_updated event without the price, got %s", payloads)
+	}
+
+	var terms CommercialTerms
+	f.decode(f.ok(f.maker, "get_product_terms", pid), &terms)
+
+	if terms.Price != 12050 || terms.Currency != "USD" {
+		t.Errorf("expected the price updated in the collection, got %+v", terms)
+	}
+
+	f.decode(f.stub.PvtState["terms"][pid], &stored)
+
+	if stored.Salt != hex.EncodeToString(salt) {
+		t.Errorf("expected the salt to be kept, got %q", stored.Salt)
+	}
+
+	if public := string(f.stub.State[pid]); strings.Contains(public, "12050") || strings.Contains(public, "10000") {
+		t.Errorf("public record holds the price: %s", public)
+	}
+
+	// The letter of credit and the payment of a paid product give the price away too
+	f.stub.transient = map[string][]byte{"salt": salt}
+	paid := f.create(f.maker, f.buyer, "London")
+
+	f.ok(f.sbank, "bank_issue_accreditive", `{"Amount":10000,"Currency":"USD"}`, paid)
+	f.ok(f.bbank, "check_accreditive", paid)
+	f.ok(f.maker, "start_shipping", f.shipper.Name, paid)
+	f.ok(f.shipper, "shipper_to_buyer", f.buyer.Name, paid)
+	f.ok(f.buyer, "confirm_delivery", paid)
+	f.ok(f.bbank, "pay_full", paid)
+	f.ok(f.buyer, "put_in_use", paid)
+
+	credit := "Accreditive_" + f.product(paid).AccreditiveID
+
+	for _, public := range []string{string(f.stub.State[paid]), string(f.stub.State[credit])} {
+		if strings.Contains(public, "10000") || strings.Contains(public, "USD") {
+			t.Errorf("public record of a paid product holds the price: %s", public)
+		}
+	}
+
+	var held Product
+	f.decode(f.ok(f.buyer, "get_vehicle_details", paid), &held)
+
+	var lc Accreditive
+	f.decode(f.ok(f.gov, "get_accreditive", held.AccreditiveID), &lc)
+
+	if len(held.Payments) != 1 || held.Payments[0].Amount != 10000 || lc.Amount != 10000 || lc.Currency != "USD" {
+		t.Errorf("expected the amounts kept in the collection, got %+v and %+v", held.Payments, lc)
+	}
+
+	// A peer outside the collection only has the public record
+	f.stub.PvtState = map[string]map[string][]byte{}
+
+	var p Product
+	f.decode(f.ok(f.gov, "get_vehicle_details", pid), &p)
+
+	if p.Price != 0 || p.Currency != "" {
+		t.Errorf("expected no terms outside the collection, got %v %s", p.Price, p.Currency)
+	}
+
+	f.decode(f.ok(f.gov, "get_vehicle_details", paid), &p)
+
+	if len(p.Payments) != 1 || p.Payments[0].Payer != f.bbank.Name || p.Payments[0].Amount != 0 {
+		t.Errorf("expected the payment without its amount outside the collection, got %+v", p.Payments)
+	}
+
+	f.decode(f.ok(f.gov, "get_accreditive", p.AccreditiveID), &lc)
+
+	if lc.IssuingBank != f.sbank.Name || lc.Amount != 0 {
+		t.Errorf("expected the accreditive without its amount outside the collection, got %+v", lc)
+	}
+}
+
+func TestDeliveryToBuyer(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	f.advance(pid, STATE_SHIPPING)
+
+	f.fails(ERR_VALIDATION_FAILED, f.shipper, "shipper_to_buyer", f.buyer2.Name, pid)
+	f.ok(f.shipper, "shipper_to_buyer", f.buyer.Name, pid)
+	f.fails(ERR_PERMISSION_DENIED, f.buyer2, "confirm_delivery", pid)
+	f.ok(f.buyer, "confirm_delivery", pid)
+
+	// Handed to another buyer before the recipient was checked
+	misdelivered := f.create(f.maker, f.buyer, "London")
+	f.advance(misdelivered, STATE_SHIPPING)
+
+	p := f.product(misdelivered)
+	p.Custodian = f.buyer2.Name
+	f.store(p)
+
+	f.fails(ERR_PERMISSION_DENIED, f.buyer2, "confirm_delivery", misdelivered)
+
+	// The holder of a surrendered bill of lading takes delivery instead of the buyer
+	endorsed := f.create(f.maker, f.buyer, "London")
+	f.advance(endorsed, STATE_SHIPPING)
+
+	var id string
+	f.decode(f.ok(f.shipper, "issue_bill_of_lading", endorsed, f.sbank.Name), &id)
+	f.ok(f.sbank, "endorse_bill_of_lading", id, f.buyer2.Name)
+	f.ok(f.buyer2, "surrender_bill_of_lading", id)
+
+	f.fails(ERR_INVALID_STATE, f.shipper, "shipper_to_buyer", f.buyer.Name, endorsed)
+	f.ok(f.shipper, "shipper_to_buyer", f.buyer2.Name, endorsed)
+	f.ok(f.buyer2, "confirm_delivery", endorsed)
+
+	if p := f.product(endorsed); p.State != STATE_PAYMENT || p.Delivery == nil || p.Delivery.Recipient != f.buyer2.Name {
+		t.Errorf("expected the delivery confirmed by the holder, got %+v in state %d", p.Delivery, p.State)
+	}
+}
+
+func TestProofOfDelivery(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	block, _ := pem.Decode([]byte(f.buyer.certificate))
+	sum := sha256.Sum256(block.Bytes)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	receipt := strings.Repeat("ab", 32)
+
+	tests := []struct {
+		name    string
+		receipt []string
+		code    string
+		want    string
+	}{
+		{"without a receipt", nil, "", ""},
+		{"with a receipt", []string{receipt}, "", receipt},
+		{"receipt in capitals", []string{" " + strings.ToUpper(receipt) + " "}, "", receipt},
+		{"receipt too short", []string{"abcd"}, ERR_VALIDATION_FAILED, ""},
+		{"receipt not hex", []string{strings.Repeat("zz", 32)}, ERR_VALIDATION_FAILED, ""},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			pid := f.create(f.maker, f.buyer, "London")
+			f.advance(pid, STATE_SHIPPING)
+			f.ok(f.shipper, "shipper_to_buyer", f.buyer.Name, pid)
+
+			if tt.code != "" {
+				if message := f.fails(tt.code, f.buyer, "confirm_delivery", append([]string{pid}, tt.receipt...)...); !strings.Contains(message, "SHA-256") {
+					t.Errorf("expected a message about the receipt hash, got %q", message)
+				}
+				if p := f.product(pid); p.State != STATE_SHIPPING || p.Delivery != nil {
+					t.Errorf("expected the delivery not to be confirmed, got %+v in state %d", p.Delivery, p.State)
+				}
+				return
+			}
+
+			f.ok(f.buyer, "confirm_delivery", append([]string{pid}, tt.receipt...)...)
+
+			p := f.product(pid)
+
+			want := ProofOfDelivery{Recipient: f.buyer.Name, DeliveredAt: f.stub.now, CertFingerprint: fingerprint, ReceiptHash: tt.want}
+
+			if p.State != STATE_PAYMENT || p.Delivery == nil || *p.Delivery != want {
+				t.Errorf("expected proof of delivery %+v, got %+v in state %d", want, p.Delivery, p.State)
+			}
+		})
+	}
+}
+
+func TestPagedProductQueries(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	template := f.product(pid)
+
+	// Enough products to fill more than one page, written straight to the ledger with their index entries
+	ids := []string{pid}
+
+	f.stub.MockTransactionStart("store")
+
+	for i := 1; i <= MAX_PAGE_READS; i++ {
+
+		p := template
+		p.ProductID = strconv.Itoa(900000000 + i)
+
+		bytes, err := json.Marshal(p)
+		if err != nil {
+			t.Fatalf("encoding product: %v", err)
+		}
+
+		key, err := f.stub.CreateCompositeKey(PRODUCT_INDEX, []string{p.ProductID})
+		if err != nil {
+			t.Fatalf("creating index key: %v", err)
+		}
+
+		f.stub.PutState(p.ProductID, bytes)
+		f.stub.PutState(key, []byte{0})
+
+		ids = append(ids, p.ProductID)
+	}
+
+	f.stub.MockTransactionEnd("store")
+
+	sort.Strings(ids)
+
+	f.run("first page", func(t *testing.T) {
+
+		var page ProductPage
+		f.decode(f.ok(f.maker, "get_products_modified_since", "0"), &page)
+
+		if len(page.Products) != MAX_PAGE_READS || page.NextBookmark != ids[MAX_PAGE_READS] {
+			t.Errorf("expected %d products and bookmark %s, got %d and %q", MAX_PAGE_READS, ids[MAX_PAGE_READS], len(page.Products), page.NextBookmark)
+		}
+	})
+
+	f.run("last page", func(t *testing.T) {
+
+		var page ProductPage
+		f.decode(f.ok(f.maker, "get_products_modified_since", "0", ids[MAX_PAGE_READS]), &page)
+
+		if got := ids_of(page.Products); !reflect.DeepEqual(got, ids[MAX_PAGE_READS:]) || page.NextBookmark != "" {
+			t.Errorf("expected %v and no bookmark, got %v and %q", ids[MAX_PAGE_READS:], got, page.NextBookmark)
+		}
+	})
+
+	f.run("csv", func(t *testing.T) {
+
+		var csv string
+		f.decode(f.ok(f.maker, "get_products_summary_csv"), &csv)
+
+		lines := strings.Split(strings.TrimSuffix(csv, "\n"), "\n")
+
+		if len(lines) != MAX_PAGE_READS + 2 || lines[len(lines)-1] != "nextBookmark," + ids[MAX_PAGE_READS] {
+			t.Errorf("expected a header, %d rows and the bookmark, got %d lines ending %q", MAX_PAGE_READS, len(lines), lines[len(lines)-1])
+		}
+	})
+
+	f.fails(ERR_NOT_FOUND, f.maker, "get_products_modified_since", "0", "123456789")
+}
+
+func TestStateHistory(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	created := f.stub.now
+
+	want := []StateEntry{{State: STATE_SALESCONTRACT, TxID: "tx" + strconv.Itoa(f.tx), Timestamp: created, Actor: f.maker.Name}}
+
+	steps := []struct {
+		caller   identity
+		function string
+		args     []string
+		state    int
+	}{
+		{f.sbank, "bank_issue_accreditive", []string{`{"Amount":10000,"Currency":"USD"}`, pid}, STATE_CHECK_ACCREDITIVE},
+		{f.bbank, "check_accreditive", []string{pid}, STATE_MANUFACTURE},
+	}
+
+	for _, step := range steps {
+		f.ok(step.caller, step.function, step.args...)
+		want = append(want, StateEntry{State: step.state, TxID: "tx" + strconv.Itoa(f.tx), Timestamp: f.stub.now, Actor: step.caller.Name})
+	}
+
+	p := f.product(pid)
+
+	if !reflect.DeepEqual(p.StateHistory, want) {
+		t.Errorf("expected state history %+v, got %+v", want, p.StateHistory)
+	}
+
+	if p.CreatedAt != created || p.LastModified != f.stub.now {
+		t.Errorf("expected created at %d and last modified at %d, got %d and %d", created, f.stub.now, p.CreatedAt, p.LastModified)
+	}
+}
+
+func TestGetProductHistory(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+
+	txids := []string{"tx" + strconv.Itoa(f.tx)}
+	states := []int{STATE_SALESCONTRACT}
+
+	steps := []struct {
+		caller   identity
+		function string
+		args     []string
+		state    int
+	}{
+		{f.sbank, "bank_issue_accreditive", []string{`{"Amount":10000,"Currency":"USD"}`, pid}, STATE_CHECK_ACCREDITIVE},
+		{f.bbank, "check_accreditive", []string{pid}, STATE_MANUFACTURE},
+		{f.maker, "start_shipping", []string{f.shipper.Name, pid}, STATE_SHIPPING},
+		{f.shipper, "shipper_to_buyer", []string{f.buyer.Name, pid}, STATE_SHIPPING},
+		{f.buyer, "confirm_delivery", []string{pid}, STATE_PAYMENT},
+		{f.bbank, "pay_full", []string{pid}, STATE_PAYMENT},
+		{f.buyer, "put_in_use", []string{pid}, STATE_INUSE},
+	}
+
+	for _, step := range steps {
+		f.ok(step.caller, step.function, step.args...)
+		txids = append(txids, "tx"+strconv.Itoa(f.tx))
+		states = append(states, step.state)
+	}
+
+	f.run("in order", func(t *testing.T) {
+
+		var history []HistoryEntry
+		f.decode(f.ok(f.buyer, "get_product_history", pid), &history)
+
+		if len(history) != len(txids) {
+			t.Fatalf("expected %d versions, got %d", len(txids), len(history))
+		}
+
+		for i, entry := range history {
+
+			var version Product
+			f.decode(entry.Value, &version)
+
+			if entry.TxID != txids[i] || entry.IsDelete || version.State != states[i] {
+				t.Errorf("expected version %d written by %s in state %d, got %s in state %d", i, txids[i], states[i], entry.TxID, version.State)
+			}
+
+			if i > 0 && entry.Timestamp <= history[i-1].Timestamp {
+				t.Errorf("expected version %d to be later than version %d", i, i-1)
+			}
+		}
+	})
+
+	f.fails(ERR_PERMISSION_DENIED, f.buyer2, "get_product_history", pid)
+	f.fails(ERR_NOT_FOUND, f.buyer, "get_product_history", "123456789")
+}
+
+func TestGetProductTerms(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	terms := `{"sellerBank":"` + f.sbank.Name + `","buyerBank":"` + f.bbank.Name + `"}`
+	pid := strings.Trim(string(f.ok(f.maker, "create_product", f.buyer.Name, "London", "250.00", "EUR", terms)), "\"")
+	f.advance(pid, STATE_SHIPPING)
+
+	tests := []struct {
+		name   string
+		caller identity
+		code   string
+	}{
+		{"manufacturer", f.maker, ""},
+		{"buyer", f.buyer, ""},
+		{"issuing bank", f.sbank, ""},
+		{"buyer's bank", f.bbank, ""},
+		{"regulator", f.gov, ""},
+		{"shipper holding it", f.shipper, ERR_PERMISSION_DENIED},
+		{"another buyer", f.buyer2, ERR_PERMISSION_DENIED},
+		{"another bank", f.bbank2, ERR_PERMISSION_DENIED},
+	}
+
+	for _, tt := range tests {
+		f.run(tt.name, func(t *testing.T) {
+
+			if tt.code != "" {
+				f.fails(tt.code, tt.caller, "get_product_terms", pid)
+				return
+			}
+
+			var terms CommercialTerms
+			f.decode(f.ok(tt.caller, "get_product_terms", pid), &terms)
+
+			if terms.Price != 25000 || terms.Currency != "EUR" || !terms.MinorUnits || terms.BuyerBank != f.bbank.Name {
+				t.Errorf("expected the terms of the product, got %+v", terms)
+			}
+		})
+	}
+
+	f.run("not held by this peer", func(t *testing.T) {
+
+		p := f.product(pid)
+		p.TermsHash, p.Price, p.Currency = "abc", 0, ""
+		f.store(p)
+
+		f.fails(ERR_INVALID_STATE, f.maker, "get_product_terms", pid)
+	})
+}
+
+func TestCorruptProductRecord(t *testing.T) {
+
+	f := newFixture(t, `{"auditLog":true}`)
+
+	pid := "123456789"
+
+	f.stub.MockTransactionStart("corrupt")
+	f.stub.PutState(pid, []byte(`{"ProductID":"%d %s`))
+	_, err := f.cc.retrieve_product(f.stub, pid)
+	f.stub.MockTransactionEnd("corrupt")
+
+	if err == nil || err.Error() != "RETRIEVE_PRODUCT: Corrupt product record "+pid {
+		t.Fatalf("expected the corrupt record to be reported by id, got %v", err)
+	}
+
+	var entries []AuditEntry
+	f.decode(f.ok(f.gov, "get_audit_log"), &entries)
+
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Message, "RETRIEVE_PRODUCT: Corrupt product record") {
+
+			if !strings.HasPrefix(entry.Message, "RETRIEVE_PRODUCT: Corrupt product record "+pid+": ") || strings.Contains(entry.Message, "%!") {
+				t.Errorf("expected the record's id and the error in the entry, got %q", entry.Message)
+			}
+
+			return
+		}
+	}
+
+	t.Errorf("expected the corrupt record to be audited, got %+v", entries)
+}
+
+func TestPrivateTermsNotIndexed(t *testing.T) {
+
+	f := newFixture(t, `{"privateCollection":"terms"}`)
+
+	terms := `{"sellerBank":"` + f.sbank.Name + `","buyerBank":"` + f.bbank.Name + `"}`
+
+	f.stub.transient = map[string][]byte{"salt": []byte("0123456789abcdef")}
+	pid := strings.Trim(string(f.ok(f.maker, "create_product", f.buyer.Name, "London", "100.00", "USD", terms)), "\"")
+
+	f.ok(f.sbank, "bank_issue_accreditive", `{"Amount":10000,"Currency":"USD"}`, pid)
+	f.ok(f.bbank, "check_accreditive", pid)
+
+	for key := range f.stub.State {
+		if strings.HasPrefix(key, "\x00") && (strings.Contains(key, "USD") || strings.Contains(key, f.bbank.Name)) {
+			t.Errorf("public index key %q holds the private terms", key)
+		}
+	}
+
+	// The currency index can't answer for private currencies, so the query says so instead of finding nothing
+	f.fails(ERR_INVALID_STATE, f.gov, "get_products_by_currency", "USD")
+
+	// Without a collection the same product is indexed by its currency
+	f = newFixture(t, "")
+	pid = f.create(f.maker, f.buyer, "London")
+
+	key, _ := f.stub.CreateCompositeKey("currency", []string{"USD", pid})
+
+	if _, ok := f.stub.State[key]; !ok {
+		t.Errorf("expected %s in the currency index", pid)
+	}
+
+	var exposure CurrencyExposure
+	f.decode(f.ok(f.gov, "get_products_by_currency", "USD"), &exposure)
+
+	if exposure.Count != 1 || exposure.Products[0].ProductID != pid {
+		t.Errorf("expected %s priced in USD, got %+v", pid, exposure)
+	}
+}
+
+func TestPrivateCollectionUpgrade(t *testing.T) {
+
+	f := newFixture(t, `{"defaultCurrency":"EUR"}`)
+
+	pid := f.create_contracted(f.maker, f.buyer, "London", f.bbank)
+	f.advance(pid, STATE_CHECK_ACCREDITIVE)
+
+	contract := f.product(pid).SalesContract
+	credit := f.product(pid).AccreditiveID
+
+	if response := f.reinit(`{"privateCollection":"terms"}`); response.Status == shim.OK {
+		t.Fatalf("expected the terms of existing products to need a salt")
+	}
+
+	f.stub.transient = map[string][]byte{"salt": []byte("0123456789abcdef")}
+	f.upgrade(`{"privateCollection":"terms"}`)
+
+	f.run("terms moved into the collection", func(t *testing.T) {
+
+		if p := f.product(pid); p.Price != 0 || p.Currency != "" || p.BuyerBank != "" || p.TermsHash == "" {
+			t.Errorf("expected only the public view on the ledger, got %+v", p)
+		}
+
+		if _, ok := f.stub.PvtState["terms"][pid]; !ok {
+			t.Errorf("expected the terms of %s in the collection", pid)
+		}
+
+		if _, ok := f.stub.State["SalesContract_"+contract]; ok {
+			t.Errorf("expected the sales contract to leave the world state")
+		}
+
+		if _, ok := f.stub.PvtState["terms"]["SalesContract_"+contract]; !ok {
+			t.Errorf("expected the sales contract in the collection")
+		}
+
+		var public Accreditive
+		f.decode(f.stub.State["Accreditive_"+credit], &public)
+
+		if public.Amount != 0 || public.Currency != "" {
+			t.Errorf("expected the amount of the accreditive to leave the world state, got %+v", public)
+		}
+
+		for key := range f.stub.State {
+			if strings.HasPrefix(key, "\x00") && (strings.Contains(key, "USD") || strings.Contains(key, f.bbank.Name)) {
+				t.Errorf("public index key %q holds the private terms", key)
+			}
+		}
+
+		var terms CommercialTerms
+		f.decode(f.ok(f.maker, "get_product_terms", pid), &terms)
+
+		if terms.Price != 10000 || terms.Currency != "USD" || terms.BuyerBank != f.bbank.Name {
+			t.Errorf("expected the terms to be readable from the collection, got %d %s", terms.Price, terms.Currency)
+		}
+	})
+
+	f.run("config merged", func(t *testing.T) {
+
+		f.upgrade(`{"auditLog":true}`)
+		f.upgrade()
+
+		var config Config
+		f.decode(f.stub.State["Config"], &config)
+
+		if config.PrivateCollection != "terms" || config.DefaultCurrency != "EUR" || !config.AuditLog {
+			t.Errorf("expected the settings of every Init to be kept, got %+v", config)
+		}
+	})
+
+	for _, collection := range []string{"", "other"} {
+		f.run("collection changed to "+collection, func(t *testing.T) {
+			if response := f.reinit(`{"privateCollection":"` + collection + `"}`); response.Status == shim.OK {
+				t.Errorf("expected the collection to stay terms")
+			}
+		})
+	}
+}
+
+func TestProductAccreditive(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create_contracted(f.maker, f.buyer, "London", f.bbank)
+	f.advance(pid, STATE_CHECK_ACCREDITIVE)
+
+	id := f.product(pid).AccreditiveID
+
+	f.fails(ERR_PERMISSION_DENIED, f.bbank2, "check_accreditive", pid)
+	f.fails(ERR_PERMISSION_DENIED, f.bbank2, "reject_accreditive", "non-compliant", pid)
+	f.ok(f.bbank, "check_accreditive", pid)
+
+	// The credit issued for the product is the accreditive the asset functions work on
+	f.ok(f.maker, "draw_accreditive", id, "40.00")
+	f.fails(ERR_VALIDATION_FAILED, f.sbank, "amend_accreditive", id, `{"amount":9999}`)
+	f.ok(f.sbank, "amend_accreditive", id, `{"amount":12000}`)
+
+	if credit := f.credit(pid); credit.Amount != 12000 || credit.Drawn != 4000 || credit.ConfirmedBy != "" {
+		t.Errorf("expected the amended accreditive to be confirmed again, got %+v", credit)
+	}
+
+	var status TradeFinanceStatus
+	f.decode(f.ok(f.bbank, "get_trade_finance_status", pid), &status)
+
+	if status.AccreditiveAmount != 12000 || status.AccreditiveCurrency != "USD" {
+		t.Errorf("expected the amended amount in the status, got %+v", status)
+	}
+
+	var exposure BankExposure
+	f.decode(f.ok(f.sbank, "get_products_for_bank", f.sbank.Name), &exposure)
+
+	if len(exposure.Products) != 1 || exposure.Products[0].Role != "issuing" || exposure.Products[0].Amount != 12000 {
+		t.Errorf("expected the amended amount in the exposure, got %+v", exposure)
+	}
+
+	f.fails(ERR_PERMISSION_DENIED, f.bbank2, "confirm_accreditive", id)
+	f.ok(f.bbank, "confirm_accreditive", id)
+
+	// Only the buyer's bank of the products covered confirms an accreditive opened for them
+	other := f.create_contracted(f.maker, f.buyer, "Paris", f.bbank)
+	opened := strings.Trim(string(f.ok(f.sbank, "open_accreditive", `{"beneficiary":"`+f.maker.Name+`","amount":10000,"currency":"USD","productIds":["`+other+`"]}`)), "\"")
+
+	f.fails(ERR_PERMISSION_DENIED, f.bbank2, "confirm_accreditive", opened)
+	f.ok(f.bbank, "confirm_accreditive", opened)
+
+	// The copy a product held before accreditives became records of their own moves to one once it changes
+	legacy := f.create(f.maker, f.buyer, "London")
+
+	p := f.product(legacy)
+	p.State = STATE_CHECK_ACCREDITIVE
+	p.Accreditive = &Accreditive{IssuingBank: f.sbank.Name, Beneficiary: f.maker.Name, Amount: 10000, Currency: "USD"}
+	f.store(p)
+
+	f.ok(f.sbank, "withdraw_accreditive", legacy)
+
+	if p := f.product(legacy); p.Accreditive != nil || p.AccreditiveID != "LC"+legacy || !f.credit(legacy).Withdrawn {
+		t.Errorf("expected the withdrawn accreditive in a record of its own, got %+v linked as %s", p.Accreditive, p.AccreditiveID)
+	}
+}
+
+func TestGetVehiclesPage(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	var mine []string
+
+	for i := 0; i < 5; i++ {
+		mine = append(mine, f.create(f.maker, f.buyer, "London"))
+		f.create(f.maker2, f.buyer2, "Paris")
+	}
+
+	sort.Strings(mine)
+
+	var seen []string
+	bookmark := ""
+
+	for pages := 0; ; pages++ {
+
+		if pages == 10 {
+			t.Fatalf("paging didn't end, saw %v", seen)
+		}
+
+		options, _ := json.Marshal(ListOptions{PageSize: 2, Bookmark: bookmark})
+
+		var page RecordPage
+		f.decode(f.ok(f.maker, "get_vehicles", string(options)), &page)
+
+		if page.Count != len(page.Records) || page.Count > 2 {
+			t.Fatalf("expected at most 2 records, got %+v", page)
+		}
+
+		for _, record := range page.Records {
+			var p Product
+			f.decode(record, &p)
+			seen = append(seen, p.ProductID)
+		}
+
+		if page.NextBookmark == "" {
+			break
+		}
+
+		if page.Count != 2 {
+			t.Errorf("expected a full page before the last, got %d records", page.Count)
+		}
+
+		bookmark = page.NextBookmark
+	}
+
+	// Products of the other manufacturer are skipped without ending the page early
+	if !reflect.DeepEqual(seen, mine) {
+		t.Errorf("expected %v across the pages, got %v", mine, seen)
+	}
+
+	f.fails(ERR_VALIDATION_FAILED, f.maker, "get_vehicles", `{"pageSize":-1}`)
+}
+
+func TestSalesContractBeforeCollection(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	document := sha256.Sum256([]byte("sales contract for one vehicle"))
+	hash := hex.EncodeToString(document[:])
+
+	terms := `{"terms":"FOB Hamburg","documentHash":"` + hash + `"}`
+	pid := strings.Trim(string(f.ok(f.maker, "create_product", f.buyer.Name, "London", "100.00", "USD", terms)), "\"")
+
+	// The ledger is given a private collection after the contract was stored
+	f.stub.MockTransactionStart("config")
+	f.stub.MockStub.PutState("Config", []byte(`{"privateCollection":"terms"}`))
+	f.stub.MockTransactionEnd("config")
+
+	var contract SalesContract
+	f.decode(f.ok(f.gov, "get_sales_contract", "SC"+pid), &contract)
+
+	if contract.ContractID != "SC"+pid || contract.Status != CONTRACT_PENDING {
+		t.Fatalf("expected the public contract to be read, got %+v", contract)
+	}
+
+	f.ok(f.gov, "register_participant", f.buyer.Name, strconv.Itoa(BUYER), f.buyer.certificate)
+	f.ok(f.maker, "execute_sales_contract", "SC"+pid, hash, f.maker.sign(t, document[:]), f.buyer.sign(t, document[:]))
+
+	// Saving it moves it to the collection
+	if _, ok := f.stub.State["SalesContract_SC"+pid]; ok {
+		t.Errorf("public contract record not deleted")
+	}
+
+	if _, ok := f.stub.PvtState["terms"]["SalesContract_SC"+pid]; !ok {
+		t.Errorf("contract not stored in the collection")
+	}
+
+	f.decode(f.ok(f.gov, "get_sales_contract", "SC"+pid), &contract)
+
+	if contract.Status != CONTRACT_EXECUTED {
+		t.Errorf("expected the contract to be executed, got %+v", contract)
+	}
+}
+
+func TestShipperTransfers(t *testing.T) {
+
+	f := newFixture(t, "")
+
+	pid := f.create(f.maker, f.buyer, "London")
+	other := f.create(f.maker, f.buyer, "Paris")
+	foreign := f.create(f.maker2, f.buyer2, "Rome")
+
+	f.advance(pid, STATE_MANUFACTURE)
+
+	by_owner := func(caller identity) []string {
+
+		var products []Product
+		f.decode(f.ok(caller, "get_products_by_owner"), &products)
+
+		ids := ids_of(products)
+		sort.Strings(ids)
+
+		return ids
+	}
+
+	by_state := func(state int) []string {
+
+		var products []Product
+		f.decode(f.ok(f.gov, "get_products_by_state", strconv.Itoa(state)), &products)
+
+		ids := ids_of(products)
+		sort.Strings(ids)
+
+		return ids
+	}
+
+	expect := func(got []string, ids ...string) {
+
+		f.t.Helper()
+
+		if ids == nil {
+			ids = []string{}
+		}
+
+		if got == nil {
+			got = []string{}
+		}
+
+		sort.Strings(ids)
+
+		if !reflect.DeepEqual(got, ids) {
+			f.t.Errorf("expected %v, got %v", ids, got)
+		}
+	}
+
+	f.run("before any transfer", func(t *testing.T) {
+		expect(by_owner(f.maker), pid, other)
+		expect(by_owner(f.maker2), foreign)
+		expect(by_owner(f.buyer))
+		expect(by_state(STATE_SALESCONTRACT), other, foreign)
+		expect(by_state(STATE_MANUFACTURE), pid)
+	})
+
+	steps := []struct {
+		name   string
+		caller identity
+		to     identity
+		pid    string
+		code   string
+	}{
+		{"not manufactured yet", f.maker, f.shipper, other, ERR_PERMISSION_DENIED},
+		{"by another manufacturer", f.maker2, f.shipper, pid, ERR_PERMISSION_DENIED},
+		{"by the shipper", f.shipper, f.shipper2, pid, ERR_PERMISSION_DENIED},
+		{"to someone other than a shipper", f.maker, f.buyer, pid, ERR_PERMISSION_DENIED},
+		{"by the manufacturer to a shipper", f.maker, f.shipper, pid, ""},
+		{"twice", f.maker, f.shipper2, pid, ERR_PERMISSION_DENIED},
+	}
+
+	for _, step := range steps {
+		f.run(step.name, func(t *testing.T) {
+
+			if step.code != "" {
+				f.fails(step.code, step.caller, "manufacturer_to_shipper", step.to.Name, step.pid)
+				return
+			}
+
+			f.ok(step.caller, "manufacturer_to_shipper", step.to.Name, step.pid)
+
+			if p := f.product(step.pid); p.State != STATE_SHIPPING || p.Custodian != step.to.Name || p.Owner != step.caller.Name {
+				t.Errorf("expected %s in shipping with %s, owned by %s, got %+v", step.pid, step.to.Name, step.caller.Name, p)
+			}
+		})
+	}
+
+	f.run("indexes follow the shipment", func(t *testing.T) {
+		expect(by_owner(f.maker), pid, other)
+		expect(by_state(STATE_MANUFACTURE))
+		expect(by_state(STATE_SHIPPING), pid)
+	})
+
+	f.run("indexes follow the sale", func(t *testing.T) {
+
+		f.advance(pid, STATE_INUSE)
+
+		expect(by_owner(f.maker), other)
+		expect(by_owner(f.buyer), pid)
+		expect(by_state(STATE_SHIPPING))
+		expect(by_state(STATE_INUSE), pid)
+		expect(by_state(STATE_SALESCONTRACT), other, foreign)
+	})
+}